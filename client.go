@@ -2,25 +2,51 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
+// whoamiName is the server's membership control name.
+const whoamiName = "_whoami.internal."
+
+// serverAddr is where the server listens.
+const serverAddr = "127.0.0.1:8053"
+
 func main() {
+	whoami := flag.Bool("whoami", false, "print the client and group serving a domain (the optional argument) instead of resolving")
+	file := flag.String("file", "", "resolve every domain listed in `path`, one per line, instead of prompting")
+	parallel := flag.Int("parallel", 16, "number of queries in flight at once with -file")
+	flag.Parse()
+	if *whoami {
+		os.Exit(printWhoami(flag.Arg(0)))
+	}
+	if *file != "" {
+		os.Exit(runBatch(*file, *parallel))
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
 		fmt.Print("Enter domain name: ")
 		domain, _ := reader.ReadString('\n')
 		domain = strings.TrimSpace(domain)
+		name, err := queryName(domain)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
 
 		m := new(dns.Msg)
-		m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		m.SetQuestion(name, dns.TypeA)
 
 		c := new(dns.Client)
-		in, _, err := c.Exchange(m, "127.0.0.1:8053")
+		in, _, err := c.Exchange(m, serverAddr)
 		if err != nil {
 			fmt.Printf("Failed to get DNS response: %v\n", err)
 			continue
@@ -28,11 +54,164 @@ func main() {
 
 		if len(in.Answer) > 0 {
 			if a, ok := in.Answer[0].(*dns.A); ok {
-				fmt.Printf("IP address for %s: %s\n", domain, a.A.String())
+				fmt.Printf("IP address for %s: %s\n", displayName(domain, name), a.A.String())
 				continue
 			}
 		}
 
-		fmt.Printf("No IP address found for %s\n", domain)
+		fmt.Printf("No IP address found for %s\n", displayName(domain, name))
+	}
+}
+
+// queryName is the fully qualified name to ask for domain. Internationalized
+// names typed in Unicode are converted to punycode (xn--) labels, which is
+// what goes on the wire; ASCII names are sent as they are.
+func queryName(domain string) (string, error) {
+	for i := 0; i < len(domain); i++ {
+		if domain[i] >= 0x80 {
+			ascii, err := idna.Lookup.ToASCII(domain)
+			if err != nil {
+				return "", fmt.Errorf("%q is not a valid internationalized domain name: %v", domain, err)
+			}
+			return dns.Fqdn(ascii), nil
+		}
+	}
+	return dns.Fqdn(domain), nil
+}
+
+// displayName shows domain along with the punycode name it was sent as, if
+// that differs.
+func displayName(domain string, name string) string {
+	if strings.TrimSuffix(name, ".") == strings.TrimSuffix(domain, ".") {
+		return domain
+	}
+	return fmt.Sprintf("%s (%s)", domain, name)
+}
+
+// printWhoami asks the server which client and group serve domain, or the
+// control name itself when domain is empty.
+func printWhoami(domain string) int {
+	name := whoamiName
+	if domain != "" {
+		ascii, err := queryName(domain)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		name = ascii + whoamiName
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+
+	c := new(dns.Client)
+	in, _, err := c.Exchange(m, serverAddr)
+	if err != nil {
+		fmt.Printf("Failed to get DNS response: %v\n", err)
+		return 1
+	}
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			fmt.Println(strings.Join(txt.Txt, " "))
+			return 0
+		}
+	}
+	fmt.Printf("No membership answer: %s\n", dns.RcodeToString[in.Rcode])
+	return 1
+}
+
+// runBatch resolves the domains listed in path with at most parallel queries
+// in flight, printing each result as it completes and a summary at the end.
+// Blank lines and lines starting with # are skipped.
+func runBatch(path string, parallel int) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Failed to open %s: %v\n", path, err)
+		return 1
+	}
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("Failed to read %s: %v\n", path, err)
+		return 1
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		successes int
+		failures  int
+		tokens    = make(chan struct{}, parallel)
+		start     = time.Now()
+	)
+	for _, domain := range domains {
+		wg.Add(1)
+		tokens <- struct{}{}
+		go func(domain string) {
+			defer wg.Done()
+			defer func() { <-tokens }()
+
+			name, err := queryName(domain)
+			if err != nil {
+				mu.Lock()
+				failures++
+				fmt.Println(err)
+				mu.Unlock()
+				return
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			c := new(dns.Client)
+			queryStart := time.Now()
+			in, _, err := c.Exchange(m, serverAddr)
+			elapsed := time.Since(queryStart).Round(time.Microsecond)
+
+			var result string
+			ok := false
+			switch {
+			case err != nil:
+				result = fmt.Sprintf("failed: %v", err)
+			case in.Rcode != dns.RcodeSuccess:
+				result = dns.RcodeToString[in.Rcode]
+			default:
+				var ips []string
+				for _, rr := range in.Answer {
+					if a, isA := rr.(*dns.A); isA {
+						ips = append(ips, a.A.String())
+					}
+				}
+				if len(ips) == 0 {
+					result = "no IP address found"
+				} else {
+					result = strings.Join(ips, ", ")
+					ok = true
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				successes++
+			} else {
+				failures++
+			}
+			fmt.Printf("%s: %s (%v)\n", displayName(domain, name), result, elapsed)
+		}(domain)
+	}
+	wg.Wait()
+	total := time.Since(start).Round(time.Millisecond)
+	fmt.Printf("%d domains: %d resolved, %d failed in %v\n", len(domains), successes, failures, total)
+	if failures > 0 {
+		return 1
 	}
+	return 0
 }
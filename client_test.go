@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		domain, want string
+	}{
+		{"example.com", "example.com."},
+		{"example.com.", "example.com."},
+		{"bücher.example", "xn--bcher-kva.example."},
+		{"Bücher.Example", "xn--bcher-kva.example."},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example."},
+		{"münchen.de.", "xn--mnchen-3ya.de."},
+	}
+	for _, tt := range tests {
+		got, err := queryName(tt.domain)
+		if err != nil || got != tt.want {
+			t.Errorf("queryName(%q) = %q, %v; want %q", tt.domain, got, err, tt.want)
+		}
+	}
+
+	// A label that is not valid IDNA is reported rather than sent raw.
+	if got, err := queryName("ü_x.example"); err == nil {
+		t.Errorf("invalid IDN converted to %q", got)
+	} else if !strings.Contains(err.Error(), "not a valid internationalized domain name") {
+		t.Errorf("invalid IDN: %v", err)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	if got := displayName("example.com", "example.com."); got != "example.com" {
+		t.Errorf("ASCII name displayed as %q", got)
+	}
+	if got := displayName("bücher.example", "xn--bcher-kva.example."); got != "bücher.example (xn--bcher-kva.example.)" {
+		t.Errorf("IDN displayed as %q", got)
+	}
+}
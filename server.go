@@ -1,209 +1,8618 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
+	mathrand "math/rand"
 	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/idna"
 )
 
 const (
 	GroupSize = 15
+	// DefaultHistoryMinutes is how many minutes of hit-rate history each
+	// client keeps when stats_history_minutes is not set.
+	DefaultHistoryMinutes = 60
+	// DefaultTTL applies to answers that carry no TTL of their own, such as
+	// those from the system resolver or caches saved by older versions.
+	DefaultTTL = time.Hour
+	// DefaultSweepInterval is how often expired entries are purged.
+	DefaultSweepInterval = time.Minute
+	// DefaultMaxForwardHops bounds how many caching instances a query may
+	// pass through before it is treated as a forwarding loop.
+	DefaultMaxForwardHops = 4
+	// DefaultMaxNameLength and DefaultMaxLabels are the largest query name
+	// DNS allows: 255 octets in wire form, which holds at most 127 labels
+	// besides the root.
+	DefaultMaxNameLength = 255
+	DefaultMaxLabels     = 127
+	// DefaultQueryPaddingBlock and DefaultResponsePaddingBlock are the
+	// EDNS padding block sizes RFC 8467 recommends.
+	DefaultQueryPaddingBlock    = 128
+	DefaultResponsePaddingBlock = 468
+	// DefaultMaxCNAMEDepth bounds how many CNAMEs are chased to answer a
+	// single query.
+	DefaultMaxCNAMEDepth = 8
+	// Circuit breaker defaults: open after DefaultBreakerThreshold
+	// consecutive upstream failures within DefaultBreakerWindow, and probe
+	// again after DefaultBreakerCooldown.
+	DefaultBreakerThreshold = 5
+	DefaultBreakerWindow    = 30 * time.Second
+	DefaultBreakerCooldown  = 30 * time.Second
+	// A name is quarantined, not cached, for DefaultQuarantineCooldown
+	// after DefaultQuarantineThreshold bad answers for it within as long.
+	DefaultQuarantineThreshold = 3
+	DefaultQuarantineCooldown  = 10 * time.Minute
+	// A name whose last DefaultShortTTLStreak answers all had TTLs under
+	// DefaultShortTTLThreshold is not shared with peers.
+	DefaultShortTTLThreshold = 10 * time.Second
+	DefaultShortTTLStreak    = 3
+	// DefaultUpstreamStatsInterval is how often upstream_stats_file is
+	// written.
+	DefaultUpstreamStatsInterval = time.Minute
+	// DefaultDedupeWindow is how long a completed resolution answers
+	// identical misses.
+	DefaultDedupeWindow = 250 * time.Millisecond
+	// DefaultUpstreamMaxInFlight is how many queries may be outstanding to a
+	// single upstream address at once.
+	DefaultUpstreamMaxInFlight = 64
+	// DefaultListenAddr is where the DNS server listens unless configured.
+	DefaultListenAddr = ":8053"
+	// listenFDsStart is the first file descriptor passed by systemd.
+	listenFDsStart = 3
+	// DefaultQueryTimeout is the usual stub resolver timeout.
+	DefaultQueryTimeout = 5 * time.Second
+	// DefaultCacheBudgetShare is the part of query_budget given to the
+	// peer caches.
+	DefaultCacheBudgetShare = 0.1
+	// DefaultTCPIdleTimeout closes TCP connections that sit idle this long.
+	DefaultTCPIdleTimeout = 10 * time.Second
+	// DefaultStaleAnswerTTL is the TTL of stale answers, as RFC 8767
+	// recommends.
+	DefaultStaleAnswerTTL = 30 * time.Second
+	// DefaultRedisPrefix namespaces cache keys in a shared Redis.
+	DefaultRedisPrefix = "dnscache:"
+	// DefaultGossipQueue is each client's backlog of gossiped entries.
+	DefaultGossipQueue = 256
+	// DefaultMirrorQueue is the backlog of cache writes waiting to be sent
+	// to the standby.
+	DefaultMirrorQueue = 1024
+	// DefaultWarmupTop is how many of the most queried names in the query
+	// log are resolved at startup, and DefaultWarmupTimeout bounds how long
+	// that may delay it.
+	DefaultWarmupTop     = 100
+	DefaultWarmupTimeout = 10 * time.Second
+	// DefaultReadyTimeout is how long startup waits for min_ready_clients
+	// clients to reach an upstream, and readyProbeInterval how often the
+	// others are probed again meanwhile.
+	DefaultReadyTimeout = 30 * time.Second
+	readyProbeInterval  = time.Second
+	// warmupConcurrency is how many warmup resolutions run at once.
+	warmupConcurrency = 8
+	// RingReplicas is how many points each client gets on the hash ring.
+	RingReplicas = 64
+	// CacheDistributionInterval is how often the cache distribution metrics
+	// are recomputed.
+	CacheDistributionInterval = 15 * time.Second
+	// hopCountOption is the local EDNS0 option carrying the hop count
+	// between chained instances of this server.
+	hopCountOption = dns.EDNS0LOCALSTART
 )
 
 type DNSResponse struct {
-	IPAddress string
-	Timestamp time.Time
+	IPAddress string   // first address of an A or AAAA answer
+	Records   []dns.RR // answer section as returned upstream
+	// Authority holds the SOA of a NODATA answer, whose Records have none
+	// of the requested type. Clients caching all sections keep the whole
+	// authority section there, and the additional records (glue, but not
+	// OPT) in Additional.
+	Authority  []dns.RR
+	Additional []dns.RR
+	Timestamp  time.Time
+	TTL        time.Duration
+	Hits       int // times served from this client's cache; not persisted
+	// Extension is extra lifetime granted to a hot entry by the adaptive
+	// TTL policy. It is local to one client and not persisted.
+	Extension time.Duration
+	// MAC authenticates the entry when caches are signed; see EntrySigner.
+	MAC []byte
+	// Upstream is the upstream that resolved the entry, if known. It is
+	// not persisted.
+	Upstream string
+	// compressed holds Records, Authority and Additional as a gzipped DNS
+	// message while the entry sits in a cache that compresses large
+	// entries; the sections are nil then. See compress and expand.
+	compressed []byte
+}
+
+// compress returns r with its records gzipped if they pack to at least
+// threshold bytes. Smaller entries, and a threshold of 0, are left alone.
+func (r DNSResponse) compress(threshold int) DNSResponse {
+	if threshold <= 0 || r.compressed != nil {
+		return r
+	}
+	msg := &dns.Msg{Answer: r.Records, Ns: r.Authority, Extra: r.Additional}
+	msg.Compress = true
+	if msg.Len() < threshold {
+		return r
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return r
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(packed)
+	if err := zw.Close(); err != nil {
+		return r
+	}
+	r.compressed = buf.Bytes()
+	r.Records, r.Authority, r.Additional = nil, nil, nil
+	return r
+}
+
+// expand undoes compress. It is a no-op on entries that are not
+// compressed, so anything reading records out of a cache can call it.
+func (r DNSResponse) expand() DNSResponse {
+	if r.compressed == nil {
+		return r
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(r.compressed))
+	if err != nil {
+		fmt.Println("Error expanding cache entry:", err)
+		return r
+	}
+	packed, err := io.ReadAll(zr)
+	if err != nil {
+		fmt.Println("Error expanding cache entry:", err)
+		return r
+	}
+	var msg dns.Msg
+	if err := msg.Unpack(packed); err != nil {
+		fmt.Println("Error expanding cache entry:", err)
+		return r
+	}
+	r.Records, r.Authority, r.Additional, r.compressed = msg.Answer, msg.Ns, msg.Extra, nil
+	return r
+}
+
+// persistedResponse is how a DNSResponse is written to a cache file. Records
+// are kept in presentation format so any record type round-trips.
+type persistedResponse struct {
+	IPAddress  string   `json:",omitempty"`
+	Records    []string `json:",omitempty"`
+	Authority  []string `json:",omitempty"`
+	Additional []string `json:",omitempty"`
+	Timestamp  time.Time
+	TTL        time.Duration `json:",omitempty"`
+	MAC        []byte        `json:",omitempty"`
+}
+
+func (r DNSResponse) persisted() persistedResponse {
+	r = r.expand()
+	p := persistedResponse{IPAddress: r.IPAddress, Timestamp: r.Timestamp, TTL: r.TTL, MAC: r.MAC}
+	for _, rr := range r.Records {
+		p.Records = append(p.Records, rr.String())
+	}
+	for _, rr := range r.Authority {
+		p.Authority = append(p.Authority, rr.String())
+	}
+	for _, rr := range r.Additional {
+		p.Additional = append(p.Additional, rr.String())
+	}
+	return p
+}
+
+func (r *DNSResponse) restore(p persistedResponse) error {
+	*r = DNSResponse{IPAddress: p.IPAddress, Timestamp: p.Timestamp, TTL: p.TTL, MAC: p.MAC}
+	if len(p.Records) == 0 && p.TTL == 0 {
+		// Written before entries carried a TTL.
+		r.TTL = DefaultTTL
+	}
+	for _, record := range p.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return err
+		}
+		r.Records = append(r.Records, rr)
+	}
+	for _, record := range p.Authority {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return err
+		}
+		r.Authority = append(r.Authority, rr)
+	}
+	for _, record := range p.Additional {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return err
+		}
+		r.Additional = append(r.Additional, rr)
+	}
+	return nil
+}
+
+func (r DNSResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.persisted())
+}
+
+func (r *DNSResponse) UnmarshalJSON(data []byte) error {
+	var p persistedResponse
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	return r.restore(p)
+}
+
+func (r DNSResponse) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(r.persisted())
+	return buf.Bytes(), err
+}
+
+func (r *DNSResponse) GobDecode(data []byte) error {
+	var p persistedResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return err
+	}
+	return r.restore(p)
+}
+
+// RemainingTTL is how long the entry stays fresh, rounded up to a second.
+// It is derived from Timestamp, so entries loaded from disk count down from
+// when they were first cached rather than from when they were loaded.
+func (r DNSResponse) RemainingTTL() uint32 {
+	remaining := time.Until(r.ExpiresAt())
+	if remaining <= 0 {
+		return 0
+	}
+	return uint32((remaining + time.Second - 1) / time.Second)
+}
+
+// Answer returns copies of the cached records with their TTLs set to the
+// time the entry has left in the cache.
+func (r DNSResponse) Answer() []dns.RR {
+	return r.counted(r.Records)
+}
+
+// Ns is Answer for the authority section.
+func (r DNSResponse) Ns() []dns.RR {
+	return r.counted(r.Authority)
+}
+
+// Extra is Answer for the additional section.
+func (r DNSResponse) Extra() []dns.RR {
+	return r.counted(r.Additional)
+}
+
+func (r DNSResponse) counted(records []dns.RR) []dns.RR {
+	ttl := r.RemainingTTL()
+	counted := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		counted = append(counted, rr)
+	}
+	return counted
+}
+
+// normalizeName is the form of a query name that picks its client and cache
+// entry: lowercased, and with labels sent as raw UTF-8 instead of punycode
+// converted to their xn-- form, so every spelling of a name shares one
+// entry. Names that do not convert are only lowercased.
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.Contains(name, `\`) {
+		// Bytes outside printable ASCII are always escaped.
+		return name
+	}
+	wire := make([]byte, DefaultMaxNameLength+1)
+	end, err := dns.PackDomainName(name, wire, 0, nil, false)
+	if err != nil {
+		return name
+	}
+	var labels []string
+	raw := false
+	for i := 0; i < end && wire[i] != 0; i += int(wire[i]) + 1 {
+		label := string(wire[i+1 : i+1+int(wire[i])])
+		if strings.Contains(label, ".") {
+			return name
+		}
+		for j := 0; j < len(label); j++ {
+			raw = raw || label[j] >= 0x80
+		}
+		labels = append(labels, label)
+	}
+	unicodeName := strings.Join(labels, ".")
+	if !raw || !utf8.ValidString(unicodeName) {
+		return name
+	}
+	ascii, err := idna.Punycode.ToASCII(strings.ToLower(unicodeName))
+	if err != nil {
+		return name
+	}
+	return dns.Fqdn(ascii)
+}
+
+// cacheKey is the cache map key for a name and query type, e.g.
+// "example.com./A".
+func cacheKey(domain string, qtype uint16) string {
+	return dns.Fqdn(domain) + "/" + dns.Type(qtype).String()
+}
+
+// dnssecKeySuffix marks the cache keys of answers to queries with the DO
+// bit set, which hold DNSSEC records the answers to other queries lack.
+const dnssecKeySuffix = "/DO"
+
+// cacheKeyFor is cacheKey for a query made with ctx: with DNSSECKeys set,
+// DO queries get entries of their own.
+func (c *Client) cacheKeyFor(ctx context.Context, domain string, qtype uint16) string {
+	key := cacheKey(domain, qtype)
+	if c.DNSSECKeys && dnssecOK(ctx) {
+		key += dnssecKeySuffix
+	}
+	return key
+}
+
+// splitCacheKey is the inverse of cacheKey, ignoring dnssecKeySuffix. Keys
+// written before the cache was keyed by type hold just the name and are A
+// entries.
+func splitCacheKey(key string) (string, uint16) {
+	key = strings.TrimSuffix(key, dnssecKeySuffix)
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return dns.Fqdn(key), dns.TypeA
+	}
+	qtype, ok := dns.StringToType[key[i+1:]]
+	if !ok {
+		return dns.Fqdn(key), dns.TypeA
+	}
+	return key[:i], qtype
+}
+
+// TTLPolicy decides how long upstream answers are cached. Precedence is
+// override > clamp > upstream TTL: an override for the record type replaces
+// the upstream TTL, and Min and Max then bound whichever TTL was chosen.
+// With RespectZero, a zero upstream TTL ("do not cache", RFC 1035 section
+// 3.2.1) stays zero whatever the rest of the policy says.
+type TTLPolicy struct {
+	Min         time.Duration
+	Max         time.Duration
+	Overrides   map[uint16]time.Duration
+	RespectZero bool
+}
+
+func (p TTLPolicy) Apply(qtype uint16, ttl time.Duration) time.Duration {
+	if ttl == 0 && p.RespectZero {
+		return 0
+	}
+	if override, ok := p.Overrides[qtype]; ok {
+		ttl = override
+	}
+	if p.Min > 0 && ttl < p.Min {
+		ttl = p.Min
+	}
+	if p.Max > 0 && ttl > p.Max {
+		ttl = p.Max
+	}
+	return ttl
+}
+
+// ExpiresAt is when the entry stops being served from cache.
+func (r DNSResponse) ExpiresAt() time.Time {
+	return r.Timestamp.Add(r.TTL + r.Extension)
+}
+
+// Extended reports whether the entry is past its upstream TTL and only
+// alive because the adaptive TTL policy extended it.
+func (r DNSResponse) Extended() bool {
+	return r.Extension > 0 && time.Now().After(r.Timestamp.Add(r.TTL))
+}
+
+func (r DNSResponse) Fresh() bool {
+	return time.Now().Before(r.ExpiresAt())
+}
+
+type expiryItem struct {
+	Key     string
+	Expires time.Time
+	index   int
+}
+
+// expiryHeap is a min-heap of cache keys ordered by expiry time.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].Expires.Before(h[j].Expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// ExpiryQueue tracks when each cache key expires so the sweeper only has to
+// look at entries that are actually due. It is not safe for concurrent use;
+// the owning client's Mutex guards it together with the cache map.
+type ExpiryQueue struct {
+	heap  expiryHeap
+	items map[string]*expiryItem
+}
+
+func NewExpiryQueue() *ExpiryQueue {
+	return &ExpiryQueue{items: make(map[string]*expiryItem)}
+}
+
+// Set records or updates the expiry time of key.
+func (q *ExpiryQueue) Set(key string, expires time.Time) {
+	if item, ok := q.items[key]; ok {
+		item.Expires = expires
+		heap.Fix(&q.heap, item.index)
+		return
+	}
+	item := &expiryItem{Key: key, Expires: expires}
+	heap.Push(&q.heap, item)
+	q.items[key] = item
+}
+
+func (q *ExpiryQueue) Remove(key string) {
+	if item, ok := q.items[key]; ok {
+		heap.Remove(&q.heap, item.index)
+		delete(q.items, key)
+	}
+}
+
+// PopExpired removes and returns every key that expired before now.
+func (q *ExpiryQueue) PopExpired(now time.Time) []string {
+	var keys []string
+	for len(q.heap) > 0 && !q.heap[0].Expires.After(now) {
+		item := heap.Pop(&q.heap).(*expiryItem)
+		delete(q.items, item.Key)
+		keys = append(keys, item.Key)
+	}
+	return keys
 }
 
 type Client struct {
-	ID        string
-	Group     *Group
+	ID string
+	// group is the client's group, read with Group. Rebalance moves
+	// clients while they serve queries.
+	group     atomic.Pointer[Group]
 	Cache     map[string]DNSResponse
+	Expiry    *ExpiryQueue // expiry order of Cache, guarded by Mutex
 	Mutex     sync.Mutex
-	Server    string // DNS resolver address
+	Server    string   // DNS resolver address
+	Upstreams []string // additional resolvers tried after Server
+	// Protocol, when set, is the transport to Server and Upstreams: "udp",
+	// "tcp", "dot" or "doh". Without it the address scheme decides.
+	Protocol  string
 	CacheFile string
+	// NoCache is set on clients that only forward: nothing is stored in
+	// Cache or saved to CacheFile, and peers do not look in it.
+	NoCache bool
+	// CacheCodec encodes the cache when it is saved to CacheFile.
+	CacheCodec CacheCodec
+	// SaveInterval, when set by startSaver, defers saves to a periodic
+	// write of the cache if dirty is set; otherwise every change is
+	// written at once.
+	SaveInterval time.Duration
+	dirty        atomic.Bool
+	// MaxFileBytes bounds the size of CacheFile; 0 is unbounded.
+	MaxFileBytes int
+	// Signer, when set with SetSigner, signs every entry stored and checks
+	// entries read by peers, loaded from CacheFile or pushed by gossip.
+	Signer *EntrySigner
+	// DNSSECKeys caches answers to queries with the DO bit apart from the
+	// others, since only they carry RRSIGs and the rest of DNSSEC.
+	DNSSECKeys bool
+	// Quarantine counts bad answers (0x20 mismatches, failed MACs) per name
+	// and stops caching names that keep getting them; nil never does.
+	Quarantine *Quarantine
+	// ShortTTLs spots names that keep getting short TTLs, which are then
+	// neither shared with peers nor looked up on them; nil never does.
+	ShortTTLs *ShortTTLs
+	// CompressAbove gzips the records of entries that pack to at least
+	// this many bytes while they are in Cache; 0 stores everything as is.
+	// Set it with SetCompression.
+	CompressAbove int
+	// Offline stops QueryDNS from resolving anything: misses are answered
+	// with OfflineRcode instead.
+	Offline      bool
+	OfflineRcode int
+	// SystemFallback lets queryDNSResolver fall back to the system resolver
+	// once every configured upstream has failed.
+	SystemFallback bool
+	// ParentCache marks the upstreams as parent instances of this server, so
+	// forwarded queries carry a hop count for loop prevention.
+	ParentCache bool
+	// MaxCNAMEDepth bounds the CNAME chain queryDNSResolver follows when an
+	// answer ends at an alias; 0 does not follow CNAMEs at all.
+	MaxCNAMEDepth int
+	// MinimalResponses strips upstream answers down to the answer section.
+	MinimalResponses bool
+	// AllSections caches the authority and additional sections of upstream
+	// answers along with the answer.
+	AllSections bool
+	// RandomizeCase sends cleartext queries with 0x20 encoding and rejects
+	// answers that do not echo the query name's casing.
+	RandomizeCase bool
+	// PaddingBlock pads queries to DoT and DoH upstreams to a multiple of
+	// this many bytes (RFC 7830); 0 sends them unpadded.
+	PaddingBlock int
+	// DoHGet sends queries to DNS-over-HTTPS upstreams with GET instead of
+	// POST.
+	DoHGet    bool
+	TTLPolicy TTLPolicy
+	// Entries served from cache with less than PrefetchThreshold of their
+	// TTL left, and more than PrefetchMinHits hits, are refreshed in the
+	// background. A zero threshold disables prefetching.
+	PrefetchThreshold float64
+	PrefetchMinHits   int
+	prefetching       map[string]bool // keys being refreshed, guarded by Mutex
+	// resolutions coalesces identical misses: one resolution runs per key
+	// and its result is reused for DedupeWindow after it completes, for
+	// answers that are not cached such as failures and NXDOMAIN. Guarded
+	// by Mutex.
+	resolutions  map[string]*resolution
+	DedupeWindow time.Duration
+	// Adaptive extends the lifetime of hot entries beyond their TTL.
+	Adaptive AdaptiveTTL
+	Stale    StalePolicy
+	// Partitions bounds the number of entries per record type; nil leaves
+	// the cache unbounded.
+	Partitions *CachePartitions
+	// Shared is a cache outside this process, such as Redis, consulted
+	// after the group's peers and written on every upstream answer. It lets
+	// several server instances share one cache. Nil means none.
+	Shared Cache
+	// Store, when set, replaces the in-memory Cache: QueryDNS looks entries
+	// up in it and stores answers to it. With a RedisCache the clients of
+	// every instance share one cache, like one large group, so peers are
+	// not asked; entries in it earn no hits and are not served stale. Nil
+	// keeps the cache in memory.
+	Store Cache
+	// DNS64Prefix is the NAT64 prefix AAAA answers are synthesized in for
+	// names without AAAA records; nil disables DNS64.
+	DNS64Prefix *net.IPNet
+	// FallbackIP answers address queries whose resolution failed; nil
+	// leaves them failing.
+	FallbackIP net.IP
+	// ForwardZones override the upstreams for names inside them.
+	ForwardZones []ForwardZone
+	// Rewrites are applied to upstream answers before they are cached.
+	Rewrites []RewriteRule
+	// Iterative resolves from the root with QNAME minimization before the
+	// configured upstreams are tried. Nil means forwarding only.
+	Iterative *IterativeResolver
+	// Breakers holds one circuit breaker per upstream address, created on
+	// first use from BreakerSettings. Guarded by Mutex.
+	Breakers        map[string]*CircuitBreaker
+	BreakerSettings BreakerSettings
+	History         *HitHistory
+	// PeerTimeout bounds the peer lookups of one query; 0 is unbounded.
+	PeerTimeout time.Duration
+	// Budget bounds the time a miss spends in the cache tiers and
+	// resolving; a zero Total leaves only the query's own deadline.
+	Budget QueryBudget
+	// PeerSelection picks among the peers holding an entry; see the
+	// PeerSelect constants.
+	PeerSelection string
+	// GossipMinTTL is the shortest TTL worth pushing to peers; gossip is
+	// only delivered to peers whose receiver was started.
+	Gossip       bool
+	GossipMinTTL time.Duration
+	gossip       chan gossipEntry
+	// Mirror copies resolved entries to a standby instance; nil if none.
+	Mirror *Mirror
+	// inFlight counts this client's outstanding upstream queries, and
+	// inFlightSlots caps them when client_max_inflight is set.
+	inFlight      atomic.Int64
+	inFlightSlots chan struct{}
+	// persistFailed is set while the cache file cannot be written, so the
+	// failure is logged once and reported on /healthz.
+	persistFailed atomic.Bool
+}
+
+type BreakerSettings struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker stops queries to an upstream that keeps failing. After
+// Threshold consecutive failures within Window it opens and rejects queries
+// for Cooldown; then a single probe query is let through, and its outcome
+// closes or re-opens the breaker.
+type CircuitBreaker struct {
+	BreakerSettings
+	mu           sync.Mutex
+	state        BreakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+}
+
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{BreakerSettings: settings}
+}
+
+// Allow reports whether a query may be sent to the upstream now.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// The probe is still in flight.
+		return false
+	}
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+		b.openedAt = now
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.Window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.Threshold && b.state == BreakerClosed {
+		fmt.Printf("Circuit breaker opened after %d failures\n", b.failures)
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerSnapshot is a breaker's state as saved in the upstream stats file.
+type breakerSnapshot struct {
+	State        string    `json:"state"`
+	Failures     int       `json:"failures"`
+	FirstFailure time.Time `json:"first_failure"`
+	OpenedAt     time.Time `json:"opened_at"`
+}
+
+func (b *CircuitBreaker) snapshot() breakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	if state == BreakerHalfOpen {
+		// The probe dies with the process; the next start probes again.
+		state = BreakerOpen
+	}
+	return breakerSnapshot{State: state.String(), Failures: b.failures, FirstFailure: b.firstFailure, OpenedAt: b.openedAt}
+}
+
+func (b *CircuitBreaker) restore(s breakerSnapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	if s.State == BreakerOpen.String() {
+		b.state = BreakerOpen
+	}
+	b.failures, b.firstFailure, b.openedAt = s.Failures, s.FirstFailure, s.OpenedAt
+}
+
+// breaker returns the circuit breaker for upstream.
+func (c *Client) breaker(upstream string) *CircuitBreaker {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	b, ok := c.Breakers[upstream]
+	if !ok {
+		b = NewCircuitBreaker(c.BreakerSettings)
+		c.Breakers[upstream] = b
+	}
+	return b
+}
+
+// BreakerStates returns the state of every upstream's breaker.
+func (c *Client) BreakerStates() map[string]BreakerState {
+	c.Mutex.Lock()
+	breakers := make(map[string]*CircuitBreaker, len(c.Breakers))
+	for upstream, b := range c.Breakers {
+		breakers[upstream] = b
+	}
+	c.Mutex.Unlock()
+
+	states := make(map[string]BreakerState, len(breakers))
+	for upstream, b := range breakers {
+		states[upstream] = b.State()
+	}
+	return states
+}
+
+type Group struct {
+	ID string
+	// Clients is never changed in place: it is replaced by a new slice
+	// with Mutex held, under GroupManager.Mutex, so the slice returned by
+	// Members stays valid while queries range over it.
+	Clients []*Client
+	Mutex   sync.Mutex
+	// HitRatio smooths the hit ratio over the lookups of every client
+	// while it is in the group.
+	HitRatio EWMA
+}
+
+// Members returns the group's clients as of now. Callers must not modify
+// the slice.
+func (g *Group) Members() []*Client {
+	if g == nil {
+		return nil
+	}
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	return g.Clients
+}
+
+type GroupManager struct {
+	Groups []*Group
+	Ring   *HashRing // which client is responsible for each domain
+	Mutex  sync.Mutex
+	// View is the name of the view these groups serve, empty for the
+	// default groups. Group IDs are only unique within one manager.
+	View string
+}
+
+// HashRing maps keys to clients by consistent hashing, so adding or removing
+// a client only moves the keys that client owns.
+type HashRing struct {
+	replicas int
+	points   []uint64 // sorted
+	owners   map[uint64]*Client
+}
+
+func NewHashRing(replicas int) *HashRing {
+	return &HashRing{replicas: replicas, owners: make(map[uint64]*Client)}
+}
+
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (r *HashRing) Add(client *Client) {
+	for i := 0; i < r.replicas; i++ {
+		point := ringHash(fmt.Sprintf("%s#%d", client.ID, i))
+		if _, taken := r.owners[point]; taken {
+			continue
+		}
+		r.owners[point] = client
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *HashRing) Remove(client *Client) {
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == client {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Get returns the client owning key, or nil if the ring is empty.
+func (r *HashRing) Get(key string) *Client {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+type ClientConfig struct {
+	ID        string   `toml:"id"`
+	Server    string   `toml:"server"`
+	Upstreams []string `toml:"upstreams"`
+	// Protocol overrides the transport inferred from the upstream
+	// addresses; see Client.Protocol.
+	Protocol string `toml:"protocol"`
+	// ParentCache is set when the upstreams are parent caches running this
+	// same server rather than ordinary resolvers.
+	ParentCache bool `toml:"parent_cache"`
+	// Cache = false makes the client a pure forwarder: it resolves for its
+	// share of the hash ring but keeps no cache of its own.
+	Cache *bool `toml:"cache"`
+}
+
+// CacheEnabled reports whether the client keeps a cache, which is the
+// default.
+func (c ClientConfig) CacheEnabled() bool {
+	return c.Cache == nil || *c.Cache
+}
+
+// ViewConfig is one split-horizon view: queries from MatchClients are
+// answered from the view's own zone and clients, with caches of their own.
+type ViewConfig struct {
+	Name         string         `toml:"name"`
+	MatchClients []string       `toml:"match_clients"` // CIDRs
+	ZoneFile     string         `toml:"zone_file"`
+	ZoneOrigin   string         `toml:"zone_origin"`
+	Clients      []ClientConfig `toml:"clients"`
+}
+
+// ChaosConfig injects faults into query handling to exercise timeouts,
+// retries and serve-stale. Each probability is between 0 and 1.
+type ChaosConfig struct {
+	Enabled             bool          `toml:"enabled"`
+	DelayProbability    float64       `toml:"delay_probability"`
+	Delay               time.Duration `toml:"delay"`
+	DropProbability     float64       `toml:"drop_probability"`
+	ServfailProbability float64       `toml:"servfail_probability"`
+}
+
+// SyntheticSOAConfig is the SOA put in the authority section of negative
+// answers the server makes up itself. Unset fields take the values of the
+// special-use zones' SOA; Minimum defaults to BlockedTTL.
+type SyntheticSOAConfig struct {
+	MName   string `toml:"mname"`
+	RName   string `toml:"rname"`
+	Serial  uint32 `toml:"serial"`
+	Refresh uint32 `toml:"refresh"`
+	Retry   uint32 `toml:"retry"`
+	Expire  uint32 `toml:"expire"`
+	Minimum uint32 `toml:"minimum"`
+}
+
+// SOA builds the configured record with defaults filled in. Its owner is
+// set per answer by syntheticSOA.
+func (c *SyntheticSOAConfig) SOA() *dns.SOA {
+	soa := specialUseSOA(".")
+	soa.Minttl = uint32(BlockedTTL / time.Second)
+	if c.MName != "" {
+		soa.Ns = dns.Fqdn(c.MName)
+	}
+	if c.RName != "" {
+		soa.Mbox = dns.Fqdn(c.RName)
+	}
+	for _, v := range []struct {
+		field *uint32
+		value uint32
+	}{{&soa.Serial, c.Serial}, {&soa.Refresh, c.Refresh}, {&soa.Retry, c.Retry}, {&soa.Expire, c.Expire}, {&soa.Minttl, c.Minimum}} {
+		if v.value != 0 {
+			*v.field = v.value
+		}
+	}
+	soa.Hdr.Ttl = soa.Minttl
+	return soa
+}
+
+// ChaosEnvVar must be set to 1 as well as chaos.enabled for faults to be
+// injected, so a config copied from a test setup cannot turn them on.
+const ChaosEnvVar = "DNS_CHAOS"
+
+type Config struct {
+	Clients []ClientConfig `toml:"clients"`
+	// ForwardZones pin domains to their own upstreams; the longest
+	// matching suffix wins.
+	ForwardZones []ForwardZone `toml:"forward_zones"`
+	// Rewrites change upstream answers before they are cached, in order.
+	Rewrites []RewriteRule `toml:"rewrite"`
+	// Views are matched in order by source address; queries matching none
+	// use the top-level clients and zone.
+	Views []ViewConfig `toml:"views"`
+	// DisableSystemFallback restricts resolution to the configured upstreams.
+	DisableSystemFallback bool `toml:"disable_system_fallback"`
+	// Offline answers only from the caches and local records, never asking
+	// an upstream. Misses get OfflineRcode: "servfail" (default) or
+	// "nxdomain".
+	Offline      bool   `toml:"offline"`
+	OfflineRcode string `toml:"offline_rcode"`
+	// FallbackIP, when set, answers A (or AAAA, for an IPv6 address) queries
+	// that could not be resolved, with a 5 second TTL. NXDOMAIN and NODATA
+	// are passed on.
+	FallbackIP string `toml:"fallback_ip"`
+	// HealthCheckName is answered with HealthCheckAnswer, an A (or, for an
+	// IPv6 address, AAAA) record, without any resolution, so DNS monitors
+	// can check that the server is up and answering.
+	HealthCheckName   string `toml:"health_check_name"`
+	HealthCheckAnswer string `toml:"health_check_answer"`
+	// Blocklist names a file of blocked domains, one per line or in hosts
+	// file format; Blocked lists more inline. A name blocks itself, and a
+	// name with a leading dot (".ads.example") blocks it and everything
+	// under it. The file is read again on SIGHUP.
+	Blocklist string   `toml:"blocklist"`
+	Blocked   []string `toml:"blocked"`
+	// BlocklistAnswer is "nxdomain" (default) or the sinkhole IP address
+	// blocked A or AAAA queries are answered with.
+	BlocklistAnswer string `toml:"blocklist_answer"`
+	// DNS64 synthesizes AAAA answers for names that only have A records
+	// (RFC 6147), embedding the IPv4 addresses in DNS64Prefix, by default
+	// the well-known prefix 64:ff9b::/96.
+	DNS64       bool   `toml:"dns64"`
+	DNS64Prefix string `toml:"dns64_prefix"`
+	// DisableSpecialUse forwards special-use names (RFC 6761) such as
+	// localhost. and 10.in-addr.arpa. upstream instead of answering them.
+	DisableSpecialUse bool `toml:"disable_special_use"`
+	// CacheSecret, when set, keys an HMAC over every cache entry. Entries
+	// whose MAC does not verify when read by a peer, loaded from a cache
+	// file or received from another instance are discarded.
+	CacheSecret string `toml:"cache_secret"`
+	// QuarantineThreshold bad answers for one name within
+	// QuarantineCooldown stop it being cached for QuarantineCooldown. A
+	// negative threshold disables quarantine.
+	QuarantineThreshold int           `toml:"quarantine_threshold"`
+	QuarantineCooldown  time.Duration `toml:"quarantine_cooldown"`
+	// A name whose last ShortTTLStreak answers had TTLs under
+	// ShortTTLThreshold is kept out of peer sharing and resolved fresh
+	// rather than taken from peers. A negative threshold disables this.
+	ShortTTLThreshold time.Duration `toml:"short_ttl_threshold"`
+	ShortTTLStreak    int           `toml:"short_ttl_streak"`
+	// CookieSecret keys the server cookies (RFC 7873). A random secret is
+	// generated at startup when it is empty.
+	CookieSecret string `toml:"cookie_secret"`
+	// AdminAddr is the listen address of the admin HTTP API; empty disables it.
+	AdminAddr string `toml:"admin_addr"`
+	// LogLevel is the starting level of the per-query traces, "info"
+	// (default) or "debug" to see them; /loglevel changes it at runtime.
+	// DebugLogRate caps debug lines a second; negative removes the cap.
+	LogLevel     string `toml:"log_level"`
+	DebugLogRate int    `toml:"debug_log_rate"`
+	// Pprof serves the net/http/pprof profiles under /debug/pprof/ on the
+	// admin API.
+	Pprof               bool `toml:"pprof"`
+	StatsHistoryMinutes int  `toml:"stats_history_minutes"`
+	// CacheFormat selects how caches are persisted: "json" (default), "gob",
+	// "msgpack" or "wire".
+	CacheFormat string `toml:"cache_format"`
+	// MaxLoadEntries caps how many entries each client loads from its cache
+	// file at startup, so an oversized file cannot exhaust memory. 0 loads
+	// them all.
+	MaxLoadEntries int `toml:"max_load_entries"`
+	// MaxCacheFileBytes bounds each cache file: saves that would be larger
+	// leave out the least valuable entries, which stay in memory. 0 is
+	// unbounded.
+	MaxCacheFileBytes int `toml:"max_cache_file_bytes"`
+	// SweepInterval is how often each client purges expired cache entries.
+	SweepInterval time.Duration `toml:"sweep_interval"`
+	// SaveInterval batches cache file writes: changes are saved at most
+	// this often, each client at its own point in the interval. 0 saves on
+	// every change.
+	SaveInterval time.Duration `toml:"save_interval"`
+	// UpstreamStatsFile keeps the upstreams' latency and failure averages
+	// and the circuit breakers across restarts, saved every
+	// UpstreamStatsInterval and on shutdown. Empty disables it.
+	UpstreamStatsFile     string        `toml:"upstream_stats_file"`
+	UpstreamStatsInterval time.Duration `toml:"upstream_stats_interval"`
+	// DedupeWindow is how long a completed resolution keeps answering
+	// identical misses, such as a burst of retries for a name that failed.
+	// Misses arriving while it runs always share it. Negative disables
+	// the window.
+	DedupeWindow time.Duration `toml:"dedupe_window"`
+	// MaxForwardHops is the longest chain of parent caches a query may cross.
+	MaxForwardHops int `toml:"max_forward_hops"`
+	// MaxNameLength (octets in wire form) and MaxLabels bound query names;
+	// longer ones are answered with FORMERR.
+	MaxNameLength int `toml:"max_name_length"`
+	MaxLabels     int `toml:"max_labels"`
+	// MaxCNAMEDepth is the longest CNAME chain followed for a query whose
+	// upstream answer stops at an alias.
+	MaxCNAMEDepth int `toml:"max_cname_depth"`
+	// MinimalResponses drops the authority and additional sections of
+	// upstream answers before they are cached or served.
+	MinimalResponses bool `toml:"minimal_responses"`
+	// CacheAllSections caches and serves the authority (NS) and additional
+	// (glue) sections of upstream answers, not just the answer section and
+	// a NODATA SOA. MinimalResponses takes precedence.
+	CacheAllSections bool `toml:"cache_all_sections"`
+	// MinTTL and MaxTTL clamp how long upstream answers are cached.
+	MinTTL time.Duration `toml:"min_ttl"`
+	MaxTTL time.Duration `toml:"max_ttl"`
+	// RespectZeroTTL (the default) passes answers with a zero TTL through
+	// uncached; set to false, they are cached for MinTTL or any override.
+	RespectZeroTTL *bool `toml:"respect_zero_ttl"`
+	// TTLOverrides replaces the upstream TTL for a record type ("A", "TXT",
+	// ...) before the min/max clamps are applied.
+	TTLOverrides map[string]time.Duration `toml:"ttl_overrides"`
+	// PrefetchThreshold is the fraction of TTL left (e.g. 0.1) below which a
+	// popular entry is refreshed before it expires; 0 disables prefetch.
+	PrefetchThreshold float64 `toml:"prefetch_threshold"`
+	// PrefetchMinHits is how many cache hits an entry needs to be prefetched.
+	PrefetchMinHits int `toml:"prefetch_min_hits"`
+	// Entries served from cache at least adaptive_min_hits times live up to
+	// adaptive_ttl_factor times their TTL, never longer than
+	// adaptive_ttl_ceiling, and are refreshed in the background once their
+	// upstream TTL runs out. A zero factor disables the extension.
+	AdaptiveMinHits    int           `toml:"adaptive_min_hits"`
+	AdaptiveTTLFactor  float64       `toml:"adaptive_ttl_factor"`
+	AdaptiveTTLCeiling time.Duration `toml:"adaptive_ttl_ceiling"`
+	// StaleMaxAge is how long past expiry entries are kept to serve stale
+	// (RFC 8767), including across restarts; 0 disables it. A stale
+	// answer is served, with StaleAnswerTTL, when resolving the name fails
+	// or takes longer than StaleAnswerClientTimeout (0 waits for
+	// resolution to finish).
+	StaleMaxAge              time.Duration `toml:"stale_max_age"`
+	StaleAnswerTTL           time.Duration `toml:"stale_answer_ttl"`
+	StaleAnswerClientTimeout time.Duration `toml:"stale_answer_client_timeout"`
+	// RedisAddr enables a Redis cache shared by every instance pointing at
+	// it. With CacheBackend "memory" (the default) it sits behind the
+	// in-memory caches of each group; with "redis" it replaces them.
+	RedisAddr     string `toml:"redis_addr"`
+	RedisPassword string `toml:"redis_password"`
+	RedisDB       int    `toml:"redis_db"`
+	RedisPrefix   string `toml:"redis_prefix"`
+	CacheBackend  string `toml:"cache_backend"`
+	// MaxEntriesPerType caps the cached entries of each record type, e.g.
+	// A = 10000. The "*" key sets the cap of every type not listed.
+	MaxEntriesPerType map[string]int `toml:"max_entries_per_type"`
+	// Chaos is for testing only; see ChaosEnvVar.
+	Chaos ChaosConfig `toml:"chaos"`
+	// SyntheticSOA, when set, is the authority of NXDOMAIN and NODATA
+	// answers that have no SOA of their own, such as blocked names and
+	// offline misses.
+	SyntheticSOA *SyntheticSOAConfig `toml:"synthetic_soa"`
+	// QNameMinimization resolves iteratively from RootHints, sending each
+	// server only the labels it needs (RFC 7816). It keeps the full query
+	// name private from root and TLD servers at the cost of extra round
+	// trips on a cold cache. The upstreams remain a fallback.
+	QNameMinimization bool     `toml:"qname_minimization"`
+	RootHints         []string `toml:"root_hints"`
+	// BreakerThreshold consecutive failures of an upstream within
+	// BreakerWindow stop queries to it for BreakerCooldown.
+	BreakerThreshold int           `toml:"breaker_threshold"`
+	BreakerWindow    time.Duration `toml:"breaker_window"`
+	BreakerCooldown  time.Duration `toml:"breaker_cooldown"`
+	// ZoneFile is an RFC 1035 zone answered authoritatively before any
+	// cache lookup or forwarding. ZoneOrigin is needed only when the file
+	// has no $ORIGIN and uses relative names.
+	ZoneFile   string `toml:"zone_file"`
+	ZoneOrigin string `toml:"zone_origin"`
+	// AnswerOrder is how address records are ordered in each response:
+	// "stored" (default, as cached), "rotate" (round-robin) or "random".
+	AnswerOrder string `toml:"answer_order"`
+	// CompressResponses (the default) uses name compression in responses;
+	// false writes every name in full for clients that mishandle
+	// compression pointers.
+	CompressResponses *bool `toml:"compress_responses"`
+	// DNSSECCacheKey (the default) caches answers to DO queries under keys
+	// of their own, so a validating client never gets an answer cached for
+	// a client that did not ask for signatures, nor the reverse.
+	DNSSECCacheKey *bool `toml:"dnssec_cache_key"`
+	// UpstreamMaxInFlight caps concurrent queries to each upstream address,
+	// shared by all clients; further queries wait for a free slot.
+	UpstreamMaxInFlight int `toml:"upstream_max_inflight"`
+	// ClientMaxInFlight caps each client's outstanding upstream queries,
+	// across all upstreams; 0 leaves only the per-upstream cap.
+	ClientMaxInFlight int `toml:"client_max_inflight"`
+	// CompressAbove gzips cached entries whose records pack to at least
+	// this many bytes, trading CPU on every hit for memory; 0 disables it.
+	CompressAbove int `toml:"compress_above"`
+	// RandomizeCase randomizes the case of query names sent to plain DNS
+	// upstreams (0x20 encoding) and drops answers not echoing it exactly.
+	RandomizeCase bool `toml:"randomize_case"`
+	// EDNSPadding pads queries to encrypted upstreams, and responses on
+	// encrypted connections to clients that sent padding, to multiples of
+	// the block sizes (RFC 7830, RFC 8467). Plain DNS is never padded.
+	EDNSPadding              bool `toml:"edns_padding"`
+	EDNSPaddingBlock         int  `toml:"edns_padding_block"`
+	EDNSPaddingResponseBlock int  `toml:"edns_padding_response_block"`
+	// DoHMethod is how queries are sent to https:// upstreams: "post"
+	// (default) or "get", whose URLs HTTP caches can store.
+	DoHMethod string `toml:"doh_method"`
+	// ListenAddr is the address to serve UDP and TCP on. Binding a
+	// privileged port needs root; User and Group name the account to switch
+	// to once the sockets are bound. Sockets passed by systemd (LISTEN_FDS)
+	// take precedence over ListenAddr.
+	ListenAddr string `toml:"listen_addr"`
+	// DoQAddr, when set, also serves DNS over QUIC (RFC 9250) there,
+	// usually on port 853, with the certificate and key in DoQCertFile and
+	// DoQKeyFile. It is bound before privileges are dropped too.
+	DoQAddr     string `toml:"doq_addr"`
+	DoQCertFile string `toml:"doq_cert_file"`
+	DoQKeyFile  string `toml:"doq_key_file"`
+	// AllowQuery and DenyQuery are the CIDRs that may and may not query
+	// the server; deny wins, and an empty AllowQuery allows everyone not
+	// denied. ACLAction is what refused sources get: "refuse" (default),
+	// an answer with REFUSED, or "drop", no answer at all.
+	AllowQuery []string `toml:"allow_query"`
+	DenyQuery  []string `toml:"deny_query"`
+	ACLAction  string   `toml:"acl_action"`
+	User       string   `toml:"user"`
+	Group      string   `toml:"group"`
+	// UDPReadBufferBytes sets the receive buffer of the UDP socket; 0
+	// keeps the OS default.
+	UDPReadBufferBytes int `toml:"udp_read_buffer_bytes"`
+	// QueryTimeout is how long a query may take before resolution is
+	// abandoned, roughly how long clients wait for an answer.
+	QueryTimeout time.Duration `toml:"query_timeout"`
+	// TCPIdleTimeout closes TCP connections idle for longer, and
+	// TCPMaxConnections caps how many may be open at once (0 is unlimited).
+	TCPIdleTimeout    time.Duration `toml:"tcp_idle_timeout"`
+	TCPMaxConnections int           `toml:"tcp_max_connections"`
+	// PeerTimeout bounds how long a miss spends looking in the group's
+	// other caches before it is resolved; 0 waits for every peer.
+	PeerTimeout time.Duration `toml:"peer_timeout"`
+	// QueryBudget, when set, is the most a miss may take to be answered:
+	// CacheBudgetShare of it for the peer caches, the rest for resolving,
+	// and a stale entry is served once it runs out. See QueryBudget. A
+	// share of 0, unlike an unset one, skips the peer and shared caches.
+	QueryBudget      time.Duration `toml:"query_budget"`
+	CacheBudgetShare *float64      `toml:"cache_budget_share"`
+	// PeerSelection is which peer's entry a miss takes when several have
+	// one: "first" (default), "freshest" or "best-source".
+	PeerSelection string `toml:"peer_selection"`
+	// Gossip pushes newly resolved entries to the other clients of the group
+	// instead of waiting for them to be pulled on a miss. Entries with a TTL
+	// below GossipMinTTL are not worth spreading. GossipQueue bounds each
+	// client's backlog of incoming entries; overflow is dropped.
+	Gossip       bool          `toml:"gossip"`
+	GossipMinTTL time.Duration `toml:"gossip_min_ttl"`
+	GossipQueue  int           `toml:"gossip_queue"`
+	// MirrorAddr is a warm standby's mirror_listen address. Every entry
+	// resolved here is streamed to it, best effort: at most MirrorQueue
+	// entries wait to be sent and the rest are dropped. MirrorListen
+	// accepts such a stream, filling the caches of this instance.
+	MirrorAddr   string `toml:"mirror_addr"`
+	MirrorQueue  int    `toml:"mirror_queue"`
+	MirrorListen string `toml:"mirror_listen"`
+	// QueryLog appends a line per query answered through the caches:
+	// time, client address, name, type, rcode and source.
+	QueryLog string `toml:"query_log"`
+	// WarmupLogLines, when set, reads that many lines from the end of
+	// QueryLog at startup and resolves the WarmupTop most frequent queries
+	// before serving, giving up after WarmupTimeout.
+	WarmupLogLines int           `toml:"warmup_log_lines"`
+	WarmupTop      int           `toml:"warmup_top"`
+	WarmupTimeout  time.Duration `toml:"warmup_timeout"`
+	// MinReadyClients holds off serving until that many clients have had
+	// an answer from one of their upstreams, probing for up to
+	// ReadyTimeout; the server exits if too few did. 0 serves at once.
+	MinReadyClients int           `toml:"min_ready_clients"`
+	ReadyTimeout    time.Duration `toml:"ready_timeout"`
+}
+
+// Validate reports the first problem found in the configuration.
+func (c *Config) Validate() error {
+	if len(c.Clients) == 0 {
+		return fmt.Errorf("no clients configured")
+	}
+	seen := make(map[string]bool)
+	for _, client := range c.Clients {
+		if client.ID == "" {
+			return fmt.Errorf("client without an id")
+		}
+		if seen[client.ID] {
+			return fmt.Errorf("duplicate client id %q", client.ID)
+		}
+		seen[client.ID] = true
+	}
+	if c.EDNSPaddingBlock > dns.MaxMsgSize || c.EDNSPaddingResponseBlock > dns.MaxMsgSize {
+		return fmt.Errorf("edns padding blocks must be at most %d bytes", dns.MaxMsgSize)
+	}
+	if c.MaxNameLength > DefaultMaxNameLength || c.MaxLabels > DefaultMaxLabels {
+		return fmt.Errorf("max_name_length and max_labels cannot exceed the DNS limits of %d and %d", DefaultMaxNameLength, DefaultMaxLabels)
+	}
+	if _, ok := dns.IsDomainName(c.HealthCheckName); c.HealthCheckName != "" && !ok {
+		return fmt.Errorf("health_check_name %q is not a domain name", c.HealthCheckName)
+	}
+	if c.HealthCheckAnswer != "" && net.ParseIP(c.HealthCheckAnswer) == nil {
+		return fmt.Errorf("health_check_answer %q is not an IP address", c.HealthCheckAnswer)
+	}
+	if c.FallbackIP != "" && net.ParseIP(c.FallbackIP) == nil {
+		return fmt.Errorf("fallback_ip %q is not an IP address", c.FallbackIP)
+	}
+	if c.BlocklistAnswer != "" && c.BlocklistAnswer != "nxdomain" && net.ParseIP(c.BlocklistAnswer) == nil {
+		return fmt.Errorf("blocklist_answer %q is neither nxdomain nor an IP address", c.BlocklistAnswer)
+	}
+	if soa := c.SyntheticSOA; soa != nil {
+		for key, name := range map[string]string{"mname": soa.MName, "rname": soa.RName} {
+			if _, ok := dns.IsDomainName(name); name != "" && !ok {
+				return fmt.Errorf("synthetic_soa.%s %q is not a domain name", key, name)
+			}
+		}
+	}
+	if c.DNS64Prefix != "" {
+		if _, err := parseDNS64Prefix(c.DNS64Prefix); err != nil {
+			return err
+		}
+	}
+	for _, zone := range c.ForwardZones {
+		if zone.Name == "" {
+			return fmt.Errorf("forward zone without a name")
+		}
+		if _, ok := dns.IsDomainName(zone.Name); !ok {
+			return fmt.Errorf("forward zone %q is not a valid domain name", zone.Name)
+		}
+		if len(zone.Upstreams) == 0 {
+			return fmt.Errorf("forward zone %q: no upstreams", zone.Name)
+		}
+	}
+	for i, rule := range c.Rewrites {
+		if err := rule.check(); err != nil {
+			return fmt.Errorf("rewrite %d: %v", i+1, err)
+		}
+	}
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return fmt.Errorf("log_level: %v", err)
+		}
+	}
+	if _, err := NewACL(c.AllowQuery, c.DenyQuery, false); err != nil {
+		return fmt.Errorf("allow_query/deny_query: %v", err)
+	}
+	if c.ACLAction != "" && c.ACLAction != "refuse" && c.ACLAction != "drop" {
+		return fmt.Errorf("acl_action %q is neither refuse nor drop", c.ACLAction)
+	}
+	if c.DoQAddr != "" && (c.DoQCertFile == "" || c.DoQKeyFile == "") {
+		return fmt.Errorf("doq_addr needs doq_cert_file and doq_key_file")
+	}
+	switch c.CacheBackend {
+	case "", "memory":
+	case "redis":
+		if c.RedisAddr == "" {
+			return fmt.Errorf("cache_backend redis needs redis_addr")
+		}
+	default:
+		return fmt.Errorf("cache_backend %q is neither memory nor redis", c.CacheBackend)
+	}
+	// Cache files are named after client ids, so they must be unique across
+	// views as well.
+	for _, view := range c.Views {
+		if view.Name == "" {
+			return fmt.Errorf("view without a name")
+		}
+		if len(view.MatchClients) == 0 {
+			return fmt.Errorf("view %q: no match_clients", view.Name)
+		}
+		for _, cidr := range view.MatchClients {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("view %q: %v", view.Name, err)
+			}
+		}
+		if len(view.Clients) == 0 {
+			return fmt.Errorf("view %q: no clients configured", view.Name)
+		}
+		for _, client := range view.Clients {
+			if client.ID == "" {
+				return fmt.Errorf("view %q: client without an id", view.Name)
+			}
+			if seen[client.ID] {
+				return fmt.Errorf("duplicate client id %q", client.ID)
+			}
+			seen[client.ID] = true
+		}
+	}
+	if _, err := CacheCodecByName(c.CacheFormat); err != nil {
+		return err
+	}
+	if c.MinTTL > 0 && c.MaxTTL > 0 && c.MinTTL > c.MaxTTL {
+		return fmt.Errorf("min_ttl %s is greater than max_ttl %s", c.MinTTL, c.MaxTTL)
+	}
+	switch c.AnswerOrder {
+	case "", "stored", "rotate", "random":
+	default:
+		return fmt.Errorf("unknown answer_order %q", c.AnswerOrder)
+	}
+	switch c.OfflineRcode {
+	case "", "servfail", "nxdomain":
+	default:
+		return fmt.Errorf("unknown offline_rcode %q", c.OfflineRcode)
+	}
+	switch c.DoHMethod {
+	case "", "post", "get":
+	default:
+		return fmt.Errorf("unknown doh_method %q", c.DoHMethod)
+	}
+	clients := [][]ClientConfig{c.Clients}
+	for _, view := range c.Views {
+		clients = append(clients, view.Clients)
+	}
+	for _, group := range clients {
+		for _, client := range group {
+			upstreams := client.Upstreams
+			if client.Server != "" {
+				upstreams = append([]string{client.Server}, upstreams...)
+			}
+			if _, err := parseUpstreams(upstreams, client.Protocol); err != nil {
+				return fmt.Errorf("client %q: %v", client.ID, err)
+			}
+		}
+	}
+	for _, zone := range c.ForwardZones {
+		if _, err := parseUpstreams(zone.Upstreams, ""); err != nil {
+			return fmt.Errorf("forward zone %q: %v", zone.Name, err)
+		}
+	}
+	if c.QueryBudget < 0 {
+		return fmt.Errorf("query_budget must not be negative, got %s", c.QueryBudget)
+	}
+	if share := c.CacheBudgetShare; share != nil && (*share < 0 || *share >= 1) {
+		return fmt.Errorf("cache_budget_share must be between 0 and 1, got %g", *share)
+	}
+	if c.PrefetchThreshold < 0 || c.PrefetchThreshold >= 1 {
+		return fmt.Errorf("prefetch_threshold must be between 0 and 1, got %g", c.PrefetchThreshold)
+	}
+	if c.WarmupLogLines > 0 && c.QueryLog == "" {
+		return fmt.Errorf("warmup_log_lines needs a query_log to read")
+	}
+	switch c.PeerSelection {
+	case "", PeerSelectFirst, PeerSelectFreshest, PeerSelectBestSource:
+	default:
+		return fmt.Errorf("peer_selection must be first, freshest or best-source, got %q", c.PeerSelection)
+	}
+	if c.MinReadyClients > len(c.Clients) {
+		return fmt.Errorf("min_ready_clients is %d but only %d clients are configured", c.MinReadyClients, len(c.Clients))
+	}
+	if c.AdaptiveTTLFactor != 0 && c.AdaptiveTTLFactor < 1 {
+		return fmt.Errorf("adaptive_ttl_factor must be at least 1, got %g", c.AdaptiveTTLFactor)
+	}
+	for name, p := range map[string]float64{
+		"chaos.delay_probability":    c.Chaos.DelayProbability,
+		"chaos.drop_probability":     c.Chaos.DropProbability,
+		"chaos.servfail_probability": c.Chaos.ServfailProbability,
+	} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %g", name, p)
+		}
+	}
+	for name, limit := range c.MaxEntriesPerType {
+		if _, ok := dns.StringToType[strings.ToUpper(name)]; !ok && name != "*" {
+			return fmt.Errorf("max_entries_per_type: unknown record type %q", name)
+		}
+		if limit < 0 {
+			return fmt.Errorf("max_entries_per_type: negative limit for %s", name)
+		}
+	}
+	for name := range c.TTLOverrides {
+		if _, ok := dns.StringToType[strings.ToUpper(name)]; !ok {
+			return fmt.Errorf("ttl_overrides: unknown record type %q", name)
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads the configuration from a file, or from every *.toml file
+// in a directory. Files in a directory are merged in name order: clients,
+// views and forward zones are concatenated, tables such as ttl_overrides
+// are merged key by key, and any other setting takes the value from the
+// last file defining it, with a warning when files disagree.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	info, err := os.Stat(path)
+	if err != nil {
+		return config, err
+	}
+	if !info.IsDir() {
+		_, err := toml.DecodeFile(path, &config)
+		return config, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.toml"))
+	if err != nil {
+		return config, err
+	}
+	if len(files) == 0 {
+		return config, fmt.Errorf("no *.toml files in %s", path)
+	}
+	sort.Strings(files)
+
+	definedBy := make(map[string]string)
+	merged := reflect.ValueOf(&config).Elem()
+	for _, file := range files {
+		var part Config
+		md, err := toml.DecodeFile(file, &part)
+		if err != nil {
+			return config, fmt.Errorf("%s: %v", file, err)
+		}
+		config.Clients = append(config.Clients, part.Clients...)
+		config.Views = append(config.Views, part.Views...)
+		config.ForwardZones = append(config.ForwardZones, part.ForwardZones...)
+		config.Rewrites = append(config.Rewrites, part.Rewrites...)
+
+		partValue := reflect.ValueOf(part)
+		for i := 0; i < partValue.NumField(); i++ {
+			key := strings.Split(merged.Type().Field(i).Tag.Get("toml"), ",")[0]
+			if key == "" || key == "clients" || key == "views" || key == "forward_zones" || key == "rewrite" || !md.IsDefined(key) {
+				continue
+			}
+			dst, src := merged.Field(i), partValue.Field(i)
+			if src.Kind() == reflect.Map {
+				if dst.IsNil() {
+					dst.Set(reflect.MakeMap(dst.Type()))
+				}
+				for _, k := range src.MapKeys() {
+					entry := key + "." + k.String()
+					if prev := dst.MapIndex(k); prev.IsValid() && !reflect.DeepEqual(prev.Interface(), src.MapIndex(k).Interface()) {
+						fmt.Printf("Config warning: %s set in %s is overridden by %s\n", entry, definedBy[entry], file)
+					}
+					dst.SetMapIndex(k, src.MapIndex(k))
+					definedBy[entry] = file
+				}
+				continue
+			}
+			if prev, ok := definedBy[key]; ok && !reflect.DeepEqual(dst.Interface(), src.Interface()) {
+				fmt.Printf("Config warning: %s set in %s is overridden by %s\n", key, prev, file)
+			}
+			dst.Set(src)
+			definedBy[key] = file
+		}
+	}
+	return config, nil
+}
+
+// WithDefaults returns the configuration with every unset setting that has a
+// default filled in, as the server will run with it.
+func (c Config) WithDefaults() Config {
+	if c.ListenAddr == "" {
+		c.ListenAddr = DefaultListenAddr
+	}
+	if c.QueryTimeout <= 0 {
+		c.QueryTimeout = DefaultQueryTimeout
+	}
+	if c.CacheBudgetShare == nil {
+		share := DefaultCacheBudgetShare
+		c.CacheBudgetShare = &share
+	}
+	if c.TCPIdleTimeout <= 0 {
+		c.TCPIdleTimeout = DefaultTCPIdleTimeout
+	}
+	if c.CacheFormat == "" {
+		c.CacheFormat = "json"
+	}
+	if c.CacheBackend == "" {
+		c.CacheBackend = "memory"
+	}
+	if c.SweepInterval <= 0 {
+		c.SweepInterval = DefaultSweepInterval
+	}
+	if c.StatsHistoryMinutes <= 0 {
+		c.StatsHistoryMinutes = DefaultHistoryMinutes
+	}
+	if c.MaxNameLength <= 0 {
+		c.MaxNameLength = DefaultMaxNameLength
+	}
+	if c.EDNSPaddingBlock <= 0 {
+		c.EDNSPaddingBlock = DefaultQueryPaddingBlock
+	}
+	if c.EDNSPaddingResponseBlock <= 0 {
+		c.EDNSPaddingResponseBlock = DefaultResponsePaddingBlock
+	}
+	if c.MaxLabels <= 0 {
+		c.MaxLabels = DefaultMaxLabels
+	}
+	if c.MaxForwardHops <= 0 {
+		c.MaxForwardHops = DefaultMaxForwardHops
+	}
+	if c.MaxCNAMEDepth <= 0 {
+		c.MaxCNAMEDepth = DefaultMaxCNAMEDepth
+	}
+	if c.AnswerOrder == "" {
+		c.AnswerOrder = "stored"
+	}
+	if c.OfflineRcode == "" {
+		c.OfflineRcode = "servfail"
+	}
+	if c.DNS64Prefix == "" {
+		c.DNS64Prefix = "64:ff9b::/96"
+	}
+	if c.BlocklistAnswer == "" {
+		c.BlocklistAnswer = "nxdomain"
+	}
+	if c.DoHMethod == "" {
+		c.DoHMethod = "post"
+	}
+	if c.ACLAction == "" {
+		c.ACLAction = "refuse"
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.DebugLogRate == 0 {
+		c.DebugLogRate = DefaultDebugLogRate
+	}
+	if c.HealthCheckName == "" {
+		c.HealthCheckName = DefaultHealthCheckName
+	}
+	if c.HealthCheckAnswer == "" {
+		c.HealthCheckAnswer = "127.0.0.1"
+	}
+	if c.DedupeWindow == 0 {
+		c.DedupeWindow = DefaultDedupeWindow
+	}
+	if c.UpstreamStatsInterval <= 0 {
+		c.UpstreamStatsInterval = DefaultUpstreamStatsInterval
+	}
+	if c.QuarantineThreshold == 0 {
+		c.QuarantineThreshold = DefaultQuarantineThreshold
+	}
+	if c.QuarantineCooldown <= 0 {
+		c.QuarantineCooldown = DefaultQuarantineCooldown
+	}
+	if c.ShortTTLThreshold == 0 {
+		c.ShortTTLThreshold = DefaultShortTTLThreshold
+	}
+	if c.ShortTTLStreak <= 0 {
+		c.ShortTTLStreak = DefaultShortTTLStreak
+	}
+	// Zone names are matched against canonical query names, so store them
+	// the same way; the slice is copied so the caller's config is untouched.
+	zones := make([]ForwardZone, len(c.ForwardZones))
+	for i, zone := range c.ForwardZones {
+		zone.Name = dns.CanonicalName(zone.Name)
+		zones[i] = zone
+	}
+	c.ForwardZones = zones
+	if c.QNameMinimization && len(c.RootHints) == 0 {
+		c.RootHints = DefaultRootHints
+	}
+	breakers := c.BreakerSettings()
+	c.BreakerThreshold, c.BreakerWindow, c.BreakerCooldown = breakers.Threshold, breakers.Window, breakers.Cooldown
+	if c.UpstreamMaxInFlight <= 0 {
+		c.UpstreamMaxInFlight = DefaultUpstreamMaxInFlight
+	}
+	if c.GossipQueue <= 0 {
+		c.GossipQueue = DefaultGossipQueue
+	}
+	if c.MirrorQueue <= 0 {
+		c.MirrorQueue = DefaultMirrorQueue
+	}
+	if c.RespectZeroTTL == nil {
+		respect := true
+		c.RespectZeroTTL = &respect
+	}
+	if c.DNSSECCacheKey == nil {
+		separate := true
+		c.DNSSECCacheKey = &separate
+	}
+	if c.CompressResponses == nil {
+		compress := true
+		c.CompressResponses = &compress
+	}
+	if c.WarmupTop <= 0 {
+		c.WarmupTop = DefaultWarmupTop
+	}
+	if c.WarmupTimeout <= 0 {
+		c.WarmupTimeout = DefaultWarmupTimeout
+	}
+	if c.PeerSelection == "" {
+		c.PeerSelection = PeerSelectFirst
+	}
+	if c.ReadyTimeout <= 0 {
+		c.ReadyTimeout = DefaultReadyTimeout
+	}
+	if c.RedisAddr != "" && c.RedisPrefix == "" {
+		c.RedisPrefix = DefaultRedisPrefix
+	}
+	if c.StaleAnswerTTL <= 0 {
+		c.StaleAnswerTTL = DefaultStaleAnswerTTL
+	}
+	return c
+}
+
+// Redacted returns a copy of the configuration that is safe to print.
+func (c Config) Redacted() Config {
+	if c.CookieSecret != "" {
+		c.CookieSecret = "REDACTED"
+	}
+	if c.CacheSecret != "" {
+		c.CacheSecret = "REDACTED"
+	}
+	if c.RedisPassword != "" {
+		c.RedisPassword = "REDACTED"
+	}
+	return c
+}
+
+// BreakerSettings returns the circuit breaker settings with defaults applied.
+func (c *Config) BreakerSettings() BreakerSettings {
+	settings := BreakerSettings{Threshold: c.BreakerThreshold, Window: c.BreakerWindow, Cooldown: c.BreakerCooldown}
+	if settings.Threshold <= 0 {
+		settings.Threshold = DefaultBreakerThreshold
+	}
+	if settings.Window <= 0 {
+		settings.Window = DefaultBreakerWindow
+	}
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = DefaultBreakerCooldown
+	}
+	return settings
+}
+
+// CachePartitions builds the per-type cache limits, or returns nil when no
+// limits are configured.
+func (c *Config) CachePartitions() *CachePartitions {
+	if len(c.MaxEntriesPerType) == 0 {
+		return nil
+	}
+	limits := make(map[uint16]int)
+	other := 0
+	for name, limit := range c.MaxEntriesPerType {
+		if name == "*" {
+			other = limit
+			continue
+		}
+		limits[dns.StringToType[strings.ToUpper(name)]] = limit
+	}
+	return NewCachePartitions(limits, other)
+}
+
+// TTLPolicy builds the caching TTL policy. The config must be valid.
+func (c *Config) TTLPolicy() TTLPolicy {
+	policy := TTLPolicy{Min: c.MinTTL, Max: c.MaxTTL, Overrides: make(map[uint16]time.Duration), RespectZero: c.RespectZeroTTL == nil || *c.RespectZeroTTL}
+	for name, ttl := range c.TTLOverrides {
+		policy.Overrides[dns.StringToType[strings.ToUpper(name)]] = ttl
+	}
+	return policy
+}
+
+type forwardInfoKey struct{}
+
+// forwardInfo describes where a query came from, for loop prevention when
+// forwarding to parent caches.
+type forwardInfo struct {
+	Hops int
+	From net.IP
+}
+
+func withForwardInfo(ctx context.Context, info forwardInfo) context.Context {
+	return context.WithValue(ctx, forwardInfoKey{}, info)
+}
+
+func forwardInfoFromContext(ctx context.Context) forwardInfo {
+	info, _ := ctx.Value(forwardInfoKey{}).(forwardInfo)
+	return info
+}
+
+type dnssecOKKey struct{}
+
+// withDNSSECOK records whether the client set the DO bit, so upstream queries
+// ask for DNSSEC records too.
+func withDNSSECOK(ctx context.Context, do bool) context.Context {
+	return context.WithValue(ctx, dnssecOKKey{}, do)
+}
+
+func dnssecOK(ctx context.Context) bool {
+	do, _ := ctx.Value(dnssecOKKey{}).(bool)
+	return do
+}
+
+type checkingDisabledKey struct{}
+
+// withCheckingDisabled records whether the client set the CD bit, asking for
+// answers its own validator will check rather than ours upstream.
+func withCheckingDisabled(ctx context.Context, cd bool) context.Context {
+	return context.WithValue(ctx, checkingDisabledKey{}, cd)
+}
+
+func checkingDisabled(ctx context.Context) bool {
+	cd, _ := ctx.Value(checkingDisabledKey{}).(bool)
+	return cd
+}
+
+type cnameChainKey struct{}
+
+// withCNAMEChain records the names already resolved on the way to the
+// current one, so CNAME chasing can detect loops and bound its depth.
+func withCNAMEChain(ctx context.Context, chain []string) context.Context {
+	return context.WithValue(ctx, cnameChainKey{}, chain)
+}
+
+func cnameChain(ctx context.Context) []string {
+	chain, _ := ctx.Value(cnameChainKey{}).([]string)
+	return chain
+}
+
+// hopCount returns the hop count a chained instance attached to r.
+func hopCount(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == hopCountOption && len(local.Data) == 1 {
+			return int(local.Data[0])
+		}
+	}
+	return 0
+}
+
+func setHopCount(m *dns.Msg, hops int) {
+	if hops > 255 {
+		hops = 255
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: hopCountOption, Data: []byte{byte(hops)}})
+}
+
+// CacheCodec is a persistence format for a client's cache.
+type CacheCodec interface {
+	Name() string
+	Marshal(cache map[string]DNSResponse) ([]byte, error)
+	// Decode reads a cache file and calls visit for each entry until visit
+	// returns false.
+	Decode(r io.Reader, visit func(key string, response DNSResponse) bool) error
+}
+
+// gobMagic prefixes gob cache files so loadCache never mistakes them for
+// JSON. Version 1 files, which hold the cache as one gob-encoded map, are
+// still read.
+var (
+	gobMagic   = []byte("DNSGOB2\n")
+	gobMagicV1 = []byte("DNSGOB1\n")
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(cache map[string]DNSResponse) ([]byte, error) {
+	return json.Marshal(cache)
+}
+
+// Decode streams the entries one at a time, so a large cache file is never
+// held in memory all at once.
+func (jsonCodec) Decode(r io.Reader, visit func(key string, response DNSResponse) bool) error {
+	decoder := json.NewDecoder(r)
+	if t, err := decoder.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return fmt.Errorf("cache file is not a JSON object")
+	}
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("unexpected %v in cache file", t)
+		}
+		var response DNSResponse
+		if err := decoder.Decode(&response); err != nil {
+			return fmt.Errorf("entry %s: %v", key, err)
+		}
+		if !visit(key, response) {
+			return nil
+		}
+	}
+	_, err := decoder.Token()
+	return err
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+// gobEntry is one cache entry of a gob cache file. Entries are encoded one
+// after the other rather than as a map, which gob can only decode whole,
+// and as persistedResponse so that one encoder sends its type once rather
+// than DNSResponse.GobEncode starting a new one for every entry.
+type gobEntry struct {
+	Key      string
+	Response persistedResponse
+}
+
+func (gobCodec) Marshal(cache map[string]DNSResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(gobMagic)
+	encoder := gob.NewEncoder(&buf)
+	for key, response := range cache {
+		if err := encoder.Encode(gobEntry{Key: key, Response: response.persisted()}); err != nil {
+			return nil, fmt.Errorf("entry %s: %v", key, err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode streams the entries of version 2 files one at a time. Version 1
+// files are a single map, which has to be read whole before it is visited.
+func (gobCodec) Decode(r io.Reader, visit func(key string, response DNSResponse) bool) error {
+	magic := make([]byte, len(gobMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return fmt.Errorf("not a gob cache file")
+	}
+	decoder := gob.NewDecoder(r)
+	switch {
+	case bytes.Equal(magic, gobMagic):
+		for {
+			var entry gobEntry
+			if err := decoder.Decode(&entry); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			var response DNSResponse
+			if err := response.restore(entry.Response); err != nil {
+				return fmt.Errorf("entry %s: %v", entry.Key, err)
+			}
+			if !visit(entry.Key, response) {
+				return nil
+			}
+		}
+	case bytes.Equal(magic, gobMagicV1):
+		var cache map[string]DNSResponse
+		if err := decoder.Decode(&cache); err != nil {
+			return err
+		}
+		for key, response := range cache {
+			if !visit(key, response) {
+				break
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("not a gob cache file")
+}
+
+// msgpackMagic prefixes MessagePack cache files.
+var msgpackMagic = []byte("DNSMSGP1\n")
+
+// msgpackCodec stores the entries as MessagePack, one after the other,
+// with the same fields as JSON files but binary: smaller and faster to
+// read and write, and still readable by any MessagePack tool.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(cache map[string]DNSResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(msgpackMagic)
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetOmitEmpty(true)
+	for key, response := range cache {
+		if err := encoder.EncodeString(key); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(response.persisted()); err != nil {
+			return nil, fmt.Errorf("entry %s: %v", key, err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(r io.Reader, visit func(key string, response DNSResponse) bool) error {
+	magic := make([]byte, len(msgpackMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, msgpackMagic) {
+		return fmt.Errorf("not a msgpack cache file")
+	}
+	decoder := msgpack.NewDecoder(r)
+	for {
+		key, err := decoder.DecodeString()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var p persistedResponse
+		if err := decoder.Decode(&p); err != nil {
+			return fmt.Errorf("entry %s: %v", key, err)
+		}
+		var response DNSResponse
+		if err := response.restore(p); err != nil {
+			return fmt.Errorf("entry %s: %v", key, err)
+		}
+		if !visit(key, response) {
+			return nil
+		}
+	}
+}
+
+// wireMagic prefixes wire-format cache files. Files of earlier versions
+// are still read: version 1 entries have no MAC, and versions 1 and 2 no
+// additional section.
+var wireMagic = []byte("DNSWIRE3\n")
+
+// wireVersion returns the wire format version a file header announces, or 0
+// if it is not a wire cache file.
+func wireVersion(header []byte) int {
+	for version := 1; version <= 3; version++ {
+		if bytes.HasPrefix(header, []byte(fmt.Sprintf("DNSWIRE%d\n", version))) {
+			return version
+		}
+	}
+	return 0
+}
+
+// wireCodec stores each entry with its records in DNS wire format, so every
+// record type round-trips exactly and files stay small. An entry is its key,
+// address, timestamp and TTL followed by its packed answer, authority and
+// additional records and its MAC, each field length-prefixed with a
+// uvarint.
+type wireCodec struct{}
+
+func (wireCodec) Name() string { return "wire" }
+
+func (wireCodec) Marshal(cache map[string]DNSResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(wireMagic)
+	var scratch [binary.MaxVarintLen64]byte
+	putBytes := func(b []byte) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(b)))])
+		buf.Write(b)
+	}
+	putInt := func(v int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch[:], v)])
+	}
+	for key, response := range cache {
+		response = response.expand()
+		putBytes([]byte(key))
+		putBytes([]byte(response.IPAddress))
+		putInt(response.Timestamp.UnixNano())
+		putInt(int64(response.TTL))
+		for _, section := range [][]dns.RR{response.Records, response.Authority, response.Additional} {
+			buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(section)))])
+			for _, rr := range section {
+				packed := make([]byte, dns.Len(rr))
+				n, err := dns.PackRR(rr, packed, 0, nil, false)
+				if err != nil {
+					return nil, fmt.Errorf("entry %s: %v", key, err)
+				}
+				putBytes(packed[:n])
+			}
+		}
+		putBytes(response.MAC)
+	}
+	return buf.Bytes(), nil
+}
+
+func (wireCodec) Decode(r io.Reader, visit func(key string, response DNSResponse) bool) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(wireMagic))
+	_, err := io.ReadFull(br, magic)
+	version := wireVersion(magic)
+	if err != nil || version == 0 {
+		return fmt.Errorf("not a wire cache file")
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n > dns.MaxMsgSize {
+			return nil, fmt.Errorf("field of %d bytes is too long", n)
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return b, err
+	}
+	for {
+		key, err := readBytes()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		response, err := decodeWireEntry(br, readBytes, version)
+		if err != nil {
+			return fmt.Errorf("entry %s: %v", key, err)
+		}
+		if !visit(string(key), response) {
+			return nil
+		}
+	}
+}
+
+func decodeWireEntry(br *bufio.Reader, readBytes func() ([]byte, error), version int) (DNSResponse, error) {
+	var response DNSResponse
+	ip, err := readBytes()
+	if err != nil {
+		return response, err
+	}
+	response.IPAddress = string(ip)
+	timestamp, err := binary.ReadVarint(br)
+	if err != nil {
+		return response, err
+	}
+	response.Timestamp = time.Unix(0, timestamp)
+	ttl, err := binary.ReadVarint(br)
+	if err != nil {
+		return response, err
+	}
+	response.TTL = time.Duration(ttl)
+	sections := []*[]dns.RR{&response.Records, &response.Authority, &response.Additional}
+	if version < 3 {
+		sections = sections[:2]
+	}
+	for _, section := range sections {
+		count, err := binary.ReadUvarint(br)
+		if err != nil {
+			return response, err
+		}
+		for i := uint64(0); i < count; i++ {
+			packed, err := readBytes()
+			if err != nil {
+				return response, err
+			}
+			rr, _, err := dns.UnpackRR(packed, 0)
+			if err != nil {
+				return response, err
+			}
+			*section = append(*section, rr)
+		}
+	}
+	if version >= 2 {
+		if response.MAC, err = readBytes(); err != nil {
+			return response, err
+		}
+		if len(response.MAC) == 0 {
+			response.MAC = nil
+		}
+	}
+	return response, nil
+}
+
+// CacheCodecByName returns the codec for a cache_format value.
+func CacheCodecByName(name string) (CacheCodec, error) {
+	switch name {
+	case "", "json":
+		return jsonCodec{}, nil
+	case "gob":
+		return gobCodec{}, nil
+	case "msgpack":
+		return msgpackCodec{}, nil
+	case "wire":
+		return wireCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown cache format %q", name)
+}
+
+// detectCacheCodec picks the codec a cache file was written with from its
+// leading bytes, regardless of the currently configured format.
+func detectCacheCodec(header []byte) CacheCodec {
+	if bytes.HasPrefix(header, gobMagic) || bytes.HasPrefix(header, gobMagicV1) {
+		return gobCodec{}
+	}
+	if bytes.HasPrefix(header, msgpackMagic) {
+		return msgpackCodec{}
+	}
+	if wireVersion(header) != 0 {
+		return wireCodec{}
+	}
+	return jsonCodec{}
+}
+
+// historyBucket holds the counters for a single minute. Minute is the Unix
+// minute the counters belong to, so a bucket left over from a previous lap of
+// the ring can be recognised and reset.
+type historyBucket struct {
+	Minute   atomic.Int64
+	Hits     atomic.Uint64
+	PeerHits atomic.Uint64
+	Misses   atomic.Uint64
+}
+
+// HitHistory is a fixed-size ring of per-minute cache counters, with
+// running totals since startup.
+type HitHistory struct {
+	buckets []historyBucket
+	total   historyBucket // Minute unused
+	// HitRatio smooths the share of lookups answered from the caches,
+	// peers and the shared cache included.
+	HitRatio EWMA
+}
+
+type HistoryPoint struct {
+	Minute   time.Time `json:"minute"`
+	Hits     uint64    `json:"hits"`
+	PeerHits uint64    `json:"peer_hits"`
+	Misses   uint64    `json:"misses"`
+}
+
+func NewHitHistory(minutes int) *HitHistory {
+	if minutes <= 0 {
+		minutes = DefaultHistoryMinutes
+	}
+	return &HitHistory{buckets: make([]historyBucket, minutes)}
+}
+
+// bucket returns the bucket for the current minute, resetting it if it still
+// holds counts from an earlier lap.
+func (h *HitHistory) bucket() *historyBucket {
+	now := time.Now().Unix() / 60
+	b := &h.buckets[now%int64(len(h.buckets))]
+	if old := b.Minute.Load(); old != now && b.Minute.CompareAndSwap(old, now) {
+		b.Hits.Store(0)
+		b.PeerHits.Store(0)
+		b.Misses.Store(0)
+	}
+	return b
+}
+
+func (h *HitHistory) RecordHit() {
+	h.bucket().Hits.Add(1)
+	h.total.Hits.Add(1)
+	h.HitRatio.Observe(1)
+}
+
+func (h *HitHistory) RecordPeerHit() {
+	h.bucket().PeerHits.Add(1)
+	h.total.PeerHits.Add(1)
+	h.HitRatio.Observe(1)
+}
+
+func (h *HitHistory) RecordMiss() {
+	h.bucket().Misses.Add(1)
+	h.total.Misses.Add(1)
+	h.HitRatio.Observe(0)
+}
+
+// HitRatioAlpha is the weight of each lookup in the smoothed hit ratios,
+// which then follow roughly the last 1/HitRatioAlpha lookups.
+const HitRatioAlpha = 0.01
+
+// EWMA is an exponentially weighted moving average with weight
+// HitRatioAlpha, updated without locks so recording a lookup stays cheap.
+// Until 1/HitRatioAlpha values are seen it is their plain mean, so it does
+// not start out biased towards zero.
+type EWMA struct {
+	bits  atomic.Uint64 // math.Float64bits of the average
+	count atomic.Uint64
+}
+
+// Observe folds x into the average.
+func (e *EWMA) Observe(x float64) {
+	alpha := max(HitRatioAlpha, 1/float64(e.count.Add(1)))
+	for {
+		old := e.bits.Load()
+		average := math.Float64frombits(old)
+		if e.bits.CompareAndSwap(old, math.Float64bits(average+alpha*(x-average))) {
+			return
+		}
+	}
+}
+
+// Value is the current average, 0 before anything was observed.
+func (e *EWMA) Value() float64 {
+	return math.Float64frombits(e.bits.Load())
+}
+
+// Totals returns the counts since startup.
+func (h *HitHistory) Totals() (hits, peerHits, misses uint64) {
+	return h.total.Hits.Load(), h.total.PeerHits.Load(), h.total.Misses.Load()
+}
+
+// Snapshot returns the recorded minutes, oldest first. Minutes with no
+// activity are omitted.
+func (h *HitHistory) Snapshot() []HistoryPoint {
+	now := time.Now().Unix() / 60
+	size := int64(len(h.buckets))
+	var points []HistoryPoint
+	for minute := now - size + 1; minute <= now; minute++ {
+		b := &h.buckets[minute%size]
+		if b.Minute.Load() != minute {
+			continue
+		}
+		points = append(points, HistoryPoint{
+			Minute:   time.Unix(minute*60, 0),
+			Hits:     b.Hits.Load(),
+			PeerHits: b.PeerHits.Load(),
+			Misses:   b.Misses.Load(),
+		})
+	}
+	return points
+}
+
+// NewClient creates a client and loads its cache file, keeping at most
+// maxEntries fresh entries from it (0 keeps them all).
+func NewClient(id string, server string, codec CacheCodec, maxEntries int) *Client {
+	client := newClient(id, server, codec)
+	client.loadCache(maxEntries)
+	return client
+}
+
+// newClient creates a client with an empty cache, for callers that set the
+// stale policy before loading the cache file.
+func newClient(id string, server string, codec CacheCodec) *Client {
+	cacheFile := fmt.Sprintf("%s_cache.%s", id, codec.Name())
+	client := &Client{
+		ID:          id,
+		Cache:       make(map[string]DNSResponse),
+		Expiry:      NewExpiryQueue(),
+		prefetching: make(map[string]bool),
+		resolutions: make(map[string]*resolution),
+		Breakers:    make(map[string]*CircuitBreaker),
+		Server:      server,
+		CacheFile:   cacheFile,
+		CacheCodec:  codec,
+		History:     NewHitHistory(DefaultHistoryMinutes),
+	}
+	return client
+}
+
+func (c *Client) loadCache(maxEntries int) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if loaded, ok := c.readCacheFile(maxEntries); ok {
+		// Older cache files may hold relative names, entries keyed by name
+		// only, or bare IP addresses; bring them in line with QueryDNS.
+		c.Cache = make(map[string]DNSResponse, len(loaded))
+		for key, response := range loaded {
+			domain, qtype := splitCacheKey(key)
+			if len(response.Records) == 0 && response.IPAddress != "" {
+				rr, err := newAddressRecord(domain, qtype, response.IPAddress, response.TTL)
+				if err != nil {
+					continue
+				}
+				response.Records = []dns.RR{rr}
+			}
+			if !response.Fresh() && !c.Stale.Usable(response) {
+				// Expired while we were down, past serving stale.
+				continue
+			}
+			normalized := cacheKey(domain, qtype)
+			if strings.HasSuffix(key, dnssecKeySuffix) {
+				normalized += dnssecKeySuffix
+			}
+			c.storeLocked(normalized, response)
+		}
+	}
+}
+
+// storeLocked caches response under key. c.Mutex must be held.
+// Expired entries are kept as long as they may be served stale.
+func (c *Client) storeLocked(key string, response DNSResponse) {
+	if c.NoCache {
+		return
+	}
+	if domain, _ := splitCacheKey(key); c.Quarantine.Active(domain) {
+		fmt.Printf("Client %s: not caching %s, the name is quarantined\n", c.ID, key)
+		return
+	}
+	c.Cache[key] = c.sign(key, response).compress(c.CompressAbove)
+	c.Expiry.Set(key, response.ExpiresAt().Add(c.Stale.MaxAge))
+	if c.Partitions != nil {
+		c.Partitions.Touch(key)
+		c.trimLocked(key)
+	}
+}
+
+// removeLocked drops key from the cache. c.Mutex must be held.
+func (c *Client) removeLocked(key string) {
+	delete(c.Cache, key)
+	c.Expiry.Remove(key)
+	if c.Partitions != nil {
+		c.Partitions.Remove(key)
+	}
+}
+
+// trimLocked evicts the least recently used entries of key's record type
+// until its partition is back within its limit. c.Mutex must be held.
+func (c *Client) trimLocked(key string) {
+	_, qtype := splitCacheKey(key)
+	for {
+		victim, ok := c.Partitions.Overflow(qtype)
+		if !ok {
+			return
+		}
+		delete(c.Cache, victim)
+		c.Expiry.Remove(victim)
+		partitionEvictions.With(labels("client", c.ID, "type", dns.Type(qtype).String())).Add(1)
+	}
+}
+
+// Quarantine tracks bad answers per name. A name with Threshold of them
+// within Cooldown of each other is quarantined for Cooldown: its answers
+// are still served but never cached, so a forgery that gets through cannot
+// stick. Every bad answer and quarantine is logged and counted in
+// dns_security_events_total.
+type Quarantine struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu      sync.Mutex
+	strikes map[string]*quarantineStrikes
+}
+
+type quarantineStrikes struct {
+	count int
+	last  time.Time
+	until time.Time // zero unless quarantined
+}
+
+// NewQuarantine returns a quarantine, or nil, which never quarantines
+// anything, if threshold is negative.
+func NewQuarantine(threshold int, cooldown time.Duration) *Quarantine {
+	if threshold < 0 {
+		return nil
+	}
+	return &Quarantine{Threshold: threshold, Cooldown: cooldown, strikes: make(map[string]*quarantineStrikes)}
+}
+
+// Strike records a bad answer for name, reason saying what was wrong with
+// it, and reports whether name is now quarantined.
+func (q *Quarantine) Strike(name string, reason string) bool {
+	securityEvents.With(labels("event", reason)).Add(1)
+	if q == nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.strikes[name]
+	if s == nil || now.Sub(s.last) > q.Cooldown {
+		s = &quarantineStrikes{}
+		q.strikes[name] = s
+	}
+	s.count++
+	s.last = now
+	if s.count < q.Threshold || now.Before(s.until) {
+		return !s.until.IsZero() && now.Before(s.until)
+	}
+	s.until = now.Add(q.Cooldown)
+	fmt.Printf("SECURITY WARNING: quarantining %s for %v after %d bad answers (last: %s); possible spoofing or a broken upstream\n", name, q.Cooldown, s.count, reason)
+	securityEvents.With(labels("event", "quarantine")).Add(1)
+	return true
+}
+
+// Active reports whether name is quarantined. Names whose strikes are all
+// older than Cooldown are forgotten.
+func (q *Quarantine) Active(name string) bool {
+	if q == nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.strikes[name]
+	if s == nil {
+		return false
+	}
+	if now.Before(s.until) {
+		return true
+	}
+	if now.Sub(s.last) > q.Cooldown {
+		if !s.until.IsZero() {
+			fmt.Printf("Quarantine of %s lifted\n", name)
+		}
+		delete(q.strikes, name)
+	}
+	return false
+}
+
+// ShortTTLs tracks names whose answers keep coming back with TTLs under
+// Threshold, as failover and load-balanced names often do. Their answers
+// change quickly, so peers should not serve them or keep them alive.
+type ShortTTLs struct {
+	Threshold time.Duration
+	Streak    int
+
+	mu    sync.Mutex
+	names map[string]int // consecutive short answers, up to Streak
+}
+
+// maxShortTTLNames bounds the names tracked; past it, tracking restarts.
+const maxShortTTLNames = 10000
+
+// NewShortTTLs returns a tracker, or nil, which never reports a name as
+// short, if threshold is negative.
+func NewShortTTLs(threshold time.Duration, streak int) *ShortTTLs {
+	if threshold < 0 {
+		return nil
+	}
+	return &ShortTTLs{Threshold: threshold, Streak: streak, names: make(map[string]int)}
+}
+
+// Observe records an answer for name cached for ttl and reports whether
+// name now counts as short: its last Streak answers were all short.
+func (s *ShortTTLs) Observe(name string, ttl time.Duration) bool {
+	if s == nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ttl >= s.Threshold {
+		delete(s.names, name)
+		return false
+	}
+	count, tracked := s.names[name]
+	if !tracked && len(s.names) >= maxShortTTLNames {
+		clear(s.names)
+	}
+	if count < s.Streak {
+		count++
+		s.names[name] = count
+		if count == s.Streak {
+			fmt.Printf("%s keeps getting TTLs under %v, no longer sharing it with peers\n", name, s.Threshold)
+		}
+	}
+	return count >= s.Streak
+}
+
+// Short reports whether name's recent answers all had short TTLs.
+func (s *ShortTTLs) Short(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.names[strings.ToLower(name)] >= s.Streak
+}
+
+// EntrySigner computes and checks HMAC-SHA256 MACs over cache entries, so
+// entries altered in a cache file or handed over by a misbehaving peer are
+// noticed. A MAC covers the key (name and type), address, timestamp, TTL
+// and records; hit counts and adaptive extensions change as an entry is
+// served and are not covered.
+type EntrySigner struct {
+	secret []byte
+}
+
+// NewEntrySigner returns a signer keyed with secret, or nil if it is empty.
+func NewEntrySigner(secret string) *EntrySigner {
+	if secret == "" {
+		return nil
+	}
+	return &EntrySigner{secret: []byte(secret)}
+}
+
+// Sign returns the MAC of response stored under key. response must not be
+// compressed.
+func (s *EntrySigner) Sign(key string, response DNSResponse) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\x00%s\x00%d\x00%d\x00", key, response.IPAddress, response.Timestamp.UnixNano(), response.TTL)
+	sections := [][]dns.RR{response.Records, response.Authority}
+	if len(response.Additional) > 0 {
+		// Left out when empty, which keeps the MACs of entries signed
+		// before additional records were cached valid.
+		sections = append(sections, response.Additional)
+	}
+	for _, section := range sections {
+		for _, rr := range section {
+			fmt.Fprintf(mac, "%s\x00", rr.String())
+		}
+		mac.Write([]byte{0xff})
+	}
+	return mac.Sum(nil)
+}
+
+// Verify reports whether response carries a valid MAC for key. A nil
+// signer accepts everything.
+func (s *EntrySigner) Verify(key string, response DNSResponse) bool {
+	if s == nil {
+		return true
+	}
+	return hmac.Equal(response.MAC, s.Sign(key, response.expand()))
+}
+
+// sign returns response with its MAC set, if c signs its entries. A
+// compressed entry was signed before it was first stored and is returned
+// as it is.
+func (c *Client) sign(key string, response DNSResponse) DNSResponse {
+	if c.Signer != nil && response.compressed == nil {
+		response.MAC = c.Signer.Sign(key, response)
+	}
+	return response
+}
+
+// SetSigner sets Signer and drops the cached entries it rejects, such as
+// those loaded from a tampered CacheFile, or written unsigned or under
+// another secret. They are resolved again when next asked for.
+func (c *Client) SetSigner(s *EntrySigner) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.Signer = s
+	for key, response := range c.Cache {
+		if !s.Verify(key, response) {
+			c.rejectLocked(key, "cache file")
+		}
+	}
+}
+
+// rejectLocked discards an entry that failed verification. c.Mutex must be
+// held.
+func (c *Client) rejectLocked(key string, from string) {
+	fmt.Printf("Client %s: discarding %s from %s, its MAC does not verify\n", c.ID, key, from)
+	macFailures.With(labels("client", c.ID, "from", from)).Add(1)
+	c.removeLocked(key)
+	domain, _ := splitCacheKey(key)
+	c.Quarantine.Strike(domain, "mac")
+}
+
+// SetCompression sets CompressAbove and applies it to the entries already
+// cached, such as those loaded from CacheFile.
+func (c *Client) SetCompression(threshold int) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.CompressAbove = threshold
+	for key, response := range c.Cache {
+		c.Cache[key] = response.compress(threshold)
+	}
+}
+
+// DisableCache turns c into a forwarder that caches nothing, dropping any
+// entries loaded from its cache file.
+func (c *Client) DisableCache() {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.NoCache = true
+	c.Cache = make(map[string]DNSResponse)
+	c.Expiry = NewExpiryQueue()
+}
+
+// SetPartitions bounds the cache per record type, evicting whatever the
+// cache already holds beyond the limits.
+func (c *Client) SetPartitions(p *CachePartitions) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.Partitions = p
+	if p == nil {
+		return
+	}
+	for key := range c.Cache {
+		p.Touch(key)
+	}
+	for key := range c.Cache {
+		c.trimLocked(key)
+	}
+}
+
+// CachePartitions gives each record type its own bounded share of a cache,
+// so a flood of one type (say unique TXT lookups) only evicts entries of
+// that type. Each partition is evicted least recently used first. It is
+// guarded by the owning client's Mutex.
+type CachePartitions struct {
+	Limits map[uint16]int
+	// Other is the limit of every type not in Limits; 0 leaves them
+	// unbounded.
+	Other int
+
+	lru   map[uint16]*list.List // front is most recently used
+	elems map[string]*list.Element
+}
+
+func NewCachePartitions(limits map[uint16]int, other int) *CachePartitions {
+	return &CachePartitions{
+		Limits: limits,
+		Other:  other,
+		lru:    make(map[uint16]*list.List),
+		elems:  make(map[string]*list.Element),
+	}
+}
+
+func (p *CachePartitions) limit(qtype uint16) int {
+	if limit, ok := p.Limits[qtype]; ok {
+		return limit
+	}
+	return p.Other
+}
+
+// Touch marks key as just used.
+func (p *CachePartitions) Touch(key string) {
+	_, qtype := splitCacheKey(key)
+	if e, ok := p.elems[key]; ok {
+		p.lru[qtype].MoveToFront(e)
+		return
+	}
+	l, ok := p.lru[qtype]
+	if !ok {
+		l = list.New()
+		p.lru[qtype] = l
+	}
+	p.elems[key] = l.PushFront(key)
+}
+
+func (p *CachePartitions) Remove(key string) {
+	e, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	_, qtype := splitCacheKey(key)
+	p.lru[qtype].Remove(e)
+	delete(p.elems, key)
+}
+
+// Overflow removes and returns the least recently used key of qtype if its
+// partition is over its limit.
+func (p *CachePartitions) Overflow(qtype uint16) (string, bool) {
+	l := p.lru[qtype]
+	limit := p.limit(qtype)
+	if l == nil || limit <= 0 || l.Len() <= limit {
+		return "", false
+	}
+	key := l.Remove(l.Back()).(string)
+	delete(p.elems, key)
+	return key, true
+}
+
+// Sizes returns the number of entries in each partition.
+func (p *CachePartitions) Sizes() map[uint16]int {
+	sizes := make(map[uint16]int, len(p.lru))
+	for qtype, l := range p.lru {
+		sizes[qtype] = l.Len()
+	}
+	return sizes
+}
+
+// Cache is a store of DNS responses by cache key. Clients implement it over
+// their in-memory map, and RedisCache implements it over a Redis server.
+type Cache interface {
+	// Get returns the entry for key if it is still fresh.
+	Get(key string) (DNSResponse, bool)
+	Set(key string, response DNSResponse)
+	// Delete drops the entries for keys, in one round trip where the
+	// store is remote.
+	Delete(keys ...string)
+}
+
+// Peek returns the cached entry for domain and qtype, fresh or not, without
+// resolving on a miss or touching hit counts and eviction order.
+func (c *Client) Peek(domain string, qtype uint16) (DNSResponse, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	response, found := c.Cache[cacheKey(domain, qtype)]
+	return response.expand(), found
+}
+
+// GetAllTypes is Peek for every record type cached for name, keyed by
+// type. The entries kept apart for DNSSEC-aware clients are left out. It
+// walks the whole cache, so it suits ANY answers and the admin API rather
+// than every query.
+func (c *Client) GetAllTypes(name string) map[uint16]DNSResponse {
+	name = dns.Fqdn(name)
+	entries := make(map[uint16]DNSResponse)
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	for key, response := range c.Cache {
+		if strings.HasSuffix(key, dnssecKeySuffix) {
+			continue
+		}
+		if domain, qtype := splitCacheKey(key); strings.EqualFold(domain, name) {
+			entries[qtype] = response.expand()
+		}
+	}
+	return entries
+}
+
+// ClosestEncloser returns the longest of name and its ancestors whose NS
+// records are cached and fresh, with that entry. The root counts too.
+func (c *Client) ClosestEncloser(name string) (string, DNSResponse, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	for zone := dns.Fqdn(strings.ToLower(name)); ; {
+		if response, ok := c.Cache[cacheKey(zone, dns.TypeNS)]; ok && response.Fresh() {
+			return zone, response.expand(), true
+		}
+		if zone == "." {
+			break
+		}
+		if next, end := dns.NextLabel(zone, 0); end {
+			zone = "."
+		} else {
+			zone = zone[next:]
+		}
+	}
+	return "", DNSResponse{}, false
+}
+
+// delegationHint looks for the closest enclosing zone of domain with cached
+// name servers and addresses for them, from the entry's glue or cached A
+// records, so iterative resolution need not start at the root.
+func (c *Client) delegationHint(domain string) (string, []string, time.Time, bool) {
+	zone, response, ok := c.ClosestEncloser(domain)
+	if !ok {
+		return "", nil, time.Time{}, false
+	}
+	var servers []string
+	for _, rr := range response.Records {
+		ns, isNS := rr.(*dns.NS)
+		if !isNS {
+			continue
+		}
+		glue := glueFor(&dns.Msg{Extra: response.Additional}, []string{ns.Ns})
+		if len(glue) == 0 {
+			if a, found := c.Peek(ns.Ns, dns.TypeA); found && a.Fresh() {
+				glue = addressesIn(&dns.Msg{Answer: a.Records})
+			}
+		}
+		servers = append(servers, glue...)
+	}
+	return zone, servers, response.ExpiresAt(), len(servers) > 0
+}
+
+// Get looks key up without counting a hit, as peers do.
+func (c *Client) Get(key string) (DNSResponse, bool) {
+	c.Mutex.Lock()
+	response, found := c.Cache[key]
+	c.Mutex.Unlock()
+	if !found || !response.Fresh() {
+		return DNSResponse{}, false
+	}
+	response = response.expand()
+	if !c.Signer.Verify(key, response) {
+		c.Mutex.Lock()
+		if current, ok := c.Cache[key]; ok && current.Timestamp.Equal(response.Timestamp) {
+			c.rejectLocked(key, "peer read")
+		}
+		c.Mutex.Unlock()
+		return DNSResponse{}, false
+	}
+	return response, true
+}
+
+// Set caches an entry obtained elsewhere. Hit counts and adaptive
+// extensions belong to the cache that earned them, so they are reset.
+func (c *Client) Set(key string, response DNSResponse) {
+	response.Hits = 0
+	response.Extension = 0
+	c.Mutex.Lock()
+	c.storeLocked(key, response)
+	c.Mutex.Unlock()
+	c.saveCache()
+}
+
+func (c *Client) Delete(keys ...string) {
+	found := false
+	c.Mutex.Lock()
+	for _, key := range keys {
+		if _, ok := c.Cache[key]; ok {
+			c.removeLocked(key)
+			found = true
+		}
+	}
+	c.Mutex.Unlock()
+	if found {
+		c.saveCache()
+	}
+}
+
+// RedisCache is a Cache kept in Redis, so that every server instance using
+// the same Redis shares its entries. Entries are stored as JSON and expire
+// in Redis along with their TTL. It speaks just enough RESP for GET, SET and
+// DEL, over a small pool of connections. After a failed dial no other is
+// tried for a backoff that doubles up to redisMaxBackoff, so a Redis that
+// is down costs misses nothing but a failed lookup.
+type RedisCache struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+
+	mu        sync.Mutex
+	idle      []*redisConn // at most redisPoolSize, guarded by mu
+	failures  int          // dial failures in a row, guarded by mu
+	downUntil time.Time    // no dial before this, guarded by mu
+}
+
+const (
+	redisTimeout    = time.Second
+	redisPoolSize   = 8
+	redisMaxBackoff = 30 * time.Second
+)
+
+// errRedisDown is returned without trying Redis while dials back off.
+var errRedisDown = errors.New("redis is unreachable, backing off")
+
+// redisConn is one connection to Redis.
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply from Redis. The connection that carried it
+// is still good.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (r *RedisCache) Get(key string) (DNSResponse, bool) {
+	reply, err := r.do("GET", r.Prefix+key)
+	if err != nil {
+		r.logFailure("GET", key, err)
+		return DNSResponse{}, false
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return DNSResponse{}, false
+	}
+	var response DNSResponse
+	if err := json.Unmarshal(data, &response); err != nil || !response.Fresh() {
+		return DNSResponse{}, false
+	}
+	return response, true
+}
+
+func (r *RedisCache) Set(key string, response DNSResponse) {
+	ttl := time.Until(response.ExpiresAt())
+	if ttl < time.Millisecond {
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	if _, err := r.do("SET", r.Prefix+key, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		r.logFailure("SET", key, err)
+	}
+}
+
+// Delete removes keys with a single DEL.
+func (r *RedisCache) Delete(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	args := make([]string, 0, len(keys)+1)
+	args = append(args, "DEL")
+	for _, key := range keys {
+		args = append(args, r.Prefix+key)
+	}
+	if _, err := r.do(args...); err != nil {
+		r.logFailure("DEL", keys[0], err)
+	}
+}
+
+// logFailure reports a failed command, but not each one skipped while
+// dials back off.
+func (r *RedisCache) logFailure(command string, key string, err error) {
+	if !errors.Is(err, errRedisDown) {
+		fmt.Printf("Redis %s %s failed: %v\n", command, key, err)
+	}
+}
+
+// do sends one command and returns its reply: nil, a string for status
+// replies, an int64, or []byte for bulk strings.
+func (r *RedisCache) do(args ...string) (interface{}, error) {
+	conn, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	r.release(conn)
+	return reply, err
+}
+
+// conn returns an idle connection, or dials a new one unless dials are
+// backing off.
+func (r *RedisCache) conn() (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return conn, nil
+	}
+	if time.Now().Before(r.downUntil) {
+		r.mu.Unlock()
+		return nil, errRedisDown
+	}
+	r.mu.Unlock()
+
+	conn, err := r.dial()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failures++
+		backoff := min(redisTimeout<<min(r.failures-1, 5), redisMaxBackoff)
+		r.downUntil = time.Now().Add(backoff)
+		return nil, err
+	}
+	r.failures = 0
+	return conn, nil
+}
+
+// release returns conn to the pool, or closes it if the pool is full.
+func (r *RedisCache) release(conn *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) < redisPoolSize {
+		r.idle = append(r.idle, conn)
+		return
+	}
+	conn.Close()
+}
+
+// dial connects and authenticates.
+func (r *RedisCache) dial() (*redisConn, error) {
+	c, err := net.DialTimeout("tcp", r.Addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, reader: bufio.NewReader(c)}
+	var setup [][]string
+	if r.Password != "" {
+		setup = append(setup, []string{"AUTH", r.Password})
+	}
+	if r.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.DB)})
+	}
+	for _, args := range setup {
+		if _, err := conn.roundTrip(args); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %v", args[0], err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) roundTrip(args []string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(redisTimeout))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// Invalidate drops every cached record type for domain.
+func (c *Client) Invalidate(domain string) bool {
+	domain = dns.Fqdn(domain)
+	found := false
+	c.Mutex.Lock()
+	for key := range c.Cache {
+		if name, _ := splitCacheKey(key); name == domain {
+			c.removeLocked(key)
+			found = true
+		}
+	}
+	c.Mutex.Unlock()
+
+	if c.Store != nil || c.Shared != nil {
+		// Remote caches cannot be listed by name, so every type goes.
+		keys := make([]string, 0, 2*len(dns.TypeToString))
+		for qtype := range dns.TypeToString {
+			keys = append(keys, cacheKey(domain, qtype), cacheKey(domain, qtype)+dnssecKeySuffix)
+		}
+		for _, cache := range []Cache{c.Store, c.Shared} {
+			if cache != nil {
+				cache.Delete(keys...)
+			}
+		}
+	}
+	if found {
+		c.saveCache()
+	}
+	return found
+}
+
+// sweepExpired removes entries whose TTL has run out and returns how many
+// were removed.
+func (c *Client) sweepExpired() int {
+	c.Mutex.Lock()
+	expired := c.Expiry.PopExpired(time.Now())
+	for _, key := range expired {
+		delete(c.Cache, key)
+		if c.Partitions != nil {
+			c.Partitions.Remove(key)
+		}
+	}
+	c.Mutex.Unlock()
+
+	if len(expired) > 0 {
+		c.saveCache()
+	}
+	return len(expired)
+}
+
+func (c *Client) startSweeper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if n := c.sweepExpired(); n > 0 {
+				fmt.Printf("Client %s: swept %d expired entries\n", c.ID, n)
+			}
+		}
+	}()
+}
+
+// readCacheFile reads the cache file, or its backup if the file is missing
+// or cannot be parsed, as when the last save was interrupted. Expired
+// entries are skipped as they are read, and reading stops after maxEntries
+// fresh ones unless it is 0.
+func (c *Client) readCacheFile(maxEntries int) (map[string]DNSResponse, bool) {
+	for _, path := range []string{c.CacheFile, c.CacheFile + ".bak"} {
+		cache, truncated, err := readCacheEntries(path, maxEntries, c.Stale)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Client %s: cannot load cache from %s: %v\n", c.ID, path, err)
+			continue
+		}
+		fmt.Printf("Client %s: loaded %d cache entries from %s\n", c.ID, len(cache), path)
+		if truncated {
+			fmt.Printf("Client %s: %s holds more than %d usable entries, the rest were not loaded\n", c.ID, path, maxEntries)
+		}
+		return cache, true
+	}
+	return nil, false
+}
+
+// readCacheEntries reads up to maxEntries entries from the cache file at
+// path that are fresh or may still be served stale under policy.
+func readCacheEntries(path string, maxEntries int, policy StalePolicy) (map[string]DNSResponse, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	header, _ := r.Peek(16) // enough for any codec's magic
+	cache := make(map[string]DNSResponse)
+	truncated := false
+	err = detectCacheCodec(header).Decode(r, func(key string, response DNSResponse) bool {
+		if !response.Fresh() && !policy.Usable(response) {
+			return true
+		}
+		if maxEntries > 0 && len(cache) >= maxEntries {
+			truncated = true
+			return false
+		}
+		cache[key] = response
+		return true
+	})
+	return cache, truncated, err
+}
+
+// validateCache is the validate-cache subcommand: it checks a cache file
+// without running the server and reports how many entries it holds, how
+// many have expired, are malformed or fail their MAC, optionally rewriting
+// it with only the usable ones. It returns the exit status, 1 when the file
+// cannot be read at all.
+func validateCache(args []string) int {
+	fs := flag.NewFlagSet("validate-cache", flag.ExitOnError)
+	configPath := fs.String("config", "config.toml", "config whose cache_secret checks entry MACs; skipped if it does not exist")
+	rewrite := fs.Bool("rewrite", false, "rewrite the file keeping only fresh, well-formed, verified entries (the original is kept as .bak)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s validate-cache [-config file] [-rewrite] cache-file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	var signer *EntrySigner
+	if config, err := LoadConfig(*configPath); err == nil {
+		signer = NewEntrySigner(config.CacheSecret)
+	} else if !os.IsNotExist(err) {
+		fmt.Println("Error loading config:", err)
+		return 1
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Cannot open %s: %v\n", path, err)
+		return 1
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64*1024)
+	header, _ := r.Peek(16)
+	codec := detectCacheCodec(header)
+
+	var total, expired, malformed, badMAC int
+	kept := make(map[string]DNSResponse)
+	err = codec.Decode(r, func(key string, response DNSResponse) bool {
+		total++
+		switch problem := cacheEntryProblem(key, response); {
+		case problem != "":
+			malformed++
+			fmt.Printf("%s: malformed, %s\n", key, problem)
+		case !signer.Verify(key, response):
+			badMAC++
+			fmt.Printf("%s: MAC does not verify\n", key)
+		case !response.Fresh():
+			expired++
+		default:
+			kept[key] = response
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Printf("%s is unusable after %d entries: %v\n", path, total, err)
+		return 1
+	}
+	fmt.Printf("%s (%s): %d entries, %d expired, %d malformed", path, codec.Name(), total, expired, malformed)
+	if signer != nil {
+		fmt.Printf(", %d with a bad MAC", badMAC)
+	} else {
+		fmt.Print(", MACs not checked (no cache_secret)")
+	}
+	fmt.Printf("; %d usable\n", len(kept))
+
+	if *rewrite && len(kept) < total {
+		data, err := codec.Marshal(kept)
+		if err == nil {
+			err = writeCacheFile(path, data)
+		}
+		if err != nil {
+			fmt.Printf("Cannot rewrite %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("Rewrote %s with %d entries, the original is %s.bak\n", path, len(kept), path)
+	}
+	return 0
+}
+
+// cacheEntryProblem says what is wrong with a decoded cache entry that
+// loadCache could not sensibly serve, or returns "" if nothing is.
+func cacheEntryProblem(key string, response DNSResponse) string {
+	domain, _ := splitCacheKey(key)
+	if base := strings.TrimSuffix(key, dnssecKeySuffix); strings.Contains(base, "/") {
+		qtype := base[strings.LastIndex(base, "/")+1:]
+		if _, ok := dns.StringToType[qtype]; !ok {
+			return fmt.Sprintf("unknown record type %q", qtype)
+		}
+	}
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return "the key is not a domain name"
+	}
+	switch {
+	case response.Timestamp.IsZero():
+		return "no timestamp"
+	case response.Timestamp.After(time.Now().Add(time.Minute)):
+		return "timestamp in the future"
+	case response.TTL < 0:
+		return "negative TTL"
+	case response.IPAddress != "" && net.ParseIP(response.IPAddress) == nil:
+		return fmt.Sprintf("bad address %q", response.IPAddress)
+	}
+	return ""
+}
+
+// writeCacheFile replaces path with data without ever leaving a partly
+// written file in its place. The previous contents are kept as path.bak.
+func writeCacheFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".bak"); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveCache persists the cache, or marks it for the next periodic save.
+func (c *Client) saveCache() {
+	if c.NoCache || c.Store != nil {
+		// Keep the file from an earlier cached run rather than empty it.
+		return
+	}
+	if c.SaveInterval > 0 {
+		c.dirty.Store(true)
+		return
+	}
+	c.writeCache()
+}
+
+// saveOffset is the point in each save interval at which client id saves,
+// derived from a hash of the ID so the clients' writes spread across the
+// interval instead of landing on the same tick.
+func saveOffset(id string, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	// FNV barely moves the high bits for IDs differing in one character
+	// ("A", "B"); the murmur3 finalizer spreads them out.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return time.Duration(x % uint64(interval))
+}
+
+// startSaver switches c to periodic saves. Each save is also delayed by a
+// random jitter of up to a twentieth of the interval, so clients whose
+// offsets happen to be close still do not write together.
+func (c *Client) startSaver(interval time.Duration) {
+	if interval <= 0 || c.NoCache {
+		return
+	}
+	c.SaveInterval = interval
+	go func() {
+		time.Sleep(saveOffset(c.ID, interval))
+		ticker := time.NewTicker(interval)
+		for {
+			c.flushCache()
+			<-ticker.C
+			if jitter := int64(interval / 20); jitter > 0 {
+				time.Sleep(time.Duration(mathrand.Int63n(jitter)))
+			}
+		}
+	}()
+}
+
+// flushCache writes changes that a periodic saver has not saved yet.
+func (c *Client) flushCache() {
+	if c.dirty.Swap(false) {
+		c.writeCache()
+	}
+}
+
+// writeCache writes the cache to CacheFile.
+func (c *Client) writeCache() {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	data, err := c.CacheCodec.Marshal(c.Cache)
+	if err == nil && c.MaxFileBytes > 0 && len(data) > c.MaxFileBytes {
+		data, err = c.prunedCacheData(len(data))
+	}
+	if err == nil {
+		err = writeCacheFile(c.CacheFile, data)
+	}
+	if err != nil {
+		if !c.persistFailed.Swap(true) {
+			fmt.Printf("Client %s: cannot save cache to %s, keeping it in memory only: %v\n", c.ID, c.CacheFile, err)
+		}
+		return
+	}
+	if c.persistFailed.Swap(false) {
+		fmt.Printf("Client %s: saving cache to %s works again\n", c.ID, c.CacheFile)
+	}
+}
+
+// prunedCacheData encodes the cache without its least valuable entries,
+// those with the fewest hits and then the least time left, so that it fits
+// in MaxFileBytes. size is the length of the full encoding. Pruned entries
+// are only left out of the file. c.Mutex must be held.
+func (c *Client) prunedCacheData(size int) ([]byte, error) {
+	keys := make([]string, 0, len(c.Cache))
+	for key := range c.Cache {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := c.Cache[keys[i]], c.Cache[keys[j]]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.ExpiresAt().After(b.ExpiresAt())
+	})
+	// Guess how many entries fit from the average entry size, and keep
+	// guessing lower until the encoding fits.
+	keep := len(keys) * c.MaxFileBytes / size
+	for {
+		kept := make(map[string]DNSResponse, keep)
+		for _, key := range keys[:keep] {
+			kept[key] = c.Cache[key]
+		}
+		data, err := c.CacheCodec.Marshal(kept)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) <= c.MaxFileBytes || keep == 0 {
+			fmt.Printf("Client %s: pruned %d of %d entries from %s to stay under %d bytes\n", c.ID, len(keys)-keep, len(keys), c.CacheFile, c.MaxFileBytes)
+			return data, nil
+		}
+		keep = keep * c.MaxFileBytes / len(data) * 95 / 100
+	}
+}
+
+// Group returns the group the client is in, or nil if it is in none.
+func (c *Client) Group() *Group {
+	return c.group.Load()
+}
+
+// PersistenceHealthy reports whether the last cache save succeeded.
+func (c *Client) PersistenceHealthy() bool {
+	return !c.persistFailed.Load()
+}
+
+func (gm *GroupManager) AddClientToGroup(client *Client) {
+	gm.Mutex.Lock()
+	defer gm.Mutex.Unlock()
+
+	if gm.Ring == nil {
+		gm.Ring = NewHashRing(RingReplicas)
+	}
+	gm.Ring.Add(client)
+
+	// Find a group with space or create a new one
+	for _, group := range gm.Groups {
+		if len(group.Clients) < GroupSize {
+			clients := make([]*Client, 0, len(group.Clients)+1)
+			clients = append(append(clients, group.Clients...), client)
+			group.Mutex.Lock()
+			group.Clients = clients
+			group.Mutex.Unlock()
+			client.group.Store(group)
+			return
+		}
+	}
+
+	// Create a new group
+	newGroup := &Group{
+		ID:      fmt.Sprintf("Group-%d", len(gm.Groups)+1),
+		Clients: []*Client{client},
+	}
+	gm.Groups = append(gm.Groups, newGroup)
+	client.group.Store(newGroup)
+}
+
+// RemoveClient takes the client with the given id out of its group and off
+// the hash ring. Empty groups are kept so group IDs stay stable.
+func (gm *GroupManager) RemoveClient(id string) *Client {
+	gm.Mutex.Lock()
+	defer gm.Mutex.Unlock()
+
+	for _, group := range gm.Groups {
+		for i, client := range group.Clients {
+			if client.ID != id {
+				continue
+			}
+			clients := make([]*Client, 0, len(group.Clients)-1)
+			clients = append(append(clients, group.Clients[:i]...), group.Clients[i+1:]...)
+			group.Mutex.Lock()
+			group.Clients = clients
+			group.Mutex.Unlock()
+			if gm.Ring != nil {
+				gm.Ring.Remove(client)
+			}
+			return client
+		}
+	}
+	return nil
+}
+
+// Rebalance evens out group sizes, as after many removals left groups
+// sparse: clients are spread over as few groups as GroupSize allows, with
+// sizes differing by at most one. The fullest groups are kept and as many
+// clients as possible stay where they are; groups left over end up empty
+// but keep their IDs. A moved client keeps its cache, and the hash ring is
+// untouched, so no domain changes owner. It returns how many clients moved.
+func (gm *GroupManager) Rebalance() int {
+	gm.Mutex.Lock()
+	defer gm.Mutex.Unlock()
+
+	total := 0
+	for _, group := range gm.Groups {
+		total += len(group.Clients)
+	}
+	if total == 0 {
+		return 0
+	}
+	count := (total + GroupSize - 1) / GroupSize
+	targets := make([]*Group, len(gm.Groups))
+	copy(targets, gm.Groups)
+	sort.SliceStable(targets, func(i, j int) bool {
+		return len(targets[i].Clients) > len(targets[j].Clients)
+	})
+	targets = targets[:count]
+
+	// The first total%count targets, the fullest, take one extra client.
+	capacity := make(map[*Group]int, count)
+	for i, group := range targets {
+		capacity[group] = total / count
+		if i < total%count {
+			capacity[group]++
+		}
+	}
+	// Groups get new slices rather than being edited in place, so a query
+	// ranging over a group's clients meanwhile sees a consistent list.
+	kept := make(map[*Group][]*Client, len(gm.Groups))
+	var homeless []*Client
+	for _, group := range gm.Groups {
+		for _, client := range group.Clients {
+			if len(kept[group]) < capacity[group] {
+				kept[group] = append(kept[group], client)
+			} else {
+				homeless = append(homeless, client)
+			}
+		}
+	}
+	moved := len(homeless)
+	for _, group := range targets {
+		for len(kept[group]) < capacity[group] {
+			client := homeless[0]
+			homeless = homeless[1:]
+			client.group.Store(group)
+			kept[group] = append(kept[group], client)
+		}
+	}
+	for _, group := range gm.Groups {
+		group.Mutex.Lock()
+		group.Clients = kept[group]
+		group.Mutex.Unlock()
+	}
+	if moved > 0 {
+		fmt.Printf("Rebalance: moved %d clients into %d groups\n", moved, count)
+	}
+	return moved
+}
+
+// Membership reports the client responsible for domain, its group and
+// the IDs of the group's members, read under one lock.
+func (gm *GroupManager) Membership(domain string) (client *Client, group string, members []string) {
+	gm.Mutex.Lock()
+	defer gm.Mutex.Unlock()
+
+	if gm.Ring == nil {
+		return nil, "", nil
+	}
+	client = gm.Ring.Get(dns.Fqdn(domain))
+	if client == nil {
+		return nil, "", nil
+	}
+	g := client.Group()
+	if g == nil {
+		return client, "", nil
+	}
+	for _, member := range g.Members() {
+		members = append(members, member.ID)
+	}
+	return client, g.ID, members
+}
+
+// ClientForKey returns the client responsible for domain.
+func (gm *GroupManager) ClientForKey(domain string) *Client {
+	gm.Mutex.Lock()
+	defer gm.Mutex.Unlock()
+
+	if gm.Ring == nil {
+		return nil
+	}
+	return gm.Ring.Get(dns.Fqdn(domain))
+}
+
+// Where a QueryResult came from.
+const (
+	SourceLocal    = "local"    // this client's cache
+	SourcePeer     = "peer"     // another client of the group
+	SourceShared   = "shared"   // the cache shared between instances
+	SourceUpstream = "upstream" // resolved just now
+	SourceStale    = "stale"    // expired entry served per RFC 8767
+	SourceFallback = "fallback" // fallback_ip after resolution failed
+	SourceDNS64    = "dns64"    // AAAA synthesized from A records
+	SourceBlocked  = "blocked"  // answered from the blocklist
+)
+
+// QueryResult is the answer to one query and where it came from. Records
+// carry the TTL the client should see, and Rcode is set on failure too. A
+// NODATA answer has no Records of the type asked for and the zone's SOA in
+// Authority. Additional is only set by clients caching all sections.
+type QueryResult struct {
+	IPs        []string
+	Records    []dns.RR
+	Authority  []dns.RR
+	Additional []dns.RR
+	TTL        time.Duration
+	Source     string
+	Rcode      int
+}
+
+// staleQueryResult answers from an expired entry, reporting ttl downstream.
+func staleQueryResult(response DNSResponse, ttl time.Duration) QueryResult {
+	result := newQueryResult(response, SourceStale)
+	for _, section := range [][]dns.RR{result.Records, result.Authority, result.Additional} {
+		for _, rr := range section {
+			rr.Header().Ttl = uint32(ttl / time.Second)
+		}
+	}
+	result.TTL = ttl
+	return result
+}
+
+func newQueryResult(response DNSResponse, source string) QueryResult {
+	result := QueryResult{
+		Records:    response.Answer(),
+		Authority:  response.Ns(),
+		Additional: response.Extra(),
+		TTL:        time.Duration(response.RemainingTTL()) * time.Second,
+		Source:     source,
+		Rcode:      dns.RcodeSuccess,
+	}
+	for _, rr := range result.Records {
+		switch rr := rr.(type) {
+		case *dns.A:
+			result.IPs = append(result.IPs, rr.A.String())
+		case *dns.AAAA:
+			result.IPs = append(result.IPs, rr.AAAA.String())
+		}
+	}
+	return result
+}
+
+// failedQueryResult maps a resolution error to the rcode clients get:
+// NXDOMAIN and NODATA are answers and passed on, anything else is SERVFAIL.
+func failedQueryResult(err error) QueryResult {
+	switch {
+	case errors.Is(err, ErrNXDomain):
+		return QueryResult{Source: SourceUpstream, Rcode: dns.RcodeNameError}
+	case errors.Is(err, ErrNoData):
+		return QueryResult{Source: SourceUpstream, Rcode: dns.RcodeSuccess}
+	}
+	return QueryResult{Source: SourceUpstream, Rcode: dns.RcodeServerFailure}
+}
+
+// lookupLocal returns the in-memory entry for key, fresh or not, counting
+// a hit on a fresh one and extending it if it has become hot.
+func (c *Client) lookupLocal(key string, domain string) (DNSResponse, bool) {
+	c.Mutex.Lock()
+	response, found := c.Cache[key]
+	found = found && !c.NoCache
+	if found && response.Fresh() {
+		response.Hits++
+		if extension := c.Adaptive.Extension(response); extension > response.Extension && !c.ShortTTLs.Short(domain) {
+			fmt.Printf("Adaptive TTL: %s has %d hits, extending TTL %s by %s\n", key, response.Hits, response.TTL, extension)
+			response.Extension = extension
+			c.storeLocked(key, response)
+		} else {
+			c.Cache[key] = response
+			if c.Partitions != nil {
+				c.Partitions.Touch(key)
+			}
+		}
+	}
+	c.Mutex.Unlock()
+	return response.expand(), found
+}
+
+// remoteGet looks key up in a cache outside this process, from naming it
+// in logs and metrics. Entries that fail their MAC are ignored.
+func (c *Client) remoteGet(cache Cache, key string, domain string, from string) (DNSResponse, bool) {
+	if c.NoCache {
+		return DNSResponse{}, false
+	}
+	response, found := cache.Get(key)
+	if found && !c.Signer.Verify(key, response) {
+		fmt.Printf("Client %s: ignoring %s from the %s cache, its MAC does not verify\n", c.ID, key, from)
+		macFailures.With(labels("client", c.ID, "from", from)).Add(1)
+		c.Quarantine.Strike(domain, "mac")
+		return DNSResponse{}, false
+	}
+	return response, found
+}
+
+// store caches a resolved answer under key, in Store if the client has one
+// and in memory otherwise.
+func (c *Client) store(key string, response DNSResponse) {
+	if c.Store == nil {
+		c.Mutex.Lock()
+		c.storeLocked(key, response)
+		c.Mutex.Unlock()
+		c.saveCache()
+		return
+	}
+	if domain, _ := splitCacheKey(key); c.NoCache || c.Quarantine.Active(domain) {
+		return
+	}
+	c.Store.Set(key, response)
+}
+
+func (c *Client) QueryDNS(ctx context.Context, domain string, qtype uint16) (QueryResult, error) {
+	// Cache keys are always fully qualified so "example.com" and
+	// "example.com." share one entry, locally and on peers.
+	domain = dns.Fqdn(domain)
+	key := c.cacheKeyFor(ctx, domain, qtype)
+
+	lookupStart := time.Now()
+	var response DNSResponse
+	var found bool
+	if c.Store != nil {
+		response, found = c.remoteGet(c.Store, key, domain, "store")
+	} else {
+		response, found = c.lookupLocal(key, domain)
+	}
+	cacheLookupDuration.With(labels("client", c.ID)).Observe(time.Since(lookupStart).Seconds())
+	stale, hasStale := response, found && c.Stale.Usable(response)
+	if found && response.Fresh() {
+		logger.Debug("cache hit", "client", c.ID, "key", key)
+		c.History.RecordHit()
+		c.recordGroupHitRatio(1)
+		if response.Extended() {
+			fmt.Printf("Adaptive TTL: serving %s past its TTL, refreshing\n", key)
+			c.refresh(ctx, domain, qtype, response.Hits)
+		} else {
+			c.maybePrefetch(ctx, domain, qtype, response)
+		}
+		return newQueryResult(response, SourceLocal), nil
+	}
+
+	// From here on the query is a miss, which the budget bounds: peers get
+	// their slice of it and resolving gets what they leave.
+	if c.Budget.Total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Budget.Total)
+		defer cancel()
+	}
+	peerCtx, cancelPeers := ctx, context.CancelFunc(func() {})
+	if timeout := c.peerTimeout(); timeout > 0 {
+		peerCtx, cancelPeers = context.WithTimeout(ctx, timeout)
+	}
+	defer cancelPeers()
+	var best DNSResponse
+	var candidates int
+	// Short-TTL names are resolved fresh: a peer's copy may already be
+	// out of date however much TTL it has left. A budget that leaves the
+	// cache tiers no time at all skips them too.
+	shortTTL := c.ShortTTLs.Short(domain)
+	skipTiers := shortTTL || (c.Budget.Total > 0 && c.Budget.CacheShare == 0)
+	skipPeers := skipTiers || c.Store != nil
+	for _, peer := range c.Group().Members() {
+		if peerCtx.Err() != nil || skipPeers {
+			break
+		}
+		if peer != c && !peer.NoCache && !peer.ShortTTLs.Short(domain) {
+			logger.Debug("checking peer cache", "client", c.ID, "peer", peer.ID, "key", key)
+			if response, found := c.peerGet(peerCtx, peer, key); found {
+				logger.Debug("peer cache hit", "client", c.ID, "peer", peer.ID, "key", key)
+				if candidates == 0 || betterPeerEntry(c.PeerSelection, response, best) {
+					best = response
+				}
+				candidates++
+				if c.PeerSelection == PeerSelectFirst || c.PeerSelection == "" {
+					break
+				}
+			}
+		}
+	}
+	if candidates > 0 {
+		if candidates > 1 {
+			logger.Debug("chose peer entry", "key", key, "candidates", candidates, "selection", c.PeerSelection)
+		}
+		c.Set(key, best)
+		c.History.RecordPeerHit()
+		c.recordGroupHitRatio(1)
+		return newQueryResult(best, SourcePeer), nil
+	}
+	if c.Shared != nil && !skipTiers {
+		if response, found := c.remoteGet(c.Shared, key, domain, "shared"); found {
+			logger.Debug("shared cache hit", "client", c.ID, "key", key)
+			c.Set(key, response)
+			c.History.RecordPeerHit()
+			c.recordGroupHitRatio(1)
+			return newQueryResult(response, SourceShared), nil
+		}
+	}
+	c.History.RecordMiss()
+	c.recordGroupHitRatio(0)
+	if c.Offline {
+		if hasStale {
+			fmt.Printf("Offline: serving stale %s\n", key)
+			return staleQueryResult(stale, c.Stale.AnswerTTL), nil
+		}
+		fmt.Printf("Offline: %s is not cached, answering %s\n", key, dns.RcodeToString[c.OfflineRcode])
+		err := &RcodeError{Rcode: c.OfflineRcode}
+		return failedQueryResult(err), err
+	}
+	logger.Debug("cache miss, resolving", "client", c.ID, "key", key)
+	if hasStale {
+		return c.resolveOrServeStale(ctx, domain, qtype, stale)
+	}
+	response, err := c.resolveAndStore(ctx, domain, qtype)
+	if err != nil {
+		if result, ok := c.fallbackResult(domain, qtype, err); ok {
+			return result, nil
+		}
+		return failedQueryResult(err), err
+	}
+	return newQueryResult(response, SourceUpstream), nil
+}
+
+// recordGroupHitRatio feeds a lookup, 1 if the caches answered it and 0 if
+// not, into the smoothed hit ratio of c's group.
+func (c *Client) recordGroupHitRatio(x float64) {
+	if group := c.Group(); group != nil {
+		group.HitRatio.Observe(x)
+	}
+}
+
+// QueryBudget splits the time a miss may take between the cache tiers and
+// resolving. CacheShare of Total bounds the peer lookups, together with
+// PeerTimeout, and a CacheShare of 0 skips the peer and shared caches.
+// Resolving has until Total runs out. An entry that can be
+// served stale is then answered with, however long the upstream takes;
+// without one the miss fails with SERVFAIL, still within the budget.
+type QueryBudget struct {
+	Total      time.Duration
+	CacheShare float64
+}
+
+// peerTimeout bounds the peer lookups of one miss: the shorter of
+// PeerTimeout and the budget's cache slice, or 0 if neither is set.
+func (c *Client) peerTimeout() time.Duration {
+	timeout := c.PeerTimeout
+	if c.Budget.Total > 0 {
+		slice := time.Duration(float64(c.Budget.Total) * c.Budget.CacheShare)
+		if timeout <= 0 || slice < timeout {
+			timeout = slice
+		}
+	}
+	return timeout
+}
+
+// How a miss chooses among the group peers holding an entry.
+const (
+	// PeerSelectFirst takes the first peer's entry, without asking the
+	// others. It is the cheapest.
+	PeerSelectFirst = "first"
+	// PeerSelectFreshest asks every peer and takes the entry with the most
+	// time left, so it is refreshed again later.
+	PeerSelectFreshest = "freshest"
+	// PeerSelectBestSource asks every peer and takes the entry resolved
+	// through the upstream with the lowest average latency, as that one is
+	// likely closest and so answers with the closest servers of CDNs. It
+	// may pick an entry close to expiry; entries whose upstream is not
+	// known, such as those loaded from a cache file, come last.
+	PeerSelectBestSource = "best-source"
+)
+
+// betterPeerEntry reports whether candidate beats current under policy.
+func betterPeerEntry(policy string, candidate, current DNSResponse) bool {
+	if policy == PeerSelectBestSource {
+		candidateLatency, candidateKnown := upstreamLatency.Get(candidate.Upstream)
+		currentLatency, currentKnown := upstreamLatency.Get(current.Upstream)
+		switch {
+		case candidateKnown && !currentKnown:
+			return true
+		case candidateKnown && currentKnown && candidateLatency != currentLatency:
+			return candidateLatency < currentLatency
+		case candidateKnown != currentKnown:
+			return false
+		}
+	}
+	return candidate.ExpiresAt().After(current.ExpiresAt())
+}
+
+// LatencyTracker keeps exponentially weighted moving averages of each
+// upstream's response time and failure rate.
+type LatencyTracker struct {
+	mu       sync.Mutex
+	ewma     map[string]time.Duration
+	failures map[string]float64
+}
+
+// latencyWeight is the weight of the newest sample in the average.
+const latencyWeight = 0.2
+
+// upstreamLatency averages successful queries per upstream, for all
+// clients.
+var upstreamLatency = &LatencyTracker{ewma: make(map[string]time.Duration), failures: make(map[string]float64)}
+
+func (t *LatencyTracker) Observe(upstream string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if avg, ok := t.ewma[upstream]; ok {
+		d = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(avg))
+	}
+	t.ewma[upstream] = d
+}
+
+// ObserveResult adds the outcome of a query to upstream's failure rate.
+func (t *LatencyTracker) ObserveResult(upstream string, failed bool) {
+	sample := 0.0
+	if failed {
+		sample = 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rate, ok := t.failures[upstream]; ok {
+		sample = latencyWeight*sample + (1-latencyWeight)*rate
+	}
+	t.failures[upstream] = sample
+}
+
+// Get returns upstream's average latency, if it has answered yet.
+func (t *LatencyTracker) Get(upstream string) (time.Duration, bool) {
+	if upstream == "" {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.ewma[upstream]
+	return d, ok
+}
+
+// UpstreamStats is the upstream stats file: what is known about each
+// upstream's health, saved so a restart does not hammer an upstream known
+// to be down before its breaker opens again.
+type UpstreamStats struct {
+	Saved     time.Time                             `json:"saved"`
+	Upstreams map[string]UpstreamHealth             `json:"upstreams"`
+	Breakers  map[string]map[string]breakerSnapshot `json:"breakers"` // by client id, then upstream
+}
+
+type UpstreamHealth struct {
+	LatencyMS   float64 `json:"latency_ms,omitempty"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// saveUpstreamStats writes the latency and failure averages of every
+// upstream and the breakers of clients to path.
+func saveUpstreamStats(path string, clients []*Client) error {
+	stats := UpstreamStats{Saved: time.Now(), Upstreams: make(map[string]UpstreamHealth), Breakers: make(map[string]map[string]breakerSnapshot)}
+	upstreamLatency.mu.Lock()
+	for upstream, rate := range upstreamLatency.failures {
+		health := UpstreamHealth{FailureRate: rate}
+		if d, ok := upstreamLatency.ewma[upstream]; ok {
+			health.LatencyMS = float64(d) / float64(time.Millisecond)
+		}
+		stats.Upstreams[upstream] = health
+	}
+	upstreamLatency.mu.Unlock()
+	for _, c := range clients {
+		c.Mutex.Lock()
+		breakers := make(map[string]breakerSnapshot, len(c.Breakers))
+		for upstream, b := range c.Breakers {
+			breakers[upstream] = b.snapshot()
+		}
+		c.Mutex.Unlock()
+		stats.Breakers[c.ID] = breakers
+	}
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(path, data)
+}
+
+// loadUpstreamStats restores what saveUpstreamStats wrote. A missing file
+// is not an error.
+func loadUpstreamStats(path string, clients []*Client) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stats UpstreamStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	upstreamLatency.mu.Lock()
+	for upstream, health := range stats.Upstreams {
+		upstreamLatency.failures[upstream] = health.FailureRate
+		if health.LatencyMS > 0 {
+			upstreamLatency.ewma[upstream] = time.Duration(health.LatencyMS * float64(time.Millisecond))
+		}
+	}
+	upstreamLatency.mu.Unlock()
+	open := 0
+	for _, c := range clients {
+		for upstream, snapshot := range stats.Breakers[c.ID] {
+			c.breaker(upstream).restore(snapshot)
+			if snapshot.State == BreakerOpen.String() {
+				open++
+			}
+		}
+	}
+	fmt.Printf("Loaded stats of %d upstreams saved %v ago, %d breakers open\n", len(stats.Upstreams), time.Since(stats.Saved).Round(time.Second), open)
+	return nil
+}
+
+// startUpstreamStatsSaver saves the upstream stats every interval. It
+// returns the save function, for main to call once more on shutdown.
+func startUpstreamStatsSaver(path string, interval time.Duration, clients []*Client) func() {
+	save := func() {
+		if err := saveUpstreamStats(path, clients); err != nil {
+			fmt.Println("Error saving upstream stats:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			save()
+		}
+	}()
+	return save
+}
+
+// peerGet is peer.Get, abandoned when ctx ends first so a peer whose
+// cache is locked, say by a long save, does not hold up the query. Without
+// a deadline on ctx it just calls peer.Get.
+func (c *Client) peerGet(ctx context.Context, peer *Client, key string) (DNSResponse, bool) {
+	if _, ok := ctx.Deadline(); !ok || c.peerTimeout() <= 0 {
+		return peer.Get(key)
+	}
+	type lookup struct {
+		response DNSResponse
+		found    bool
+	}
+	done := make(chan lookup, 1)
+	go func() {
+		response, found := peer.Get(key)
+		done <- lookup{response, found}
+	}()
+	select {
+	case l := <-done:
+		return l.response, l.found
+	case <-ctx.Done():
+		fmt.Printf("Client %s: peer %s did not answer for %s in time, skipping the other peers\n", c.ID, peer.ID, key)
+		peerTimeouts.With(labels("client", c.ID, "peer", peer.ID)).Add(1)
+		return DNSResponse{}, false
+	}
+}
+
+// FallbackTTL is the TTL of answers made up from FallbackIP, kept short so
+// clients ask again soon after resolution recovers.
+const FallbackTTL = 5 * time.Second
+
+// fallbackResult answers with FallbackIP when resolving failed, if it is
+// set and of the family asked for. NXDOMAIN and NODATA are real answers
+// and are never replaced.
+func (c *Client) fallbackResult(domain string, qtype uint16, err error) (QueryResult, bool) {
+	if c.FallbackIP == nil || errors.Is(err, ErrNXDomain) || errors.Is(err, ErrNoData) {
+		return QueryResult{}, false
+	}
+	if (c.FallbackIP.To4() != nil) != (qtype == dns.TypeA) || (qtype != dns.TypeA && qtype != dns.TypeAAAA) {
+		return QueryResult{}, false
+	}
+	rr, rrErr := newAddressRecord(domain, qtype, c.FallbackIP.String(), FallbackTTL)
+	if rrErr != nil {
+		return QueryResult{}, false
+	}
+	fmt.Printf("Answering %s %s with fallback %s after resolution failed: %v\n", domain, dns.Type(qtype), c.FallbackIP, err)
+	return QueryResult{
+		IPs:     []string{c.FallbackIP.String()},
+		Records: []dns.RR{rr},
+		TTL:     FallbackTTL,
+		Source:  SourceFallback,
+		Rcode:   dns.RcodeSuccess,
+	}, true
+}
+
+// parseDNS64Prefix parses a NAT64 prefix of one of the lengths RFC 6052
+// allows.
+func parseDNS64Prefix(s string) (*net.IPNet, error) {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("dns64_prefix %q is not an IPv6 prefix", s)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+		return prefix, nil
+	}
+	return nil, fmt.Errorf("dns64_prefix %q must be a /32, /40, /48, /56, /64 or /96", s)
+}
+
+// embedIPv4 places v4 in prefix as RFC 6052 section 2.2 lays out: right
+// after the prefix, skipping bits 64 to 71.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range v4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// dns64 replaces an AAAA result without addresses by one synthesized from
+// the name's A records (RFC 6147). The synthesized records are never
+// cached: they are rebuilt from the cached A entry on every query, so the
+// AAAA cache only holds authentic answers. Queries with DO and CD set come
+// from a validator, which would reject synthesized data, and get the
+// result unchanged, as do NXDOMAIN and failures.
+func (c *Client) dns64(ctx context.Context, domain string, result QueryResult, err error) (QueryResult, error) {
+	if c.DNS64Prefix == nil || (err != nil && !errors.Is(err, ErrNoData)) || result.Rcode != dns.RcodeSuccess {
+		return result, err
+	}
+	if dnssecOK(ctx) && checkingDisabled(ctx) {
+		return result, err
+	}
+	for _, rr := range result.Records {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return result, err
+		}
+	}
+	a, aErr := c.QueryDNS(ctx, domain, dns.TypeA)
+	if aErr != nil || len(a.IPs) == 0 {
+		return result, err
+	}
+	// RFC 6147 section 5.1.7: no longer than the AAAA NODATA may be cached.
+	var ttl uint32 = math.MaxUint32
+	for _, rr := range result.Authority {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(ttl, soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	synthesized := QueryResult{Source: SourceDNS64, Rcode: dns.RcodeSuccess, TTL: a.TTL}
+	for _, rr := range a.Records {
+		hdr := *rr.Header()
+		hdr.Ttl = min(hdr.Ttl, ttl)
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip := embedIPv4(c.DNS64Prefix, rr.A)
+			hdr.Rrtype = dns.TypeAAAA
+			synthesized.Records = append(synthesized.Records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			synthesized.IPs = append(synthesized.IPs, ip.String())
+		case *dns.CNAME:
+			synthesized.Records = append(synthesized.Records, &dns.CNAME{Hdr: hdr, Target: rr.Target})
+		}
+	}
+	if ttl != math.MaxUint32 && time.Duration(ttl)*time.Second < synthesized.TTL {
+		synthesized.TTL = time.Duration(ttl) * time.Second
+	}
+	fmt.Printf("DNS64: synthesized %d AAAA records for %s\n", len(synthesized.IPs), domain)
+	return synthesized, nil
+}
+
+// resolution is one resolution of a cache miss, shared by every query for
+// the same key that arrives while it runs or within DedupeWindow after.
+type resolution struct {
+	done     chan struct{} // closed when response and err are set
+	response DNSResponse
+	err      error
+}
+
+// resolveAndStore resolves a cache miss and caches the answer. A query
+// that finds the same key being resolved waits for that resolution, or
+// until its own ctx ends, instead of asking the upstreams again.
+func (c *Client) resolveAndStore(ctx context.Context, domain string, qtype uint16) (DNSResponse, error) {
+	key := c.cacheKeyFor(ctx, domain, qtype)
+	if checkingDisabled(ctx) {
+		// Unvalidated answers are not for queries relying on validation.
+		key += "/CD"
+	}
+	if hops := forwardInfoFromContext(ctx).Hops; hops > 0 {
+		// A query that looped back through a forwarder must not wait for
+		// the resolution it is part of; it goes round again until the hop
+		// limit answers it.
+		key += fmt.Sprintf("/hop%d", hops)
+	}
+	c.Mutex.Lock()
+	if res, ok := c.resolutions[key]; ok {
+		c.Mutex.Unlock()
+		kind := "recent"
+		select {
+		case <-res.done:
+		default:
+			kind = "inflight"
+		}
+		dedupedTotal.With(labels("client", c.ID, "kind", kind)).Add(1)
+		select {
+		case <-res.done:
+			return res.response, res.err
+		case <-ctx.Done():
+			return DNSResponse{}, ctx.Err()
+		}
+	}
+	res := &resolution{done: make(chan struct{})}
+	c.resolutions[key] = res
+	c.Mutex.Unlock()
+
+	res.response, res.err = c.resolveAndStoreNow(ctx, domain, qtype)
+	close(res.done)
+	forget := func() {
+		c.Mutex.Lock()
+		if c.resolutions[key] == res {
+			delete(c.resolutions, key)
+		}
+		c.Mutex.Unlock()
+	}
+	// An error of this query's own ctx says nothing about the name.
+	if c.DedupeWindow > 0 && ctx.Err() == nil {
+		time.AfterFunc(c.DedupeWindow, forget)
+	} else {
+		forget()
+	}
+	return res.response, res.err
+}
+
+// resolveAndStoreNow does the work of resolveAndStore.
+func (c *Client) resolveAndStoreNow(ctx context.Context, domain string, qtype uint16) (DNSResponse, error) {
+	key := c.cacheKeyFor(ctx, domain, qtype)
+	response, err := c.queryDNSResolver(ctx, domain, qtype)
+	if err != nil {
+		return DNSResponse{}, err
+	}
+	response = c.rewrite(domain, qtype, response)
+	logger.Debug("resolved", "client", c.ID, "key", key, "records", response.Records)
+	shortTTL := c.ShortTTLs.Observe(domain, response.TTL)
+	if checkingDisabled(ctx) {
+		// The upstream did not validate this answer, so it must not be
+		// served to clients relying on that validation.
+		return response, nil
+	}
+	if response.TTL == 0 {
+		fmt.Printf("Not caching %s: zero TTL\n", key)
+		return response, nil
+	}
+
+	// Signed before it is shared, so peers, the standby and the shared
+	// cache can check it.
+	response = c.sign(key, response)
+	c.store(key, response)
+	c.Mirror.Send(key, response)
+	if shortTTL {
+		return response, nil
+	}
+	c.gossipToPeers(key, response)
+	if c.Shared != nil {
+		c.Shared.Set(key, response)
+	}
+	return response, nil
+}
+
+// StaleRetryInterval is how long a stale entry whose refresh failed is
+// served before it is refreshed again (the failure recheck timer of RFC
+// 8767), so a down upstream is not asked once per stale hit.
+const StaleRetryInterval = 30 * time.Second
+
+// resolveOrServeStale resolves an expired entry, answering with the stale
+// copy instead if resolution fails or takes longer than the client timeout
+// (RFC 8767). A slow resolution still completes and refreshes the cache.
+// While a refresh of the entry runs, or for StaleRetryInterval after one
+// failed, the stale copy is answered at once.
+func (c *Client) resolveOrServeStale(ctx context.Context, domain string, qtype uint16, stale DNSResponse) (QueryResult, error) {
+	key := c.cacheKeyFor(ctx, domain, qtype)
+	c.Mutex.Lock()
+	refreshing := c.prefetching[key]
+	c.prefetching[key] = true
+	c.Mutex.Unlock()
+	if refreshing {
+		staleServedTotal.With(labels("client", c.ID)).Add(1)
+		return staleQueryResult(stale, c.Stale.AnswerTTL), nil
+	}
+
+	type outcome struct {
+		response DNSResponse
+		err      error
+	}
+	done := make(chan outcome, 1)
+	background := context.WithoutCancel(ctx)
+	go func() {
+		response, err := c.resolveAndStore(background, domain, qtype)
+		done <- outcome{response, err}
+		forget := func() {
+			c.Mutex.Lock()
+			delete(c.prefetching, key)
+			c.Mutex.Unlock()
+		}
+		if err != nil && !errors.Is(err, ErrNXDomain) {
+			time.AfterFunc(StaleRetryInterval, forget)
+		} else {
+			forget()
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if c.Stale.ClientTimeout > 0 {
+		timer := time.NewTimer(c.Stale.ClientTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case o := <-done:
+		if o.err == nil {
+			return newQueryResult(o.response, SourceUpstream), nil
+		}
+		// A name that no longer exists is an answer, not a failure.
+		if errors.Is(o.err, ErrNXDomain) {
+			return failedQueryResult(o.err), o.err
+		}
+		fmt.Printf("Serving stale %s after resolution failed: %v\n", key, o.err)
+	case <-timeout:
+		fmt.Printf("Serving stale %s, no answer within %s\n", key, c.Stale.ClientTimeout)
+	case <-ctx.Done():
+		// The query is out of time, whether by query_budget or
+		// query_timeout; the resolution still refreshes the entry.
+		fmt.Printf("Serving stale %s, out of time: %v\n", key, ctx.Err())
+	}
+	staleServedTotal.With(labels("client", c.ID)).Add(1)
+	return staleQueryResult(stale, c.Stale.AnswerTTL), nil
+}
+
+// StalePolicy controls serving expired entries (RFC 8767). Entries are kept
+// for MaxAge past their expiry; while resolving them again fails, or takes
+// longer than ClientTimeout, the stale copy is served with AnswerTTL. A zero
+// MaxAge disables serving stale data.
+type StalePolicy struct {
+	MaxAge        time.Duration
+	AnswerTTL     time.Duration
+	ClientTimeout time.Duration
+}
+
+// Usable reports whether response may still be served stale.
+func (p StalePolicy) Usable(response DNSResponse) bool {
+	return p.MaxAge > 0 && time.Now().Before(response.ExpiresAt().Add(p.MaxAge))
+}
+
+type gossipEntry struct {
+	Key      string
+	Response DNSResponse
+}
+
+// startGossipReceiver lets peers push entries to this client.
+func (c *Client) startGossipReceiver(queue int) {
+	c.gossip = make(chan gossipEntry, queue)
+	go func() {
+		for entry := range c.gossip {
+			c.ingest(entry.Key, entry.Response)
+		}
+	}()
+}
+
+// ingest caches an entry pushed by a peer unless we already hold a newer one.
+func (c *Client) ingest(key string, response DNSResponse) {
+	if !response.Fresh() {
+		return
+	}
+	c.Mutex.Lock()
+	if !c.Signer.Verify(key, response) {
+		fmt.Printf("Client %s: discarding pushed %s, its MAC does not verify\n", c.ID, key)
+		macFailures.With(labels("client", c.ID, "from", "push")).Add(1)
+		c.Mutex.Unlock()
+		domain, _ := splitCacheKey(key)
+		c.Quarantine.Strike(domain, "mac")
+		return
+	}
+	if current, ok := c.Cache[key]; ok && !current.Timestamp.Before(response.Timestamp) {
+		c.Mutex.Unlock()
+		return
+	}
+	response.Hits = 0
+	response.Extension = 0
+	c.storeLocked(key, response)
+	c.Mutex.Unlock()
+	c.saveCache()
+}
+
+// gossipToPeers pushes a freshly resolved entry to the rest of the group.
+// It never blocks: a peer with a full queue simply misses the entry.
+func (c *Client) gossipToPeers(key string, response DNSResponse) {
+	if !c.Gossip || response.TTL < c.GossipMinTTL || c.Store != nil {
+		return
+	}
+	for _, peer := range c.Group().Members() {
+		if peer == c || peer.gossip == nil {
+			continue
+		}
+		select {
+		case peer.gossip <- gossipEntry{Key: key, Response: response}:
+			gossipTotal.With(labels("client", c.ID, "result", "sent")).Add(1)
+		default:
+			gossipTotal.With(labels("client", c.ID, "result", "dropped")).Add(1)
+		}
+	}
+}
+
+// Mirror streams cache writes to a warm standby over TCP, one JSON object
+// per entry, so the standby can take over with a warm cache. Sending never
+// blocks the query path: entries queue in a bounded channel and are
+// dropped when it is full or the standby is unreachable.
+type Mirror struct {
+	Addr    string
+	entries chan gossipEntry
+}
+
+// mirrorRetry is how long the mirror waits before redialing the standby.
+const mirrorRetry = 5 * time.Second
+
+func NewMirror(addr string, queue int) *Mirror {
+	m := &Mirror{Addr: addr, entries: make(chan gossipEntry, queue)}
+	go m.run()
+	return m
+}
+
+// Send queues an entry for the standby. It is a no-op on a nil Mirror.
+func (m *Mirror) Send(key string, response DNSResponse) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.entries <- gossipEntry{Key: key, Response: response}:
+	default:
+		mirrorTotal.With(labels("result", "dropped")).Add(1)
+	}
+}
+
+func (m *Mirror) run() {
+	for {
+		conn, err := net.DialTimeout("tcp", m.Addr, mirrorRetry)
+		if err != nil {
+			fmt.Printf("Mirror: cannot reach standby %s: %v\n", m.Addr, err)
+			m.discard(mirrorRetry)
+			continue
+		}
+		fmt.Println("Mirror: streaming cache writes to standby", m.Addr)
+		encoder := json.NewEncoder(conn)
+		for entry := range m.entries {
+			conn.SetWriteDeadline(time.Now().Add(mirrorRetry))
+			if err = encoder.Encode(entry); err != nil {
+				break
+			}
+			mirrorTotal.With(labels("result", "sent")).Add(1)
+		}
+		conn.Close()
+		mirrorTotal.With(labels("result", "error")).Add(1)
+		fmt.Printf("Mirror: lost standby %s: %v\n", m.Addr, err)
+	}
+}
+
+// discard drops what is queued while the standby is down, so it is not
+// sent stale entries once it is back.
+func (m *Mirror) discard(d time.Duration) {
+	deadline := time.After(d)
+	for {
+		select {
+		case <-m.entries:
+			mirrorTotal.With(labels("result", "dropped")).Add(1)
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// serveMirror accepts mirror streams from a primary instance and caches
+// each entry in the client that owns its key here.
+func serveMirror(addr string, gm *GroupManager) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Mirror: cannot listen:", err)
+		return
+	}
+	fmt.Println("Mirror: accepting cache writes on", addr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Println("Mirror: accept failed:", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				decoder := json.NewDecoder(conn)
+				for {
+					var entry gossipEntry
+					if err := decoder.Decode(&entry); err != nil {
+						if err != io.EOF {
+							fmt.Printf("Mirror: stream from %s ended: %v\n", conn.RemoteAddr(), err)
+						}
+						return
+					}
+					domain, _ := splitCacheKey(entry.Key)
+					gm.ClientForKey(domain).ingest(entry.Key, entry.Response)
+				}
+			}()
+		}
+	}()
+}
+
+// maybePrefetch refreshes a popular entry in the background when it is close
+// to expiring, so it never has to be resolved while a client waits.
+func (c *Client) maybePrefetch(ctx context.Context, domain string, qtype uint16, response DNSResponse) {
+	if c.PrefetchThreshold <= 0 || response.Hits <= c.PrefetchMinHits {
+		return
+	}
+	if time.Until(response.ExpiresAt()) > time.Duration(float64(response.TTL)*c.PrefetchThreshold) {
+		return
+	}
+	c.refresh(ctx, domain, qtype, response.Hits)
+}
+
+// refresh re-resolves an entry in the background, unless a refresh of it is
+// already running, carrying its hit count over to the new entry.
+func (c *Client) refresh(ctx context.Context, domain string, qtype uint16, hits int) {
+	if c.Offline {
+		return
+	}
+	key := c.cacheKeyFor(ctx, domain, qtype)
+	c.Mutex.Lock()
+	if c.prefetching[key] {
+		c.Mutex.Unlock()
+		return
+	}
+	c.prefetching[key] = true
+	c.Mutex.Unlock()
+
+	// The refresh outlives the query that triggered it, and is cached, so
+	// it must be validated upstream whatever the triggering query asked.
+	ctx = withCheckingDisabled(context.WithoutCancel(ctx), false)
+	go func() {
+		logger.Debug("prefetching", "client", c.ID, "key", key)
+		fresh, err := c.queryDNSResolver(ctx, domain, qtype)
+		c.Mutex.Lock()
+		delete(c.prefetching, key)
+		if err == nil && fresh.TTL > 0 {
+			fresh = c.rewrite(domain, qtype, fresh)
+			fresh.Hits = hits
+			fresh = c.sign(key, fresh)
+			c.storeLocked(key, fresh)
+		}
+		c.Mutex.Unlock()
+		if err == nil {
+			c.Mirror.Send(key, fresh)
+		}
+
+		if err != nil {
+			fmt.Printf("Prefetch of %s failed: %v\n", key, err)
+			prefetchTotal.With(labels("client", c.ID, "result", "error")).Add(1)
+			return
+		}
+		c.saveCache()
+		prefetchTotal.With(labels("client", c.ID, "result", "ok")).Add(1)
+	}()
+}
+
+// AdaptiveTTL keeps hot entries in the cache past their upstream TTL, so
+// popular names are not re-resolved in the foreground at every expiry.
+type AdaptiveTTL struct {
+	MinHits int
+	Factor  float64
+	Ceiling time.Duration
+}
+
+// Extension is how much longer than its TTL response may be kept, or zero
+// for entries that are not queried often enough.
+func (a AdaptiveTTL) Extension(response DNSResponse) time.Duration {
+	if a.Factor <= 1 || response.Hits < a.MinHits {
+		return 0
+	}
+	lifetime := time.Duration(float64(response.TTL) * a.Factor)
+	if a.Ceiling > 0 && lifetime > a.Ceiling {
+		lifetime = a.Ceiling
+	}
+	if lifetime <= response.TTL {
+		return 0
+	}
+	return lifetime - response.TTL
+}
+
+// queryDNSResolver tries the configured upstreams in order and, if all of them
+// fail, falls back to the system resolver unless that has been disabled. With
+// QNAME minimization enabled, iterative resolution is tried first.
+func (c *Client) queryDNSResolver(ctx context.Context, domain string, qtype uint16) (DNSResponse, error) {
+	logger.Debug("querying upstreams", "client", c.ID, "name", domain, "type", dns.Type(qtype))
+	var lastErr error
+	upstreams := c.upstreams()
+	zone, forwarded := c.forwardZone(domain)
+	if forwarded {
+		logger.Debug("forward zone", "name", domain, "zone", zone.Name)
+		// Validate checked the forward zones already.
+		upstreams, _ = parseUpstreams(zone.Upstreams, "")
+	}
+	if c.Iterative != nil && !forwarded {
+		if hint, servers, expires, ok := c.delegationHint(domain); ok {
+			c.Iterative.Hint(hint, servers, expires)
+		}
+		r, err := c.Iterative.Resolve(ctx, domain, qtype)
+		var response DNSResponse
+		if err == nil {
+			response, err = c.answerResponse(ctx, r, domain, qtype)
+		}
+		if err == nil {
+			return response, nil
+		}
+		fmt.Printf("queryDNSResolver: iterative resolution failed: %v\n", err)
+		lastErr = err
+	}
+	info := forwardInfoFromContext(ctx)
+	for _, u := range upstreams {
+		if err := ctx.Err(); err != nil {
+			lastErr = err
+			break
+		}
+		upstream := u.String()
+		if c.ParentCache && upstreamIs(u.Address(), info.From) {
+			// Never hand a query back to the parent that sent it to us.
+			fmt.Printf("queryDNSResolver: skipping upstream %s, query came from it\n", upstream)
+			continue
+		}
+		breaker := c.breaker(upstream)
+		if !breaker.Allow() {
+			lastErr = fmt.Errorf("%w: circuit breaker open for upstream %s", ErrServFail, upstream)
+			continue
+		}
+		start := time.Now()
+		r, err := c.queryUpstream(ctx, u, domain, qtype)
+		elapsed := time.Since(start)
+		upstreamDuration.With(labels("upstream", upstream, "qtype", dns.Type(qtype).String())).Observe(elapsed.Seconds())
+		if err == nil || errors.Is(err, ErrNXDomain) {
+			breaker.Success()
+			upstreamLatency.Observe(upstream, elapsed)
+			upstreamLatency.ObserveResult(upstream, false)
+		} else if !errors.Is(ctx.Err(), context.Canceled) {
+			// A client that gave up says nothing about the upstream.
+			breaker.Failure()
+			upstreamLatency.ObserveResult(upstream, true)
+		}
+		var response DNSResponse
+		if err == nil {
+			response, err = c.answerResponse(ctx, r, domain, qtype)
+		}
+		if err == nil {
+			logger.Debug("upstream answered", "upstream", upstream, "records", response.Records)
+			if response.Upstream == "" {
+				response.Upstream = upstream
+			}
+			return response, nil
+		}
+		fmt.Printf("queryDNSResolver: upstream %s failed: %v\n", upstream, err)
+		lastErr = err
+	}
+
+	// Names in a forward zone are usually private, so they are never handed
+	// to the system resolver.
+	if !c.SystemFallback || forwarded || (qtype != dns.TypeA && qtype != dns.TypeAAAA) {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no upstream configured for client %s", c.ID)
+		}
+		return DNSResponse{}, lastErr
+	}
+	ip, err := c.querySystemResolver(ctx, domain, qtype)
+	if err != nil {
+		return DNSResponse{}, err
+	}
+	ttl := c.TTLPolicy.Apply(qtype, DefaultTTL)
+	rr, err := newAddressRecord(domain, qtype, ip, ttl)
+	if err != nil {
+		return DNSResponse{}, err
+	}
+	return DNSResponse{IPAddress: ip, Records: []dns.RR{rr}, Timestamp: time.Now(), TTL: ttl}, nil
+}
+
+// DefaultRootHints are the IPv4 addresses of the root servers.
+var DefaultRootHints = []string{
+	"198.41.0.4:53", "170.247.170.2:53", "192.33.4.12:53", "199.7.91.13:53",
+	"192.203.230.10:53", "192.5.5.241:53", "192.112.36.4:53", "198.97.190.53:53",
+	"192.36.148.17:53", "192.58.128.30:53", "193.0.14.129:53", "199.7.83.42:53",
+	"202.12.27.33:53",
+}
+
+const (
+	// maxIterativeSteps bounds the queries made for a single resolution.
+	maxIterativeSteps = 32
+	// maxIterativeDepth bounds nested lookups of name servers without glue.
+	maxIterativeDepth = 4
+)
+
+type referral struct {
+	Servers []string
+	Expires time.Time
+}
+
+// IterativeResolver resolves names from the root down, using QNAME
+// minimization (RFC 7816): each server is asked about the name only one label
+// deeper than the zone it is known to serve, so the full name is only sent to
+// the server authoritative for it. Referrals are cached so later queries
+// start from the closest known zone cut.
+type IterativeResolver struct {
+	RootHints []string
+	mu        sync.Mutex
+	referrals map[string]referral
+}
+
+func NewIterativeResolver(rootHints []string) *IterativeResolver {
+	if len(rootHints) == 0 {
+		rootHints = DefaultRootHints
+	}
+	return &IterativeResolver{RootHints: rootHints, referrals: make(map[string]referral)}
+}
+
+func (ir *IterativeResolver) Resolve(ctx context.Context, domain string, qtype uint16) (*dns.Msg, error) {
+	return ir.resolve(ctx, dns.Fqdn(domain), qtype, 0)
+}
+
+func (ir *IterativeResolver) resolve(ctx context.Context, qname string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxIterativeDepth {
+		return nil, fmt.Errorf("iterative resolution of %s nested too deeply", qname)
+	}
+	labels := dns.SplitDomainName(qname)
+	zone, servers := ir.closestZone(qname)
+	known := dns.CountLabel(zone)
+
+	for step := 0; step < maxIterativeSteps; step++ {
+		// Ask for one label more than we know about, until we reach qname.
+		if known < len(labels) {
+			known++
+		}
+		name := dns.Fqdn(strings.Join(labels[len(labels)-known:], "."))
+		if known == 0 {
+			name = "."
+		}
+		final := name == qname
+		asked := dns.TypeNS
+		if final {
+			asked = qtype
+		}
+
+		r, err := ir.exchange(ctx, servers, name, asked)
+		if err != nil {
+			return nil, err
+		}
+
+		if cut, ns, ttl := referralFrom(r, zone); cut != "" {
+			next := glueFor(r, ns)
+			for _, target := range ns {
+				if len(next) > 0 {
+					break
+				}
+				// No glue: resolve the name server address separately.
+				if a, err := ir.resolve(ctx, target, dns.TypeA, depth+1); err == nil {
+					next = append(next, addressesIn(a)...)
+				}
+			}
+			if len(next) == 0 {
+				return nil, fmt.Errorf("no reachable name server for zone %s", cut)
+			}
+			ir.mu.Lock()
+			ir.referrals[cut] = referral{Servers: next, Expires: time.Now().Add(ttl)}
+			ir.mu.Unlock()
+			zone, servers, known = cut, next, dns.CountLabel(cut)
+			continue
+		}
+
+		if final || r.Rcode == dns.RcodeNameError {
+			// NXDOMAIN for an ancestor means qname cannot exist either.
+			return r, nil
+		}
+		// No zone cut at name: keep asking the same servers, one label deeper.
+	}
+	return nil, fmt.Errorf("iterative resolution of %s did not finish", qname)
+}
+
+// Hint records servers for zone, learned elsewhere than from a referral,
+// unless a referral for it is already known. Resolution then starts there
+// when zone is the closest known cut above the name.
+func (ir *IterativeResolver) Hint(zone string, servers []string, expires time.Time) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	if ref, ok := ir.referrals[zone]; ok && time.Now().Before(ref.Expires) {
+		return
+	}
+	ir.referrals[zone] = referral{Servers: servers, Expires: expires}
+}
+
+// closestZone returns the deepest cached zone cut above qname and its servers.
+func (ir *IterativeResolver) closestZone(qname string) (string, []string) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	now := time.Now()
+	for name := qname; ; {
+		if ref, ok := ir.referrals[name]; ok && now.Before(ref.Expires) {
+			return name, ref.Servers
+		}
+		next, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[next:]
+	}
+	return ".", ir.RootHints
+}
+
+func (ir *IterativeResolver) exchange(ctx context.Context, servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(name, qtype)
+	message.RecursionDesired = false
+
+	var lastErr error
+	for _, server := range servers {
+		r, err := exchange(ctx, message, server)
+		if err == nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+			return r, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s answered %s for %s: %w", server, dns.RcodeToString[r.Rcode], name, &RcodeError{Rcode: r.Rcode})
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// referralFrom returns the zone cut a response delegates to, if it is a
+// referral below zone, with the name server names and the delegation TTL.
+func referralFrom(r *dns.Msg, zone string) (string, []string, time.Duration) {
+	if len(r.Answer) > 0 || r.Rcode != dns.RcodeSuccess {
+		return "", nil, 0
+	}
+	var cut string
+	var ns []string
+	ttl := DefaultTTL
+	for _, rr := range r.Ns {
+		record, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.Fqdn(record.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		ns = append(ns, record.Ns)
+		ttl = min(ttl, time.Duration(record.Hdr.Ttl)*time.Second)
+	}
+	return cut, ns, ttl
+}
+
+// glueFor returns the addresses the additional section gives for ns.
+func glueFor(r *dns.Msg, ns []string) []string {
+	var servers []string
+	for _, rr := range r.Extra {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		for _, name := range ns {
+			if strings.EqualFold(a.Hdr.Name, name) {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+	}
+	return servers
+}
+
+func addressesIn(r *dns.Msg) []string {
+	var servers []string
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+	return servers
+}
+
+// upstreamIs reports whether the upstream address resolves to ip.
+func upstreamIs(upstream string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host = upstream
+	}
+	parsed := net.ParseIP(host)
+	return parsed != nil && parsed.Equal(ip)
+}
+
+// ForwardZone sends queries for a domain and everything below it to its own
+// upstreams (conditional forwarding).
+type ForwardZone struct {
+	Name      string   `toml:"name"`
+	Upstreams []string `toml:"upstreams"`
+}
+
+// forwardZone returns the most specific forward zone containing domain.
+func (c *Client) forwardZone(domain string) (ForwardZone, bool) {
+	var best ForwardZone
+	bestLabels := -1
+	for _, zone := range c.ForwardZones {
+		if n := dns.CountLabel(zone.Name); n > bestLabels && dns.IsSubDomain(dns.Fqdn(zone.Name), dns.Fqdn(domain)) {
+			best, bestLabels = zone, n
+		}
+	}
+	return best, bestLabels >= 0
+}
+
+// upstreams returns the resolvers in the order they should be tried.
+// Addresses that do not parse are skipped; Validate reports them.
+func (c *Client) upstreams() []Upstream {
+	var upstreams []Upstream
+	for _, s := range append([]string{c.Server}, c.Upstreams...) {
+		if u, err := parseUpstream(s, c.Protocol); err == nil {
+			upstreams = append(upstreams, u)
+		} else if s != "" {
+			fmt.Printf("Client %s: ignoring upstream: %v\n", c.ID, err)
+		}
+	}
+	return upstreams
+}
+
+// Upstream is a parsed upstream resolver address.
+type Upstream struct {
+	Scheme string // "udp" (plain DNS, the default), "tcp", "tls" or "https"
+	Host   string
+	Port   string
+	Path   string // URL path of a DNS-over-HTTPS endpoint
+}
+
+// Default ports by upstream scheme.
+var upstreamPorts = map[string]string{"udp": "53", "tcp": "53", "tls": "853", "https": "443"}
+
+// protocolSchemes maps the client protocol setting to upstream schemes.
+var protocolSchemes = map[string]string{"udp": "udp", "tcp": "tcp", "dot": "tls", "doh": "https"}
+
+// parseUpstream parses an upstream address: "host", "host:port" or
+// "[v6]:port" for plain DNS, or a URL whose scheme picks the transport:
+// tcp://, tls:// (DNS over TLS), https:// (DNS over HTTPS). Ports default
+// per scheme. A non-empty protocol ("udp", "tcp", "dot" or "doh") sets the
+// transport of bare addresses and must agree with the scheme of URLs.
+func parseUpstream(s string, protocol string) (Upstream, error) {
+	if s == "" {
+		return Upstream{}, fmt.Errorf("empty upstream address")
+	}
+	if protocol != "" && protocolSchemes[protocol] == "" {
+		return Upstream{}, fmt.Errorf("unknown protocol %q, want udp, tcp, dot or doh", protocol)
+	}
+	u := Upstream{Scheme: "udp"}
+	if strings.Contains(s, "://") {
+		parsed, err := url.Parse(s)
+		if err != nil {
+			return Upstream{}, fmt.Errorf("upstream %q: %v", s, err)
+		}
+		u.Scheme, u.Host, u.Port, u.Path = parsed.Scheme, parsed.Hostname(), parsed.Port(), parsed.Path
+		switch u.Scheme {
+		case "udp", "tcp", "tls", "https":
+		case "quic":
+			// The server answers DoQ (doq_addr) but cannot query over it.
+			return Upstream{}, fmt.Errorf("upstream %q: DNS-over-QUIC upstreams are not supported", s)
+		default:
+			return Upstream{}, fmt.Errorf("upstream %q: unknown scheme %q", s, u.Scheme)
+		}
+		if u.Path != "" && u.Scheme != "https" {
+			return Upstream{}, fmt.Errorf("upstream %q: only https upstreams take a path", s)
+		}
+		if protocol != "" && protocolSchemes[protocol] != u.Scheme {
+			return Upstream{}, fmt.Errorf("upstream %q: scheme %s:// conflicts with protocol %q", s, u.Scheme, protocol)
+		}
+	} else {
+		if host, port, err := net.SplitHostPort(s); err == nil {
+			u.Host, u.Port = host, port
+		} else {
+			// No port: a bare name or address, possibly IPv6.
+			u.Host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		}
+		if protocol != "" {
+			u.Scheme = protocolSchemes[protocol]
+		}
+	}
+	if u.Scheme == "https" && u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	if u.Host == "" {
+		return Upstream{}, fmt.Errorf("upstream %q has no host", s)
+	}
+	if u.Port == "" {
+		u.Port = upstreamPorts[u.Scheme]
+	}
+	if port, err := strconv.Atoi(u.Port); err != nil || port < 1 || port > 65535 {
+		return Upstream{}, fmt.Errorf("upstream %q: bad port %q", s, u.Port)
+	}
+	return u, nil
+}
+
+func parseUpstreams(list []string, protocol string) ([]Upstream, error) {
+	upstreams := make([]Upstream, 0, len(list))
+	for _, s := range list {
+		u, err := parseUpstream(s, protocol)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// Address is the upstream's host:port.
+func (u Upstream) Address() string {
+	return net.JoinHostPort(u.Host, u.Port)
+}
+
+// URL is the endpoint of a DNS-over-HTTPS upstream.
+func (u Upstream) URL() string {
+	return "https://" + u.Address() + u.Path
+}
+
+// String is the canonical form of the upstream, used to key its breaker,
+// limiter and metrics: plain host:port for UDP, a URL otherwise.
+func (u Upstream) String() string {
+	switch u.Scheme {
+	case "udp":
+		return u.Address()
+	case "https":
+		return u.URL()
+	}
+	return u.Scheme + "://" + u.Address()
+}
+
+// queryUpstream sends the query for domain to a single upstream and returns
+// its processed response.
+func (c *Client) queryUpstream(ctx context.Context, u Upstream, domain string, qtype uint16) (*dns.Msg, error) {
+	upstream := u.String()
+	message := new(dns.Msg)
+	message.SetQuestion(dns.Fqdn(domain), qtype)
+	// Encrypted transports cannot be spoofed off-path, and DoH GET
+	// requests must stay cacheable, so only cleartext queries use 0x20.
+	randomized := c.RandomizeCase && (u.Scheme == "udp" || u.Scheme == "tcp")
+	if randomized {
+		message.Question[0].Name = randomizeCase(message.Question[0].Name)
+	}
+	message.RecursionDesired = true
+	message.CheckingDisabled = checkingDisabled(ctx)
+	if dnssecOK(ctx) {
+		// Large enough for DNSKEY sets and their signatures.
+		message.SetEdns0(4096, true)
+	}
+	if _, forwarded := c.forwardZone(domain); c.ParentCache || forwarded {
+		// Forwarders may be instances of this server too, and two of them
+		// forwarding a zone to each other would loop without the count.
+		setHopCount(message, forwardInfoFromContext(ctx).Hops+1)
+	}
+	if c.PaddingBlock > 0 && (u.Scheme == "tls" || u.Scheme == "https") {
+		if message.IsEdns0() == nil {
+			message.SetEdns0(4096, false)
+		}
+		padMessage(message, c.PaddingBlock)
+	}
+
+	if err := c.acquireInFlight(ctx); err != nil {
+		return nil, fmt.Errorf("client %s waiting for a free slot: %w", c.ID, timeoutError(err))
+	}
+	defer c.releaseInFlight()
+	limiter := upstreamLimiter(upstream)
+	if err := limiter.Acquire(ctx, c.ID); err != nil {
+		return nil, fmt.Errorf("waiting for a free slot to %s: %w", upstream, timeoutError(err))
+	}
+	var r *dns.Msg
+	var err error
+	switch u.Scheme {
+	case "https":
+		r, err = exchangeDoH(ctx, message, u.URL(), c.DoHGet)
+	case "tls":
+		r, err = exchangeDoT(ctx, message, u)
+	case "tcp":
+		r, err = exchangeContext(ctx, &dns.Client{Net: "tcp"}, message, u.Address())
+		err = timeoutError(err)
+	default:
+		r, err = exchange(ctx, message, u.Address())
+	}
+	limiter.Release()
+	if err != nil {
+		return nil, err
+	}
+	if randomized {
+		sent := message.Question[0].Name
+		if len(r.Question) != 1 || r.Question[0].Name != sent {
+			fmt.Printf("Rejecting answer from %s for %s: query name case not echoed (0x20), possibly spoofed\n", upstream, sent)
+			c.Quarantine.Strike(dns.Fqdn(domain), "0x20")
+			return nil, fmt.Errorf("%w: %s did not echo the query name %s exactly", ErrServFail, upstream, sent)
+		}
+		restoreCase(r, sent, dns.Fqdn(domain))
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, &RcodeError{Rcode: r.Rcode}
+	}
+
+	if c.MinimalResponses {
+		minimizeResponse(r)
+	}
+	return r, nil
+}
+
+// randomizeCase flips the case of each letter of name at random (DNS 0x20,
+// draft-vixie-dnsext-dns0x20). Upstreams echo the name as sent, so a forged
+// answer also has to guess the casing.
+func randomizeCase(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	rand.Read(bits)
+	b := []byte(name)
+	for i, ch := range b {
+		if ('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z') && bits[i/8]&(1<<(i%8)) != 0 {
+			b[i] = ch ^ 0x20
+		}
+	}
+	return string(b)
+}
+
+// restoreCase puts the query name back as asked in an answer to a query
+// sent as sent, so cached records do not keep the randomized casing.
+func restoreCase(r *dns.Msg, sent string, name string) {
+	r.Question[0].Name = name
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == sent {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// exchange sends message to server over UDP and repeats it over TCP if the
+// answer comes back truncated, so only complete answers are returned.
+func exchange(ctx context.Context, message *dns.Msg, server string) (*dns.Msg, error) {
+	r, err := exchangeContext(ctx, new(dns.Client), message, server)
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	if !r.Truncated {
+		return r, nil
+	}
+	fmt.Printf("Truncated answer from %s for %s, retrying over TCP\n", server, message.Question[0].Name)
+	r, err = exchangeContext(ctx, &dns.Client{Net: "tcp"}, message, server)
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	return r, nil
+}
+
+// exchangeContext is client.ExchangeContext, but also gives up as soon as
+// ctx is cancelled: miekg/dns only applies ctx's deadline.
+func exchangeContext(ctx context.Context, client *dns.Client, message *dns.Msg, server string) (*dns.Msg, error) {
+	conn, err := client.DialContext(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeOn(ctx, client, message, conn)
+}
+
+// exchangeOn is client.ExchangeWithConnContext, also given up as soon as
+// ctx is cancelled. A deadline left on conn by a late cancellation is
+// replaced by the next exchange on it.
+func exchangeOn(ctx context.Context, client *dns.Client, message *dns.Msg, conn *dns.Conn) (*dns.Msg, error) {
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	r, _, err := client.ExchangeWithConnContext(ctx, message, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return r, err
+}
+
+// dohClient is shared by every DNS-over-HTTPS query. Its transport keeps
+// one HTTP/2 connection per endpoint and multiplexes concurrent queries
+// over it, so only the first query to an endpoint pays for the TCP and TLS
+// handshakes.
+var dohClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// connectionDropped reports whether err means the connection an upstream
+// query went out on was closed or reset, rather than the upstream being
+// slow or wrong. HTTP/2 reports a lost connection only as text.
+func connectionDropped(err error) bool {
+	for _, dropped := range []error{io.EOF, io.ErrUnexpectedEOF, net.ErrClosed, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE} {
+		if errors.Is(err, dropped) {
+			return true
+		}
+	}
+	return strings.Contains(err.Error(), "client connection lost") || strings.Contains(err.Error(), "GOAWAY")
+}
+
+// dotIdleConns is how many idle DNS-over-TLS connections are kept per
+// upstream for reuse.
+const dotIdleConns = 4
+
+// dotConns holds idle DNS-over-TLS connections by upstream, so queries do
+// not each pay for a TLS handshake.
+var dotConns = struct {
+	sync.Mutex
+	idle map[string][]*dns.Conn
+}{idle: make(map[string][]*dns.Conn)}
+
+// dotRootCAs verifies DNS-over-TLS upstreams; nil uses the system roots.
+var dotRootCAs *x509.CertPool
+
+// exchangeDoT sends message to a DNS-over-TLS upstream over an idle
+// connection if one is left, or a new one. Servers close idle connections
+// (RFC 7766) and middleboxes drop them, so when a reused connection turns
+// out to be gone the query is retried once on a fresh connection.
+func exchangeDoT(ctx context.Context, message *dns.Msg, u Upstream) (*dns.Msg, error) {
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: u.Host, RootCAs: dotRootCAs}}
+	key := u.String()
+	dotConns.Lock()
+	var conn *dns.Conn
+	if idle := dotConns.idle[key]; len(idle) > 0 {
+		conn = idle[len(idle)-1]
+		dotConns.idle[key] = idle[:len(idle)-1]
+	}
+	dotConns.Unlock()
+
+	reused := conn != nil
+	var err error
+	if !reused {
+		if conn, err = client.DialContext(ctx, u.Address()); err != nil {
+			return nil, timeoutError(err)
+		}
+	}
+	r, err := exchangeOn(ctx, client, message, conn)
+	if err != nil && reused && connectionDropped(err) && ctx.Err() == nil {
+		conn.Close()
+		fmt.Printf("DoT connection to %s dropped (%v), reconnecting\n", key, err)
+		upstreamReconnects.With(labels("upstream", key)).Add(1)
+		if conn, err = client.DialContext(ctx, u.Address()); err != nil {
+			return nil, timeoutError(err)
+		}
+		r, err = exchangeOn(ctx, client, message, conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, timeoutError(err)
+	}
+
+	dotConns.Lock()
+	if len(dotConns.idle[key]) < dotIdleConns {
+		dotConns.idle[key] = append(dotConns.idle[key], conn)
+		conn = nil
+	}
+	dotConns.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return r, nil
+}
+
+// dohMaxResponse bounds the body read from a DoH endpoint.
+const dohMaxResponse = dns.MaxMsgSize
+
+// exchangeDoH sends message to a DNS-over-HTTPS endpoint. The query ID is
+// zeroed on the wire, as RFC 8484 recommends so identical GET requests can
+// be cached, and restored on the answer.
+func exchangeDoH(ctx context.Context, message *dns.Msg, endpoint string, get bool) (*dns.Msg, error) {
+	query := message.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	target := endpoint
+	if get {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		params := u.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+		u.RawQuery = params.Encode()
+		target = u.String()
+	}
+	send := func() (*http.Response, error) {
+		var req *http.Request
+		var err error
+		if get {
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		} else {
+			req, err = http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(packed))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !get {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+		req.Header.Set("Accept", "application/dns-message")
+		return dohClient.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil && connectionDropped(err) && ctx.Err() == nil {
+		// The pooled HTTP/2 connection died under us. Drop the idle ones,
+		// which are likely dead too, and retry once on a fresh one.
+		fmt.Printf("DoH connection to %s dropped (%v), reconnecting\n", endpoint, err)
+		upstreamReconnects.With(labels("upstream", endpoint)).Add(1)
+		dohClient.Transport.(*http.Transport).CloseIdleConnections()
+		resp, err = send()
+	}
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered HTTP %s", endpoint, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxResponse))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, fmt.Errorf("%s: %v", endpoint, err)
+	}
+	r.Id = message.Id
+	return r, nil
+}
+
+// Zone holds the records of a locally served zone.
+type Zone struct {
+	Origin  string
+	SOA     *dns.SOA
+	Records map[string][]dns.RR // by lowercased owner name
+}
+
+// LoadZone parses an RFC 1035 zone file. The zone apex is taken from its SOA.
+func LoadZone(path string, origin string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zone := &Zone{Records: make(map[string][]dns.RR)}
+	if origin != "" {
+		origin = dns.Fqdn(origin)
+	}
+	parser := dns.NewZoneParser(f, origin, path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		zone.Records[name] = append(zone.Records[name], rr)
+		if soa, isSOA := rr.(*dns.SOA); isSOA && zone.SOA == nil {
+			zone.SOA = soa
+			zone.Origin = name
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if zone.SOA == nil {
+		return nil, fmt.Errorf("zone file %s has no SOA record", path)
+	}
+	return zone, nil
+}
+
+// The reverse zones of the loopback addresses, 127.0.0.0/8 and ::1.
+const (
+	loopbackReverseV4 = "127.in-addr.arpa."
+	loopbackReverseV6 = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."
+)
+
+// specialUseZones are the special-use domains (RFC 6761, RFC 7686) that must
+// never be forwarded, unless a forward zone covers them. Loopback zones are
+// answered, the rest do not exist.
+var specialUseZones = func() []string {
+	zones := []string{
+		"localhost.", "invalid.", "test.", "onion.",
+		loopbackReverseV4, loopbackReverseV6,
+		"10.in-addr.arpa.", "168.192.in-addr.arpa.",
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+	return zones
+}()
+
+// WhoamiName is the control name answered with the serving client's group
+// membership. A name prefixed to it, as in example.com._whoami.internal.,
+// asks about the client that serves that name instead.
+const WhoamiName = "_whoami.internal."
+
+// whoamiAnswer answers TXT queries for WhoamiName from gm, or returns nil
+// for any other name. Nothing is resolved or cached, and the answer has a
+// zero TTL so it always reflects the current assignment.
+func whoamiAnswer(gm *GroupManager, r *dns.Msg, q dns.Question) *dns.Msg {
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(WhoamiName, name) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return m
+	}
+	domain := strings.TrimSuffix(name, WhoamiName)
+	if domain == "" {
+		domain = name
+	}
+	client, group, members := gm.Membership(domain)
+	if client == nil {
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	}
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"client=" + client.ID, "group=" + group, "members=" + strings.Join(members, ",")},
+	})
+	return m
+}
+
+// DefaultHealthCheckName is the name answered for liveness probes.
+const DefaultHealthCheckName = "health.check."
+
+// healthCheckAnswer answers queries for name with an A or AAAA record of ip
+// and a zero TTL, returning nil for any other name. Other query types, and
+// the address family ip is not, get an empty answer.
+func healthCheckAnswer(r *dns.Msg, q dns.Question, name string, ip string) *dns.Msg {
+	if name == "" || !strings.EqualFold(q.Name, dns.Fqdn(name)) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if rr, err := newAddressRecord(q.Name, q.Qtype, ip, 0); err == nil {
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+// BlockedTTL is the TTL of answers to blocked names.
+const BlockedTTL = time.Minute
+
+// Blocklist holds the names answered without resolving, with Sinkhole or
+// NXDOMAIN when Sinkhole is nil. It is safe for concurrent use, and Reload
+// swaps in a new list without disturbing queries in flight.
+type Blocklist struct {
+	Path     string   // file read by Reload; may be empty
+	Inline   []string // entries from the config, kept across reloads
+	Sinkhole net.IP
+
+	mu       sync.RWMutex
+	exact    map[string]bool
+	suffixes map[string]bool
+}
+
+// NewBlocklist reads path, if set, together with the inline entries.
+func NewBlocklist(path string, inline []string, sinkhole net.IP) (*Blocklist, error) {
+	b := &Blocklist{Path: path, Inline: inline, Sinkhole: sinkhole}
+	return b, b.Reload()
+}
+
+// Reload reads the blocklist file again. On error the current list is
+// kept.
+func (b *Blocklist) Reload() error {
+	exact := make(map[string]bool)
+	suffixes := make(map[string]bool)
+	add := func(entry string) {
+		if strings.HasPrefix(entry, ".") {
+			suffixes[dns.Fqdn(strings.ToLower(entry[1:]))] = true
+		} else {
+			exact[dns.Fqdn(strings.ToLower(entry))] = true
+		}
+	}
+	for _, entry := range b.Inline {
+		add(entry)
+	}
+	if b.Path != "" {
+		data, err := os.ReadFile(b.Path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			// Hosts file lines ("0.0.0.0 ads.example") name the domain second.
+			if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+				fields = fields[1:]
+			}
+			for _, field := range fields {
+				add(field)
+			}
+		}
+	}
+	b.mu.Lock()
+	b.exact, b.suffixes = exact, suffixes
+	b.mu.Unlock()
+	fmt.Printf("Blocklist: %d names and %d domains blocked\n", len(exact), len(suffixes))
+	return nil
+}
+
+// Blocked reports whether name is on the list, exactly or below a blocked
+// domain.
+func (b *Blocklist) Blocked(name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.exact[name] {
+		return true
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if b.suffixes[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer answers q if its name is blocked, or returns nil. Address queries
+// of the sinkhole's family get the sinkhole, other types NODATA.
+func (b *Blocklist) Answer(r *dns.Msg, q dns.Question) *dns.Msg {
+	if b == nil || !b.Blocked(q.Name) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if b.Sinkhole == nil {
+		m.Rcode = dns.RcodeNameError
+	} else if rr, err := newAddressRecord(q.Name, q.Qtype, b.Sinkhole.String(), BlockedTTL); err == nil {
+		m.Answer = append(m.Answer, rr)
+	}
+	attachExtendedError(m, r, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeFiltered, ExtraText: "blocklist"})
+	return m
+}
+
+// specialUseAnswer answers q if it falls in a special-use domain, or returns
+// nil if it should be resolved normally.
+func specialUseAnswer(r *dns.Msg, q dns.Question) *dns.Msg {
+	name := strings.ToLower(q.Name)
+	zone := ""
+	for _, z := range specialUseZones {
+		if dns.IsSubDomain(z, name) {
+			zone = z
+			break
+		}
+	}
+	if zone == "" {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: uint32(DefaultTTL / time.Second)}
+	loopback := true
+	switch zone {
+	case "localhost.":
+		// RFC 6761 section 6.3: every name under localhost. is loopback.
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		}
+		if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+	case loopbackReverseV4, loopbackReverseV6:
+		// A full loopback address: four labels below in-addr.arpa., or
+		// ::1 which is the whole ip6.arpa. zone.
+		full := dns.CountLabel(name) == 6 || zone == loopbackReverseV6
+		if full && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) {
+			hdr.Rrtype = dns.TypePTR
+			m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, Ptr: "localhost."})
+		}
+	default:
+		loopback = false
+	}
+	if len(m.Answer) == 0 {
+		// Loopback names exist without the asked type (NODATA); the other
+		// special-use domains have no names at all here.
+		if !loopback {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(m.Ns, specialUseSOA(zone))
+	}
+	return m
+}
+
+// specialUseSOA is the SOA for negative answers from a special-use zone.
+func specialUseSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 10800},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  10800,
+	}
+}
+
+// loadZoneIfSet loads the zone file at path, or returns nil if there is none.
+func loadZoneIfSet(path string, origin string) (*Zone, error) {
+	if path == "" {
+		return nil, nil
+	}
+	zone, err := LoadZone(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Serving zone %s from %s\n", zone.Origin, path)
+	return zone, nil
+}
+
+// Answer builds an authoritative reply for q, or returns nil when q is not
+// inside the zone and should be resolved normally.
+func (z *Zone) Answer(r *dns.Msg, q dns.Question) *dns.Msg {
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(z.Origin, name) {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	_, exists := z.lookup(name)
+	// Follow CNAMEs that stay inside the zone, a bounded number of times.
+	for owner, hops := name, 0; hops < 8; hops++ {
+		var next string
+		records, _ := z.lookup(owner)
+		for _, rr := range records {
+			rrtype := rr.Header().Rrtype
+			if rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, rr)
+			} else if cname, ok := rr.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+				m.Answer = append(m.Answer, rr)
+				next = strings.ToLower(cname.Target)
+			}
+		}
+		if next == "" || !dns.IsSubDomain(z.Origin, next) {
+			break
+		}
+		owner = next
+	}
+	if len(m.Answer) == 0 {
+		// NODATA or NXDOMAIN: the SOA tells the client how long to cache it.
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(m.Ns, z.SOA)
+	}
+	return m
+}
+
+// lookup returns the records of name, a lowercased name in the zone, and
+// whether it exists. Names that do not exist are synthesized from the
+// wildcard at their closest encloser, if there is one (RFC 4592): with
+// *.dev.local. in the zone, a.dev.local. and b.a.dev.local. match it, but
+// not a name below an existing x.dev.local. nor dev.local. itself.
+func (z *Zone) lookup(name string) ([]dns.RR, bool) {
+	if records, ok := z.Records[name]; ok {
+		return records, true
+	}
+	if z.hasDescendant(name) {
+		return nil, true
+	}
+	wildcard, ok := z.Records["*."+z.closestEncloser(name)]
+	if !ok {
+		return nil, false
+	}
+	records := make([]dns.RR, len(wildcard))
+	for i, rr := range wildcard {
+		records[i] = dns.Copy(rr)
+		records[i].Header().Name = name
+	}
+	return records, true
+}
+
+// closestEncloser returns the longest existing ancestor of name, which does
+// not exist itself. The zone apex always exists.
+func (z *Zone) closestEncloser(name string) string {
+	labels := dns.Split(name)
+	for _, start := range labels[1:] {
+		ancestor := name[start:]
+		if _, ok := z.Records[ancestor]; ok || ancestor == z.Origin || z.hasDescendant(ancestor) {
+			return ancestor
+		}
+	}
+	return z.Origin
+}
+
+// hasDescendant reports whether name is an empty non-terminal, which exists
+// even though it owns no records.
+func (z *Zone) hasDescendant(name string) bool {
+	for owner := range z.Records {
+		if owner != name && dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerRotation advances on every response reordered in "rotate" mode.
+var answerRotation atomic.Uint64
+
+// orderAnswer reorders the A and AAAA records of an answer in place,
+// leaving other records such as CNAMEs where they are, which gives clients
+// primitive load balancing across the addresses.
+func orderAnswer(answer []dns.RR, mode string) {
+	if mode == "" || mode == "stored" {
+		return
+	}
+	var positions []int
+	var addresses []dns.RR
+	for i, rr := range answer {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			positions = append(positions, i)
+			addresses = append(addresses, rr)
+		}
+	}
+	if len(addresses) < 2 {
+		return
+	}
+	switch mode {
+	case "rotate":
+		shift := int(answerRotation.Add(1) % uint64(len(addresses)))
+		addresses = append(addresses[shift:], addresses[:shift]...)
+	case "random":
+		mathrand.Shuffle(len(addresses), func(i, j int) { addresses[i], addresses[j] = addresses[j], addresses[i] })
+	}
+	for i, pos := range positions {
+		answer[pos] = addresses[i]
+	}
+}
+
+// Rewrite actions.
+const (
+	// RewriteStripCNAME flattens a CNAME chain: the aliases are dropped and
+	// the records they led to are renamed to the queried name.
+	RewriteStripCNAME = "strip-cname"
+	// RewriteReplaceIP replaces the address From with To in A and AAAA
+	// records.
+	RewriteReplaceIP = "replace-ip"
+)
+
+// RewriteRule changes upstream answers for Name and the names below it,
+// for queries of Type (any type when empty).
+type RewriteRule struct {
+	Name   string `toml:"name"`
+	Type   string `toml:"type"`
+	Action string `toml:"action"`
+	From   string `toml:"from"`
+	To     string `toml:"to"`
+}
+
+func (r RewriteRule) check() error {
+	if _, ok := dns.IsDomainName(r.Name); !ok || r.Name == "" {
+		return fmt.Errorf("%q is not a valid domain name", r.Name)
+	}
+	if _, ok := dns.StringToType[strings.ToUpper(r.Type)]; r.Type != "" && !ok {
+		return fmt.Errorf("unknown record type %q", r.Type)
+	}
+	switch r.Action {
+	case RewriteStripCNAME:
+	case RewriteReplaceIP:
+		from, to := net.ParseIP(r.From), net.ParseIP(r.To)
+		if from == nil || to == nil {
+			return fmt.Errorf("replace-ip needs from and to addresses")
+		}
+		if (from.To4() == nil) != (to.To4() == nil) {
+			return fmt.Errorf("replace-ip from %s and to %s are different address families", r.From, r.To)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+func (r RewriteRule) matches(domain string, qtype uint16) bool {
+	if r.Type != "" && dns.StringToType[strings.ToUpper(r.Type)] != qtype {
+		return false
+	}
+	return dns.IsSubDomain(dns.Fqdn(r.Name), dns.Fqdn(domain))
+}
+
+// Apply returns response rewritten by r if the rule matches the query. The
+// records are copied, never changed in place.
+func (r RewriteRule) Apply(domain string, qtype uint16, response DNSResponse) DNSResponse {
+	if !r.matches(domain, qtype) {
+		return response
+	}
+	var records []dns.RR
+	changed := false
+	for _, rr := range response.Records {
+		switch r.Action {
+		case RewriteStripCNAME:
+			if rr.Header().Rrtype == dns.TypeCNAME || rr.Header().Rrtype == dns.TypeDNAME {
+				changed = true
+				continue
+			}
+			if !strings.EqualFold(rr.Header().Name, domain) {
+				rr = dns.Copy(rr)
+				rr.Header().Name = domain
+				changed = true
+			}
+		case RewriteReplaceIP:
+			from := net.ParseIP(r.From)
+			switch a := rr.(type) {
+			case *dns.A:
+				if a.A.Equal(from) {
+					a = dns.Copy(a).(*dns.A)
+					a.A = net.ParseIP(r.To).To4()
+					rr, changed = a, true
+				}
+			case *dns.AAAA:
+				if a.AAAA.Equal(from) {
+					a = dns.Copy(a).(*dns.AAAA)
+					a.AAAA = net.ParseIP(r.To)
+					rr, changed = a, true
+				}
+			}
+		}
+		records = append(records, rr)
+	}
+	if !changed {
+		return response
+	}
+	fmt.Printf("Rewrite %s %s for %s %s: %v -> %v\n", r.Action, r.Name, domain, dns.Type(qtype), response.Records, records)
+	response.Records = records
+	response.IPAddress = ""
+	for _, rr := range records {
+		if ip := addressOf(rr); ip != "" {
+			response.IPAddress = ip
+			break
+		}
+	}
+	return response
+}
+
+// rewrite applies the client's rewrite rules to a fresh upstream answer.
+func (c *Client) rewrite(domain string, qtype uint16, response DNSResponse) DNSResponse {
+	for _, rule := range c.Rewrites {
+		response = rule.Apply(domain, qtype, response)
+	}
+	return response
+}
+
+// addressOf returns the address of an A or AAAA record, or "".
+func addressOf(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	}
+	return ""
+}
+
+// tcpListener caps the number of open TCP connections. Connections over
+// the limit are closed as soon as they are accepted, rather than left in the
+// backlog where they would still hold a file descriptor.
+type tcpListener struct {
+	net.Listener
+	max int64
+}
+
+var (
+	tcpConnections atomic.Int64
+	tcpRejected    = NewCounterVec("dns_tcp_rejected_total", "TCP connections closed because too many were open.")
+	// tcpConns holds the open connections by remote address, for the
+	// handler to watch while it answers.
+	tcpConns sync.Map
+)
+
+func newTCPListener(l net.Listener, max int) net.Listener {
+	return &tcpListener{Listener: l, max: int64(max)}
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if open := tcpConnections.Add(1); l.max > 0 && open > l.max {
+			tcpConnections.Add(-1)
+			tcpRejected.With("").Add(1)
+			conn.Close()
+			continue
+		}
+		tc := &tcpConn{Conn: conn}
+		tcpConns.Store(conn.RemoteAddr().String(), tc)
+		return tc, nil
+	}
+}
+
+type tcpConn struct {
+	net.Conn
+	closed sync.Once
+}
+
+func (c *tcpConn) Close() error {
+	c.closed.Do(func() {
+		tcpConnections.Add(-1)
+		tcpConns.CompareAndDelete(c.RemoteAddr().String(), c)
+	})
+	return c.Conn.Close()
+}
+
+// watch returns a context that is cancelled when the client closes the
+// connection or resets it, and a function that stops watching. Queries on
+// a connection are read one at a time, so nothing else reads it while a
+// query is answered: watch peeks without consuming, and gives up once the
+// client pipelines its next query. stop must be called before the
+// connection is read again.
+func (c *tcpConn) watch(parent context.Context) (ctx context.Context, stop func()) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return parent, func() {}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return parent, func() {}
+	}
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		raw.Read(func(fd uintptr) bool {
+			n, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			if err == syscall.EAGAIN {
+				return false // wait until there is something to read
+			}
+			if n == 0 || err != nil {
+				cancel()
+			}
+			return true
+		})
+	}()
+	return ctx, func() {
+		// The server sets a new deadline before its next read.
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		cancel()
+	}
+}
+
+// DoQ error codes, from RFC 9250 section 4.3.
+const (
+	doqNoError          quic.ApplicationErrorCode = 0x0
+	doqProtocolError    quic.ApplicationErrorCode = 0x2
+	doqRequestCancelled quic.StreamErrorCode      = 0x3
+)
+
+// DoQListener accepts DoQ connections. Its transport outlives the
+// listener, so connections already accepted can finish after it closes.
+type DoQListener struct {
+	*quic.Listener
+	transport *quic.Transport
+}
+
+// ListenDoQ listens for DNS over QUIC on addr. Connections idle for
+// longer than idleTimeout are closed.
+func ListenDoQ(addr string, cert tls.Certificate, idleTimeout time.Duration) (*DoQListener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+		MinVersion:   tls.VersionTLS13,
+	}
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.Listen(tlsConfig, &quic.Config{MaxIdleTimeout: idleTimeout})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &DoQListener{Listener: listener, transport: transport}, nil
+}
+
+// Close closes the listener, its connections and its socket.
+func (l *DoQListener) Close() error {
+	l.Listener.Close()
+	err := l.transport.Close()
+	l.transport.Conn.Close()
+	return err
+}
+
+// DoQServer answers DNS over QUIC (RFC 9250) with Handler, the same one
+// the UDP and TCP servers use. Each stream carries one query and its
+// response, both prefixed with their length as over TCP.
+type DoQServer struct {
+	Handler dns.Handler
+	// ReadTimeout bounds how long a stream may take to send its query.
+	ReadTimeout time.Duration
+
+	mu       sync.Mutex
+	listener *DoQListener
+	conns    map[quic.Connection]bool
+	closing  bool
+	streams  sync.WaitGroup // added to under mu while not closing
+}
+
+// Serve accepts connections on listener until Shutdown.
+func (s *DoQServer) Serve(listener *DoQListener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listener.Close()
+		return quic.ErrServerClosed
+	}
+	s.listener = listener
+	s.conns = make(map[quic.Connection]bool)
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// doqCloseDelay is how long Shutdown keeps connections open after the last
+// query is answered. Closing a QUIC connection discards the data it has
+// not sent yet, so responses get this long to reach their clients.
+const doqCloseDelay = time.Second
+
+// Shutdown stops accepting connections, waits for the queries being
+// answered or for ctx to end, and closes every connection once the clients
+// have closed them or doqCloseDelay has passed.
+func (s *DoQServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	listener := s.listener
+	if listener != nil {
+		listener.Listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.mu.Lock()
+	conns := make([]quic.Connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	timer := time.NewTimer(doqCloseDelay)
+	defer timer.Stop()
+	for _, conn := range conns {
+		select {
+		case <-conn.Context().Done():
+			continue
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		break
+	}
+	for _, conn := range conns {
+		conn.CloseWithError(doqNoError, "server shutting down")
+	}
+	if listener != nil {
+		listener.Close()
+	}
+	return err
+}
+
+func (s *DoQServer) serveConn(conn quic.Connection) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		conn.CloseWithError(doqNoError, "server shutting down")
+		return
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			stream.CancelRead(doqRequestCancelled)
+			stream.CancelWrite(doqRequestCancelled)
+			continue
+		}
+		s.streams.Add(1)
+		s.mu.Unlock()
+		go s.serveStream(conn, stream)
+	}
+}
+
+// serveStream reads the query on stream and answers it. A malformed query
+// or one with a message ID other than 0 is a protocol error, which closes
+// the connection.
+func (s *DoQServer) serveStream(conn quic.Connection, stream quic.Stream) {
+	defer s.streams.Done()
+	if s.ReadTimeout > 0 {
+		stream.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, query); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(query); err != nil {
+		conn.CloseWithError(doqProtocolError, "malformed query")
+		return
+	}
+	if r.Id != 0 {
+		conn.CloseWithError(doqProtocolError, "message ID is not 0")
+		return
+	}
+	w := &doqWriter{conn: conn, stream: stream}
+	s.Handler.ServeDNS(w, r)
+	if !w.wrote {
+		// Dropped, as by acl_action = "drop": there is no response to
+		// wait for.
+		stream.CancelWrite(doqRequestCancelled)
+	}
+}
+
+// doqWriter is the dns.ResponseWriter of one DoQ stream. The response
+// ends the stream.
+type doqWriter struct {
+	conn   quic.Connection
+	stream quic.Stream
+	wrote  bool
+}
+
+func (w *doqWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *doqWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+func (w *doqWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+func (w *doqWriter) Write(b []byte) (int, error) {
+	if w.wrote {
+		return 0, errors.New("response already written")
+	}
+	w.wrote = true
+	message := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(message, uint16(len(b)))
+	copy(message[2:], b)
+	if _, err := w.stream.Write(message); err != nil {
+		return 0, err
+	}
+	return len(b), w.stream.Close()
+}
+
+// Context ends when the client cancels the stream or the connection
+// closes, so the handler stops resolving for it.
+func (w *doqWriter) Context() context.Context { return w.stream.Context() }
+
+// ConnectionState makes the handler pad responses as over TLS.
+func (w *doqWriter) ConnectionState() *tls.ConnectionState {
+	state := w.conn.ConnectionState().TLS
+	return &state
+}
+
+func (w *doqWriter) Close() error        { return w.conn.CloseWithError(doqNoError, "") }
+func (w *doqWriter) TsigStatus() error   { return nil }
+func (w *doqWriter) TsigTimersOnly(bool) {}
+func (w *doqWriter) Hijack()             {}
+
+// UpstreamLimiter is a semaphore bounding in-flight queries to one upstream.
+// When it is full, freed slots go to the waiting clients in turn rather
+// than in arrival order, so a client with a burst of misses cannot starve
+// the others.
+type UpstreamLimiter struct {
+	mu       sync.Mutex
+	max      int
+	inFlight int
+	queues   map[string][]chan struct{} // waiters by client, oldest first
+	turns    []string                   // clients with waiters, next first
+	waiting  atomic.Int64
+}
+
+func NewUpstreamLimiter(max int) *UpstreamLimiter {
+	return &UpstreamLimiter{max: max, queues: make(map[string][]chan struct{})}
+}
+
+// Acquire blocks until client is granted a slot or ctx is done.
+func (l *UpstreamLimiter) Acquire(ctx context.Context, client string) error {
+	l.mu.Lock()
+	if l.inFlight < l.max && len(l.turns) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{})
+	if len(l.queues[client]) == 0 {
+		l.turns = append(l.turns, client)
+	}
+	l.queues[client] = append(l.queues[client], granted)
+	l.mu.Unlock()
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-granted:
+		// Granted while giving up: pass the slot on.
+		l.releaseLocked()
+	default:
+		l.dequeueLocked(client, granted)
+	}
+	return ctx.Err()
+}
+
+func (l *UpstreamLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked hands the freed slot to the oldest waiter of the client
+// whose turn it is, then moves that client to the back of the line.
+func (l *UpstreamLimiter) releaseLocked() {
+	if len(l.turns) == 0 {
+		l.inFlight--
+		return
+	}
+	client := l.turns[0]
+	l.turns = l.turns[1:]
+	queue := l.queues[client]
+	close(queue[0])
+	if len(queue) == 1 {
+		delete(l.queues, client)
+	} else {
+		l.queues[client] = queue[1:]
+		l.turns = append(l.turns, client)
+	}
+}
+
+func (l *UpstreamLimiter) dequeueLocked(client string, granted chan struct{}) {
+	queue := l.queues[client]
+	for i, ch := range queue {
+		if ch == granted {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.queues[client] = queue
+		return
+	}
+	delete(l.queues, client)
+	for i, name := range l.turns {
+		if name == client {
+			l.turns = append(l.turns[:i:i], l.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// InFlight is the number of slots taken.
+func (l *UpstreamLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// acquireInFlight takes one of the client's own upstream query slots, when
+// it has a limit, and counts the query as in flight.
+func (c *Client) acquireInFlight(ctx context.Context) error {
+	if c.inFlightSlots != nil {
+		select {
+		case c.inFlightSlots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.inFlight.Add(1)
+	return nil
+}
+
+func (c *Client) releaseInFlight() {
+	c.inFlight.Add(-1)
+	if c.inFlightSlots != nil {
+		<-c.inFlightSlots
+	}
+}
+
+// upstreamLimiters holds one limiter per upstream address.
+var upstreamLimiters = struct {
+	sync.Mutex
+	max    int
+	byAddr map[string]*UpstreamLimiter
+}{max: DefaultUpstreamMaxInFlight, byAddr: make(map[string]*UpstreamLimiter)}
+
+func upstreamLimiter(upstream string) *UpstreamLimiter {
+	upstreamLimiters.Lock()
+	defer upstreamLimiters.Unlock()
+	l, ok := upstreamLimiters.byAddr[upstream]
+	if !ok {
+		l = NewUpstreamLimiter(upstreamLimiters.max)
+		upstreamLimiters.byAddr[upstream] = l
+	}
+	return l
+}
+
+// Resolution failures, matched with errors.Is. Errors from upstreams wrap
+// one of these along with the details.
+var (
+	ErrNXDomain        = errors.New("name does not exist")
+	ErrNoData          = errors.New("no records of the requested type")
+	ErrUpstreamTimeout = errors.New("upstream timed out")
+	ErrUpstreamRefused = errors.New("upstream refused the query")
+	ErrServFail        = errors.New("upstream failed to answer")
+)
+
+// RcodeError is returned when an upstream answers with an error rcode. It
+// matches the sentinel error for that rcode.
+type RcodeError struct {
+	Rcode int
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("DNS query failed with Rcode %d", e.Rcode)
+}
+
+func (e *RcodeError) Is(target error) bool {
+	switch e.Rcode {
+	case dns.RcodeNameError:
+		return target == ErrNXDomain
+	case dns.RcodeRefused:
+		return target == ErrUpstreamRefused
+	}
+	return target == ErrServFail
+}
+
+// timeoutError marks err as ErrUpstreamTimeout if it is a network or
+// context timeout.
+func timeoutError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+	}
+	return err
+}
+
+// minimizeResponse strips the authority and additional sections, keeping
+// only the answer section, like BIND's minimal-responses. The SOA of a
+// negative answer is kept since it carries the negative-caching TTL.
+func minimizeResponse(r *dns.Msg) {
+	var ns []dns.RR
+	if r.Rcode == dns.RcodeNameError || len(r.Answer) == 0 {
+		for _, rr := range r.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				ns = append(ns, rr)
+			}
+		}
+	}
+	r.Ns = ns
+
+	// Keep the OPT pseudo-record; it is not part of the additional data.
+	var extra []dns.RR
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	r.Extra = extra
+}
+
+// responseFromAnswer builds the cache entry for an upstream answer. The whole
+// answer section is kept, so CNAMEs leading to the requested type are served
+// along with it; the TTL is the lowest TTL of the requested RRset and of
+// the aliases leading to it.
+func (c *Client) responseFromAnswer(r *dns.Msg, domain string, qtype uint16) (DNSResponse, error) {
+	response := DNSResponse{Records: r.Answer, Timestamp: time.Now()}
+	found := false
+	// The RRset expires as a whole, at the shortest TTL among its records
+	// (RFC 2181 section 5.2 requires them to match, but not every server
+	// gets that right).
+	var ttl uint32
+	for _, answer := range r.Answer {
+		if answer.Header().Rrtype != qtype && qtype != dns.TypeANY {
+			continue
+		}
+		if !found || answer.Header().Ttl < ttl {
+			ttl = answer.Header().Ttl
+		}
+		found = true
+		switch rr := answer.(type) {
+		case *dns.A:
+			if response.IPAddress == "" {
+				response.IPAddress = rr.A.String()
+			}
+		case *dns.AAAA:
+			if response.IPAddress == "" {
+				response.IPAddress = rr.AAAA.String()
+			}
+		}
+	}
+	if !found {
+		return DNSResponse{}, fmt.Errorf("%w: no %s record for %s", ErrNoData, dns.Type(qtype), domain)
+	}
+	// The chain is only as fresh as its shortest-lived link: serving the
+	// target's records after an alias to them expired would keep a stale
+	// alias alive.
+	if chain, ok := aliasTTL(r.Answer, qtype); ok && chain < ttl {
+		ttl = chain
+	}
+	response.TTL = c.TTLPolicy.Apply(qtype, time.Duration(ttl)*time.Second)
+	c.keepSections(&response, r)
+	return response, nil
+}
+
+// keepSections copies the authority and additional sections of r into
+// response when c caches all sections. The OPT record is per message and
+// is left out.
+func (c *Client) keepSections(response *DNSResponse, r *dns.Msg) {
+	if !c.AllSections {
+		return
+	}
+	response.Authority = append([]dns.RR(nil), r.Ns...)
+	response.Additional = nil
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			response.Additional = append(response.Additional, rr)
+		}
+	}
+}
+
+// answerResponse is responseFromAnswer for queryDNSResolver: when the answer
+// is only a CNAME chain, the name it ends at is resolved in turn and its
+// records appended, up to MaxCNAMEDepth links.
+func (c *Client) answerResponse(ctx context.Context, r *dns.Msg, domain string, qtype uint16) (DNSResponse, error) {
+	response, err := c.responseFromAnswer(r, domain, qtype)
+	if err == nil || qtype == dns.TypeCNAME {
+		return response, err
+	}
+	target, loopErr := cnameTarget(r.Answer, domain)
+	if loopErr != nil {
+		return DNSResponse{}, loopErr
+	}
+	if target == "" {
+		if r.Rcode == dns.RcodeSuccess {
+			return c.noDataResponse(r, qtype), nil
+		}
+		// The iterative resolver hands back NXDOMAIN answers as they are.
+		return DNSResponse{}, &RcodeError{Rcode: r.Rcode}
+	}
+	chain := append(cnameChain(ctx), dns.CanonicalName(domain))
+	for _, name := range chain {
+		if name == target {
+			fmt.Printf("CNAME loop: %s -> %s\n", strings.Join(chain, " -> "), target)
+			return DNSResponse{}, fmt.Errorf("CNAME loop at %s", target)
+		}
+	}
+	if len(chain) > c.MaxCNAMEDepth {
+		fmt.Printf("CNAME chain too long: %s -> %s\n", strings.Join(chain, " -> "), target)
+		return DNSResponse{}, fmt.Errorf("CNAME chain from %s longer than %d", chain[0], c.MaxCNAMEDepth)
+	}
+	final, err := c.queryDNSResolver(withCNAMEChain(ctx, chain), target, qtype)
+	if err != nil {
+		return DNSResponse{}, err
+	}
+	final.Records = append(append([]dns.RR(nil), r.Answer...), final.Records...)
+	if chain, ok := aliasTTL(r.Answer, qtype); ok {
+		final.TTL = min(final.TTL, c.TTLPolicy.Apply(qtype, time.Duration(chain)*time.Second))
+	}
+	return final, nil
+}
+
+// aliasTTL is the lowest TTL of the CNAMEs and DNAMEs in answer, which a
+// flattened chain must not outlive. It reports false if there are none or
+// qtype asks for the aliases themselves.
+func aliasTTL(answer []dns.RR, qtype uint16) (uint32, bool) {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeDNAME || qtype == dns.TypeANY {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for _, rr := range answer {
+		if t := rr.Header().Rrtype; t != dns.TypeCNAME && t != dns.TypeDNAME {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		found = true
+	}
+	return ttl, found
+}
+
+// noDataResponse builds the cache entry for a NODATA answer: the name
+// exists but has no records of qtype. It is cached for the negative TTL of
+// RFC 2308, the lower of the SOA's own TTL and its MINIMUM field; without
+// an SOA there is nothing to bound it by and only min_ttl applies.
+func (c *Client) noDataResponse(r *dns.Msg, qtype uint16) DNSResponse {
+	response := DNSResponse{Records: r.Answer, Timestamp: time.Now()}
+	var ttl uint32
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			response.Authority = []dns.RR{soa}
+			break
+		}
+	}
+	response.TTL = c.TTLPolicy.Apply(qtype, time.Duration(ttl)*time.Second)
+	c.keepSections(&response, r)
+	return response
+}
+
+// cnameTarget follows the CNAMEs in answer starting at domain and returns
+// the name the chain ends at, or "" if domain is not an alias. A chain that
+// loops within the answer itself is an error.
+func cnameTarget(answer []dns.RR, domain string) (string, error) {
+	name := dns.CanonicalName(domain)
+	seen := map[string]bool{name: true}
+	for {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == name {
+				next = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+		if next == "" {
+			if name == dns.CanonicalName(domain) {
+				return "", nil
+			}
+			return name, nil
+		}
+		if seen[next] {
+			fmt.Printf("CNAME loop in answer for %s at %s\n", domain, next)
+			return "", fmt.Errorf("CNAME loop at %s", next)
+		}
+		seen[next] = true
+		name = next
+	}
+}
+
+// querySystemResolver is the last resort used when every upstream failed. It
+// only handles address queries.
+func (c *Client) querySystemResolver(ctx context.Context, domain string, qtype uint16) (string, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "", fmt.Errorf("%w: system resolver: %v", ErrNXDomain, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve domain %s: %w", domain, timeoutError(err))
+	}
+
+	// Return the first address of the family that was asked for
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || (parsed.To4() != nil) != (qtype == dns.TypeA) {
+			continue
+		}
+		fmt.Printf("queryDNSResolver: system resolver response: %s\n", ip)
+		return ip, nil
+	}
+
+	return "", fmt.Errorf("%w: no %s record for %s from the system resolver", ErrNoData, dns.Type(qtype), domain)
+}
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16
+)
+
+// CookieJar issues and validates DNS server cookies (RFC 7873).
+type CookieJar struct {
+	Secret []byte
+}
+
+func NewCookieJar(secret string) (*CookieJar, error) {
+	if secret != "" {
+		return &CookieJar{Secret: []byte(secret)}, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie secret: %v", err)
+	}
+	return &CookieJar{Secret: key}, nil
+}
+
+// ServerCookie derives the server cookie for a client cookie and source IP.
+func (j *CookieJar) ServerCookie(clientCookie []byte, ip net.IP) []byte {
+	mac := hmac.New(sha256.New, j.Secret)
+	mac.Write(clientCookie)
+	mac.Write(ip)
+	return mac.Sum(nil)[:serverCookieLen]
+}
+
+// Check inspects the COOKIE option of a query. It returns the option to echo
+// in the reply (nil when the client sent none) and the rcode to answer with:
+// FORMERR for a malformed cookie, BADCOOKIE for a server cookie we did not
+// issue, and NOERROR otherwise.
+func (j *CookieJar) Check(r *dns.Msg, remote net.Addr) (*dns.EDNS0_COOKIE, int) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, dns.RcodeSuccess
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		// A client cookie alone is 8 bytes; with a server cookie it is 16-40.
+		raw, err := hex.DecodeString(cookie.Cookie)
+		if err != nil || !(len(raw) == clientCookieLen || (len(raw) >= 16 && len(raw) <= 40)) {
+			return nil, dns.RcodeFormatError
+		}
+
+		clientCookie := raw[:clientCookieLen]
+		expected := j.ServerCookie(clientCookie, remoteIP(remote))
+		reply := &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(append(append([]byte{}, clientCookie...), expected...)),
+		}
+		if len(raw) > clientCookieLen && !hmac.Equal(raw[clientCookieLen:], expected) {
+			// A stale or forged server cookie: hand out the right one and
+			// make the client retry with it.
+			return reply, dns.RcodeBadCookie
+		}
+		return reply, dns.RcodeSuccess
+	}
+	return nil, dns.RcodeSuccess
+}
+
+// setReplyEdns adds an OPT record to the reply when the query had one,
+// echoing the DO bit.
+func setReplyEdns(m *dns.Msg, r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil || m.IsEdns0() != nil {
+		return
+	}
+	m.SetEdns0(max(opt.UDPSize(), dns.MinMsgSize), opt.Do())
+}
+
+// stripDNSSEC removes signatures from an answer for clients that did not set
+// the DO bit (RFC 4035 section 3.2.1), unless they asked for them.
+func stripDNSSEC(answer []dns.RR, qtype uint16) []dns.RR {
+	if qtype == dns.TypeRRSIG || qtype == dns.TypeANY {
+		return answer
+	}
+	kept := answer[:0]
+	for _, rr := range answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// extendedError explains an unusual answer with an Extended DNS Error
+// (RFC 8914): stale and made-up answers, and SERVFAILs whose cause is
+// known. It returns nil when there is nothing to add.
+func extendedError(result QueryResult, err error) *dns.EDNS0_EDE {
+	switch {
+	case result.Source == SourceStale:
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer}
+	case result.Source == SourceFallback:
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeForgedAnswer, ExtraText: "fallback_ip after resolution failed"}
+	case err == nil, errors.Is(err, ErrNXDomain), errors.Is(err, ErrNoData):
+		return nil
+	case errors.Is(err, ErrUpstreamTimeout):
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError, ExtraText: ErrUpstreamTimeout.Error()}
+	case errors.Is(err, ErrUpstreamRefused):
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: ErrUpstreamRefused.Error()}
+	case errors.Is(err, ErrServFail):
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: ErrServFail.Error()}
+	}
+	return nil
+}
+
+// attachExtendedError adds ede to m if the query used EDNS, which clients
+// that understand EDE always do.
+func attachExtendedError(m *dns.Msg, r *dns.Msg, ede *dns.EDNS0_EDE) {
+	if ede == nil || r.IsEdns0() == nil {
+		return
+	}
+	setReplyEdns(m, r)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, ede)
+}
+
+// attachCookie echoes the client cookie and our server cookie in the reply.
+func attachCookie(m *dns.Msg, r *dns.Msg, cookie *dns.EDNS0_COOKIE) {
+	if cookie == nil {
+		return
+	}
+	udpSize := uint16(dns.MinMsgSize)
+	if opt := r.IsEdns0(); opt != nil {
+		udpSize = opt.UDPSize()
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(udpSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, cookie)
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// newAddressRecord builds an A or AAAA record for name, failing if ip is not
+// an address of the matching family.
+func newAddressRecord(name string, qtype uint16, ip string, ttl time.Duration) (dns.RR, error) {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid domain name %q", name)
+	}
+	hdr := dns.RR_Header{
+		Name:   dns.Fqdn(name),
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl / time.Second),
+	}
+	parsed := net.ParseIP(ip)
+	switch {
+	case qtype == dns.TypeA && parsed.To4() != nil:
+		return &dns.A{Hdr: hdr, A: parsed.To4()}, nil
+	case qtype == dns.TypeAAAA && parsed != nil && parsed.To4() == nil:
+		return &dns.AAAA{Hdr: hdr, AAAA: parsed}, nil
+	}
+	return nil, fmt.Errorf("invalid %s address %q for %s", dns.Type(qtype), ip, name)
+}
+
+type ClientStats struct {
+	ID           string            `json:"id"`
+	View         string            `json:"view,omitempty"`
+	Group        string            `json:"group"`
+	CacheEntries int               `json:"cache_entries"`
+	Breakers     map[string]string `json:"breakers"`
+	History      []HistoryPoint    `json:"history"`
+	// HitRatioEWMA is the smoothed hit ratio; see HitRatioAlpha.
+	HitRatioEWMA float64 `json:"hit_ratio_ewma"`
+}
+
+func (c *Client) Stats() ClientStats {
+	c.Mutex.Lock()
+	entries := len(c.Cache)
+	c.Mutex.Unlock()
+
+	stats := ClientStats{ID: c.ID, CacheEntries: entries, Breakers: make(map[string]string), History: c.History.Snapshot(), HitRatioEWMA: c.History.HitRatio.Value()}
+	for upstream, state := range c.BreakerStates() {
+		stats.Breakers[upstream] = state.String()
+	}
+	if group := c.Group(); group != nil {
+		stats.Group = group.ID
+	}
+	return stats
+}
+
+// Clients returns every client across all groups.
+func (gm *GroupManager) Clients() []*Client {
+	gm.Mutex.Lock()
+	defer gm.Mutex.Unlock()
+
+	var clients []*Client
+	for _, group := range gm.Groups {
+		clients = append(clients, group.Clients...)
+	}
+	return clients
+}
+
+func (gm *GroupManager) Stats() []ClientStats {
+	var stats []ClientStats
+	for _, client := range gm.Clients() {
+		clientStats := client.Stats()
+		clientStats.View = gm.View
+		stats = append(stats, clientStats)
+	}
+	return stats
+}
+
+// clientsOf returns every client of the given group managers.
+func clientsOf(managers []*GroupManager) []*Client {
+	var clients []*Client
+	for _, gm := range managers {
+		clients = append(clients, gm.Clients()...)
+	}
+	return clients
+}
+
+// GroupStats sums the cache counters of a group's clients since startup.
+// A client moved by Rebalance takes its counts along.
+type GroupStats struct {
+	ID           string `json:"id"`
+	View         string `json:"view,omitempty"`
+	Clients      int    `json:"clients"`
+	CacheEntries int    `json:"cache_entries"`
+	Hits         uint64 `json:"hits"`
+	PeerHits     uint64 `json:"peer_hits"`
+	Misses       uint64 `json:"misses"`
+	// HitRatio is the share of lookups answered by the group's caches,
+	// and PeerHitRatio the share of local misses a peer could answer,
+	// which shows how well the group shares.
+	HitRatio     float64 `json:"hit_ratio"`
+	PeerHitRatio float64 `json:"peer_hit_ratio"`
+	// HitRatioEWMA is the group's smoothed hit ratio, which reacts to a
+	// drop within a few hundred lookups where HitRatio takes far longer.
+	HitRatioEWMA float64 `json:"hit_ratio_ewma"`
+}
+
+// AggregateStats sums the stats of the group's clients.
+func (g *Group) AggregateStats() GroupStats {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	stats := GroupStats{ID: g.ID, Clients: len(g.Clients), HitRatioEWMA: g.HitRatio.Value()}
+	for _, client := range g.Clients {
+		hits, peerHits, misses := client.History.Totals()
+		stats.Hits += hits
+		stats.PeerHits += peerHits
+		stats.Misses += misses
+		client.Mutex.Lock()
+		stats.CacheEntries += len(client.Cache)
+		client.Mutex.Unlock()
+	}
+	if lookups := stats.Hits + stats.PeerHits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits+stats.PeerHits) / float64(lookups)
+	}
+	if localMisses := stats.PeerHits + stats.Misses; localMisses > 0 {
+		stats.PeerHitRatio = float64(stats.PeerHits) / float64(localMisses)
+	}
+	return stats
+}
+
+// AggregateStats returns the aggregate stats of every group.
+func (gm *GroupManager) AggregateStats() []GroupStats {
+	gm.Mutex.Lock()
+	groups := append([]*Group(nil), gm.Groups...)
+	gm.Mutex.Unlock()
+
+	stats := make([]GroupStats, 0, len(groups))
+	for _, group := range groups {
+		groupStats := group.AggregateStats()
+		groupStats.View = gm.View
+		stats = append(stats, groupStats)
+	}
+	return stats
+}
+
+// The admin API's /metrics serves the Prometheus text exposition format.
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, braces(labels), h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+// HistogramVec is a family of histograms with the same bounds, one per label
+// set.
+type HistogramVec struct {
+	Name   string
+	Help   string
+	bounds []float64
+	mu     sync.Mutex
+	series map[string]*Histogram
+}
+
+func NewHistogramVec(name string, help string, bounds []float64) *HistogramVec {
+	return &HistogramVec{Name: name, Help: help, bounds: bounds, series: make(map[string]*Histogram)}
+}
+
+// With returns the histogram for a label set built by labels.
+func (v *HistogramVec) With(labels string) *Histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[labels]
+	if !ok {
+		h = NewHistogram(v.bounds)
+		v.series[labels] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.Name, v.Help, v.Name)
+	v.mu.Lock()
+	keys := sortedKeys(v.series)
+	v.mu.Unlock()
+	for _, labels := range keys {
+		v.With(labels).write(w, v.Name, labels)
+	}
+}
+
+// CounterVec is a family of counters, one per label set.
+type CounterVec struct {
+	Name   string
+	Help   string
+	mu     sync.Mutex
+	series map[string]*atomic.Uint64
+}
+
+func NewCounterVec(name string, help string) *CounterVec {
+	return &CounterVec{Name: name, Help: help, series: make(map[string]*atomic.Uint64)}
+}
+
+// With returns the counter for a label set built by labels.
+func (v *CounterVec) With(labels string) *atomic.Uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.series[labels]
+	if !ok {
+		c = new(atomic.Uint64)
+		v.series[labels] = c
+	}
+	return c
+}
+
+func (v *CounterVec) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.Name, v.Help, v.Name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, labels := range sortedKeys(v.series) {
+		fmt.Fprintf(w, "%s%s %d\n", v.Name, braces(labels), v.series[labels].Load())
+	}
+}
+
+// writeGauges writes a gauge family whose values are keyed by label set.
+func writeGauges(w io.Writer, name string, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %g\n", name, braces(labels), values[labels])
+	}
+}
+
+// labels formats name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	prefetchTotal      = NewCounterVec("dns_prefetch_total", "Background refreshes of entries close to expiry.")
+	gossipTotal        = NewCounterVec("dns_gossip_total", "Entries pushed to group peers.")
+	mirrorTotal        = NewCounterVec("dns_mirror_total", "Cache writes streamed to the standby, by result.")
+	partitionEvictions = NewCounterVec("dns_cache_partition_evictions_total", "Entries evicted because their record type's partition was full.")
+	staleServedTotal   = NewCounterVec("dns_stale_served_total", "Expired entries served because resolution failed or was slow.")
+	peerTimeouts       = NewCounterVec("dns_peer_timeouts_total", "Peer cache lookups abandoned after peer_timeout.")
+	upstreamReconnects = NewCounterVec("dns_upstream_reconnects_total", "Dropped DoT and DoH connections re-dialed to retry a query.")
+	macFailures        = NewCounterVec("dns_cache_mac_failures_total", "Cache entries discarded because their MAC did not verify, by where they came from.")
+	aclRefused         = NewCounterVec("dns_acl_refused_total", "Queries from sources not allowed by allow_query/deny_query, by whether they were refused or dropped.")
+	debugLogDropped    = NewCounterVec("dns_debug_log_dropped_total", "Debug log lines dropped by debug_log_rate.")
+	dedupedTotal       = NewCounterVec("dns_resolutions_deduplicated_total", "Cache misses served by another query's resolution, in flight or just completed (recent).")
+	securityEvents     = NewCounterVec("dns_security_events_total", "Bad answers by what was wrong (0x20, mac), and names quarantined after repeated ones (quarantine).")
+)
+
+// cacheTTLBuckets are in seconds and span short-lived answers to a day.
+var cacheTTLBuckets = []float64{1, 5, 10, 30, 60, 300, 900, 3600, 21600, 86400}
+
+// latencyBuckets, in seconds, span cache hits (well under a millisecond)
+// to upstreams timing out.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+var (
+	upstreamDuration    = NewHistogramVec("dns_upstream_query_duration_seconds", "Time taken by each upstream query, including failures.", latencyBuckets)
+	requestDuration     = NewHistogramVec("dns_request_duration_seconds", "Time taken to handle a client query.", latencyBuckets)
+	cacheLookupDuration = NewHistogramVec("dns_cache_lookup_duration_seconds", "Time taken to look a query up in a client's own cache.", latencyBuckets)
+)
+
+// cacheDistribution is a point-in-time breakdown of every client's cache.
+type cacheDistribution struct {
+	RemainingTTL *HistogramVec
+	Age          *HistogramVec
+	Entries      map[string]float64
+}
+
+var latestCacheDistribution atomic.Pointer[cacheDistribution]
+
+// computeCacheDistribution buckets cached entries by remaining TTL and age,
+// and counts them by record type. Each client's lock is only held while its
+// entries are copied out.
+func computeCacheDistribution(managers []*GroupManager) *cacheDistribution {
+	d := &cacheDistribution{
+		RemainingTTL: NewHistogramVec("dns_cache_entry_remaining_ttl_seconds", "Remaining TTL of cached entries.", cacheTTLBuckets),
+		Age:          NewHistogramVec("dns_cache_entry_age_seconds", "Time since cached entries were stored.", cacheTTLBuckets),
+		Entries:      make(map[string]float64),
+	}
+	now := time.Now()
+	type entry struct {
+		qtype   uint16
+		stored  time.Time
+		expires time.Time
+	}
+	for _, client := range clientsOf(managers) {
+		client.Mutex.Lock()
+		entries := make([]entry, 0, len(client.Cache))
+		for key, response := range client.Cache {
+			_, qtype := splitCacheKey(key)
+			entries = append(entries, entry{qtype: qtype, stored: response.Timestamp, expires: response.ExpiresAt()})
+		}
+		client.Mutex.Unlock()
+
+		clientLabels := labels("client", client.ID)
+		remaining := d.RemainingTTL.With(clientLabels)
+		age := d.Age.With(clientLabels)
+		for _, e := range entries {
+			remaining.Observe(max(e.expires.Sub(now).Seconds(), 0))
+			age.Observe(now.Sub(e.stored).Seconds())
+			d.Entries[labels("client", client.ID, "type", dns.Type(e.qtype).String())]++
+		}
+	}
+	return d
+}
+
+func startCacheDistribution(managers []*GroupManager, interval time.Duration) {
+	latestCacheDistribution.Store(computeCacheDistribution(managers))
+	go func() {
+		for range time.Tick(interval) {
+			latestCacheDistribution.Store(computeCacheDistribution(managers))
+		}
+	}()
+}
+
+// writeMetrics writes every metric in the Prometheus text format, for the
+// clients of all the given group managers.
+func writeMetrics(w io.Writer, managers []*GroupManager) {
+	clients := clientsOf(managers)
+	prefetchTotal.Write(w)
+	gossipTotal.Write(w)
+	mirrorTotal.Write(w)
+	staleServedTotal.Write(w)
+	peerTimeouts.Write(w)
+	macFailures.Write(w)
+	securityEvents.Write(w)
+	dedupedTotal.Write(w)
+	debugLogDropped.Write(w)
+	aclRefused.Write(w)
+	upstreamReconnects.Write(w)
+	partitionEvictions.Write(w)
+	upstreamDuration.Write(w)
+	requestDuration.Write(w)
+	cacheLookupDuration.Write(w)
+	partitions := make(map[string]float64)
+	for _, client := range clients {
+		client.Mutex.Lock()
+		if client.Partitions != nil {
+			for qtype, size := range client.Partitions.Sizes() {
+				partitions[labels("client", client.ID, "type", dns.Type(qtype).String())] = float64(size)
+			}
+		}
+		client.Mutex.Unlock()
+	}
+	writeGauges(w, "dns_cache_partition_entries", "Entries in each record type's cache partition.", partitions)
+	breakers := make(map[string]float64)
+	for _, client := range clients {
+		for upstream, state := range client.BreakerStates() {
+			breakers[labels("client", client.ID, "upstream", upstream)] = float64(state)
+		}
+	}
+	inFlight := make(map[string]float64)
+	queued := make(map[string]float64)
+	upstreamLimiters.Lock()
+	for upstream, l := range upstreamLimiters.byAddr {
+		inFlight[labels("upstream", upstream)] = float64(l.InFlight())
+		queued[labels("upstream", upstream)] = float64(l.waiting.Load())
+	}
+	upstreamLimiters.Unlock()
+	writeGauges(w, "dns_upstream_inflight", "Queries outstanding to each upstream.", inFlight)
+	writeGauges(w, "dns_upstream_queue_depth", "Queries waiting for a free slot to each upstream.", queued)
+	clientInFlight := make(map[string]float64)
+	for _, client := range clients {
+		clientInFlight[labels("client", client.ID)] = float64(client.inFlight.Load())
+	}
+	writeGauges(w, "dns_client_upstream_inflight", "Upstream queries outstanding for each client.", clientInFlight)
+	writeGauges(w, "dns_tcp_connections_open", "Open TCP client connections.", map[string]float64{"": float64(tcpConnections.Load())})
+	tcpRejected.Write(w)
+	lookups := make(map[string]float64)
+	hitRatios := make(map[string]float64)
+	groupEWMAs := make(map[string]float64)
+	for _, gm := range managers {
+		// Group IDs repeat across views, so the view tells them apart.
+		for _, group := range gm.AggregateStats() {
+			groupEWMAs[labels("view", group.View, "group", group.ID)] = group.HitRatioEWMA
+			lookups[labels("view", group.View, "group", group.ID, "result", "hit")] = float64(group.Hits)
+			lookups[labels("view", group.View, "group", group.ID, "result", "peer_hit")] = float64(group.PeerHits)
+			lookups[labels("view", group.View, "group", group.ID, "result", "miss")] = float64(group.Misses)
+			hitRatios[labels("view", group.View, "group", group.ID)] = group.HitRatio
+		}
+	}
+	// Gauges, not counters: a group's sums drop when Rebalance moves a
+	// client out of it.
+	writeGauges(w, "dns_group_cache_lookups", "Cache lookups of each group's clients since startup, by result.", lookups)
+	writeGauges(w, "dns_group_hit_ratio", "Share of each group's lookups answered by its caches.", hitRatios)
+	writeGauges(w, "dns_group_hit_ratio_ewma", "Moving average of each group's hit ratio over roughly its last 100 lookups.", groupEWMAs)
+	clientEWMAs := make(map[string]float64)
+	for _, client := range clients {
+		clientEWMAs[labels("client", client.ID)] = client.History.HitRatio.Value()
+	}
+	writeGauges(w, "dns_client_hit_ratio_ewma", "Moving average of each client's hit ratio over roughly its last 100 lookups.", clientEWMAs)
+	writeGauges(w, "dns_upstream_breaker_state", "Upstream circuit breaker state (0 closed, 1 open, 2 half-open).", breakers)
+	if d := latestCacheDistribution.Load(); d != nil {
+		d.RemainingTTL.Write(w)
+		d.Age.Write(w)
+		writeGauges(w, "dns_cache_entries", "Cached entries by client and record type.", d.Entries)
+	}
+}
+
+// logLevel is the level of logger, changed at runtime through /loglevel.
+var logLevel = new(slog.LevelVar)
+
+// logger writes the per-query traces, at debug level; the rest of the
+// server prints its messages directly. Debug lines are rate limited so a
+// busy server does not drown in them while an operator has them on.
+var logger = slog.New(&rateLimitedHandler{
+	Handler: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}),
+	limiter: &logRateLimiter{},
+})
+
+// DefaultDebugLogRate is how many debug lines a second are written.
+const DefaultDebugLogRate = 200
+
+// logRateLimiter admits at most PerSecond lines each second; a limit of
+// zero or less admits everything.
+type logRateLimiter struct {
+	PerSecond atomic.Int64
+
+	mu      sync.Mutex
+	second  time.Time
+	count   int64
+	dropped int64
+}
+
+func (l *logRateLimiter) allow() bool {
+	limit := l.PerSecond.Load()
+	if limit <= 0 {
+		return true
+	}
+	now := time.Now().Truncate(time.Second)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !now.Equal(l.second) {
+		if l.dropped > 0 {
+			fmt.Printf("Dropped %d debug log lines over debug_log_rate (%d a second)\n", l.dropped, limit)
+		}
+		l.second, l.count, l.dropped = now, 0, 0
+	}
+	if l.count >= limit {
+		l.dropped++
+		debugLogDropped.With("").Add(1)
+		return false
+	}
+	l.count++
+	return true
+}
+
+// rateLimitedHandler passes records below info level through limiter.
+type rateLimitedHandler struct {
+	slog.Handler
+	limiter *logRateLimiter
+}
+
+func (h *rateLimitedHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelInfo && !h.limiter.allow() {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *rateLimitedHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &rateLimitedHandler{Handler: h.Handler.WithAttrs(attrs), limiter: h.limiter}
+}
+
+func (h *rateLimitedHandler) WithGroup(name string) slog.Handler {
+	return &rateLimitedHandler{Handler: h.Handler.WithGroup(name), limiter: h.limiter}
+}
+
+// setDebugLogRate sets how many debug lines a second logger writes.
+func setDebugLogRate(perSecond int) {
+	logger.Handler().(*rateLimitedHandler).limiter.PerSecond.Store(int64(perSecond))
+}
+
+// serveLogLevel reports the log level on GET and changes it on POST, from
+// a body such as {"level":"debug"}.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&body); err != nil {
+			http.Error(w, "bad body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if old := logLevel.Level(); old != level {
+			fmt.Printf("Log level changed from %s to %s by %s\n", old, level, r.RemoteAddr)
+		}
+		logLevel.Set(level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logLevel.Level().String()})
+}
+
+// startAdminServer serves the admin HTTP API on addr in the background.
+func startAdminServer(addr string, managers []*GroupManager, profiling bool) {
+	mux := adminMux(managers, profiling)
+	go func() {
+		fmt.Printf("Starting admin API on %s\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("Admin API stopped: %s\n", err.Error())
+		}
+	}()
+}
+
+// adminMux routes the admin API for the default groups and those of every
+// view, managers[0] being the default ones.
+func adminMux(managers []*GroupManager, profiling bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	if profiling {
+		// Registered on the admin mux rather than http.DefaultServeMux, so
+		// the profiles are reachable only where the admin API is.
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := []ClientStats{}
+		for _, gm := range managers {
+			stats = append(stats, gm.Stats()...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	mux.HandleFunc("/stats/groups", func(w http.ResponseWriter, r *http.Request) {
+		stats := []GroupStats{}
+		for _, gm := range managers {
+			stats = append(stats, gm.AggregateStats()...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		// Losing persistence degrades the server but it still answers, so
+		// this stays 200 and reports which caches are memory-only.
+		health := struct {
+			Status           string   `json:"status"`
+			MemoryOnlyCaches []string `json:"memory_only_caches,omitempty"`
+		}{Status: "ok"}
+		for _, client := range clientsOf(managers) {
+			if !client.PersistenceHealthy() {
+				health.Status = "degraded"
+				health.MemoryOnlyCaches = append(health.MemoryOnlyCaches, client.ID)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(health)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		// Ready once the listeners are up, which with min_ready_clients
+		// waits for enough clients to reach an upstream.
+		if !serving.Load() {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+	})
+	mux.HandleFunc("/loglevel", serveLogLevel)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, managers)
+	})
+
+	mux.HandleFunc("/groups/rebalance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		moved := 0
+		groups := make(map[string][]string)
+		for _, gm := range managers {
+			moved += gm.Rebalance()
+			gm.Mutex.Lock()
+			for _, group := range gm.Groups {
+				// Groups of a view are listed as view/group.
+				id := group.ID
+				if gm.View != "" {
+					id = gm.View + "/" + id
+				}
+				groups[id] = []string{}
+				for _, client := range group.Clients {
+					groups[id] = append(groups[id], client.ID)
+				}
+			}
+			gm.Mutex.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Moved  int                 `json:"moved"`
+			Groups map[string][]string `json:"groups"`
+		}{moved, groups})
+	})
+
+	mux.HandleFunc("/cache/lookup", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		// type=ALL lists every type cached for the name.
+		qtype := dns.TypeA
+		all := false
+		if t := strings.ToUpper(r.URL.Query().Get("type")); t == "ALL" {
+			all = true
+		} else if t != "" {
+			var ok bool
+			if qtype, ok = dns.StringToType[t]; !ok {
+				http.Error(w, "unknown type", http.StatusBadRequest)
+				return
+			}
+		}
+		type entry struct {
+			Client       string   `json:"client"`
+			Type         string   `json:"type"`
+			Fresh        bool     `json:"fresh"`
+			RemainingTTL uint32   `json:"remaining_ttl"`
+			Records      []string `json:"records"`
+		}
+		entries := []entry{}
+		for _, client := range clientsOf(managers) {
+			found := map[uint16]DNSResponse{}
+			if all {
+				found = client.GetAllTypes(name)
+			} else if response, ok := client.Peek(name, qtype); ok {
+				found[qtype] = response
+			}
+			types := make([]uint16, 0, len(found))
+			for t := range found {
+				types = append(types, t)
+			}
+			sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+			for _, t := range types {
+				response := found[t]
+				e := entry{Client: client.ID, Type: dns.Type(t).String(), Fresh: response.Fresh(), RemainingTTL: response.RemainingTTL()}
+				for _, rr := range response.Records {
+					e.Records = append(e.Records, rr.String())
+				}
+				entries = append(entries, e)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+	return mux
+}
+
+// Handler answers DNS queries: from the local zone when one is configured,
+// otherwise through the client owning the queried name.
+type Handler struct {
+	// Groups and Zone form the default view, used by queries that match
+	// none of Views.
+	Groups *GroupManager
+	Zone   *Zone
+	Views  []*View
+	Chaos  *ChaosConfig // nil unless fault injection is enabled
+	// SpecialUse answers RFC 6761 names locally, after any local zone had
+	// the chance to.
+	SpecialUse  bool
+	Cookies     *CookieJar
+	MaxHops     int
+	AnswerOrder string
+	// MaxNameLength and MaxLabels bound query names.
+	MaxNameLength int
+	MaxLabels     int
+	// ACL refuses queries from sources not allowed; nil allows all.
+	ACL *ACL
+	// PaddingBlock pads responses sent over TLS to padded queries to a
+	// multiple of this many bytes; 0 disables padding.
+	PaddingBlock int
+	// HealthCheckName is answered with HealthCheckAnswer without resolving.
+	HealthCheckName   string
+	HealthCheckAnswer string
+	// Compress turns on name compression in replies.
+	Compress bool
+	// QueryTimeout bounds all the work done for one query.
+	QueryTimeout time.Duration
+	QueryLog     *QueryLog // nil when query_log is not set
+	// Blocklist answers blocked names before they reach a client; nil
+	// when nothing is blocked.
+	Blocklist *Blocklist
+	// SyntheticSOA is added to negative answers without an SOA; nil adds
+	// nothing.
+	SyntheticSOA *dns.SOA
+}
+
+// checkQuery validates an incoming query before any work is done for it and
+// returns the rcode to reject it with, or NOERROR if it may proceed.
+func checkQuery(r *dns.Msg) int {
+	if r.Response || r.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented
+	}
+	// Only one question per query is supported, as by nearly every server.
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	q := r.Question[0]
+	if len(q.Name) > 255 {
+		return dns.RcodeFormatError
+	}
+	if _, ok := dns.IsDomainName(q.Name); !ok {
+		return dns.RcodeFormatError
+	}
+	if q.Qclass != dns.ClassINET {
+		return dns.RcodeNotImplemented
+	}
+	return dns.RcodeSuccess
+}
+
+// nameOverLimits says how name, a valid domain name, exceeds maxLength
+// octets in wire form or maxLabels labels, or returns "" if it does not.
+func nameOverLimits(name string, maxLength int, maxLabels int) string {
+	buf := make([]byte, DefaultMaxNameLength+1)
+	length, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return fmt.Sprintf("name does not pack: %v", err)
+	}
+	if length > maxLength {
+		return fmt.Sprintf("name of %d octets is over max_name_length %d", length, maxLength)
+	}
+	if labels := dns.CountLabel(name); labels > maxLabels {
+		return fmt.Sprintf("name of %d labels is over max_labels %d", labels, maxLabels)
+	}
+	return ""
+}
+
+// Inject applies the configured faults to a query. It reports true if the
+// query was dropped or answered and must not be handled further.
+func (c *ChaosConfig) Inject(w dns.ResponseWriter, r *dns.Msg) bool {
+	if mathrand.Float64() < c.DelayProbability {
+		fmt.Printf("Chaos: delaying %s by %s\n", r.Question[0].Name, c.Delay)
+		time.Sleep(c.Delay)
+	}
+	if mathrand.Float64() < c.DropProbability {
+		fmt.Printf("Chaos: dropping %s\n", r.Question[0].Name)
+		return true
+	}
+	if mathrand.Float64() < c.ServfailProbability {
+		fmt.Printf("Chaos: failing %s\n", r.Question[0].Name)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return true
+	}
+	return false
+}
+
+// QueryLog appends one line per query to a file, for operators and for
+// warming the cache at the next start.
+type QueryLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenQueryLog(path string) (*QueryLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryLog{file: file}, nil
+}
+
+// Record logs a query. It is a no-op on a nil QueryLog.
+func (l *QueryLog) Record(remote net.Addr, q dns.Question, rcode int, source string) {
+	if l == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s %s %s %s\n", time.Now().UTC().Format(time.RFC3339), remoteIP(remote),
+		q.Name, dns.Type(q.Qtype), dns.RcodeToString[rcode], source)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.WriteString(line); err != nil {
+		fmt.Println("Error writing query log:", err)
+	}
+}
+
+// tailLines returns up to n lines from the end of the file at path,
+// reading it backwards so a large log is not read whole.
+func tailLines(path string, n int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const block = 64 << 10
+	var tail []byte
+	for offset := info.Size(); offset > 0 && bytes.Count(tail, []byte("\n")) <= n; {
+		size := int64(block)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+	}
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	if len(lines) > n {
+		// The first line may be cut short; it is beyond n anyway.
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// warmupQueries returns the top most frequent name and type pairs among
+// query log lines, most frequent first. Failed queries are skipped.
+func warmupQueries(lines []string, top int) []dns.Question {
+	counts := make(map[dns.Question]int)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != dns.RcodeToString[dns.RcodeSuccess] {
+			continue
+		}
+		qtype, ok := dns.StringToType[fields[3]]
+		if !ok {
+			continue
+		}
+		counts[dns.Question{Name: dns.Fqdn(fields[2]), Qtype: qtype, Qclass: dns.ClassINET}]++
+	}
+	questions := make([]dns.Question, 0, len(counts))
+	for q := range counts {
+		questions = append(questions, q)
+	}
+	sort.Slice(questions, func(i, j int) bool {
+		if counts[questions[i]] != counts[questions[j]] {
+			return counts[questions[i]] > counts[questions[j]]
+		}
+		return questions[i].String() < questions[j].String()
+	})
+	if len(questions) > top {
+		questions = questions[:top]
+	}
+	return questions
+}
+
+// serving is set once the DNS listeners are up; /readyz reports it.
+var serving atomic.Bool
+
+// Probe reports whether one of c's upstreams answers, by asking it for the
+// root's NS records.
+func (c *Client) Probe(ctx context.Context) error {
+	upstreams := c.upstreams()
+	if len(upstreams) == 0 {
+		return fmt.Errorf("no upstreams")
+	}
+	var lastErr error
+	for _, upstream := range upstreams {
+		if _, err := c.queryUpstream(ctx, upstream, ".", dns.TypeNS); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
 }
 
-type Group struct {
-	ID      string
-	Clients []*Client
-	Mutex   sync.Mutex
+// waitForReadyClients probes gm's clients until at least want of them
+// reached an upstream, giving up with an error after timeout.
+func waitForReadyClients(gm *GroupManager, want int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ready := make(map[*Client]bool)
+	for {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for _, client := range gm.Clients() {
+			if ready[client] {
+				continue
+			}
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), readyProbeInterval)
+				defer cancel()
+				if err := client.Probe(ctx); err != nil {
+					fmt.Printf("Readiness: client %s has no upstream answering yet: %v\n", client.ID, err)
+					return
+				}
+				mu.Lock()
+				ready[client] = true
+				mu.Unlock()
+			}(client)
+		}
+		wg.Wait()
+		if len(ready) >= want {
+			fmt.Printf("Readiness: %d of %d clients can reach an upstream\n", len(ready), len(gm.Clients()))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("only %d of the %d clients required reached an upstream within %s", len(ready), want, timeout)
+		}
+		time.Sleep(readyProbeInterval)
+	}
 }
 
-type GroupManager struct {
-	Groups []*Group
-	Mutex  sync.Mutex
+// warmup resolves questions through gm, a few at a time, until all are done
+// or timeout passes. Names cached already are left alone.
+func warmup(gm *GroupManager, questions []dns.Question, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	var warmed atomic.Int64
+	work := make(chan dns.Question)
+	for i := 0; i < warmupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range work {
+				client := gm.ClientForKey(q.Name)
+				if _, cached := client.Peek(q.Name, q.Qtype); cached {
+					continue
+				}
+				if _, err := client.QueryDNS(ctx, q.Name, q.Qtype); err == nil {
+					warmed.Add(1)
+				}
+			}
+		}()
+	}
+feed:
+	for _, q := range questions {
+		select {
+		case work <- q:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	fmt.Printf("Warmup: resolved %d of the %d most queried names in %s\n", warmed.Load(), len(questions), time.Since(start).Round(time.Millisecond))
 }
 
-type Config struct {
-	Clients []struct {
-		ID     string `toml:"id"`
-		Server string `toml:"server"`
-	} `toml:"clients"`
+// View is a split-horizon view: the zone and clients answering queries
+// from a set of source networks.
+type View struct {
+	Name     string
+	Networks []*net.IPNet
+	Groups   *GroupManager
+	Zone     *Zone
 }
 
-func NewClient(id string, server string) *Client {
-	cacheFile := fmt.Sprintf("%s_cache.json", id)
-	client := &Client{
-		ID:        id,
-		Cache:     make(map[string]DNSResponse),
-		Server:    server,
-		CacheFile: cacheFile,
+func NewView(config Config, viewConfig ViewConfig, codec CacheCodec) (*View, error) {
+	view := &View{Name: viewConfig.Name}
+	for _, cidr := range viewConfig.MatchClients {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		view.Networks = append(view.Networks, network)
 	}
-	client.loadCache()
-	return client
+	zone, err := loadZoneIfSet(viewConfig.ZoneFile, viewConfig.ZoneOrigin)
+	if err != nil {
+		return nil, err
+	}
+	view.Zone = zone
+	// The shared cache holds default-view answers, so views do without it.
+	view.Groups = newGroupManager(config, viewConfig.Clients, codec, nil)
+	view.Groups.View = view.Name
+	return view, nil
 }
 
-func (c *Client) loadCache() {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+func (v *View) Matches(ip net.IP) bool {
+	for _, network := range v.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	if _, err := os.Stat(c.CacheFile); err == nil {
-		data, err := ioutil.ReadFile(c.CacheFile)
-		if err == nil {
-			json.Unmarshal(data, &c.Cache)
+// ACL decides which sources may query the server. Deny wins over Allow;
+// an empty Allow admits every source not denied.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	// Drop ignores refused queries instead of answering REFUSED.
+	Drop bool
+}
+
+// NewACL parses the allow and deny CIDRs, returning nil, which admits
+// everyone, if both are empty.
+func NewACL(allow []string, deny []string, drop bool) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	acl := &ACL{Drop: drop}
+	for _, list := range []struct {
+		cidrs []string
+		into  *[]*net.IPNet
+	}{{allow, &acl.Allow}, {deny, &acl.Deny}} {
+		for _, cidr := range list.cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			*list.into = append(*list.into, network)
 		}
 	}
+	return acl, nil
 }
 
-func (c *Client) saveCache() {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+// Allowed reports whether ip may query the server.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, network := range a.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	data, err := json.Marshal(c.Cache)
-	if err == nil {
-		ioutil.WriteFile(c.CacheFile, data, 0644)
+// view picks the groups and zone that answer a query from addr.
+func (h *Handler) view(addr net.Addr) (*GroupManager, *Zone) {
+	if ip := remoteIP(addr); ip != nil {
+		for _, view := range h.Views {
+			if view.Matches(ip) {
+				return view.Groups, view.Zone
+			}
+		}
 	}
+	return h.Groups, h.Zone
 }
 
-func (gm *GroupManager) AddClientToGroup(client *Client) {
-	gm.Mutex.Lock()
-	defer gm.Mutex.Unlock()
+func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	defer func() { requestDuration.With("").Observe(time.Since(start).Seconds()) }()
 
-	// Find a group with space or create a new one
-	for _, group := range gm.Groups {
-		if len(group.Clients) < GroupSize {
-			group.Clients = append(group.Clients, client)
-			client.Group = group
+	if !h.ACL.Allowed(remoteIP(w.RemoteAddr())) {
+		fmt.Printf("Refusing query from %s: not allowed by allow_query/deny_query\n", w.RemoteAddr())
+		if h.ACL.Drop {
+			aclRefused.With(labels("action", "drop")).Add(1)
 			return
 		}
+		aclRefused.With(labels("action", "refuse")).Add(1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	if rcode := checkQuery(r); rcode != dns.RcodeSuccess {
+		fmt.Printf("Rejecting malformed query from %s with %s\n", w.RemoteAddr(), dns.RcodeToString[rcode])
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+		return
+	}
+	if problem := nameOverLimits(r.Question[0].Name, h.MaxNameLength, h.MaxLabels); problem != "" {
+		fmt.Printf("Rejecting query from %s with FORMERR: %s\n", w.RemoteAddr(), problem)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	// Liveness probes are answered before chaos injection and resolution,
+	// so they only fail when the server does.
+	if m := healthCheckAnswer(r, r.Question[0], h.HealthCheckName, h.HealthCheckAnswer); m != nil {
+		setReplyEdns(m, r)
+		w.WriteMsg(m)
+		return
+	}
+	if h.Chaos != nil && h.Chaos.Inject(w, r) {
+		return
 	}
 
-	// Create a new group
-	newGroup := &Group{
-		ID:      fmt.Sprintf("Group-%d", len(gm.Groups)+1),
-		Clients: []*Client{client},
+	hops := hopCount(r)
+	if hops >= h.MaxHops {
+		fmt.Printf("Forwarding loop suspected: query from %s already crossed %d hops\n", w.RemoteAddr(), hops)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		attachExtendedError(m, r, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: "forwarding loop"})
+		w.WriteMsg(m)
+		return
 	}
-	gm.Groups = append(gm.Groups, newGroup)
-	client.Group = newGroup
+	// Resolving for longer than the client waits only wastes upstream
+	// queries; work that should outlive the query detaches from ctx.
+	ctx, cancel := h.requestContext(w)
+	defer cancel()
+	ctx = withForwardInfo(ctx, forwardInfo{Hops: hops, From: remoteIP(w.RemoteAddr())})
+	do := r.IsEdns0() != nil && r.IsEdns0().Do()
+	ctx = withDNSSECOK(ctx, do)
+	ctx = withCheckingDisabled(ctx, r.CheckingDisabled)
+
+	cookie, rcode := h.Cookies.Check(r, w.RemoteAddr())
+	if rcode != dns.RcodeSuccess {
+		fmt.Println("Rejecting query with bad cookie from", w.RemoteAddr())
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		attachCookie(m, r, cookie)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	groups, zone := h.view(w.RemoteAddr())
+	if m := whoamiAnswer(groups, r, q); m != nil {
+		h.reply(w, r, m, cookie)
+		return
+	}
+	if zone != nil {
+		if m := zone.Answer(r, q); m != nil {
+			h.reply(w, r, m, cookie)
+			return
+		}
+	}
+	// A forward zone is an explicit instruction to ask someone else, so it
+	// wins over the special-use defaults: split DNS for 10.in-addr.arpa is
+	// the common case.
+	if h.SpecialUse && !h.forwarded(groups, q.Name) {
+		if m := specialUseAnswer(r, q); m != nil {
+			h.reply(w, r, m, cookie)
+			return
+		}
+	}
+
+	if m := h.Blocklist.Answer(r, q); m != nil {
+		fmt.Printf("Blocked %s %s from %s\n", q.Name, dns.Type(q.Qtype), w.RemoteAddr())
+		h.QueryLog.Record(w.RemoteAddr(), q, m.Rcode, SourceBlocked)
+		h.syntheticSOA(m, q)
+		h.reply(w, r, m, cookie)
+		return
+	}
+
+	domain := normalizeName(q.Name)
+	logger.Debug("query", "name", domain, "type", dns.Type(q.Qtype), "from", w.RemoteAddr())
+	client := groups.ClientForKey(domain)
+	result, err := client.QueryDNS(ctx, domain, q.Qtype)
+	if q.Qtype == dns.TypeAAAA {
+		result, err = client.dns64(ctx, domain, result, err)
+	}
+	m := new(dns.Msg)
+	// SetReply echoes CD. AD stays clear: this server does not validate,
+	// and RFC 4035 only allows AD on data the responder validated itself.
+	m.SetReply(r)
+	if err != nil {
+		m.Rcode = result.Rcode
+	} else {
+		logger.Debug("answering", "name", domain, "type", dns.Type(q.Qtype), "source", result.Source)
+		m.Answer = append(m.Answer, result.Records...)
+		m.Ns = append(m.Ns, result.Authority...)
+		m.Extra = append(m.Extra, result.Additional...)
+		if !do {
+			m.Answer = stripDNSSEC(m.Answer, q.Qtype)
+			m.Ns = stripDNSSEC(m.Ns, q.Qtype)
+			m.Extra = stripDNSSEC(m.Extra, q.Qtype)
+		}
+		orderAnswer(m.Answer, h.AnswerOrder)
+	}
+	attachExtendedError(m, r, extendedError(result, err))
+	h.QueryLog.Record(w.RemoteAddr(), q, m.Rcode, result.Source)
+	h.syntheticSOA(m, q)
+	h.reply(w, r, m, cookie)
 }
 
-func (c *Client) QueryDNS(domain string) (string, error) {
-	c.Mutex.Lock()
-	response, found := c.Cache[domain]
-	c.Mutex.Unlock()
+// requestContext is the context a query from w is resolved in. It ends
+// after QueryTimeout, or as soon as the client gives up if that can be
+// told: when it closes its TCP connection, or cancels its DoQ stream.
+func (h *Handler) requestContext(w dns.ResponseWriter) (context.Context, context.CancelFunc) {
+	parent, stop := context.Background(), func() {}
+	if stream, ok := w.(interface{ Context() context.Context }); ok {
+		parent = stream.Context()
+	} else if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		if conn, ok := tcpConns.Load(w.RemoteAddr().String()); ok {
+			parent, stop = conn.(*tcpConn).watch(parent)
+		}
+	}
+	ctx, cancel := context.WithTimeout(parent, h.QueryTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
 
-	if found && time.Since(response.Timestamp) < time.Hour {
-		fmt.Println("Domain name found in cache", c)
-		return response.IPAddress, nil
+// forwarded reports whether name falls in a forward zone of the client
+// that would resolve it.
+func (h *Handler) forwarded(groups *GroupManager, name string) bool {
+	client := groups.ClientForKey(normalizeName(name))
+	if client == nil {
+		return false
 	}
+	_, ok := client.forwardZone(name)
+	return ok
+}
 
-	for _, peer := range c.Group.Clients {
-		if peer != c {
-			peer.Mutex.Lock()
-			fmt.Println("Checking domain name in next client's cache...")
-			response, found = peer.Cache[domain]
-			peer.Mutex.Unlock()
-			if found && time.Since(response.Timestamp) < time.Hour {
-				fmt.Println("Domain found in client's cache...", found)
-				c.Mutex.Lock()
-				c.Cache[domain] = response
-				c.Mutex.Unlock()
-				c.saveCache()
-				return response.IPAddress, nil
-			}
+// syntheticSOA adds the configured SOA to m if it is an NXDOMAIN or NODATA
+// answer to q without one, owned by q's parent so it is in bailiwick.
+// Downstream resolvers cache the negative answer for its minimum.
+func (h *Handler) syntheticSOA(m *dns.Msg, q dns.Question) {
+	if h.SyntheticSOA == nil || len(m.Answer) > 0 {
+		return
+	}
+	if m.Rcode != dns.RcodeNameError && m.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, rr := range m.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return
 		}
 	}
-	fmt.Println("Domain not found in client's cache, calling QueryDNSResolver", domain, "\n")
-	ip, err := c.queryDNSResolver(domain)
-	fmt.Println("\nIP address is found", ip)
-	if err != nil {
-		return "", err
+	soa := dns.Copy(h.SyntheticSOA).(*dns.SOA)
+	soa.Hdr.Name = "."
+	if labels := dns.Split(q.Name); len(labels) > 1 {
+		soa.Hdr.Name = q.Name[labels[1]:]
 	}
+	m.Ns = append(m.Ns, soa)
+}
 
-	c.Mutex.Lock()
-	c.Cache[domain] = DNSResponse{IPAddress: ip, Timestamp: time.Now()}
-	c.Mutex.Unlock()
-	c.saveCache()
+// reply finishes the EDNS part of a response and sends it.
+func (h *Handler) reply(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, cookie *dns.EDNS0_COOKIE) {
+	setReplyEdns(m, r)
+	attachCookie(m, r, cookie)
+	m.Compress = h.Compress
+	// Padding goes last, once the size no longer changes. RFC 7830 only
+	// pads responses to queries that were padded themselves.
+	if h.PaddingBlock > 0 && encrypted(w) && paddingOption(r) != nil {
+		padMessage(m, h.PaddingBlock)
+	}
+	w.WriteMsg(m)
+}
 
-	return ip, nil
+// encrypted reports whether w answers over TLS.
+func encrypted(w dns.ResponseWriter) bool {
+	stater, ok := w.(dns.ConnectionStater)
+	return ok && stater.ConnectionState() != nil
 }
 
-func (c *Client) queryDNSResolver(domain string) (string, error) {
-	fmt.Printf("queryDNSResolver: query: %s\n", domain)
-	// Perform the DNS query using net.LookupHost
-	ips, err := net.LookupHost(domain)
-	if err != nil {
-		return "", fmt.Errorf("failed to resolve domain %s: %v", domain, err)
+// paddingOption returns the EDNS padding option of m, if it has one.
+func paddingOption(m *dns.Msg) *dns.EDNS0_PADDING {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if padding, ok := option.(*dns.EDNS0_PADDING); ok {
+				return padding
+			}
+		}
 	}
+	return nil
+}
 
-	// Return the first IP address found
-	if len(ips) > 0 {
-		ip := ips[0]
-		fmt.Printf("queryDNSResolver: resolver response: %s\n", ip)
-		return ip, nil
+// padMessage adds an EDNS padding option to m, which must have an OPT
+// record, making its packed size a multiple of block (RFC 7830). The size
+// depends on m.Compress, so set that first.
+func padMessage(m *dns.Msg, block int) {
+	padding := paddingOption(m)
+	if padding == nil {
+		padding = &dns.EDNS0_PADDING{}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, padding)
+	}
+	padding.Padding = nil
+	size := m.Len()
+	if rest := size % block; rest != 0 && size+block-rest <= dns.MaxMsgSize {
+		padding.Padding = make([]byte, block-rest)
 	}
+}
 
-	return "", fmt.Errorf("no A record found for domain %s", domain)
+// newGroupManager creates the clients of one view and groups them. remote
+// is the Redis cache, if any: the clients' store with cache_backend redis,
+// and their shared cache otherwise.
+func newGroupManager(config Config, clients []ClientConfig, codec CacheCodec, remote Cache) *GroupManager {
+	groupManager := &GroupManager{}
+	for _, clientConfig := range clients {
+		client := newClient(clientConfig.ID, clientConfig.Server, codec)
+		if config.CacheBackend == "redis" {
+			client.Store = remote
+		} else {
+			client.Shared = remote
+		}
+		// Set before loading, so entries that expired while the server was
+		// down are kept for as long as they may be served stale.
+		client.Stale = StalePolicy{
+			MaxAge:        config.StaleMaxAge,
+			AnswerTTL:     config.StaleAnswerTTL,
+			ClientTimeout: config.StaleAnswerClientTimeout,
+		}
+		if client.Store == nil {
+			client.loadCache(config.MaxLoadEntries)
+		}
+		client.Upstreams = clientConfig.Upstreams
+		client.Protocol = clientConfig.Protocol
+		if !clientConfig.CacheEnabled() {
+			client.DisableCache()
+		}
+		client.ForwardZones = config.ForwardZones
+		client.Rewrites = config.Rewrites
+		client.FallbackIP = net.ParseIP(config.FallbackIP)
+		if config.DNS64 {
+			client.DNS64Prefix, _ = parseDNS64Prefix(config.DNS64Prefix)
+		}
+		client.SystemFallback = !config.DisableSystemFallback
+		client.Offline = config.Offline
+		client.OfflineRcode = dns.RcodeServerFailure
+		if config.OfflineRcode == "nxdomain" {
+			client.OfflineRcode = dns.RcodeNameError
+		}
+		client.ParentCache = clientConfig.ParentCache
+		client.MaxCNAMEDepth = config.MaxCNAMEDepth
+		client.PeerTimeout = config.PeerTimeout
+		client.Budget = QueryBudget{Total: config.QueryBudget, CacheShare: *config.CacheBudgetShare}
+		client.PeerSelection = config.PeerSelection
+		client.MinimalResponses = config.MinimalResponses
+		client.AllSections = config.CacheAllSections
+		client.DoHGet = config.DoHMethod == "get"
+		client.RandomizeCase = config.RandomizeCase
+		if config.EDNSPadding {
+			client.PaddingBlock = config.EDNSPaddingBlock
+		}
+		client.DedupeWindow = config.DedupeWindow
+		client.DNSSECKeys = config.DNSSECCacheKey == nil || *config.DNSSECCacheKey
+		client.TTLPolicy = config.TTLPolicy()
+		client.PrefetchThreshold = config.PrefetchThreshold
+		client.PrefetchMinHits = config.PrefetchMinHits
+		client.Adaptive = AdaptiveTTL{
+			MinHits: config.AdaptiveMinHits,
+			Factor:  config.AdaptiveTTLFactor,
+			Ceiling: config.AdaptiveTTLCeiling,
+		}
+		client.BreakerSettings = config.BreakerSettings()
+		if config.ClientMaxInFlight > 0 {
+			client.inFlightSlots = make(chan struct{}, config.ClientMaxInFlight)
+		}
+		client.SetPartitions(config.CachePartitions())
+		client.Quarantine = NewQuarantine(config.QuarantineThreshold, config.QuarantineCooldown)
+		client.ShortTTLs = NewShortTTLs(config.ShortTTLThreshold, config.ShortTTLStreak)
+		client.SetSigner(NewEntrySigner(config.CacheSecret))
+		client.SetCompression(config.CompressAbove)
+		if config.Gossip {
+			client.Gossip = true
+			client.GossipMinTTL = config.GossipMinTTL
+			if !client.NoCache {
+				client.startGossipReceiver(config.GossipQueue)
+			}
+		}
+		if config.QNameMinimization {
+			client.Iterative = NewIterativeResolver(config.RootHints)
+		}
+		client.History = NewHitHistory(config.StatsHistoryMinutes)
+		client.startSweeper(config.SweepInterval)
+		client.MaxFileBytes = config.MaxCacheFileBytes
+		client.startSaver(config.SaveInterval)
+		groupManager.AddClientToGroup(client)
+	}
+	return groupManager
 }
 
 func main() {
-	fmt.Println("Starting....")
+	if len(os.Args) > 1 && os.Args[1] == "validate-cache" {
+		os.Exit(validateCache(os.Args[2:]))
+	}
+	configPath := flag.String("config", "config.toml", "config file, or a directory of *.toml files to merge")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+
 	// Load the configuration
-	var config Config
-	if _, err := toml.DecodeFile("config.toml", &config); err != nil {
+	config, err := LoadConfig(*configPath)
+	if err != nil {
 		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Println("Invalid config:", err)
+		os.Exit(1)
+	}
+	config = config.WithDefaults()
+	if *printConfig {
+		if err := toml.NewEncoder(os.Stdout).Encode(config.Redacted()); err != nil {
+			fmt.Println("Error printing config:", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	// Create a group manager
-	groupManager := &GroupManager{}
+	fmt.Println("Starting....")
+	upstreamLimiters.max = config.UpstreamMaxInFlight
 
-	// Create clients and add them to groups based on the configuration
-	for _, clientConfig := range config.Clients {
-		client := NewClient(clientConfig.ID, clientConfig.Server)
-		groupManager.AddClientToGroup(client)
+	codec, err := CacheCodecByName(config.CacheFormat)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return
 	}
+
+	// Validate checked the level.
+	var level slog.Level
+	level.UnmarshalText([]byte(config.LogLevel))
+	logLevel.Set(level)
+	setDebugLogRate(config.DebugLogRate)
+	var remote Cache
+	if config.RedisAddr != "" {
+		remote = &RedisCache{Addr: config.RedisAddr, Password: config.RedisPassword, DB: config.RedisDB, Prefix: config.RedisPrefix}
+		if config.CacheBackend == "redis" {
+			fmt.Println("Caching in Redis at", config.RedisAddr)
+		} else {
+			fmt.Println("Sharing the cache through Redis at", config.RedisAddr)
+		}
+	}
+	groupManager := newGroupManager(config, config.Clients, codec, remote)
 	fmt.Println("All clients added successfully....")
+	if config.MirrorAddr != "" {
+		mirror := NewMirror(config.MirrorAddr, config.MirrorQueue)
+		for _, client := range groupManager.Clients() {
+			client.Mirror = mirror
+		}
+	}
+	if config.MirrorListen != "" {
+		serveMirror(config.MirrorListen, groupManager)
+	}
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		for _, q := range r.Question {
-			domain := q.Name
-			fmt.Println("Looking for client domain: ", domain)
-			ip, err := groupManager.Groups[0].Clients[0].QueryDNS(domain)
-			m := new(dns.Msg)
-			m.SetReply(r)
-			if err != nil {
-				m.Rcode = dns.RcodeServerFailure
+	var views []*View
+	for _, viewConfig := range config.Views {
+		view, err := NewView(config, viewConfig, codec)
+		if err != nil {
+			fmt.Printf("Error setting up view %s: %v\n", viewConfig.Name, err)
+			return
+		}
+		fmt.Printf("View %s serves %s\n", view.Name, strings.Join(viewConfig.MatchClients, ", "))
+		views = append(views, view)
+	}
+	managers := []*GroupManager{groupManager}
+	for _, view := range views {
+		managers = append(managers, view.Groups)
+	}
+
+	if config.AdminAddr != "" {
+		startCacheDistribution(managers, CacheDistributionInterval)
+		startAdminServer(config.AdminAddr, managers, config.Pprof)
+	}
+	if config.MinReadyClients > 0 {
+		if err := waitForReadyClients(groupManager, config.MinReadyClients, config.ReadyTimeout); err != nil {
+			fmt.Println("Not starting:", err)
+			os.Exit(1)
+		}
+	}
+
+	cookies, err := NewCookieJar(config.CookieSecret)
+	if err != nil {
+		fmt.Println("Error setting up DNS cookies:", err)
+		return
+	}
+
+	zone, err := loadZoneIfSet(config.ZoneFile, config.ZoneOrigin)
+	if err != nil {
+		fmt.Println("Error loading zone file:", err)
+		return
+	}
+
+	saveUpstreamStats := func() {}
+	if config.UpstreamStatsFile != "" {
+		clients := clientsOf(managers)
+		if err := loadUpstreamStats(config.UpstreamStatsFile, clients); err != nil {
+			fmt.Println("Error loading upstream stats, starting without them:", err)
+		}
+		saveUpstreamStats = startUpstreamStatsSaver(config.UpstreamStatsFile, config.UpstreamStatsInterval, clients)
+	}
+
+	var queryLog *QueryLog
+	if config.QueryLog != "" {
+		if config.WarmupLogLines > 0 {
+			if lines, err := tailLines(config.QueryLog, config.WarmupLogLines); err != nil {
+				fmt.Println("Warmup: cannot read query log:", err)
 			} else {
-				rr, _ := dns.NewRR(fmt.Sprintf("%s A %s", domain, ip))
-				m.Answer = append(m.Answer, rr)
+				warmup(groupManager, warmupQueries(lines, config.WarmupTop), config.WarmupTimeout)
+			}
+		}
+		if queryLog, err = OpenQueryLog(config.QueryLog); err != nil {
+			fmt.Println("Error opening query log:", err)
+			return
+		}
+	}
+
+	var blocklist *Blocklist
+	if config.Blocklist != "" || len(config.Blocked) > 0 {
+		if blocklist, err = NewBlocklist(config.Blocklist, config.Blocked, net.ParseIP(config.BlocklistAnswer)); err != nil {
+			fmt.Println("Error loading blocklist:", err)
+			return
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := blocklist.Reload(); err != nil {
+					fmt.Println("Error reloading blocklist, keeping the old one:", err)
+				}
 			}
-			w.WriteMsg(m)
+		}()
+	}
+
+	paddingBlock := 0
+	if config.EDNSPadding {
+		paddingBlock = config.EDNSPaddingResponseBlock
+	}
+	// Validate checked the CIDRs.
+	acl, _ := NewACL(config.AllowQuery, config.DenyQuery, config.ACLAction == "drop")
+	var syntheticSOA *dns.SOA
+	if config.SyntheticSOA != nil {
+		syntheticSOA = config.SyntheticSOA.SOA()
+	}
+	var chaos *ChaosConfig
+	if config.Chaos.Enabled {
+		if os.Getenv(ChaosEnvVar) == "1" {
+			fmt.Printf("WARNING: chaos testing enabled, queries will be delayed, dropped and failed at random\n")
+			chaos = &config.Chaos
+		} else {
+			fmt.Printf("Ignoring chaos.enabled: %s=1 is not set\n", ChaosEnvVar)
 		}
+	}
+
+	dns.Handle(".", &Handler{
+		Groups:            groupManager,
+		Zone:              zone,
+		Views:             views,
+		Chaos:             chaos,
+		SpecialUse:        !config.DisableSpecialUse,
+		QueryTimeout:      config.QueryTimeout,
+		Cookies:           cookies,
+		MaxHops:           config.MaxForwardHops,
+		MaxNameLength:     config.MaxNameLength,
+		MaxLabels:         config.MaxLabels,
+		ACL:               acl,
+		PaddingBlock:      paddingBlock,
+		HealthCheckName:   config.HealthCheckName,
+		HealthCheckAnswer: config.HealthCheckAnswer,
+		AnswerOrder:       config.AnswerOrder,
+		Compress:          config.CompressResponses == nil || *config.CompressResponses,
+		QueryLog:          queryLog,
+		Blocklist:         blocklist,
+		SyntheticSOA:      syntheticSOA,
 	})
 
-	server := &dns.Server{Addr: ":8053", Net: "udp"}
-	fmt.Printf("Starting server on :8053\n")
-	err := server.ListenAndServe()
+	conn, listener, err := activatedSockets()
+	if err != nil {
+		fmt.Println("Error using activated sockets:", err)
+		return
+	}
+	if conn == nil {
+		if conn, err = net.ListenPacket("udp", config.ListenAddr); err != nil {
+			fmt.Printf("Failed to start server: %s\n", err.Error())
+			return
+		}
+	}
+	if listener == nil {
+		if listener, err = net.Listen("tcp", config.ListenAddr); err != nil {
+			fmt.Printf("Failed to start server: %s\n", err.Error())
+			return
+		}
+	}
+	if config.UDPReadBufferBytes > 0 {
+		setReadBuffer(conn, config.UDPReadBufferBytes)
+	}
+	var doqListener *DoQListener
+	if config.DoQAddr != "" {
+		cert, err := tls.LoadX509KeyPair(config.DoQCertFile, config.DoQKeyFile)
+		if err != nil {
+			fmt.Println("Error loading the DoQ certificate:", err)
+			return
+		}
+		if doqListener, err = ListenDoQ(config.DoQAddr, cert, config.TCPIdleTimeout); err != nil {
+			fmt.Printf("Failed to start DoQ server: %s\n", err.Error())
+			return
+		}
+	}
+	// The sockets are bound, so root is no longer needed.
+	if err := dropPrivileges(config.User, config.Group); err != nil {
+		fmt.Println("Error dropping privileges:", err)
+		return
+	}
+
+	idleTimeout := config.TCPIdleTimeout
+	tcpServer := &dns.Server{
+		Listener:    newTCPListener(listener, config.TCPMaxConnections),
+		Net:         "tcp",
+		ReadTimeout: idleTimeout,
+		IdleTimeout: func() time.Duration { return idleTimeout },
+	}
+	failed := make(chan error, 3)
+	go func() {
+		fmt.Printf("Starting TCP server on %s\n", listener.Addr())
+		failed <- fmt.Errorf("TCP server: %v", tcpServer.ActivateAndServe())
+	}()
+	udpServer := &dns.Server{PacketConn: conn, Net: "udp", NotifyStartedFunc: func() { serving.Store(true) }}
+	go func() {
+		fmt.Printf("Starting server on %s\n", conn.LocalAddr())
+		failed <- fmt.Errorf("UDP server: %v", udpServer.ActivateAndServe())
+	}()
+	doqServer := &DoQServer{Handler: dns.DefaultServeMux, ReadTimeout: idleTimeout}
+	if doqListener != nil {
+		go func() {
+			fmt.Printf("Starting DoQ server on %s\n", doqListener.Addr())
+			failed <- fmt.Errorf("DoQ server: %v", doqServer.Serve(doqListener))
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		fmt.Printf("Shutting down on %v\n", sig)
+	case err := <-failed:
+		fmt.Printf("Failed to serve: %s, shutting down\n", err.Error())
+	}
+	serving.Store(false)
+	// Queries already being answered get as long as clients wait for them.
+	ctx, cancel := context.WithTimeout(context.Background(), config.QueryTimeout)
+	defer cancel()
+	shutdowns := []func(context.Context) error{udpServer.ShutdownContext, tcpServer.ShutdownContext, doqServer.Shutdown}
+	var wg sync.WaitGroup
+	for _, shutdown := range shutdowns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	for _, client := range clientsOf(managers) {
+		client.flushCache()
+	}
+	saveUpstreamStats()
+}
+
+// activatedSockets returns the UDP and TCP sockets handed over by systemd
+// socket activation. Either is nil when it was not passed.
+func activatedSockets() (net.PacketConn, net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, count)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), "listen_fd")
+	}
+	return socketsFromFiles(files)
+}
+
+// socketsFromFiles makes the UDP and TCP sockets out of the passed socket
+// files, and closes the files. There may be one of each: anything else is
+// an error, and no socket is left open then.
+func socketsFromFiles(files []*os.File) (net.PacketConn, net.Listener, error) {
+	var conn net.PacketConn
+	var listener net.Listener
+	var err error
+	for _, file := range files {
+		if err != nil {
+			file.Close()
+			continue
+		}
+		if c, cerr := net.FilePacketConn(file); cerr == nil {
+			if conn == nil {
+				conn = c
+			} else {
+				c.Close()
+				err = fmt.Errorf("file descriptor %d is a second UDP socket, only one is supported", file.Fd())
+			}
+		} else if l, lerr := net.FileListener(file); lerr == nil {
+			if listener == nil {
+				listener = l
+			} else {
+				l.Close()
+				err = fmt.Errorf("file descriptor %d is a second TCP socket, only one is supported", file.Fd())
+			}
+		} else {
+			err = fmt.Errorf("file descriptor %d is not a usable socket", file.Fd())
+		}
+		file.Close()
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, nil, err
+	}
+	return conn, listener, nil
+}
+
+// setReadBuffer asks for a receive buffer of size bytes on conn and logs the
+// size the OS granted, which it may cap (net.core.rmem_max on Linux, where
+// the reported size is also doubled for bookkeeping). The socket is created
+// by main rather than dns.Server.ListenAndServe so this can be set.
+func setReadBuffer(conn net.PacketConn, size int) {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		fmt.Printf("Cannot set the UDP read buffer on a %T\n", conn)
+		return
+	}
+	if err := udp.SetReadBuffer(size); err != nil {
+		fmt.Println("Error setting the UDP read buffer:", err)
+		return
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return
+	}
+	effective := 0
+	raw.Control(func(fd uintptr) {
+		effective, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
 	if err != nil {
-		fmt.Printf("Failed to start server: %s\n", err.Error())
+		fmt.Printf("UDP read buffer: asked for %d bytes\n", size)
+		return
+	}
+	fmt.Printf("UDP read buffer: asked for %d bytes, the OS reports %d\n", size, effective)
+}
+
+// dropPrivileges switches to the configured group and user. It is called
+// once the sockets are bound, so a privileged port is only held as root for
+// as long as it takes to bind it.
+func dropPrivileges(userName, groupName string) error {
+	if userName == "" && groupName == "" {
+		return nil
+	}
+	gid := -1
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	uid := -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid < 0 {
+			if gid, err = strconv.Atoi(u.Gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The group has to go first: once the user changes we may no longer
+	// be allowed to change it.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
 	}
+	fmt.Printf("Dropped privileges to uid %d gid %d\n", uid, gid)
+	return nil
 }
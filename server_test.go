@@ -0,0 +1,4626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// inTempDir runs the rest of the test in a fresh directory, since clients
+// load and save their cache files in the working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// newTestClient returns a client with an empty cache that resolves through
+// server only.
+func newTestClient(t *testing.T, id string, server string) *Client {
+	t.Helper()
+	inTempDir(t)
+	return NewClient(id, server, jsonCodec{}, 0)
+}
+
+// startUpstream serves handler over UDP on a loopback port and returns its
+// address.
+func startUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// answerA is an upstream handler answering every A query with ip.
+func answerA(ip string, ttl uint32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.ParseIP(ip),
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// answerRcode is an upstream handler answering every query with rcode.
+func answerRcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+// recorder is a dns.ResponseWriter that keeps the reply written to it.
+type recorder struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newRecorder() *recorder {
+	return &recorder{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+}
+
+func (w *recorder) LocalAddr() net.Addr       { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *recorder) RemoteAddr() net.Addr      { return w.remote }
+func (w *recorder) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *recorder) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
+func (w *recorder) Close() error        { return nil }
+func (w *recorder) TsigStatus() error   { return nil }
+func (w *recorder) TsigTimersOnly(bool) {}
+func (w *recorder) Hijack()             {}
+
+// newTestHandler returns a handler for the clients of gm with the limits
+// main would apply by default.
+func newTestHandler(t *testing.T, gm *GroupManager) *Handler {
+	t.Helper()
+	cookies, err := NewCookieJar("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		Groups:        gm,
+		Cookies:       cookies,
+		MaxHops:       DefaultMaxForwardHops,
+		MaxNameLength: DefaultMaxNameLength,
+		MaxLabels:     DefaultMaxLabels,
+		QueryTimeout:  DefaultQueryTimeout,
+	}
+}
+
+// serve sends a query for name and qtype through h and returns the reply.
+func serve(t *testing.T, h *Handler, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	w := newRecorder()
+	h.ServeDNS(w, r)
+	if w.msg == nil {
+		t.Fatalf("no reply to %s %s", name, dns.Type(qtype))
+	}
+	return w.msg
+}
+
+func TestForwardZoneLongestSuffix(t *testing.T) {
+	c := &Client{ForwardZones: []ForwardZone{
+		{Name: "corp.internal", Upstreams: []string{"10.0.0.1"}},
+		{Name: "eng.corp.internal.", Upstreams: []string{"10.0.0.2"}},
+		{Name: "10.in-addr.arpa", Upstreams: []string{"10.0.0.3"}},
+	}}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"corp.internal.", "corp.internal"},
+		{"host.corp.internal.", "corp.internal"},
+		{"HOST.Corp.Internal", "corp.internal"},
+		{"build.eng.corp.internal.", "eng.corp.internal."},
+		{"eng.corp.internal.", "eng.corp.internal."},
+		{"4.3.2.10.in-addr.arpa.", "10.in-addr.arpa"},
+		{"notcorp.internal.", ""},
+		{"example.com.", ""},
+	}
+	for _, tt := range tests {
+		zone, ok := c.forwardZone(tt.name)
+		if ok != (tt.want != "") || zone.Name != tt.want {
+			t.Errorf("forwardZone(%q) = %q, %v; want %q", tt.name, zone.Name, ok, tt.want)
+		}
+	}
+}
+
+func TestWithDefaultsCanonicalizesForwardZones(t *testing.T) {
+	zones := []ForwardZone{{Name: "Corp.Internal", Upstreams: []string{"10.0.0.1"}}}
+	config := Config{ForwardZones: zones}.WithDefaults()
+	if got := config.ForwardZones[0].Name; got != "corp.internal." {
+		t.Errorf("forward zone name = %q, want corp.internal.", got)
+	}
+	if zones[0].Name != "Corp.Internal" {
+		t.Errorf("WithDefaults changed the caller's forward zones to %q", zones[0].Name)
+	}
+}
+
+func TestForwardZoneBeatsSpecialUse(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "fileserver.corp.internal.",
+		})
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "fwd", "")
+	client.ForwardZones = []ForwardZone{{Name: "10.in-addr.arpa", Upstreams: []string{upstream}}}
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+	h.SpecialUse = true
+
+	m := serve(t, h, "4.3.2.10.in-addr.arpa.", dns.TypePTR)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatalf("forwarded reverse zone: rcode %s, %d answers; want the upstream's PTR", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if ptr, ok := m.Answer[0].(*dns.PTR); !ok || ptr.Ptr != "fileserver.corp.internal." {
+		t.Errorf("answer = %v, want the upstream's PTR", m.Answer[0])
+	}
+
+	m = serve(t, h, "4.3.168.192.in-addr.arpa.", dns.TypePTR)
+	if m.Rcode != dns.RcodeNameError {
+		t.Errorf("unforwarded private reverse zone: rcode %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+}
+
+// testClients returns n clients with ids c0, c1, ... and no cache file.
+func testClients(t *testing.T, n int) []*Client {
+	t.Helper()
+	inTempDir(t)
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = NewClient(fmt.Sprintf("c%d", i), "", jsonCodec{}, 0)
+	}
+	return clients
+}
+
+func TestClientForKeyMovesOnlyRemovedClientsKeys(t *testing.T) {
+	gm := &GroupManager{}
+	for _, client := range testClients(t, 8) {
+		gm.AddClientToGroup(client)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		domain := fmt.Sprintf("host%d.example.com.", i)
+		before[domain] = gm.ClientForKey(domain).ID
+	}
+
+	if gm.RemoveClient("c3") == nil {
+		t.Fatal("RemoveClient(c3) found no client")
+	}
+	moved := 0
+	for domain, owner := range before {
+		now := gm.ClientForKey(domain).ID
+		if now == "c3" {
+			t.Fatalf("%s still maps to the removed client", domain)
+		}
+		if now != owner {
+			if owner != "c3" {
+				t.Errorf("%s moved from %s to %s, but only c3's keys should move", domain, owner, now)
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no key moved off the removed client")
+	}
+}
+
+func TestGroupMembersSafeDuringRemoval(t *testing.T) {
+	gm := &GroupManager{}
+	clients := testClients(t, GroupSize)
+	for _, client := range clients {
+		gm.AddClientToGroup(client)
+	}
+	group := gm.Groups[0]
+	snapshot := group.Members()
+	want := append([]*Client(nil), snapshot...)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, client := range clients[1:] {
+			gm.RemoveClient(client.ID)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, peer := range group.Members() {
+			_ = peer.ID
+		}
+	}
+	wg.Wait()
+
+	for i, client := range snapshot {
+		if client != want[i] {
+			t.Fatalf("snapshot changed at %d by RemoveClient: got %s, want %s", i, client.ID, want[i].ID)
+		}
+	}
+	if got := group.Members(); len(got) != 1 || got[0] != clients[0] {
+		t.Errorf("group has %d members after removals, want only %s", len(got), clients[0].ID)
+	}
+}
+
+func TestRebalanceEvensGroups(t *testing.T) {
+	gm := &GroupManager{}
+	clients := testClients(t, 3*GroupSize)
+	for _, client := range clients {
+		gm.AddClientToGroup(client)
+	}
+	// Leave the groups at 15, 3 and 1 clients.
+	for _, client := range clients[GroupSize : GroupSize+12] {
+		gm.RemoveClient(client.ID)
+	}
+	for _, client := range clients[2*GroupSize : 3*GroupSize-1] {
+		gm.RemoveClient(client.ID)
+	}
+	owners := make(map[string]*Client)
+	for i := 0; i < 200; i++ {
+		domain := fmt.Sprintf("host%d.example.com.", i)
+		owners[domain] = gm.ClientForKey(domain)
+	}
+	cached := gm.Groups[2].Members()[0]
+	cached.Set(cacheKey("kept.example.com.", dns.TypeA), DNSResponse{IPAddress: "192.0.2.1", TTL: time.Hour, Timestamp: time.Now()})
+
+	moved := gm.Rebalance()
+	if moved == 0 {
+		t.Fatal("Rebalance moved no clients")
+	}
+	// 19 clients fit in two groups: one of 10 and one of 9.
+	sizes := []int{len(gm.Groups[0].Members()), len(gm.Groups[1].Members()), len(gm.Groups[2].Members())}
+	if sizes[0]+sizes[1]+sizes[2] != 19 {
+		t.Fatalf("group sizes %v do not add up to the 19 clients", sizes)
+	}
+	nonEmpty := 0
+	for _, size := range sizes {
+		if size == 0 {
+			continue
+		}
+		nonEmpty++
+		if size != 9 && size != 10 {
+			t.Errorf("group sizes %v, want 10 and 9", sizes)
+		}
+	}
+	if nonEmpty != 2 {
+		t.Errorf("group sizes %v, want clients in 2 groups", sizes)
+	}
+	for _, group := range gm.Groups {
+		for _, client := range group.Members() {
+			if client.Group() != group {
+				t.Errorf("client %s is in %s but points at %s", client.ID, group.ID, client.Group().ID)
+			}
+		}
+	}
+	if _, ok := cached.Get(cacheKey("kept.example.com.", dns.TypeA)); !ok {
+		t.Error("a moved client lost its cache")
+	}
+	for domain, owner := range owners {
+		if got := gm.ClientForKey(domain); got != owner {
+			t.Errorf("%s changed owner from %s to %s", domain, owner.ID, got.ID)
+		}
+	}
+	if again := gm.Rebalance(); again != 0 {
+		t.Errorf("a second Rebalance moved %d clients, want 0", again)
+	}
+}
+
+func TestRebalanceDuringQueries(t *testing.T) {
+	gm := &GroupManager{}
+	clients := testClients(t, 2*GroupSize)
+	for _, client := range clients {
+		client.DedupeWindow = 0
+		gm.AddClientToGroup(client)
+	}
+	for _, client := range clients[:GroupSize-2] {
+		gm.RemoveClient(client.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, client := range clients[GroupSize:] {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				c.QueryDNS(ctx, fmt.Sprintf("q%d.example.com.", i), dns.TypeA)
+			}
+		}(client)
+	}
+	gm.Rebalance()
+	wg.Wait()
+}
+
+// addressEntry returns a cache entry for an A record of name, resolved at
+// resolved and valid for ttl.
+func addressEntry(t *testing.T, name string, ip string, resolved time.Time, ttl time.Duration) DNSResponse {
+	t.Helper()
+	rr, err := newAddressRecord(name, dns.TypeA, ip, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DNSResponse{IPAddress: ip, Records: []dns.RR{rr}, Timestamp: resolved, TTL: ttl}
+}
+
+func TestStaleEntriesSurviveRestart(t *testing.T) {
+	inTempDir(t)
+	key := cacheKey("down.example.com.", dns.TypeA)
+	before := newClient("restart", "", jsonCodec{})
+	before.Stale = StalePolicy{MaxAge: 24 * time.Hour}
+	before.Set(key, addressEntry(t, "down.example.com.", "192.0.2.7", time.Now().Add(-2*time.Hour), time.Minute))
+
+	stale := newClient("restart", "", jsonCodec{})
+	stale.Stale = StalePolicy{MaxAge: 24 * time.Hour}
+	stale.loadCache(0)
+	if _, ok := stale.Peek("down.example.com.", dns.TypeA); !ok {
+		t.Error("an entry within stale_max_age was dropped on load")
+	}
+
+	fresh := newClient("restart", "", jsonCodec{})
+	fresh.loadCache(0)
+	if _, ok := fresh.Peek("down.example.com.", dns.TypeA); ok {
+		t.Error("an expired entry was loaded without serve-stale")
+	}
+}
+
+func TestLoadedEntryServesRemainingTTL(t *testing.T) {
+	inTempDir(t)
+	before := newClient("remaining", "", jsonCodec{})
+	before.Set(cacheKey("soon.example.com.", dns.TypeA), addressEntry(t, "soon.example.com.", "192.0.2.8", time.Now().Add(-55*time.Second), time.Minute))
+
+	after := newClient("remaining", "", jsonCodec{})
+	after.loadCache(0)
+	gm := &GroupManager{}
+	gm.AddClientToGroup(after)
+	reply := serve(t, newTestHandler(t, gm), "soon.example.com.", dns.TypeA)
+	if len(reply.Answer) != 1 || addressOf(reply.Answer[0]) != "192.0.2.8" {
+		t.Fatalf("answers %v, want the loaded 192.0.2.8", reply.Answer)
+	}
+	// Stored 55s into a 60s TTL: about 5s are left, not a fresh minute.
+	if ttl := reply.Answer[0].Header().Ttl; ttl < 4 || ttl > 5 {
+		t.Errorf("loaded entry served with TTL %d, want about 5", ttl)
+	}
+}
+
+func TestStaleRefreshIsDeduplicated(t *testing.T) {
+	var mu sync.Mutex
+	queries := 0
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	c := newTestClient(t, "stale", upstream)
+	c.Stale = StalePolicy{MaxAge: time.Hour, AnswerTTL: 30 * time.Second}
+	// Keep the breaker from hiding repeated upstream queries.
+	c.BreakerSettings = BreakerSettings{Threshold: 100, Window: time.Minute, Cooldown: time.Minute}
+	c.Set(cacheKey("down.example.com.", dns.TypeA), addressEntry(t, "down.example.com.", "192.0.2.7", time.Now().Add(-time.Hour/2), time.Minute))
+
+	for i := 0; i < 5; i++ {
+		result, err := c.QueryDNS(context.Background(), "down.example.com.", dns.TypeA)
+		if err != nil || result.Source != SourceStale {
+			t.Fatalf("query %d: source %q, error %v; want the stale entry", i, result.Source, err)
+		}
+		if result.TTL != 30*time.Second {
+			t.Errorf("query %d: stale answer TTL %s, want 30s", i, result.TTL)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if queries != 1 {
+		t.Errorf("upstream asked %d times for one stale entry, want 1 until StaleRetryInterval passes", queries)
+	}
+}
+
+func TestAdminCoversViews(t *testing.T) {
+	clients := testClients(t, 2)
+	defaults, internal := &GroupManager{}, &GroupManager{View: "internal"}
+	defaults.AddClientToGroup(clients[0])
+	internal.AddClientToGroup(clients[1])
+	managers := []*GroupManager{defaults, internal}
+
+	var ids []string
+	for _, client := range clientsOf(managers) {
+		ids = append(ids, client.ID)
+	}
+	if len(ids) != 2 || ids[0] != "c0" || ids[1] != "c1" {
+		t.Errorf("clientsOf = %v, want [c0 c1]", ids)
+	}
+	if stats := internal.Stats(); len(stats) != 1 || stats[0].View != "internal" {
+		t.Errorf("view client stats = %+v, want c1 in view internal", stats)
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, managers)
+	for _, want := range []string{
+		`dns_client_hit_ratio_ewma{client="c1"}`,
+		`dns_group_hit_ratio_ewma{view="",group="Group-1"}`,
+		`dns_group_hit_ratio_ewma{view="internal",group="Group-1"}`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+// socketFile returns a duplicate of the socket behind conn as a file.
+func socketFile(t *testing.T, conn interface{ File() (*os.File, error) }) *os.File {
+	t.Helper()
+	file, err := conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSocketsFromFiles(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	conn, listener, err := socketsFromFiles([]*os.File{socketFile(t, udp), socketFile(t, tcp)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.LocalAddr().String() != udp.LocalAddr().String() || listener.Addr().String() != tcp.Addr().String() {
+		t.Errorf("got %s and %s, want %s and %s", conn.LocalAddr(), listener.Addr(), udp.LocalAddr(), tcp.Addr())
+	}
+	conn.Close()
+	listener.Close()
+
+	first := socketFile(t, udp)
+	conn, listener, err = socketsFromFiles([]*os.File{first, socketFile(t, tcp), socketFile(t, udp)})
+	if err == nil || conn != nil || listener != nil {
+		t.Fatalf("two UDP sockets: got %v, %v, %v; want only an error", conn, listener, err)
+	}
+	if !strings.Contains(err.Error(), "second UDP socket") {
+		t.Errorf("error %q does not name the second UDP socket", err)
+	}
+	if _, err := first.Stat(); err == nil {
+		t.Error("the first UDP socket's file was left open")
+	}
+}
+
+func TestTCPListenerLimitsAndIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          newTCPListener(l, 1),
+		Net:               "tcp",
+		Handler:           answerA("192.0.2.1", 60),
+		ReadTimeout:       200 * time.Millisecond,
+		IdleTimeout:       func() time.Duration { return 200 * time.Millisecond },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	// Wait for the first connection to be counted before the second.
+	deadline := time.Now().Add(time.Second)
+	for tcpConnections.Load() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rejected := tcpRejected.With("").Load()
+	extra, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := extra.Read(make([]byte, 1)); err == nil {
+		t.Error("a connection over tcp_max_connections was not closed")
+	}
+	if tcpRejected.With("").Load() != rejected+1 {
+		t.Error("the rejected connection was not counted")
+	}
+
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from an idle connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("idle connection was not closed by the server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle connection closed after %s, want about 200ms", elapsed)
+	}
+}
+
+// slowUpstream answers A queries with ip after delay.
+func slowUpstream(t *testing.T, delay time.Duration, ip string) string {
+	t.Helper()
+	return startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		answerA(ip, 300)(w, r)
+	})
+}
+
+func TestQueryBudgetWithSlowUpstream(t *testing.T) {
+	upstream := slowUpstream(t, 600*time.Millisecond, "192.0.2.1")
+	c := newTestClient(t, "budget", upstream)
+	c.Budget = QueryBudget{Total: 200 * time.Millisecond, CacheShare: 0.1}
+
+	start := time.Now()
+	result, err := c.QueryDNS(context.Background(), "slow.example.com.", dns.TypeA)
+	elapsed := time.Since(start)
+	if err == nil || result.Rcode != dns.RcodeServerFailure {
+		t.Errorf("miss past the budget: rcode %s, error %v; want SERVFAIL", dns.RcodeToString[result.Rcode], err)
+	}
+	if elapsed > 450*time.Millisecond {
+		t.Errorf("miss took %s, want it answered within the 200ms budget", elapsed)
+	}
+
+	c.Stale = StalePolicy{MaxAge: time.Hour, AnswerTTL: 30 * time.Second}
+	c.Set(cacheKey("stale.example.com.", dns.TypeA), addressEntry(t, "stale.example.com.", "192.0.2.9", time.Now().Add(-10*time.Minute), time.Minute))
+	start = time.Now()
+	result, err = c.QueryDNS(context.Background(), "stale.example.com.", dns.TypeA)
+	elapsed = time.Since(start)
+	if err != nil || result.Source != SourceStale || len(result.IPs) != 1 || result.IPs[0] != "192.0.2.9" {
+		t.Errorf("stale entry past the budget: source %q, IPs %v, error %v; want the stale entry", result.Source, result.IPs, err)
+	}
+	if elapsed > 450*time.Millisecond {
+		t.Errorf("stale answer took %s, want it within the 200ms budget", elapsed)
+	}
+}
+
+func TestZeroCacheBudgetShareSkipsPeers(t *testing.T) {
+	upstream := startUpstream(t, answerA("192.0.2.1", 300))
+	clients := testClients(t, 2)
+	gm := &GroupManager{}
+	for _, client := range clients {
+		client.Server = upstream
+		gm.AddClientToGroup(client)
+	}
+	clients[1].Set(cacheKey("peer.example.com.", dns.TypeA), addressEntry(t, "peer.example.com.", "192.0.2.2", time.Now(), time.Hour))
+
+	clients[0].Budget = QueryBudget{Total: time.Second, CacheShare: 0}
+	result, err := clients[0].QueryDNS(context.Background(), "peer.example.com.", dns.TypeA)
+	if err != nil || result.Source != SourceUpstream {
+		t.Errorf("with no cache share: source %q, error %v; want the upstream", result.Source, err)
+	}
+}
+
+func TestCacheBudgetShareZeroIsKept(t *testing.T) {
+	if share := *(Config{}).WithDefaults().CacheBudgetShare; share != DefaultCacheBudgetShare {
+		t.Errorf("unset cache_budget_share = %g, want %g", share, DefaultCacheBudgetShare)
+	}
+	zero := 0.0
+	if share := *(Config{CacheBudgetShare: &zero}).WithDefaults().CacheBudgetShare; share != 0 {
+		t.Errorf("cache_budget_share = 0 became %g", share)
+	}
+	var config Config
+	if _, err := toml.Decode("cache_budget_share = 0.0", &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.CacheBudgetShare == nil || *config.CacheBudgetShare != 0 {
+		t.Errorf("decoded cache_budget_share = %v, want 0", config.CacheBudgetShare)
+	}
+}
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *RedisCache) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	return server, &RedisCache{Addr: server.Addr(), Prefix: "test:"}
+}
+
+func TestRedisCacheRoundTrip(t *testing.T) {
+	server, cache := newTestRedis(t)
+	key := cacheKey("example.com.", dns.TypeA)
+	cache.Set(key, addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Minute))
+
+	response, found := cache.Get(key)
+	if !found || len(response.Records) != 1 {
+		t.Fatalf("Get after Set = %v, %v; want the entry", response, found)
+	}
+	if ttl := server.TTL("test:" + key); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Redis TTL = %s, want the entry's", ttl)
+	}
+	if _, found := cache.Get(cacheKey("other.com.", dns.TypeA)); found {
+		t.Error("Get of a missing key found an entry")
+	}
+}
+
+func TestRedisCachePoolsConnections(t *testing.T) {
+	server, cache := newTestRedis(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 4*redisPoolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				cache.Get(cacheKey("example.com.", dns.TypeA))
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(cache.idle); got > redisPoolSize {
+		t.Errorf("%d idle connections, want at most %d", got, redisPoolSize)
+	}
+	before := server.TotalConnectionCount()
+	for i := 0; i < 10; i++ {
+		cache.Get(cacheKey("example.com.", dns.TypeA))
+	}
+	if dialed := server.TotalConnectionCount() - before; dialed != 0 {
+		t.Errorf("sequential commands dialed %d connections, want them to reuse the pool", dialed)
+	}
+}
+
+func TestRedisCacheBacksOffAfterDialFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	cache := &RedisCache{Addr: addr}
+
+	if _, err := cache.do("GET", "k"); err == nil || errors.Is(err, errRedisDown) {
+		t.Fatalf("first command error = %v, want the dial failure", err)
+	}
+	if _, err := cache.do("GET", "k"); !errors.Is(err, errRedisDown) {
+		t.Fatalf("second command error = %v, want errRedisDown without dialing", err)
+	}
+
+	// Once the backoff has passed Redis is tried again.
+	server := miniredis.NewMiniRedis()
+	if err := server.StartAddr(addr); err != nil {
+		t.Skipf("cannot reuse %s: %v", addr, err)
+	}
+	defer server.Close()
+	cache.mu.Lock()
+	cache.downUntil = time.Time{}
+	cache.mu.Unlock()
+	if _, err := cache.do("GET", "k"); err != nil {
+		t.Errorf("command after the backoff: %v", err)
+	}
+	if cache.failures != 0 {
+		t.Errorf("failures = %d after a good dial, want 0", cache.failures)
+	}
+}
+
+func TestInvalidateSendsOneDEL(t *testing.T) {
+	server, cache := newTestRedis(t)
+	client := newTestClient(t, "c", "")
+	client.Shared = cache
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX} {
+		key := cacheKey("example.com.", qtype)
+		cache.Set(key, addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Minute))
+		cache.Set(key+dnssecKeySuffix, addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Minute))
+	}
+	cache.Set(cacheKey("other.com.", dns.TypeA), addressEntry(t, "other.com.", "192.0.2.2", time.Now(), time.Minute))
+
+	before := server.CommandCount()
+	client.Invalidate("example.com")
+	if got := server.CommandCount() - before; got != 1 {
+		t.Errorf("Invalidate sent %d commands to Redis, want one DEL", got)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "test:"+cacheKey("other.com.", dns.TypeA) {
+		t.Errorf("keys left after Invalidate = %v, want only other.com's", keys)
+	}
+}
+
+func TestRedisStoreSharedBetweenClients(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	_, cache := newTestRedis(t)
+	first := newTestClient(t, "first", upstream)
+	second := NewClient("second", upstream, jsonCodec{}, 0)
+	first.Store, second.Store = cache, cache
+
+	if _, err := first.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	result, err := second.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 1 || result.IPs[0] != "192.0.2.1" {
+		t.Errorf("second client's answer = %v, want 192.0.2.1", result.IPs)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream saw %d queries, want 1 with the answer shared through Redis", n)
+	}
+	if n := len(first.Cache) + len(second.Cache); n != 0 {
+		t.Errorf("%d entries cached in memory, want none with a Redis store", n)
+	}
+	if _, err := os.Stat(first.CacheFile); err == nil {
+		t.Error("a cache file was written with a Redis store")
+	}
+}
+
+func TestCacheBackendValidation(t *testing.T) {
+	tests := []struct {
+		config Config
+		ok     bool
+	}{
+		{Config{}, true},
+		{Config{CacheBackend: "memory"}, true},
+		{Config{CacheBackend: "redis", RedisAddr: "127.0.0.1:6379"}, true},
+		{Config{CacheBackend: "redis"}, false},
+		{Config{CacheBackend: "memcached"}, false},
+	}
+	for _, tt := range tests {
+		tt.config.Clients = []ClientConfig{{ID: "c", Server: "192.0.2.53"}}
+		config := tt.config.WithDefaults()
+		err := config.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("Validate(cache_backend %q, redis_addr %q) = %v, want ok %v", tt.config.CacheBackend, tt.config.RedisAddr, err, tt.ok)
+		}
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startDoQ serves handler over DoQ on a loopback port and returns a
+// connection to it.
+func startDoQ(t *testing.T, handler dns.Handler) (*DoQServer, quic.Connection) {
+	t.Helper()
+	listener, err := ListenDoQ("127.0.0.1:0", testCertificate(t), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &DoQServer{Handler: handler, ReadTimeout: time.Second}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}
+	conn, err := quic.DialAddr(context.Background(), listener.Addr().String(), tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return server, conn
+}
+
+// doqExchange sends m on a new stream of conn and reads the response.
+func doqExchange(conn quic.Connection, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	stream.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...))
+	stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(stream, data); err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	return reply, reply.Unpack(data)
+}
+
+func TestDoQAnswersThroughHandler(t *testing.T) {
+	client := newTestClient(t, "doq", startUpstream(t, answerA("192.0.2.1", 300)))
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	_, conn := startDoQ(t, newTestHandler(t, gm))
+
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Id = 0
+		reply, err := doqExchange(conn, m)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if reply.Id != 0 || len(reply.Answer) != 1 {
+			t.Fatalf("query %d: reply id %d with %d answers, want id 0 and one answer", i, reply.Id, len(reply.Answer))
+		}
+		if a, ok := reply.Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("query %d: answer %v, want 192.0.2.1", i, reply.Answer[0])
+		}
+	}
+}
+
+func TestDoQRejectsNonZeroID(t *testing.T) {
+	_, conn := startDoQ(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		t.Error("query with a non-zero ID was handled")
+	}))
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Id = 1234
+	if _, err := doqExchange(conn, m); err == nil {
+		t.Fatal("query with a non-zero ID was answered")
+	}
+	<-conn.Context().Done()
+	var appErr *quic.ApplicationError
+	if err := context.Cause(conn.Context()); !errors.As(err, &appErr) || appErr.ErrorCode != doqProtocolError {
+		t.Errorf("connection closed with %v, want DOQ_PROTOCOL_ERROR", err)
+	}
+}
+
+func TestDoQShutdownFinishesQueries(t *testing.T) {
+	handling := make(chan struct{})
+	server, conn := startDoQ(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		close(handling)
+		time.Sleep(200 * time.Millisecond)
+		answerA("192.0.2.1", 300)(w, r)
+	}))
+
+	type exchange struct {
+		reply *dns.Msg
+		err   error
+	}
+	done := make(chan exchange, 1)
+	go func() {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Id = 0
+		reply, err := doqExchange(conn, m)
+		done <- exchange{reply, err}
+	}()
+	<-handling
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	e := <-done
+	if e.err != nil || len(e.reply.Answer) != 1 {
+		t.Fatalf("query in flight at shutdown: %v, %v; want its answer", e.reply, e.err)
+	}
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Error("connection still open after Shutdown")
+	}
+}
+
+func TestDoQNeedsCertificate(t *testing.T) {
+	config := Config{Clients: []ClientConfig{{ID: "c", Server: "192.0.2.53"}}, DoQAddr: ":853"}.WithDefaults()
+	if err := config.Validate(); err == nil {
+		t.Error("doq_addr without a certificate validated")
+	}
+	config.DoQCertFile, config.DoQKeyFile = "cert.pem", "key.pem"
+	if err := config.Validate(); err != nil {
+		t.Errorf("doq_addr with a certificate: %v", err)
+	}
+}
+
+// writeTestCache writes n fresh entries to a cache file in codec and
+// returns its path.
+func writeTestCache(tb testing.TB, codec CacheCodec, n int) string {
+	tb.Helper()
+	cache := make(map[string]DNSResponse, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		cache[cacheKey(name, dns.TypeA)] = DNSResponse{
+			IPAddress: "192.0.2.1",
+			Records:   []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("192.0.2.1")}},
+			Timestamp: time.Now(),
+			TTL:       time.Hour,
+		}
+	}
+	data, err := codec.Marshal(cache)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(tb.TempDir(), "cache."+codec.Name())
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestGobCodecStopsEarly(t *testing.T) {
+	path := writeTestCache(t, gobCodec{}, 100)
+	cache, truncated, err := readCacheEntries(path, 10, StalePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 10 || !truncated {
+		t.Errorf("read %d entries, truncated %v; want 10, true", len(cache), truncated)
+	}
+}
+
+func TestGobCodecReadsVersion1(t *testing.T) {
+	entry := addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Hour)
+	var buf bytes.Buffer
+	buf.Write(gobMagicV1)
+	if err := gob.NewEncoder(&buf).Encode(map[string]DNSResponse{cacheKey("example.com.", dns.TypeA): entry}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache, _, err := readCacheEntries(path, 0, StalePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, ok := cache[cacheKey("example.com.", dns.TypeA)]; !ok || len(response.Records) != 1 {
+		t.Errorf("version 1 gob file read as %v, want its entry", cache)
+	}
+}
+
+// BenchmarkLoadCache reads a cache file of 100,000 entries with each codec.
+// "json-whole" is how files were read before loading was streamed, the
+// whole file unmarshalled at once, for comparison.
+func BenchmarkLoadCache(b *testing.B) {
+	const entries = 100000
+	for _, codec := range []CacheCodec{jsonCodec{}, gobCodec{}, msgpackCodec{}, wireCodec{}} {
+		path := writeTestCache(b, codec, entries)
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if cache, _, err := readCacheEntries(path, 0, StalePolicy{}); err != nil || len(cache) != entries {
+					b.Fatalf("read %d entries: %v", len(cache), err)
+				}
+			}
+		})
+		b.Run(codec.Name()+"-capped", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := readCacheEntries(path, entries/10, StalePolicy{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	path := writeTestCache(b, jsonCodec{}, entries)
+	b.Run("json-whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var cache map[string]DNSResponse
+			if err := json.Unmarshal(data, &cache); err != nil || len(cache) != entries {
+				b.Fatalf("read %d entries: %v", len(cache), err)
+			}
+		}
+	})
+}
+
+// hangingUpstream receives queries without ever answering them. Each query
+// is counted and announced on the returned channel.
+func hangingUpstream(t *testing.T) (string, *atomic.Int32, <-chan struct{}) {
+	t.Helper()
+	var queries atomic.Int32
+	received := make(chan struct{}, 100)
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		received <- struct{}{}
+	})
+	return addr, &queries, received
+}
+
+func TestQueryDNSCancelledMidResolve(t *testing.T) {
+	addr, queries, received := hangingUpstream(t)
+	client := newTestClient(t, "cancel", addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.QueryDNS(ctx, "example.com", dns.TypeA)
+		done <- err
+	}()
+	<-received
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("QueryDNS succeeded with its context cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("QueryDNS kept resolving after its context was cancelled")
+	}
+	sent := queries.Load()
+	time.Sleep(200 * time.Millisecond)
+	if n := queries.Load(); n != sent {
+		t.Errorf("%d more upstream queries after QueryDNS returned", n-sent)
+	}
+}
+
+// startTCPServer serves handler over TCP through tcpListener and returns
+// its address.
+func startTCPServer(t *testing.T, handler dns.Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          newTCPListener(l, 0),
+		Net:               "tcp",
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return l.Addr().String()
+}
+
+func TestTCPDisconnectCancelsQuery(t *testing.T) {
+	upstream, _, received := hangingUpstream(t)
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "tcp", upstream))
+	h := newTestHandler(t, gm)
+	h.QueryTimeout = 10 * time.Second
+	finished := make(chan struct{})
+	addr := startTCPServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		h.ServeDNS(w, r)
+		close(finished)
+	}))
+
+	conn, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if err := conn.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	conn.Close()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler kept resolving for a client that hung up")
+	}
+}
+
+func TestTCPConnectionUsableAfterWatch(t *testing.T) {
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "tcp", slowUpstream(t, 50*time.Millisecond, "192.0.2.1")))
+	addr := startTCPServer(t, newTestHandler(t, gm))
+
+	conn, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The second query is pipelined while the first is being resolved.
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if err := conn.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		reply, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Errorf("reply %d has %d answers, want 1", i, len(reply.Answer))
+		}
+	}
+}
+
+func TestDoQCancelledStreamCancelsQuery(t *testing.T) {
+	upstream, _, received := hangingUpstream(t)
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "doq", upstream))
+	h := newTestHandler(t, gm)
+	h.QueryTimeout = 10 * time.Second
+	finished := make(chan struct{})
+	_, conn := startDoQ(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		h.ServeDNS(w, r)
+		close(finished)
+	}))
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...))
+	stream.Close()
+	<-received
+	stream.CancelRead(doqRequestCancelled)
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler kept resolving for a cancelled stream")
+	}
+}
+
+func TestCacheCodecsRoundTrip(t *testing.T) {
+	entry := addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Hour)
+	entry.MAC = []byte{1, 2, 3}
+	cache := map[string]DNSResponse{cacheKey("example.com.", dns.TypeA): entry}
+	for _, name := range []string{"json", "gob", "msgpack", "wire"} {
+		codec, err := CacheCodecByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := codec.Marshal(cache)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := detectCacheCodec(data).Name(); got != name {
+			t.Errorf("%s file detected as %s", name, got)
+		}
+		var decoded []DNSResponse
+		if err := codec.Decode(bytes.NewReader(data), func(key string, response DNSResponse) bool {
+			decoded = append(decoded, response)
+			return true
+		}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(decoded) != 1 {
+			t.Fatalf("%s: decoded %d entries, want 1", name, len(decoded))
+		}
+		got := decoded[0]
+		if !got.Timestamp.Equal(entry.Timestamp) || got.TTL != entry.TTL || !bytes.Equal(got.MAC, entry.MAC) ||
+			len(got.Records) != 1 || got.Records[0].String() != entry.Records[0].String() {
+			t.Errorf("%s: decoded %+v, want %+v", name, got, entry)
+		}
+	}
+}
+
+// BenchmarkSaveCache encodes 100,000 entries with each codec and reports
+// the size of the file.
+func BenchmarkSaveCache(b *testing.B) {
+	const entries = 100000
+	for _, codec := range []CacheCodec{jsonCodec{}, gobCodec{}, msgpackCodec{}, wireCodec{}} {
+		path := writeTestCache(b, codec, entries)
+		cache, _, err := readCacheEntries(path, 0, StalePolicy{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			var size int
+			for i := 0; i < b.N; i++ {
+				data, err := codec.Marshal(cache)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "file-bytes")
+		})
+	}
+}
+
+func TestTTLPolicyPrecedence(t *testing.T) {
+	config := Config{
+		MinTTL:       time.Minute,
+		MaxTTL:       time.Hour,
+		TTLOverrides: map[string]time.Duration{"txt": 5 * time.Second, "A": 2 * time.Hour, "MX": 10 * time.Minute},
+	}
+	policy := config.TTLPolicy()
+	tests := []struct {
+		qtype    uint16
+		upstream time.Duration
+		want     time.Duration
+	}{
+		{dns.TypeMX, 30 * time.Second, 10 * time.Minute}, // override replaces the upstream TTL
+		{dns.TypeTXT, time.Hour, time.Minute},            // override, then raised to min_ttl
+		{dns.TypeA, time.Minute, time.Hour},              // override, then lowered to max_ttl
+		{dns.TypeAAAA, 10 * time.Second, time.Minute},    // no override: upstream TTL clamped
+		{dns.TypeAAAA, 30 * time.Minute, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.Apply(tt.qtype, tt.upstream); got != tt.want {
+			t.Errorf("Apply(%s, %s) = %s, want %s", dns.Type(tt.qtype), tt.upstream, got, tt.want)
+		}
+	}
+}
+
+func TestTXTOverrideShortensCaching(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600},
+			Txt: []string{"acme-challenge-token"},
+		})
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "txt", upstream)
+	config := Config{TTLOverrides: map[string]time.Duration{"TXT": time.Second}}
+	client.TTLPolicy = config.TTLPolicy()
+
+	name := "_acme-challenge.example.com"
+	result, err := client.QueryDNS(context.Background(), name, dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TTL != time.Second || result.Records[0].Header().Ttl != 1 {
+		t.Errorf("TXT answer cached for %s with TTL %d, want the 1s override", result.TTL, result.Records[0].Header().Ttl)
+	}
+	if _, err := client.QueryDNS(context.Background(), name, dns.TypeTXT); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("upstream saw %d queries within the override, want 1", n)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := client.QueryDNS(context.Background(), name, dns.TypeTXT); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("upstream saw %d queries after the override ran out, want 2", n)
+	}
+}
+
+// httpsRecord is an HTTPS record with the parameters browsers bootstrap
+// from: ALPN for HTTP/3, an alternative port, an address hint and an ECH
+// configuration.
+func httpsRecord(name string) *dns.HTTPS {
+	return &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+		Priority: 1,
+		Target:   "svc.example.com.",
+		Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h3", "h2"}},
+			&dns.SVCBPort{Port: 8443},
+			&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("192.0.2.1").To4()}},
+			&dns.SVCBECHConfig{ECH: []byte{0x00, 0x45, 0xfe, 0x0d, 0x00, 0x41, 0x2a}},
+		},
+	}}
+}
+
+// withoutTTL is rr's presentation format with its TTL zeroed, since cached
+// answers count theirs down.
+func withoutTTL(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return rr.String()
+}
+
+func TestHTTPSRecordRoundTrip(t *testing.T) {
+	want := httpsRecord("example.com.")
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeHTTPS {
+			m.Answer = append(m.Answer, httpsRecord(r.Question[0].Name))
+		}
+		w.WriteMsg(m)
+	})
+	check := func(what string, m *dns.Msg) {
+		t.Helper()
+		if len(m.Answer) != 1 {
+			t.Fatalf("%s: %d answers, want the HTTPS record", what, len(m.Answer))
+		}
+		got, ok := m.Answer[0].(*dns.HTTPS)
+		if !ok || withoutTTL(got) != withoutTTL(want) {
+			t.Errorf("%s: answer %v, want %v", what, m.Answer[0], want)
+		}
+	}
+
+	inTempDir(t)
+	for _, format := range []string{"json", "gob", "msgpack", "wire"} {
+		codec, err := CacheCodecByName(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient("https-"+format, upstream, codec, 0)
+		gm := &GroupManager{}
+		gm.AddClientToGroup(client)
+		check(format+", from upstream", serve(t, newTestHandler(t, gm), "example.com.", dns.TypeHTTPS))
+
+		// Reloaded from the cache file, with no upstream to fall back on.
+		reloaded := NewClient("https-"+format, "", codec, 0)
+		if _, ok := reloaded.Peek("example.com.", dns.TypeHTTPS); !ok {
+			t.Fatalf("%s: HTTPS entry not reloaded from %s", format, reloaded.CacheFile)
+		}
+		gm = &GroupManager{}
+		gm.AddClientToGroup(reloaded)
+		check(format+", reloaded", serve(t, newTestHandler(t, gm), "example.com.", dns.TypeHTTPS))
+	}
+}
+
+// withCookie returns a query for name carrying cookie, given in hex.
+func withCookie(name string, cookie string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return r
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	jar, err := NewCookieJar("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}
+	const clientCookie = "0102030405060708"
+
+	reply, rcode := jar.Check(withCookie("example.com.", clientCookie), remote)
+	if rcode != dns.RcodeSuccess || reply == nil {
+		t.Fatalf("first query: rcode %s, cookie %v; want NOERROR and a server cookie", dns.RcodeToString[rcode], reply)
+	}
+	if !strings.HasPrefix(reply.Cookie, clientCookie) || len(reply.Cookie) < 2*(clientCookieLen+8) {
+		t.Fatalf("reply cookie %s does not echo the client cookie followed by a server cookie", reply.Cookie)
+	}
+
+	again, rcode := jar.Check(withCookie("example.com.", reply.Cookie), remote)
+	if rcode != dns.RcodeSuccess || again.Cookie != reply.Cookie {
+		t.Errorf("repeat query with the server cookie: rcode %s, cookie %v; want NOERROR and the same cookie", dns.RcodeToString[rcode], again)
+	}
+
+	forged := reply.Cookie[:len(reply.Cookie)-2] + "00"
+	if forged == reply.Cookie {
+		forged = reply.Cookie[:len(reply.Cookie)-2] + "01"
+	}
+	if fixed, rcode := jar.Check(withCookie("example.com.", forged), remote); rcode != dns.RcodeBadCookie || fixed.Cookie != reply.Cookie {
+		t.Errorf("forged server cookie: rcode %s, cookie %v; want BADCOOKIE with the right cookie", dns.RcodeToString[rcode], fixed)
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.11"), Port: 5353}
+	if _, rcode := jar.Check(withCookie("example.com.", reply.Cookie), other); rcode != dns.RcodeBadCookie {
+		t.Errorf("server cookie from another address: rcode %s, want BADCOOKIE", dns.RcodeToString[rcode])
+	}
+	if _, rcode := jar.Check(withCookie("example.com.", "0102"), remote); rcode != dns.RcodeFormatError {
+		t.Errorf("short cookie: rcode %s, want FORMERR", dns.RcodeToString[rcode])
+	}
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	if cookie, rcode := jar.Check(plain, remote); cookie != nil || rcode != dns.RcodeSuccess {
+		t.Errorf("query without EDNS: cookie %v, rcode %s; want none and NOERROR", cookie, dns.RcodeToString[rcode])
+	}
+}
+
+func TestHandlerAnswersWithCookie(t *testing.T) {
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "cookie", startUpstream(t, answerA("192.0.2.1", 300))))
+	h := newTestHandler(t, gm)
+
+	w := newRecorder()
+	h.ServeDNS(w, withCookie("example.com.", "0102030405060708"))
+	var cookie *dns.EDNS0_COOKIE
+	if opt := w.msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				cookie = c
+			}
+		}
+	}
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 || cookie == nil {
+		t.Fatalf("reply rcode %s, %d answers, cookie %v; want an answer with a cookie", dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer), cookie)
+	}
+
+	w = newRecorder()
+	h.ServeDNS(w, withCookie("example.com.", "0102030405060708"+strings.Repeat("00", 16)))
+	if w.msg.Rcode != dns.RcodeBadCookie || len(w.msg.Answer) != 0 {
+		t.Errorf("bad server cookie: rcode %s with %d answers, want BADCOOKIE and no answer", dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer))
+	}
+}
+
+func TestRelativeAndFQDNShareOneEntry(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	clients := testClients(t, 2)
+	gm := &GroupManager{}
+	for _, c := range clients {
+		c.Upstreams = []string{upstream}
+		gm.AddClientToGroup(c)
+	}
+	first, second := clients[0], clients[1]
+	if first.Group() != second.Group() {
+		t.Fatal("test clients are not in one group")
+	}
+
+	if _, err := first.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	result, err := first.QueryDNS(context.Background(), "example.com.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != SourceLocal {
+		t.Errorf("FQDN query after a relative one answered from %s, want %s", result.Source, SourceLocal)
+	}
+	if len(first.Cache) != 1 {
+		t.Errorf("%d cache entries for one name, want 1", len(first.Cache))
+	}
+	if _, ok := first.Peek("example.com", dns.TypeA); !ok {
+		t.Error("Peek of the relative name missed the entry")
+	}
+
+	result, err = second.QueryDNS(context.Background(), "example.com.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != SourcePeer {
+		t.Errorf("peer lookup of the FQDN answered from %s, want %s", result.Source, SourcePeer)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream saw %d queries, want 1", n)
+	}
+}
+
+const testZone = `$TTL 3600
+@       IN SOA ns1.lab.local. admin.lab.local. 1 7200 900 1209600 300
+        IN NS  ns1.lab.local.
+ns1     IN A   10.0.0.53
+www     IN A   10.0.0.80
+web     IN CNAME www
+*.dev   IN A   10.0.0.99
+`
+
+// loadTestZone loads testZone as lab.local.
+func loadTestZone(t *testing.T) *Zone {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lab.local.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	zone, err := LoadZone(path, "lab.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+func TestZoneAnswersAuthoritatively(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "zone", upstream))
+	h := newTestHandler(t, gm)
+	h.Zone = loadTestZone(t)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		want    string // address of the last answer record
+	}{
+		{"www.lab.local.", dns.TypeA, dns.RcodeSuccess, 1, "10.0.0.80"},
+		{"WWW.Lab.Local.", dns.TypeA, dns.RcodeSuccess, 1, "10.0.0.80"},
+		{"web.lab.local.", dns.TypeA, dns.RcodeSuccess, 2, "10.0.0.80"},
+		{"a.dev.lab.local.", dns.TypeA, dns.RcodeSuccess, 1, "10.0.0.99"},
+		{"www.lab.local.", dns.TypeAAAA, dns.RcodeSuccess, 0, ""},
+		{"missing.lab.local.", dns.TypeA, dns.RcodeNameError, 0, ""},
+	}
+	for _, tt := range tests {
+		m := serve(t, h, tt.name, tt.qtype)
+		if !m.Authoritative || m.Rcode != tt.rcode || len(m.Answer) != tt.answers {
+			t.Errorf("%s %s: AA %v, rcode %s, %d answers; want AA, %s, %d answers", tt.name, dns.Type(tt.qtype),
+				m.Authoritative, dns.RcodeToString[m.Rcode], len(m.Answer), dns.RcodeToString[tt.rcode], tt.answers)
+			continue
+		}
+		if tt.answers == 0 {
+			if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("%s %s: authority %v, want the zone's SOA", tt.name, dns.Type(tt.qtype), m.Ns)
+			}
+		} else if got := addressOf(m.Answer[len(m.Answer)-1]); got != tt.want {
+			t.Errorf("%s %s: answer %s, want %s", tt.name, dns.Type(tt.qtype), got, tt.want)
+		}
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("upstream saw %d queries for names in the zone, want none", n)
+	}
+
+	m := serve(t, h, "example.com.", dns.TypeA)
+	if m.Authoritative || len(m.Answer) != 1 || queries.Load() != 1 {
+		t.Errorf("name outside the zone: AA %v, %d answers, %d upstream queries; want it resolved upstream", m.Authoritative, len(m.Answer), queries.Load())
+	}
+}
+
+func TestCheckQuery(t *testing.T) {
+	query := func(edit func(r *dns.Msg)) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		edit(r)
+		return r
+	}
+	tests := []struct {
+		what  string
+		r     *dns.Msg
+		rcode int
+	}{
+		{"plain query", query(func(r *dns.Msg) {}), dns.RcodeSuccess},
+		{"no question", query(func(r *dns.Msg) { r.Question = nil }), dns.RcodeFormatError},
+		{"two questions", query(func(r *dns.Msg) { r.Question = append(r.Question, r.Question[0]) }), dns.RcodeFormatError},
+		{"name too long", query(func(r *dns.Msg) { r.Question[0].Name = strings.Repeat("a.", 128) }), dns.RcodeFormatError},
+		{"label too long", query(func(r *dns.Msg) { r.Question[0].Name = strings.Repeat("a", 64) + ".com." }), dns.RcodeFormatError},
+		{"CHAOS class", query(func(r *dns.Msg) { r.Question[0].Qclass = dns.ClassCHAOS }), dns.RcodeNotImplemented},
+		{"response", query(func(r *dns.Msg) { r.Response = true }), dns.RcodeNotImplemented},
+		{"NOTIFY", query(func(r *dns.Msg) { r.Opcode = dns.OpcodeNotify }), dns.RcodeNotImplemented},
+	}
+	for _, tt := range tests {
+		if got := checkQuery(tt.r); got != tt.rcode {
+			t.Errorf("%s: checkQuery = %s, want %s", tt.what, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestNameOverLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxLength int
+		maxLabels int
+		over      bool
+	}{
+		{"example.com.", DefaultMaxNameLength, DefaultMaxLabels, false},
+		{"example.com", DefaultMaxNameLength, DefaultMaxLabels, false},
+		{"a.b.c.example.com.", DefaultMaxNameLength, 4, true},
+		{"a.b.example.com.", DefaultMaxNameLength, 4, false},
+		{"example.com.", 13, DefaultMaxLabels, false}, // 13 octets in wire form
+		{"example.com.", 12, DefaultMaxLabels, true},
+		{strings.Repeat("a.", 127), DefaultMaxNameLength, DefaultMaxLabels, false},
+		{strings.Repeat("a.", 127), DefaultMaxNameLength, 100, true},
+	}
+	for _, tt := range tests {
+		if problem := nameOverLimits(tt.name, tt.maxLength, tt.maxLabels); (problem != "") != tt.over {
+			t.Errorf("nameOverLimits(%q, %d, %d) = %q, want over the limits: %v", tt.name, tt.maxLength, tt.maxLabels, problem, tt.over)
+		}
+	}
+}
+
+// FuzzServeDNS feeds arbitrary messages through the handler, which must
+// never panic and must answer with the query's ID, or not at all.
+func FuzzServeDNS(f *testing.F) {
+	for _, seed := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("_whoami.internal.", dns.TypeTXT),
+		new(dns.Msg).SetQuestion(strings.Repeat("a.", 120), dns.TypeANY),
+		withCookie("example.com.", "0102030405060708"),
+		{MsgHdr: dns.MsgHdr{Id: 7, Opcode: dns.OpcodeUpdate}},
+	} {
+		packed, err := seed.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packed)
+	}
+	f.Add([]byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1})
+
+	wd, err := os.Getwd()
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := os.Chdir(f.TempDir()); err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { os.Chdir(wd) })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		f.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: conn, Handler: answerA("192.0.2.1", 300)}
+	go upstream.ActivateAndServe()
+	f.Cleanup(func() { upstream.Shutdown() })
+	gm := &GroupManager{}
+	gm.AddClientToGroup(NewClient("fuzz", conn.LocalAddr().String(), jsonCodec{}, 0))
+	cookies, err := NewCookieJar("fuzz secret")
+	if err != nil {
+		f.Fatal(err)
+	}
+	h := &Handler{
+		Groups:        gm,
+		Cookies:       cookies,
+		SpecialUse:    true,
+		MaxHops:       DefaultMaxForwardHops,
+		MaxNameLength: DefaultMaxNameLength,
+		MaxLabels:     DefaultMaxLabels,
+		QueryTimeout:  time.Second,
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := new(dns.Msg)
+		if err := r.Unpack(data); err != nil {
+			return // the server drops what does not parse
+		}
+		w := newRecorder()
+		h.ServeDNS(w, r)
+		if w.msg != nil && w.msg.Id != r.Id {
+			t.Errorf("reply ID %d, want the query's %d", w.msg.Id, r.Id)
+		}
+	})
+}
+
+func TestQueryResultSourceAndRcode(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if strings.HasPrefix(r.Question[0].Name, "missing.") {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return
+		}
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	client := newTestClient(t, "result", upstream)
+
+	result, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != SourceUpstream || result.Rcode != dns.RcodeSuccess || len(result.IPs) != 1 || result.IPs[0] != "192.0.2.1" {
+		t.Errorf("first answer = %+v, want 192.0.2.1 from upstream", result)
+	}
+	if result.TTL <= 0 || result.TTL > 300*time.Second || len(result.Records) != 1 {
+		t.Errorf("first answer TTL %s with %d records, want up to 300s and the A record", result.TTL, len(result.Records))
+	}
+
+	result, err = client.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if err != nil || result.Source != SourceLocal {
+		t.Errorf("second answer from %q (%v), want %q", result.Source, err, SourceLocal)
+	}
+
+	result, err = client.QueryDNS(context.Background(), "missing.example.com", dns.TypeA)
+	if err == nil || result.Rcode != dns.RcodeNameError {
+		t.Errorf("NXDOMAIN: rcode %s, error %v; want NXDOMAIN and an error", dns.RcodeToString[result.Rcode], err)
+	}
+
+	dead, _, _ := hangingUpstream(t)
+	failing := NewClient("failing", dead, jsonCodec{}, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err = failing.QueryDNS(ctx, "example.com", dns.TypeA)
+	if err == nil || result.Rcode != dns.RcodeServerFailure {
+		t.Errorf("failed resolution: rcode %s, error %v; want SERVFAIL and an error", dns.RcodeToString[result.Rcode], err)
+	}
+}
+
+// startUpstreamUDPAndTCP serves handler over UDP and TCP on the same
+// loopback port and returns its address.
+func startUpstreamUDPAndTCP(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", l.Addr().String())
+		if err != nil {
+			l.Close()
+			continue
+		}
+		for _, server := range []*dns.Server{{PacketConn: conn, Handler: handler}, {Listener: l, Handler: handler}} {
+			started := make(chan struct{})
+			server.NotifyStartedFunc = func() { close(started) }
+			go server.ActivateAndServe()
+			<-started
+			t.Cleanup(func() { server.Shutdown() })
+		}
+		return l.Addr().String()
+	}
+	t.Fatal("no port free for both UDP and TCP")
+	return ""
+}
+
+func TestTruncatedAnswerRetriedOverTCP(t *testing.T) {
+	var udpQueries, tcpQueries atomic.Int32
+	upstream := startUpstreamUDPAndTCP(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		count := 20
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			udpQueries.Add(1)
+			m.Truncated = true
+			count = 1
+		} else {
+			tcpQueries.Add(1)
+		}
+		for i := 0; i < count; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(192, 0, 2, byte(i+1)),
+			})
+		}
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "tc", upstream)
+
+	result, err := client.QueryDNS(context.Background(), "big.example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Records) != 20 {
+		t.Errorf("answer has %d records, want the 20 of the TCP answer", len(result.Records))
+	}
+	if udpQueries.Load() != 1 || tcpQueries.Load() != 1 {
+		t.Errorf("upstream saw %d UDP and %d TCP queries, want one of each", udpQueries.Load(), tcpQueries.Load())
+	}
+	if cached, ok := client.Peek("big.example.com", dns.TypeA); !ok || len(cached.Records) != 20 {
+		t.Errorf("cached %d records, want the complete answer", len(cached.Records))
+	}
+}
+
+func TestPeekLeavesCacheUnchanged(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	client := newTestClient(t, "peek", upstream)
+
+	if _, ok := client.Peek("example.com", dns.TypeA); ok {
+		t.Fatal("Peek found an entry in an empty cache")
+	}
+	if n := len(client.Cache); n != 0 || queries.Load() != 0 {
+		t.Fatalf("after a Peek miss: %d entries, %d upstream queries; want none", n, queries.Load())
+	}
+	if _, err := os.Stat(client.CacheFile); err == nil {
+		t.Error("a Peek miss wrote the cache file")
+	}
+
+	if _, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	before := client.Cache[cacheKey("example.com.", dns.TypeA)]
+	response, ok := client.Peek("example.com", dns.TypeA)
+	if !ok || !response.Fresh() || len(response.Records) != 1 {
+		t.Fatalf("Peek after resolving = %+v, %v; want the fresh entry", response, ok)
+	}
+	if after := client.Cache[cacheKey("example.com.", dns.TypeA)]; after.Hits != before.Hits {
+		t.Errorf("Peek counted a hit: %d hits, want %d", after.Hits, before.Hits)
+	}
+
+	// Expired entries are still returned, marked as not fresh.
+	client.Cache[cacheKey("old.example.com.", dns.TypeA)] = addressEntry(t, "old.example.com.", "192.0.2.2", time.Now().Add(-time.Hour), time.Minute)
+	if response, ok := client.Peek("old.example.com", dns.TypeA); !ok || response.Fresh() {
+		t.Errorf("Peek of an expired entry = fresh %v, found %v; want it found and not fresh", response.Fresh(), ok)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream saw %d queries, want only the one QueryDNS made", n)
+	}
+}
+
+func TestAdminCacheLookup(t *testing.T) {
+	client := newTestClient(t, "c0", "")
+	client.Set(cacheKey("example.com.", dns.TypeA), addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Minute))
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	mux := adminMux([]*GroupManager{gm}, false)
+
+	lookup := func(query string) (int, []map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/cache/lookup?"+query, nil))
+		var entries []map[string]interface{}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+		}
+		return w.Code, entries
+	}
+	code, entries := lookup("name=example.com&type=A")
+	if code != http.StatusOK || len(entries) != 1 || entries[0]["client"] != "c0" || entries[0]["fresh"] != true {
+		t.Errorf("lookup of a cached name: %d %v, want c0's fresh entry", code, entries)
+	}
+	if code, entries := lookup("name=example.com&type=AAAA"); code != http.StatusOK || len(entries) != 0 {
+		t.Errorf("lookup of an uncached type: %d %v, want no entries", code, entries)
+	}
+	if code, _ := lookup("type=A"); code != http.StatusBadRequest {
+		t.Errorf("lookup without a name: %d, want 400", code)
+	}
+	if code, _ := lookup("name=example.com&type=BOGUS"); code != http.StatusBadRequest {
+		t.Errorf("lookup of an unknown type: %d, want 400", code)
+	}
+	if len(client.Cache) != 1 {
+		t.Errorf("lookups left %d entries, want 1", len(client.Cache))
+	}
+}
+
+func TestFallbackIPOnlyForTransientFailures(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		switch {
+		case strings.HasPrefix(r.Question[0].Name, "broken."):
+			m.SetRcode(r, dns.RcodeServerFailure)
+		case strings.HasPrefix(r.Question[0].Name, "missing."):
+			m.SetRcode(r, dns.RcodeNameError)
+		case strings.HasPrefix(r.Question[0].Name, "nodata."):
+			m.SetReply(r)
+		default:
+			answerA("192.0.2.1", 300)(w, r)
+			return
+		}
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "fallback", upstream)
+	client.BreakerSettings = BreakerSettings{Threshold: 100, Window: time.Minute, Cooldown: time.Minute}
+
+	if _, err := client.QueryDNS(context.Background(), "broken.example.com", dns.TypeA); err == nil {
+		t.Error("SERVFAIL without fallback_ip answered")
+	}
+
+	client.FallbackIP = net.ParseIP("10.0.0.1")
+	result, err := client.QueryDNS(context.Background(), "broken.example.com", dns.TypeA)
+	if err != nil {
+		t.Fatalf("SERVFAIL with fallback_ip: %v", err)
+	}
+	if result.Source != SourceFallback || len(result.IPs) != 1 || result.IPs[0] != "10.0.0.1" || result.TTL != FallbackTTL {
+		t.Errorf("SERVFAIL with fallback_ip = %+v, want 10.0.0.1 for %s from the fallback", result, FallbackTTL)
+	}
+	if _, ok := client.Peek("broken.example.com", dns.TypeA); ok {
+		t.Error("the fallback answer was cached")
+	}
+
+	result, err = client.QueryDNS(context.Background(), "missing.example.com", dns.TypeA)
+	if err == nil || result.Rcode != dns.RcodeNameError {
+		t.Errorf("NXDOMAIN with fallback_ip: rcode %s, error %v; want NXDOMAIN kept", dns.RcodeToString[result.Rcode], err)
+	}
+	result, _ = client.QueryDNS(context.Background(), "nodata.example.com", dns.TypeA)
+	if result.Source == SourceFallback || result.Rcode != dns.RcodeSuccess || len(result.IPs) != 0 {
+		t.Errorf("NODATA with fallback_ip = %+v, want NODATA kept", result)
+	}
+	// The system resolver reports NODATA as an error.
+	noData := fmt.Errorf("%w: no A record for nodata.example.com from the system resolver", ErrNoData)
+	if result, ok := client.fallbackResult("nodata.example.com.", dns.TypeA, noData); ok {
+		t.Errorf("NODATA error replaced by %+v", result)
+	}
+	if _, err := client.QueryDNS(context.Background(), "broken.example.com", dns.TypeAAAA); err == nil {
+		t.Error("an IPv4 fallback_ip answered an AAAA query")
+	}
+}
+
+func TestCacheDisabledClientNeverCaches(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	clients := testClients(t, 2)
+	forwarder, cacher := clients[0], clients[1]
+	gm := &GroupManager{}
+	for _, c := range clients {
+		c.Upstreams = []string{upstream}
+		gm.AddClientToGroup(c)
+	}
+	var config ClientConfig
+	if err := toml.Unmarshal([]byte("id = \"c0\"\ncache = false"), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.CacheEnabled() {
+		t.Fatal("cache = false parsed as enabled")
+	}
+	forwarder.DisableCache()
+
+	for i := 0; i < 2; i++ {
+		result, err := forwarder.QueryDNS(context.Background(), "example.com", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Source != SourceUpstream {
+			t.Errorf("query %d answered from %s, want upstream every time", i, result.Source)
+		}
+	}
+	if n := len(forwarder.Cache); n != 0 {
+		t.Errorf("cache-disabled client holds %d entries", n)
+	}
+	forwarder.Set(cacheKey("other.com.", dns.TypeA), addressEntry(t, "other.com.", "192.0.2.2", time.Now(), time.Minute))
+	if n := len(forwarder.Cache); n != 0 {
+		t.Errorf("Set stored %d entries in a cache-disabled client", n)
+	}
+	if _, err := os.Stat(forwarder.CacheFile); err == nil {
+		t.Error("cache-disabled client wrote a cache file")
+	}
+
+	// The peer finds nothing in the forwarder and caches for itself.
+	if result, err := cacher.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil || result.Source != SourceUpstream {
+		t.Errorf("caching peer answered from %q (%v), want upstream", result.Source, err)
+	}
+	if len(cacher.Cache) != 1 || queries.Load() != 3 {
+		t.Errorf("caching peer holds %d entries after %d upstream queries, want 1 after 3", len(cacher.Cache), queries.Load())
+	}
+}
+
+func TestRewriteActions(t *testing.T) {
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "www.shop.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "shop.cdn.net."}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "shop.cdn.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1").To4()}
+	response := DNSResponse{IPAddress: "192.0.2.1", Records: []dns.RR{cname, a}, Timestamp: time.Now(), TTL: 300 * time.Second}
+
+	strip := RewriteRule{Name: "shop.com", Action: RewriteStripCNAME}
+	flat := strip.Apply("www.shop.com.", dns.TypeA, response)
+	if len(flat.Records) != 1 || flat.Records[0].Header().Name != "www.shop.com." || addressOf(flat.Records[0]) != "192.0.2.1" {
+		t.Errorf("strip-cname = %v, want one A record for www.shop.com.", flat.Records)
+	}
+	if response.Records[1].Header().Name != "shop.cdn.net." {
+		t.Error("strip-cname changed the original records")
+	}
+	if again := strip.Apply("www.shop.com.", dns.TypeA, response); fmt.Sprint(again.Records) != fmt.Sprint(flat.Records) {
+		t.Errorf("strip-cname is not deterministic: %v, then %v", flat.Records, again.Records)
+	}
+
+	replace := RewriteRule{Name: "cdn.net", Type: "A", Action: RewriteReplaceIP, From: "192.0.2.1", To: "10.0.0.1"}
+	replaced := replace.Apply("shop.cdn.net.", dns.TypeA, DNSResponse{IPAddress: "192.0.2.1", Records: []dns.RR{a}})
+	if len(replaced.Records) != 1 || addressOf(replaced.Records[0]) != "10.0.0.1" || replaced.IPAddress != "10.0.0.1" {
+		t.Errorf("replace-ip = %v (%s), want 10.0.0.1", replaced.Records, replaced.IPAddress)
+	}
+	if a.A.String() != "192.0.2.1" {
+		t.Error("replace-ip changed the original record")
+	}
+
+	// Rules only apply to their name and type.
+	if got := replace.Apply("shop.cdn.net.", dns.TypeAAAA, response); len(got.Records) != 2 {
+		t.Errorf("replace-ip for A rewrote an AAAA answer: %v", got.Records)
+	}
+	if got := strip.Apply("www.other.com.", dns.TypeA, response); len(got.Records) != 2 {
+		t.Errorf("strip-cname for shop.com rewrote www.other.com: %v", got.Records)
+	}
+
+	for _, bad := range []RewriteRule{
+		{Name: "shop.com", Action: "drop"},
+		{Name: "shop.com", Action: RewriteReplaceIP, From: "192.0.2.1"},
+		{Name: "shop.com", Action: RewriteReplaceIP, From: "192.0.2.1", To: "2001:db8::1"},
+		{Name: "shop.com", Type: "BOGUS", Action: RewriteStripCNAME},
+	} {
+		if err := bad.check(); err == nil {
+			t.Errorf("rule %+v passed its check", bad)
+		}
+	}
+}
+
+func TestRewritesApplyBeforeCaching(t *testing.T) {
+	upstream := startUpstream(t, answerA("192.0.2.1", 300))
+	client := newTestClient(t, "rewrite", upstream)
+	client.Rewrites = []RewriteRule{{Name: "example.com", Action: RewriteReplaceIP, From: "192.0.2.1", To: "10.0.0.1"}}
+
+	result, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 1 || result.IPs[0] != "10.0.0.1" {
+		t.Errorf("answer %v, want the rewritten 10.0.0.1", result.IPs)
+	}
+	if cached, ok := client.Peek("example.com", dns.TypeA); !ok || addressOf(cached.Records[0]) != "10.0.0.1" {
+		t.Errorf("cached %v, want the rewritten answer", cached.Records)
+	}
+}
+
+func TestOfflineNeverQueriesUpstream(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	client := newTestClient(t, "offline", upstream)
+	client.Offline = true
+	client.OfflineRcode = dns.RcodeServerFailure
+	client.Set(cacheKey("cached.com.", dns.TypeA), addressEntry(t, "cached.com.", "192.0.2.9", time.Now(), time.Minute))
+
+	result, err := client.QueryDNS(context.Background(), "cached.com", dns.TypeA)
+	if err != nil || result.Source != SourceLocal {
+		t.Errorf("cached name answered from %q (%v), want the cache", result.Source, err)
+	}
+	var rcodeErr *RcodeError
+	if _, err := client.QueryDNS(context.Background(), "missing.com", dns.TypeA); !errors.As(err, &rcodeErr) || rcodeErr.Rcode != dns.RcodeServerFailure {
+		t.Errorf("miss returned %v, want SERVFAIL", err)
+	}
+	client.OfflineRcode = dns.RcodeNameError
+	if _, err := client.QueryDNS(context.Background(), "missing.com", dns.TypeA); !errors.As(err, &rcodeErr) || rcodeErr.Rcode != dns.RcodeNameError {
+		t.Errorf("miss returned %v, want NXDOMAIN", err)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("offline client sent %d upstream queries", n)
+	}
+
+	for _, rcode := range []string{"", "servfail", "nxdomain"} {
+		config := Config{Clients: []ClientConfig{{ID: "c", Server: "192.0.2.53"}}, OfflineRcode: rcode}
+		if err := config.Validate(); err != nil {
+			t.Errorf("offline_rcode %q: %v", rcode, err)
+		}
+	}
+	config := Config{Clients: []ClientConfig{{ID: "c", Server: "192.0.2.53"}}, OfflineRcode: "refused"}
+	if err := config.Validate(); err == nil {
+		t.Error("offline_rcode \"refused\" passed validation")
+	}
+}
+
+// extendedErrorOf returns the EDE option in m, or nil.
+func extendedErrorOf(m *dns.Msg) *dns.EDNS0_EDE {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede
+			}
+		}
+	}
+	return nil
+}
+
+func TestExtendedDNSErrors(t *testing.T) {
+	hanging, _, _ := hangingUpstream(t)
+	blocklist, err := NewBlocklist("", []string{"ads.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		handler  dns.HandlerFunc
+		upstream string
+		edns     bool
+		want     int
+		wantCode uint16
+		noEDE    bool
+	}{
+		{name: "filtered", handler: answerA("192.0.2.1", 300), edns: true, want: dns.RcodeNameError, wantCode: dns.ExtendedErrorCodeFiltered},
+		{name: "timeout", upstream: hanging, edns: true, want: dns.RcodeServerFailure, wantCode: dns.ExtendedErrorCodeNetworkError},
+		{name: "servfail", handler: answerRcode(dns.RcodeServerFailure), edns: true, want: dns.RcodeServerFailure, wantCode: dns.ExtendedErrorCodeOther},
+		{name: "refused", handler: answerRcode(dns.RcodeRefused), edns: true, want: dns.RcodeServerFailure, wantCode: dns.ExtendedErrorCodeNoReachableAuthority},
+		{name: "no edns", handler: answerRcode(dns.RcodeServerFailure), want: dns.RcodeServerFailure, noEDE: true},
+		{name: "answered", handler: answerA("192.0.2.1", 300), edns: true, want: dns.RcodeSuccess, noEDE: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := tt.upstream
+			if upstream == "" {
+				upstream = startUpstream(t, tt.handler)
+			}
+			gm := &GroupManager{}
+			gm.AddClientToGroup(newTestClient(t, "ede", upstream))
+			h := newTestHandler(t, gm)
+			h.QueryTimeout = 500 * time.Millisecond
+			h.Blocklist = blocklist
+
+			name := "example.com."
+			if tt.name == "filtered" {
+				name = "ads.example.com."
+			}
+			r := new(dns.Msg)
+			r.SetQuestion(name, dns.TypeA)
+			if tt.edns {
+				r.SetEdns0(dns.DefaultMsgSize, false)
+			}
+			w := newRecorder()
+			h.ServeDNS(w, r)
+			if w.msg.Rcode != tt.want {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[w.msg.Rcode], dns.RcodeToString[tt.want])
+			}
+			ede := extendedErrorOf(w.msg)
+			switch {
+			case tt.noEDE && ede != nil:
+				t.Errorf("unexpected EDE %d (%q)", ede.InfoCode, ede.ExtraText)
+			case !tt.noEDE && ede == nil:
+				t.Errorf("no EDE, want code %d", tt.wantCode)
+			case !tt.noEDE && ede.InfoCode != tt.wantCode:
+				t.Errorf("EDE code %d (%q), want %d", ede.InfoCode, ede.ExtraText, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRespectZeroTTL(t *testing.T) {
+	for _, respect := range []bool{true, false} {
+		t.Run(fmt.Sprintf("respect=%t", respect), func(t *testing.T) {
+			var queries atomic.Int32
+			upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				queries.Add(1)
+				answerA("192.0.2.1", 0)(w, r)
+			})
+			client := newTestClient(t, "zero", upstream)
+			config := Config{MinTTL: time.Minute, RespectZeroTTL: &respect}
+			client.TTLPolicy = config.TTLPolicy()
+
+			for i := 0; i < 2; i++ {
+				result, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.IPs) != 1 || result.IPs[0] != "192.0.2.1" {
+					t.Errorf("query %d answered %v, want 192.0.2.1", i, result.IPs)
+				}
+			}
+			_, cached := client.Peek("example.com", dns.TypeA)
+			if respect {
+				if cached || queries.Load() != 2 {
+					t.Errorf("zero TTL: cached %t after %d upstream queries, want uncached after 2", cached, queries.Load())
+				}
+				return
+			}
+			if !cached || queries.Load() != 1 {
+				t.Errorf("zero TTL raised to min_ttl: cached %t after %d upstream queries, want cached after 1", cached, queries.Load())
+			}
+		})
+	}
+	var config Config
+	if err := toml.Unmarshal([]byte("min_ttl = \"1m\""), &config); err != nil {
+		t.Fatal(err)
+	}
+	if got := config.TTLPolicy().Apply(dns.TypeA, 0); got != 0 {
+		t.Errorf("default policy cached a zero TTL for %s, want it respected", got)
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		in       string
+		protocol string
+		want     Upstream
+		wantErr  bool
+	}{
+		{in: "8.8.8.8", want: Upstream{Scheme: "udp", Host: "8.8.8.8", Port: "53"}},
+		{in: "8.8.8.8:5353", want: Upstream{Scheme: "udp", Host: "8.8.8.8", Port: "5353"}},
+		{in: "2001:db8::1", want: Upstream{Scheme: "udp", Host: "2001:db8::1", Port: "53"}},
+		{in: "[2001:db8::1]", want: Upstream{Scheme: "udp", Host: "2001:db8::1", Port: "53"}},
+		{in: "[2001:db8::1]:5353", want: Upstream{Scheme: "udp", Host: "2001:db8::1", Port: "5353"}},
+		{in: "tcp://dns.example", want: Upstream{Scheme: "tcp", Host: "dns.example", Port: "53"}},
+		{in: "tls://dns.example", want: Upstream{Scheme: "tls", Host: "dns.example", Port: "853"}},
+		{in: "tls://[2001:db8::1]:8853", want: Upstream{Scheme: "tls", Host: "2001:db8::1", Port: "8853"}},
+		{in: "https://dns.example", want: Upstream{Scheme: "https", Host: "dns.example", Port: "443", Path: "/dns-query"}},
+		{in: "https://dns.example:8443/resolve", want: Upstream{Scheme: "https", Host: "dns.example", Port: "8443", Path: "/resolve"}},
+		{in: "dns.example", protocol: "dot", want: Upstream{Scheme: "tls", Host: "dns.example", Port: "853"}},
+		{in: "dns.example", protocol: "doh", want: Upstream{Scheme: "https", Host: "dns.example", Port: "443", Path: "/dns-query"}},
+		{in: "tls://dns.example", protocol: "dot", want: Upstream{Scheme: "tls", Host: "dns.example", Port: "853"}},
+		{in: "", wantErr: true},
+		{in: "8.8.8.8:0", wantErr: true},
+		{in: "8.8.8.8:99999", wantErr: true},
+		{in: "8.8.8.8:dns", wantErr: true},
+		{in: "ftp://dns.example", wantErr: true},
+		{in: "quic://dns.example", wantErr: true},
+		{in: "tls://dns.example/path", wantErr: true},
+		{in: "tls://", wantErr: true},
+		{in: "tls://dns.example", protocol: "doh", wantErr: true},
+		{in: "dns.example", protocol: "carrier-pigeon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseUpstream(tt.in, tt.protocol)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseUpstream(%q, %q) = %+v, want an error", tt.in, tt.protocol, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseUpstream(%q, %q) = %+v, %v; want %+v", tt.in, tt.protocol, got, err, tt.want)
+		}
+	}
+
+	config := Config{Clients: []ClientConfig{{ID: "c", Server: "tls://dns.example:http"}}}
+	if err := config.Validate(); err == nil {
+		t.Error("a client with a bad upstream address passed validation")
+	}
+}
+
+func TestSaveOffsetsSpreadAcrossClients(t *testing.T) {
+	const interval = time.Minute
+	ids := []string{"A", "B", "C", "D", "client1", "client2", "client3", "client4"}
+	seen := make(map[time.Duration]string)
+	first, last := interval, time.Duration(0)
+	for _, id := range ids {
+		offset := saveOffset(id, interval)
+		if offset < 0 || offset >= interval {
+			t.Errorf("saveOffset(%q) = %s, outside [0, %s)", id, offset, interval)
+		}
+		if other, ok := seen[offset]; ok {
+			t.Errorf("clients %q and %q share save offset %s", other, id, offset)
+		}
+		seen[offset] = id
+		if offset != saveOffset(id, interval) {
+			t.Errorf("saveOffset(%q) is not stable", id)
+		}
+		first, last = min(first, offset), max(last, offset)
+	}
+	// Eight clients should not all save within the same tenth of the interval.
+	if last-first < interval/10 {
+		t.Errorf("offsets span only %s of %s", last-first, interval)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	file := "# ad servers\n0.0.0.0 tracker.example.net\n.ads.example.org\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "block", upstream))
+	h := newTestHandler(t, gm)
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"malware.example.com", true},      // exact, inline
+		{"MALWARE.example.com.", true},     // case and trailing dot do not matter
+		{"www.malware.example.com", false}, // exact entries do not cover subdomains
+		{"tracker.example.net", true},      // exact, hosts file line
+		{"ads.example.org", true},          // suffix entries cover the domain itself
+		{"x.y.ads.example.org", true},
+		{"badads.example.org", false}, // but only on label boundaries
+		{"example.org", false},
+	}
+	for _, sinkhole := range []net.IP{nil, net.ParseIP("0.0.0.0")} {
+		blocklist, err := NewBlocklist(path, []string{"malware.example.com"}, sinkhole)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Blocklist = blocklist
+		for _, tt := range tests {
+			if got := blocklist.Blocked(tt.name); got != tt.blocked {
+				t.Errorf("Blocked(%q) = %t, want %t", tt.name, got, tt.blocked)
+			}
+			if !tt.blocked {
+				continue
+			}
+			reply := serve(t, h, tt.name, dns.TypeA)
+			switch {
+			case sinkhole == nil && (reply.Rcode != dns.RcodeNameError || len(reply.Answer) != 0):
+				t.Errorf("%s: rcode %s with %d answers, want NXDOMAIN", tt.name, dns.RcodeToString[reply.Rcode], len(reply.Answer))
+			case sinkhole != nil && (reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 || addressOf(reply.Answer[0]) != "0.0.0.0"):
+				t.Errorf("%s: rcode %s, answers %v; want the 0.0.0.0 sinkhole", tt.name, dns.RcodeToString[reply.Rcode], reply.Answer)
+			}
+		}
+		if sinkhole != nil {
+			if reply := serve(t, h, "ads.example.org", dns.TypeAAAA); reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 {
+				t.Errorf("AAAA for a blocked name with an IPv4 sinkhole: rcode %s, answers %v; want NODATA", dns.RcodeToString[reply.Rcode], reply.Answer)
+			}
+		}
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("blocked names caused %d upstream queries", n)
+	}
+	if reply := serve(t, h, "example.org", dns.TypeA); reply.Rcode != dns.RcodeSuccess || queries.Load() != 1 {
+		t.Errorf("unblocked name: rcode %s after %d upstream queries, want an upstream answer", dns.RcodeToString[reply.Rcode], queries.Load())
+	}
+
+	// Reload picks up a changed file and keeps the inline entries.
+	if err := os.WriteFile(path, []byte("example.org\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Blocklist.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Blocklist.Blocked("example.org") || h.Blocklist.Blocked("tracker.example.net") || !h.Blocklist.Blocked("malware.example.com") {
+		t.Error("reload did not replace the file entries while keeping the inline ones")
+	}
+	os.Remove(path)
+	if err := h.Blocklist.Reload(); err == nil || !h.Blocklist.Blocked("example.org") {
+		t.Error("a failed reload did not keep the current list")
+	}
+}
+
+func TestSlowPeerDoesNotStallQuery(t *testing.T) {
+	upstream := startUpstream(t, answerA("192.0.2.1", 300))
+	clients := testClients(t, 2)
+	c, slow := clients[0], clients[1]
+	gm := &GroupManager{}
+	for _, client := range clients {
+		client.Upstreams = []string{upstream}
+		gm.AddClientToGroup(client)
+	}
+	c.PeerTimeout = 100 * time.Millisecond
+	slow.Set(cacheKey("example.com.", dns.TypeA), addressEntry(t, "example.com.", "192.0.2.9", time.Now(), time.Hour))
+
+	if result, err := c.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil || result.Source != SourcePeer {
+		t.Fatalf("answered from %q (%v), want the peer while it is fast", result.Source, err)
+	}
+	c.Delete(cacheKey("example.com.", dns.TypeA))
+
+	// A peer whose cache stays locked, as during a long save.
+	timeouts := peerTimeouts.With(labels("client", c.ID, "peer", slow.ID))
+	before := timeouts.Load()
+	slow.Mutex.Lock()
+	defer slow.Mutex.Unlock()
+	start := time.Now()
+	result, err := c.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); result.Source != SourceUpstream || elapsed > time.Second {
+		t.Errorf("answered from %s after %s, want upstream soon after the %s peer timeout", result.Source, elapsed, c.PeerTimeout)
+	}
+	if n := timeouts.Load() - before; n != 1 {
+		t.Errorf("peer timeout counted %d times, want once", n)
+	}
+}
+
+func TestTamperedEntriesAreRejected(t *testing.T) {
+	signer := NewEntrySigner("shared secret")
+	key := cacheKey("example.com.", dns.TypeA)
+	entry := addressEntry(t, "example.com.", "192.0.2.1", time.Now(), time.Hour)
+	entry.MAC = signer.Sign(key, entry)
+	if !signer.Verify(key, entry) {
+		t.Fatal("a signed entry does not verify")
+	}
+	tampered := entry
+	tampered.IPAddress = "203.0.113.66"
+	tampered.Records = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("203.0.113.66").To4()}}
+	longer := entry
+	longer.TTL *= 2
+	for name, bad := range map[string]bool{
+		"tampered records": signer.Verify(key, tampered),
+		"longer TTL":       signer.Verify(key, longer),
+		"other key":        signer.Verify(cacheKey("example.org.", dns.TypeA), entry),
+		"other secret":     NewEntrySigner("other secret").Verify(key, entry),
+	} {
+		if bad {
+			t.Errorf("%s: entry verified", name)
+		}
+	}
+	if NewEntrySigner("") != nil {
+		t.Error("an empty secret made a signer")
+	}
+
+	// A peer handing out a tampered entry is skipped, and the entry is
+	// dropped from its cache.
+	upstream := startUpstream(t, answerA("192.0.2.1", 300))
+	clients := testClients(t, 2)
+	gm := &GroupManager{}
+	for _, c := range clients {
+		c.Upstreams = []string{upstream}
+		c.SetSigner(signer)
+		gm.AddClientToGroup(c)
+	}
+	clients[1].Mutex.Lock()
+	clients[1].Cache[key] = tampered
+	clients[1].Mutex.Unlock()
+	result, err := clients[0].QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if err != nil || result.Source != SourceUpstream || result.IPs[0] != "192.0.2.1" {
+		t.Errorf("answered %v from %q (%v), want the upstream answer", result.IPs, result.Source, err)
+	}
+	if _, found := clients[1].Peek("example.com", dns.TypeA); found {
+		t.Error("the tampered entry is still in the peer's cache")
+	}
+
+	// Entries loaded unsigned or tampered, as from a cache file, are
+	// dropped when the signer is set.
+	loaded := newTestClient(t, "loaded", upstream)
+	loaded.Cache[key] = tampered
+	loaded.Cache[cacheKey("example.net.", dns.TypeA)] = addressEntry(t, "example.net.", "192.0.2.2", time.Now(), time.Hour)
+	good := addressEntry(t, "example.org.", "192.0.2.3", time.Now(), time.Hour)
+	good.MAC = signer.Sign(cacheKey("example.org.", dns.TypeA), good)
+	loaded.Cache[cacheKey("example.org.", dns.TypeA)] = good
+	loaded.SetSigner(signer)
+	if len(loaded.Cache) != 1 {
+		t.Errorf("%d entries kept after SetSigner, want only the validly signed one", len(loaded.Cache))
+	}
+}
+
+func TestAllSectionsAreCachedAndServed(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")})
+		m.Ns = append(m.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}, Ns: "ns1.example.com."})
+		m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.53")})
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		w.WriteMsg(m)
+	})
+	for _, all := range []bool{false, true} {
+		t.Run(fmt.Sprintf("all=%t", all), func(t *testing.T) {
+			client := newTestClient(t, "sections", upstream)
+			client.AllSections = all
+			gm := &GroupManager{}
+			gm.AddClientToGroup(client)
+			h := newTestHandler(t, gm)
+			before := queries.Load()
+
+			for i := 0; i < 2; i++ {
+				reply := serve(t, h, "www.example.com", dns.TypeA)
+				extra := 0
+				for _, rr := range reply.Extra {
+					if rr.Header().Rrtype != dns.TypeOPT {
+						extra++
+						if all && addressOf(rr) != "192.0.2.53" {
+							t.Errorf("additional record %s, want the ns1 glue", rr)
+						}
+					}
+				}
+				if len(reply.Answer) != 1 {
+					t.Errorf("reply %d has %d answers, want 1", i, len(reply.Answer))
+				}
+				if all && (len(reply.Ns) != 1 || extra != 1) {
+					t.Errorf("reply %d has %d authority and %d additional records, want 1 and 1", i, len(reply.Ns), extra)
+				}
+				if !all && (len(reply.Ns) != 0 || extra != 0) {
+					t.Errorf("reply %d has %d authority and %d additional records without cache_all_sections, want none", i, len(reply.Ns), extra)
+				}
+			}
+			if n := queries.Load() - before; n != 1 {
+				t.Errorf("%d upstream queries, want the second reply from cache", n)
+			}
+			cached, _ := client.Peek("www.example.com", dns.TypeA)
+			for _, rr := range cached.Additional {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					t.Error("the upstream's OPT record was cached")
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForReadyClients(t *testing.T) {
+	good := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "a.root-servers.net."})
+		w.WriteMsg(m)
+	})
+	hanging, _, _ := hangingUpstream(t)
+	clients := testClients(t, 3)
+	gm := &GroupManager{}
+	for i, c := range clients {
+		c.Upstreams = []string{good}
+		if i == 2 {
+			c.Upstreams = []string{hanging}
+		}
+		gm.AddClientToGroup(c)
+	}
+
+	if err := waitForReadyClients(gm, 2, 5*time.Second); err != nil {
+		t.Errorf("two of three clients reach an upstream, but a quorum of 2 failed: %v", err)
+	}
+	start := time.Now()
+	if err := waitForReadyClients(gm, 3, 1500*time.Millisecond); err == nil {
+		t.Error("a quorum of 3 was reached with one upstream never answering")
+	} else if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("gave up after %s, before the 1.5s timeout", elapsed)
+	}
+
+	// /readyz reports not ready until main starts serving.
+	mux := adminMux([]*GroupManager{gm}, false)
+	defer serving.Store(serving.Load())
+	for _, up := range []bool{false, true} {
+		serving.Store(up)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if want := map[bool]int{false: http.StatusServiceUnavailable, true: http.StatusOK}[up]; w.Code != want {
+			t.Errorf("/readyz with serving %t: %d, want %d", up, w.Code, want)
+		}
+	}
+
+	config := Config{Clients: []ClientConfig{{ID: "c", Server: "192.0.2.53"}}, MinReadyClients: 2}
+	if err := config.Validate(); err == nil {
+		t.Error("min_ready_clients above the number of clients passed validation")
+	}
+}
+
+func TestLatencyEWMA(t *testing.T) {
+	tracker := &LatencyTracker{ewma: make(map[string]time.Duration), failures: make(map[string]float64)}
+	if _, ok := tracker.Get("192.0.2.53:53"); ok {
+		t.Error("latency known before any sample")
+	}
+	tracker.Observe("192.0.2.53:53", 100*time.Millisecond)
+	tracker.Observe("192.0.2.53:53", 200*time.Millisecond)
+	// The newest sample weighs latencyWeight: 0.2*200ms + 0.8*100ms.
+	if got, ok := tracker.Get("192.0.2.53:53"); !ok || got != 120*time.Millisecond {
+		t.Errorf("average %s (%t), want 120ms", got, ok)
+	}
+	if _, ok := tracker.Get(""); ok {
+		t.Error("latency known for an unknown upstream")
+	}
+	tracker.ObserveResult("192.0.2.53:53", true)
+	tracker.ObserveResult("192.0.2.53:53", false)
+	if got := tracker.failures["192.0.2.53:53"]; math.Abs(got-0.8) > 1e-9 {
+		t.Errorf("failure rate %v, want 0.8", got)
+	}
+}
+
+func TestPeerSelectionPolicies(t *testing.T) {
+	const slow, fast = "198.51.100.1:53", "198.51.100.2:53"
+	upstreamLatency.Observe(slow, 200*time.Millisecond)
+	upstreamLatency.Observe(fast, 5*time.Millisecond)
+	now := time.Now()
+	// Peers in group order: the first resolved through the slow upstream,
+	// the second through the fast one, the third from a cache file and
+	// freshest.
+	entries := []DNSResponse{
+		addressEntry(t, "example.com.", "192.0.2.1", now, time.Hour),
+		addressEntry(t, "example.com.", "192.0.2.2", now, 10*time.Minute),
+		addressEntry(t, "example.com.", "192.0.2.3", now, 2*time.Hour),
+	}
+	entries[0].Upstream, entries[1].Upstream = slow, fast
+
+	for _, tt := range []struct {
+		policy string
+		want   string
+	}{
+		{PeerSelectFirst, "192.0.2.1"},
+		{PeerSelectFreshest, "192.0.2.3"},
+		{PeerSelectBestSource, "192.0.2.2"},
+	} {
+		clients := testClients(t, 4)
+		gm := &GroupManager{}
+		for i, c := range clients {
+			gm.AddClientToGroup(c)
+			if i > 0 {
+				c.Set(cacheKey("example.com.", dns.TypeA), entries[i-1])
+			}
+		}
+		clients[0].PeerSelection = tt.policy
+		result, err := clients[0].QueryDNS(context.Background(), "example.com", dns.TypeA)
+		if err != nil || result.Source != SourcePeer || len(result.IPs) != 1 || result.IPs[0] != tt.want {
+			t.Errorf("%s: answered %v from %q (%v), want %s from a peer", tt.policy, result.IPs, result.Source, err, tt.want)
+		}
+	}
+}
+
+func TestSaveOverMaxFileBytesPrunes(t *testing.T) {
+	client := newTestClient(t, "prune", "")
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		entry := addressEntry(t, name, "192.0.2.1", now, time.Duration(i+1)*time.Minute)
+		if i < 10 {
+			entry.Hits = 100 // popular, but expiring soonest
+		}
+		client.Cache[cacheKey(name, dns.TypeA)] = entry
+	}
+	full, err := client.CacheCodec.Marshal(client.Cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.MaxFileBytes = len(full) / 4
+	client.writeCache()
+
+	data, err := os.ReadFile(client.CacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > client.MaxFileBytes {
+		t.Errorf("cache file is %d bytes, over the %d limit", len(data), client.MaxFileBytes)
+	}
+	saved := make(map[string]DNSResponse)
+	if err := client.CacheCodec.Decode(bytes.NewReader(data), func(key string, response DNSResponse) bool {
+		saved[key] = response
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) == 0 || len(saved) >= 200 {
+		t.Fatalf("%d entries saved, want some of the 200 pruned", len(saved))
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := saved[cacheKey(fmt.Sprintf("host%d.example.com.", i), dns.TypeA)]; !ok {
+			t.Errorf("host%d, hit most, was pruned", i)
+		}
+	}
+	// Of the rest, those with the least time left go first.
+	if _, ok := saved[cacheKey("host199.example.com.", dns.TypeA)]; !ok {
+		t.Error("the entry with the most time left was pruned")
+	}
+	if _, ok := saved[cacheKey("host10.example.com.", dns.TypeA)]; ok {
+		t.Error("the unpopular entry with the least time left was kept")
+	}
+	if len(client.Cache) != 200 {
+		t.Errorf("pruning the file left %d entries in memory, want all 200", len(client.Cache))
+	}
+}
+
+// connTracker is a listener remembering the connections it accepted, so a
+// test can drop them from the server side.
+type connTracker struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *connTracker) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+// dropAll closes every connection accepted so far.
+func (l *connTracker) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func TestDoTReconnectsAfterDroppedConnection(t *testing.T) {
+	cert := testCertificate(t)
+	inner, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &connTracker{Listener: inner}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: answerA("192.0.2.1", 300), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dotRootCAs = x509.NewCertPool()
+	dotRootCAs.AddCert(leaf)
+	t.Cleanup(func() { dotRootCAs = nil })
+
+	u, err := parseUpstream("tls://"+inner.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func() error {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		r, err := exchangeDoT(ctx, m, u)
+		if err == nil && len(r.Answer) != 1 {
+			err = fmt.Errorf("%d answers, want 1", len(r.Answer))
+		}
+		return err
+	}
+	reconnects := upstreamReconnects.With(labels("upstream", u.String()))
+	before := reconnects.Load()
+	if err := query(); err != nil {
+		t.Fatal(err)
+	}
+	// The server drops the connection now idle in the pool; the next query
+	// finds it dead and must reconnect instead of failing.
+	listener.dropAll()
+	if err := query(); err != nil {
+		t.Errorf("query after the connection dropped failed: %v", err)
+	}
+	if n := reconnects.Load() - before; n != 1 {
+		t.Errorf("%d reconnects counted, want 1", n)
+	}
+}
+
+func TestDoHReconnectsAfterDroppedConnection(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 2 {
+			// Drop the kept-alive connection without answering.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")})
+		packed, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	t.Cleanup(ts.Close)
+	saved := dohClient
+	dohClient = ts.Client()
+	t.Cleanup(func() { dohClient = saved })
+
+	endpoint := ts.URL + "/dns-query"
+	reconnects := upstreamReconnects.With(labels("upstream", endpoint))
+	before := reconnects.Load()
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		r, err := exchangeDoH(context.Background(), m, endpoint, false)
+		if err != nil || len(r.Answer) != 1 {
+			t.Fatalf("query %d: %v, %v; want one answer", i, r, err)
+		}
+	}
+	if n := reconnects.Load() - before; n != 1 || requests.Load() != 3 {
+		t.Errorf("%d reconnects after %d requests, want 1 after 3", n, requests.Load())
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	echoing := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		sent = append(sent, r.Question[0].Name)
+		mu.Unlock()
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	// A broken (or spoofing) upstream answering for the lowercased name.
+	lowercasing := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	name := "abcdefghijklmnopqrstuvwxyzabcdefghijklmn.example.com."
+
+	client := newTestClient(t, "case", echoing)
+	client.RandomizeCase = true
+	result, err := client.QueryDNS(context.Background(), name, dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(sent) != 1 || sent[0] == name || !strings.EqualFold(sent[0], name) {
+		t.Errorf("upstream saw %v, want %s with its case randomized", sent, name)
+	}
+	mu.Unlock()
+	if got := result.Records[0].Header().Name; got != name {
+		t.Errorf("answer owner %s, want the name as asked", got)
+	}
+	if _, cached := client.Peek(name, dns.TypeA); !cached {
+		t.Error("the answer was not cached under the canonical name")
+	}
+
+	u, err := parseUpstream(lowercasing, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.queryUpstream(context.Background(), u, name, dns.TypeA); !errors.Is(err, ErrServFail) {
+		t.Errorf("answer not echoing the query case: %v, want it rejected", err)
+	}
+	client.RandomizeCase = false
+	if _, err := client.queryUpstream(context.Background(), u, name, dns.TypeA); err != nil {
+		t.Errorf("with randomize_case off, the same answer was rejected: %v", err)
+	}
+}
+
+func TestSinkholedNXDOMAINCarriesSyntheticSOA(t *testing.T) {
+	var config Config
+	if err := toml.Unmarshal([]byte(`
+[synthetic_soa]
+mname = "ns.blocked.invalid"
+rname = "hostmaster.example.com"
+serial = 2024010101
+minimum = 30
+`), &config); err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := NewBlocklist("", []string{".ads.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "soa", startUpstream(t, answerA("192.0.2.1", 300))))
+	h := newTestHandler(t, gm)
+	h.Blocklist = blocklist
+	h.SyntheticSOA = config.SyntheticSOA.SOA()
+
+	reply := serve(t, h, "tracker.ads.example.com", dns.TypeA)
+	if reply.Rcode != dns.RcodeNameError || len(reply.Ns) != 1 {
+		t.Fatalf("rcode %s with authority %v, want NXDOMAIN with one SOA", dns.RcodeToString[reply.Rcode], reply.Ns)
+	}
+	soa, ok := reply.Ns[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("authority %s is not an SOA", reply.Ns[0])
+	}
+	if soa.Hdr.Name != "ads.example.com." || soa.Ns != "ns.blocked.invalid." || soa.Mbox != "hostmaster.example.com." || soa.Serial != 2024010101 {
+		t.Errorf("SOA %s, want the configured one owned by the parent of the name", soa)
+	}
+	// The minimum bounds negative caching downstream (RFC 2308).
+	if soa.Minttl != 30 || soa.Hdr.Ttl != 30 {
+		t.Errorf("SOA minimum %d and TTL %d, want 30", soa.Minttl, soa.Hdr.Ttl)
+	}
+	if reply := serve(t, h, "example.com", dns.TypeA); len(reply.Ns) != 0 {
+		t.Errorf("a positive answer got authority %v", reply.Ns)
+	}
+
+	h.SyntheticSOA = (&SyntheticSOAConfig{}).SOA()
+	if reply := serve(t, h, "tracker.ads.example.com", dns.TypeA); len(reply.Ns) != 1 || reply.Ns[0].(*dns.SOA).Minttl != uint32(BlockedTTL/time.Second) {
+		t.Errorf("default SOA %v, want minimum %s", reply.Ns, BlockedTTL)
+	}
+	config = Config{Clients: []ClientConfig{{ID: "c", Server: "192.0.2.53"}}, SyntheticSOA: &SyntheticSOAConfig{MName: "bad name..example"}}
+	if err := config.Validate(); err == nil {
+		t.Error("a synthetic_soa mname that is not a domain name passed validation")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	q := NewQuarantine(3, 200*time.Millisecond)
+	events := securityEvents.With(labels("event", "quarantine"))
+	before := events.Load()
+	for i := 1; i <= 3; i++ {
+		quarantined := q.Strike("Example.COM.", "0x20")
+		if want := i == 3; quarantined != want || q.Active("example.com.") != want {
+			t.Errorf("strike %d: quarantined %t, want %t", i, quarantined, want)
+		}
+	}
+	if n := events.Load() - before; n != 1 {
+		t.Errorf("%d quarantine events counted, want 1", n)
+	}
+	if q.Active("other.com.") {
+		t.Error("a name without strikes is quarantined")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if q.Active("example.com.") {
+		t.Error("quarantine did not lift after the cooldown")
+	}
+	// Strikes older than the cooldown are forgotten, not added up.
+	q.Strike("example.com.", "0x20")
+	q.Strike("example.com.", "0x20")
+	if q.Active("example.com.") {
+		t.Error("two fresh strikes quarantined a name with an expired quarantine")
+	}
+	if NewQuarantine(-1, time.Minute).Strike("example.com.", "mac") {
+		t.Error("a disabled quarantine quarantined a name")
+	}
+}
+
+func TestQuarantinedNameIsNotCached(t *testing.T) {
+	var spoofing atomic.Bool
+	spoofing.Store(true)
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		if spoofing.Load() {
+			// Flip every letter, so the casing never matches the query's.
+			r.Question[0].Name = strings.Map(func(ch rune) rune {
+				if 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' {
+					return ch ^ 0x20
+				}
+				return ch
+			}, r.Question[0].Name)
+		}
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	client := newTestClient(t, "quarantine", upstream)
+	client.RandomizeCase = true
+	client.BreakerSettings = BreakerSettings{Threshold: 100, Window: time.Minute, Cooldown: time.Minute}
+	client.Quarantine = NewQuarantine(2, 300*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA); err == nil {
+			t.Fatalf("query %d: an answer not echoing the query case was accepted", i)
+		}
+	}
+	// Honest answers are served while quarantined, but not cached.
+	spoofing.Store(false)
+	for i := 0; i < 2; i++ {
+		if result, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil || result.Source != SourceUpstream {
+			t.Errorf("quarantined query %d answered from %q (%v), want upstream", i, result.Source, err)
+		}
+	}
+	if _, cached := client.Peek("example.com", dns.TypeA); cached {
+		t.Error("a quarantined name was cached")
+	}
+	time.Sleep(350 * time.Millisecond)
+	client.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if _, cached := client.Peek("example.com", dns.TypeA); !cached {
+		t.Error("the name is still not cached after the quarantine lifted")
+	}
+}
+
+func TestZoneWildcards(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.local.zone")
+	zone := `$TTL 60
+@         IN SOA ns1.app.local. admin.app.local. 1 7200 900 1209600 300
+*.dev     IN A   10.0.0.99
+exact.dev IN A   10.0.0.10
+`
+	if err := os.WriteFile(path, []byte(zone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := LoadZone(path, "app.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  string // address answered, if any
+	}{
+		{"exact.dev.app.local.", dns.TypeA, dns.RcodeSuccess, "10.0.0.10"}, // exact beats the wildcard
+		{"web.dev.app.local.", dns.TypeA, dns.RcodeSuccess, "10.0.0.99"},
+		{"Web.DEV.app.local.", dns.TypeA, dns.RcodeSuccess, "10.0.0.99"},
+		{"a.b.dev.app.local.", dns.TypeA, dns.RcodeSuccess, "10.0.0.99"}, // closest encloser is dev
+		{"a.exact.dev.app.local.", dns.TypeA, dns.RcodeNameError, ""},    // closest encloser is exact.dev, no wildcard there
+		{"dev.app.local.", dns.TypeA, dns.RcodeSuccess, ""},              // exists, below it are names: NODATA
+		{"web.dev.app.local.", dns.TypeAAAA, dns.RcodeSuccess, ""},       // the wildcard has no AAAA
+		{"web.prod.app.local.", dns.TypeA, dns.RcodeNameError, ""},       // no wildcard above
+		{"*.dev.app.local.", dns.TypeA, dns.RcodeSuccess, "10.0.0.99"},   // the wildcard itself
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qtype)
+		m := z.Answer(r, r.Question[0])
+		if m == nil {
+			t.Errorf("%s: not answered from the zone", tt.name)
+			continue
+		}
+		var got string
+		if len(m.Answer) == 1 {
+			got = addressOf(m.Answer[0])
+			if owner := m.Answer[0].Header().Name; !strings.EqualFold(owner, tt.name) {
+				t.Errorf("%s: answer owned by %s, want the name asked", tt.name, owner)
+			}
+		}
+		if m.Rcode != tt.rcode || got != tt.want || len(m.Answer) > 1 {
+			t.Errorf("%s %s: rcode %s, answers %v; want %s, %q", tt.name, dns.Type(tt.qtype), dns.RcodeToString[m.Rcode], m.Answer, dns.RcodeToString[tt.rcode], tt.want)
+		}
+	}
+	if owner := z.Records["*.dev.app.local."][0].Header().Name; owner != "*.dev.app.local." {
+		t.Errorf("answering renamed the wildcard record to %s", owner)
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("web.dev.other.local.", dns.TypeA)
+	if m := z.Answer(r, r.Question[0]); m != nil {
+		t.Errorf("a name outside the zone was answered: %v", m)
+	}
+}
+
+func TestValidateCache(t *testing.T) {
+	dir := t.TempDir()
+	noConfig := filepath.Join(dir, "missing.toml")
+	now := time.Now()
+	write := func(name string, cache map[string]DNSResponse) string {
+		t.Helper()
+		data, err := jsonCodec{}.Marshal(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	entries := func(path string) int {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		if err := (jsonCodec{}).Decode(bytes.NewReader(data), func(string, DNSResponse) bool { n++; return true }); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	valid := write("valid_cache.json", map[string]DNSResponse{
+		cacheKey("a.example.com.", dns.TypeA): addressEntry(t, "a.example.com.", "192.0.2.1", now, time.Hour),
+		cacheKey("b.example.com.", dns.TypeA): addressEntry(t, "b.example.com.", "192.0.2.2", now, time.Hour),
+	})
+	if code := validateCache([]string{"-config", noConfig, "-rewrite", valid}); code != 0 {
+		t.Errorf("valid file: exit %d, want 0", code)
+	}
+	if _, err := os.Stat(valid + ".bak"); err == nil || entries(valid) != 2 {
+		t.Error("a file without unusable entries was rewritten")
+	}
+
+	mostlyExpired := map[string]DNSResponse{cacheKey("fresh.example.com.", dns.TypeA): addressEntry(t, "fresh.example.com.", "192.0.2.1", now, time.Hour)}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("old%d.example.com.", i)
+		mostlyExpired[cacheKey(name, dns.TypeA)] = addressEntry(t, name, "192.0.2.1", now.Add(-2*time.Hour), time.Hour)
+	}
+	bad := addressEntry(t, "bad.example.com.", "192.0.2.1", now, time.Hour)
+	bad.IPAddress = "not an address"
+	mostlyExpired[cacheKey("bad.example.com.", dns.TypeA)] = bad
+	expired := write("expired_cache.json", mostlyExpired)
+	if code := validateCache([]string{"-config", noConfig, expired}); code != 0 || entries(expired) != 22 {
+		t.Errorf("without -rewrite: exit %d with %d entries left, want 0 and the file untouched", code, entries(expired))
+	}
+	if code := validateCache([]string{"-config", noConfig, "-rewrite", expired}); code != 0 {
+		t.Errorf("expired entries: exit %d, want 0", code)
+	}
+	if n := entries(expired); n != 1 {
+		t.Errorf("rewritten file holds %d entries, want only the fresh one", n)
+	}
+	if n := entries(expired + ".bak"); n != 22 {
+		t.Errorf("backup holds %d entries, want the original 22", n)
+	}
+
+	// With cache_secret set, entries whose MAC does not verify are dropped.
+	config := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(config, []byte("cache_secret = \"s3cret\"\n\n[[clients]]\nid = \"c\"\nserver = \"192.0.2.53\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	signer := NewEntrySigner("s3cret")
+	signed := addressEntry(t, "signed.example.com.", "192.0.2.1", now, time.Hour)
+	signed.MAC = signer.Sign(cacheKey("signed.example.com.", dns.TypeA), signed)
+	forged := addressEntry(t, "forged.example.com.", "192.0.2.1", now, time.Hour)
+	forged.MAC = NewEntrySigner("guess").Sign(cacheKey("forged.example.com.", dns.TypeA), forged)
+	macs := write("signed_cache.json", map[string]DNSResponse{
+		cacheKey("signed.example.com.", dns.TypeA): signed,
+		cacheKey("forged.example.com.", dns.TypeA): forged,
+	})
+	if code := validateCache([]string{"-config", config, "-rewrite", macs}); code != 0 || entries(macs) != 1 {
+		t.Errorf("signed file: exit %d with %d entries kept, want 0 and the validly signed one", code, entries(macs))
+	}
+
+	corrupt := filepath.Join(dir, "corrupt_cache.json")
+	if err := os.WriteFile(corrupt, []byte(`{"a.example.com./A": {"ip_address": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code := validateCache([]string{"-config", noConfig, corrupt}); code != 1 {
+		t.Errorf("corrupt file: exit %d, want 1", code)
+	}
+	if code := validateCache([]string{"-config", noConfig, filepath.Join(dir, "absent_cache.json")}); code != 1 {
+		t.Errorf("missing file: exit %d, want 1", code)
+	}
+}
+
+// nsEntry is a cache entry delegating zone to server, with glue for it if
+// glue is set.
+func nsEntry(zone string, server string, glue string, resolved time.Time, ttl time.Duration) DNSResponse {
+	response := DNSResponse{
+		Records:   []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(ttl / time.Second)}, Ns: server}},
+		Timestamp: resolved,
+		TTL:       ttl,
+	}
+	if glue != "" {
+		response.Additional = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: server, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(ttl / time.Second)}, A: net.ParseIP(glue)}}
+	}
+	return response
+}
+
+func TestClosestEncloser(t *testing.T) {
+	client := newTestClient(t, "encloser", "")
+	now := time.Now()
+	client.Set(cacheKey("example.com.", dns.TypeNS), nsEntry("example.com.", "ns1.example.com.", "192.0.2.53", now, time.Hour))
+	client.Set(cacheKey("org.", dns.TypeNS), nsEntry("org.", "a0.org.afilias-nst.info.", "", now, time.Hour))
+	client.Set(cacheKey(".", dns.TypeNS), nsEntry(".", "a.root-servers.net.", "", now.Add(-2*time.Hour), time.Hour))
+	client.Set(cacheKey("example.net.", dns.TypeA), addressEntry(t, "example.net.", "192.0.2.1", now, time.Hour))
+
+	tests := []struct {
+		name string
+		want string // "" for none
+	}{
+		{"api.v2.example.com.", "example.com."},
+		{"API.Example.COM", "example.com."},
+		{"example.com.", "example.com."},
+		{"www.example.org.", "org."},
+		{"www.example.net.", ""}, // an A record is no delegation, and the root NS expired
+		{".", ""},
+	}
+	for _, tt := range tests {
+		zone, _, ok := client.ClosestEncloser(tt.name)
+		if zone != tt.want || ok != (tt.want != "") {
+			t.Errorf("ClosestEncloser(%q) = %q, %t; want %q", tt.name, zone, ok, tt.want)
+		}
+	}
+	client.Set(cacheKey(".", dns.TypeNS), nsEntry(".", "a.root-servers.net.", "", now, time.Hour))
+	if zone, _, ok := client.ClosestEncloser("www.example.net."); !ok || zone != "." {
+		t.Errorf("with a fresh root NS: %q, %t; want the root", zone, ok)
+	}
+
+	// Name server addresses come from the glue, or else the cache.
+	if zone, servers, _, ok := client.delegationHint("api.example.com."); !ok || zone != "example.com." || len(servers) != 1 || servers[0] != "192.0.2.53:53" {
+		t.Errorf("hint for api.example.com: %q %v %t, want example.com. at its glue", zone, servers, ok)
+	}
+	if _, _, _, ok := client.delegationHint("www.example.org."); ok {
+		t.Error("a hint without any address for org.'s name server")
+	}
+	client.Set(cacheKey("a0.org.afilias-nst.info.", dns.TypeA), addressEntry(t, "a0.org.afilias-nst.info.", "192.0.2.99", now, time.Hour))
+	if zone, servers, _, ok := client.delegationHint("www.example.org."); !ok || zone != "org." || len(servers) != 1 || servers[0] != "192.0.2.99:53" {
+		t.Errorf("hint for www.example.org: %q %v %t, want org. at the cached address", zone, servers, ok)
+	}
+}
+
+func TestUpstreamStatsRoundTrip(t *testing.T) {
+	const down, slow = "192.0.2.77:53", "192.0.2.78:53"
+	upstreamLatency.Observe(slow, 42*time.Millisecond)
+	upstreamLatency.ObserveResult(slow, false)
+	upstreamLatency.ObserveResult(down, true)
+	clients := testClients(t, 2)
+	for _, c := range clients {
+		c.BreakerSettings = BreakerSettings{Threshold: 2, Window: time.Minute, Cooldown: time.Hour}
+	}
+	clients[0].breaker(down).Failure()
+	clients[0].breaker(down).Failure()
+	clients[1].breaker(down).Failure()
+	if clients[0].breaker(down).State() != BreakerOpen {
+		t.Fatal("breaker did not open")
+	}
+	path := filepath.Join(t.TempDir(), "upstream_stats.json")
+	if err := saveUpstreamStats(path, clients); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart: the averages and breakers are gone until loaded.
+	upstreamLatency.mu.Lock()
+	delete(upstreamLatency.ewma, slow)
+	delete(upstreamLatency.failures, slow)
+	delete(upstreamLatency.failures, down)
+	upstreamLatency.mu.Unlock()
+	restarted := testClients(t, 2)
+	for _, c := range restarted {
+		c.BreakerSettings = clients[0].BreakerSettings
+	}
+	if err := loadUpstreamStats(path, restarted); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := upstreamLatency.Get(slow); !ok || d != 42*time.Millisecond {
+		t.Errorf("latency of %s restored as %s (%t), want 42ms", slow, d, ok)
+	}
+	upstreamLatency.mu.Lock()
+	rate := upstreamLatency.failures[down]
+	upstreamLatency.mu.Unlock()
+	if rate != 1 {
+		t.Errorf("failure rate of %s restored as %v, want 1", down, rate)
+	}
+	if b := restarted[0].breaker(down); b.State() != BreakerOpen || b.Allow() {
+		t.Errorf("c0's breaker for %s restored %s, want it open and refusing queries", down, b.State())
+	}
+	b := restarted[1].breaker(down)
+	if b.State() != BreakerClosed {
+		t.Errorf("c1's breaker for %s restored %s, want closed", down, b.State())
+	}
+	// c1's one failure was kept: one more opens the breaker.
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Error("c1's restored failure count was lost")
+	}
+
+	if err := loadUpstreamStats(filepath.Join(t.TempDir(), "missing.json"), restarted); err != nil {
+		t.Errorf("missing stats file: %v, want no error", err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadUpstreamStats(path, restarted); err == nil {
+		t.Error("a corrupt stats file loaded without error")
+	}
+}
+
+func TestDOAndNonDOQueriesDoNotShareEntries(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")})
+		if opt := r.IsEdns0(); opt != nil && opt.Do() {
+			m.Answer = append(m.Answer, &dns.RRSIG{
+				Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				TypeCovered: dns.TypeA, Algorithm: dns.ECDSAP256SHA256, Labels: 2, OrigTtl: 300,
+				Expiration: uint32(time.Now().Add(time.Hour).Unix()), Inception: uint32(time.Now().Unix()),
+				KeyTag: 1, SignerName: "example.com.", Signature: "dGVzdA==",
+			})
+			m.SetEdns0(4096, true)
+		}
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "do", upstream)
+	client.DNSSECKeys = true
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	query := func(do bool) (signed bool) {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		if do {
+			r.SetEdns0(4096, true)
+		}
+		w := newRecorder()
+		h.ServeDNS(w, r)
+		for _, rr := range w.msg.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				signed = true
+			}
+		}
+		return signed
+	}
+	if query(false) {
+		t.Error("a query without DO got an RRSIG")
+	}
+	if !query(true) {
+		t.Error("a DO query was answered from the entry cached without signatures")
+	}
+	if query(false) || !query(true) {
+		t.Error("cached answers mixed up DO and non-DO entries")
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("upstream saw %d queries, want one for each kind", n)
+	}
+	_, plain := client.Peek("example.com.", dns.TypeA)
+	client.Mutex.Lock()
+	_, signed := client.Cache[cacheKey("example.com.", dns.TypeA)+dnssecKeySuffix]
+	client.Mutex.Unlock()
+	if !plain || !signed {
+		t.Errorf("cached plain %t and DO %t, want both entries", plain, signed)
+	}
+}
+
+func TestHandlerRejectsNamesOverLimits(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	gm := &GroupManager{}
+	client := newTestClient(t, "limits", upstream)
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	// 63-octet labels make names of exactly the wire length wanted.
+	label := strings.Repeat("a", 63)
+	longest := label + "." + label + "." + label + "." + strings.Repeat("b", 61) + "." // 255 octets
+	tests := []struct {
+		name     string
+		length   int
+		labels   int
+		rejected bool
+	}{
+		{"a.b.c.d.e.f.", 40, 6, false},
+		{"a.b.c.d.e.f.g.", 40, 6, true},
+		{strings.Repeat("x", 26) + ".example.com.", 40, 6, false}, // 40 octets
+		{strings.Repeat("x", 27) + ".example.com.", 40, 6, true},  // 41 octets
+		{longest, DefaultMaxNameLength, DefaultMaxLabels, false},
+		{strings.Repeat("a.", 127), DefaultMaxNameLength, DefaultMaxLabels, false},
+	}
+	for _, tt := range tests {
+		h.MaxNameLength, h.MaxLabels = tt.length, tt.labels
+		before := queries.Load()
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		w := newRecorder()
+		h.ServeDNS(w, r)
+		rejected := w.msg.Rcode == dns.RcodeFormatError
+		if rejected != tt.rejected {
+			t.Errorf("%d-label name of %d characters under limits %d/%d: rcode %s, want rejected %t",
+				dns.CountLabel(tt.name), len(tt.name), tt.length, tt.labels, dns.RcodeToString[w.msg.Rcode], tt.rejected)
+		}
+		if rejected && queries.Load() != before {
+			t.Errorf("a rejected name reached the upstream")
+		}
+	}
+	if _, cached := client.Peek("a.b.c.d.e.f.g.", dns.TypeA); cached {
+		t.Error("a rejected name was cached")
+	}
+
+	for _, limits := range [][2]int{{256, 0}, {0, 128}} {
+		config := Config{Clients: []ClientConfig{{ID: "c", Server: "192.0.2.53"}}, MaxNameLength: limits[0], MaxLabels: limits[1]}
+		if err := config.Validate(); err == nil {
+			t.Errorf("limits %v over the DNS maxima passed validation", limits)
+		}
+	}
+}
+
+func TestGroupAggregateStats(t *testing.T) {
+	clients := testClients(t, GroupSize+2)
+	gm := &GroupManager{}
+	for _, c := range clients {
+		gm.AddClientToGroup(c)
+	}
+	// Client i records i hits, 2 peer hits and 1 miss, all at once, while
+	// the stats are read.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				gm.AggregateStats()
+			}
+		}
+	}()
+	for i, c := range clients {
+		for j := 0; j < i; j++ {
+			wg.Add(1)
+			go func(c *Client) { defer wg.Done(); c.History.RecordHit() }(c)
+		}
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(c *Client) { defer wg.Done(); c.History.RecordPeerHit() }(c)
+		}
+		wg.Add(1)
+		go func(c *Client) { defer wg.Done(); c.History.RecordMiss() }(c)
+	}
+	wg.Wait()
+	close(done)
+
+	stats := gm.AggregateStats()
+	if len(stats) != 2 {
+		t.Fatalf("%d groups, want 2", len(stats))
+	}
+	// The first group holds clients 0..14, the second 15 and 16.
+	want := []GroupStats{
+		{ID: "Group-1", Clients: GroupSize, Hits: GroupSize * (GroupSize - 1) / 2, PeerHits: 2 * GroupSize, Misses: GroupSize},
+		{ID: "Group-2", Clients: 2, Hits: GroupSize + GroupSize + 1, PeerHits: 4, Misses: 2},
+	}
+	for i, w := range want {
+		got := stats[i]
+		if got.ID != w.ID || got.Clients != w.Clients || got.Hits != w.Hits || got.PeerHits != w.PeerHits || got.Misses != w.Misses {
+			t.Errorf("group %d: %+v, want %+v", i, got, w)
+		}
+		lookups := float64(w.Hits + w.PeerHits + w.Misses)
+		if ratio := float64(w.Hits+w.PeerHits) / lookups; math.Abs(got.HitRatio-ratio) > 1e-9 {
+			t.Errorf("%s hit ratio %v, want %v", got.ID, got.HitRatio, ratio)
+		}
+		if ratio := float64(w.PeerHits) / float64(w.PeerHits+w.Misses); math.Abs(got.PeerHitRatio-ratio) > 1e-9 {
+			t.Errorf("%s peer hit ratio %v, want %v", got.ID, got.PeerHitRatio, ratio)
+		}
+	}
+
+	mux := adminMux([]*GroupManager{gm}, false)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/stats/groups", nil))
+	var served []GroupStats
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 2 || served[1].Hits != want[1].Hits {
+		t.Errorf("/stats/groups served %s (%v)", w.Body, err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `dns_group_cache_lookups{view="",group="Group-2",result="hit"} 31`; !strings.Contains(w.Body.String(), line) {
+		t.Errorf("/metrics lacks %s", line)
+	}
+}
+
+func TestBurstAfterCompletionIsDeduplicated(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		if strings.HasPrefix(r.Question[0].Name, "broken.") {
+			answerRcode(dns.RcodeServerFailure)(w, r)
+			return
+		}
+		// A zero TTL keeps the answer out of the cache, so only the
+		// window can answer the burst.
+		answerA("192.0.2.1", 0)(w, r)
+	})
+	client := newTestClient(t, "dedupe", upstream)
+	client.BreakerSettings = BreakerSettings{Threshold: 100, Window: time.Minute, Cooldown: time.Minute}
+	client.DedupeWindow = 300 * time.Millisecond
+	recent := dedupedTotal.With(labels("client", client.ID, "kind", "recent"))
+
+	for _, name := range []string{"example.com", "broken.example.com"} {
+		before, deduped := queries.Load(), recent.Load()
+		first, firstErr := client.QueryDNS(context.Background(), name, dns.TypeA)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := client.QueryDNS(context.Background(), name, dns.TypeA)
+				if (err == nil) != (firstErr == nil) || fmt.Sprint(result.IPs) != fmt.Sprint(first.IPs) {
+					t.Errorf("%s: retry got %v (%v), want the first answer %v (%v)", name, result.IPs, err, first.IPs, firstErr)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := queries.Load() - before; n != 1 {
+			t.Errorf("%s: the burst after the resolution caused %d upstream queries, want 1", name, n)
+		}
+		if n := recent.Load() - deduped; n != 10 {
+			t.Errorf("%s: %d queries counted as deduplicated, want 10", name, n)
+		}
+	}
+
+	time.Sleep(350 * time.Millisecond)
+	before := queries.Load()
+	client.QueryDNS(context.Background(), "example.com", dns.TypeA)
+	if queries.Load() != before+1 {
+		t.Error("a query after the window was answered without resolving")
+	}
+	client.DedupeWindow = 0
+	before = queries.Load()
+	client.QueryDNS(context.Background(), "other.example.com", dns.TypeA)
+	client.QueryDNS(context.Background(), "other.example.com", dns.TypeA)
+	if n := queries.Load() - before; n != 2 {
+		t.Errorf("without a window, two uncacheable queries caused %d upstream queries, want 2", n)
+	}
+}
+
+func TestACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		allowed map[string]bool
+	}{
+		{"allow only", []string{"10.0.0.0/8", "2001:db8::/32"}, nil, map[string]bool{
+			"10.1.2.3": true, "192.0.2.1": false, "2001:db8::1": true, "2001:db9::1": false,
+		}},
+		{"deny only", nil, []string{"192.0.2.0/24", "2001:db8:bad::/48"}, map[string]bool{
+			"192.0.2.1": false, "198.51.100.1": true, "2001:db8:bad::1": false, "2001:db8:1::1": true,
+		}},
+		{"deny wins over allow", []string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.0.0/24", "2001:db8:bad::/48"}, map[string]bool{
+			"10.0.0.1": false, "10.0.1.1": true, "2001:db8:bad::1": false, "2001:db8:1::1": true, "192.0.2.1": false,
+		}},
+		{"IPv4-mapped IPv6", []string{"10.0.0.0/8"}, nil, map[string]bool{"::ffff:10.0.0.1": true}},
+	}
+	for _, tt := range tests {
+		acl, err := NewACL(tt.allow, tt.deny, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for ip, want := range tt.allowed {
+			if got := acl.Allowed(net.ParseIP(ip)); got != want {
+				t.Errorf("%s: Allowed(%s) = %t, want %t", tt.name, ip, got, want)
+			}
+		}
+	}
+	if acl, err := NewACL(nil, nil, false); err != nil || acl != nil || !acl.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Errorf("no lists: %v, %v; want a nil ACL admitting everyone", acl, err)
+	}
+	if _, err := NewACL([]string{"10.0.0.0/33"}, nil, false); err == nil {
+		t.Error("a bad CIDR parsed")
+	}
+
+	// The handler refuses or drops disallowed sources before any work.
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "acl", upstream))
+	h := newTestHandler(t, gm)
+	for _, drop := range []bool{false, true} {
+		h.ACL, _ = NewACL([]string{"127.0.0.0/8", "::1/128"}, []string{"127.0.0.2/32"}, drop)
+		for _, remote := range []string{"127.0.0.1", "::1", "127.0.0.2", "192.0.2.1", "2001:db8::1"} {
+			allowed := remote == "127.0.0.1" || remote == "::1"
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			w := newRecorder()
+			w.remote = &net.UDPAddr{IP: net.ParseIP(remote), Port: 5353}
+			h.ServeDNS(w, r)
+			switch {
+			case allowed && (w.msg == nil || w.msg.Rcode != dns.RcodeSuccess):
+				t.Errorf("drop %t: query from %s not answered", drop, remote)
+			case !allowed && !drop && (w.msg == nil || w.msg.Rcode != dns.RcodeRefused):
+				t.Errorf("query from %s: %v, want REFUSED", remote, w.msg)
+			case !allowed && drop && w.msg != nil:
+				t.Errorf("query from %s answered with %s, want it dropped", remote, dns.RcodeToString[w.msg.Rcode])
+			}
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream saw %d queries, want only the first allowed one", n)
+	}
+}
+
+func TestCNAMEChainServesLowestTTL(t *testing.T) {
+	cname := func(name, target string, ttl uint32) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}, Target: target}
+	}
+	a := func(name string, ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP("192.0.2.1")}
+	}
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Name {
+		case "www.example.com.":
+			// The middle link expires first.
+			m.Answer = []dns.RR{cname("www.example.com.", "cdn.example.net.", 3600), cname("cdn.example.net.", "edge.cdn.net.", 60), a("edge.cdn.net.", 600)}
+		case "alias.example.com.":
+			// Only the alias: the target is resolved separately.
+			m.Answer = []dns.RR{cname("alias.example.com.", "target.example.org.", 30)}
+		case "target.example.org.":
+			m.Answer = []dns.RR{a("target.example.org.", 900)}
+		case "short.example.com.":
+			m.Answer = []dns.RR{cname("short.example.com.", "edge.cdn.net.", 3600), a("edge.cdn.net.", 20)}
+		}
+		w.WriteMsg(m)
+	})
+	gm := &GroupManager{}
+	client := newTestClient(t, "chain", upstream)
+	client.MaxCNAMEDepth = DefaultMaxCNAMEDepth
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	for _, tt := range []struct {
+		name string
+		ttl  uint32
+	}{
+		{"www.example.com.", 60},
+		{"alias.example.com.", 30},
+		{"short.example.com.", 20}, // the terminal record can be the lowest too
+	} {
+		result, err := client.QueryDNS(context.Background(), tt.name, dns.TypeA)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if result.TTL != time.Duration(tt.ttl)*time.Second {
+			t.Errorf("%s cached for %s, want %ds", tt.name, result.TTL, tt.ttl)
+		}
+		reply := serve(t, h, tt.name, dns.TypeA)
+		if len(reply.Answer) < 2 {
+			t.Fatalf("%s: answer %v, want the chain", tt.name, reply.Answer)
+		}
+		for _, rr := range reply.Answer {
+			if rr.Header().Ttl > tt.ttl {
+				t.Errorf("%s: served %s, longer than the chain's %ds", tt.name, rr, tt.ttl)
+			}
+		}
+	}
+	// Asking for the alias itself keeps its own TTL.
+	if result, err := client.QueryDNS(context.Background(), "alias.example.com.", dns.TypeCNAME); err != nil || result.TTL != 30*time.Second {
+		t.Errorf("CNAME query cached for %s (%v), want 30s", result.TTL, err)
+	}
+}
+
+func TestClientProtocolOverride(t *testing.T) {
+	var udpQueries, tcpQueries atomic.Int32
+	upstream := startUpstreamUDPAndTCP(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.RemoteAddr().Network() == "tcp" {
+			tcpQueries.Add(1)
+		} else {
+			udpQueries.Add(1)
+		}
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	for _, tt := range []struct {
+		protocol string
+		udp, tcp int32
+	}{
+		{"", 1, 0},
+		{"udp", 1, 0},
+		{"tcp", 0, 1},
+	} {
+		udpQueries.Store(0)
+		tcpQueries.Store(0)
+		client := newTestClient(t, "proto", upstream)
+		client.Protocol = tt.protocol
+		if _, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil {
+			t.Fatalf("protocol %q: %v", tt.protocol, err)
+		}
+		if udpQueries.Load() != tt.udp || tcpQueries.Load() != tt.tcp {
+			t.Errorf("protocol %q: %d UDP and %d TCP queries, want %d and %d", tt.protocol, udpQueries.Load(), tcpQueries.Load(), tt.udp, tt.tcp)
+		}
+	}
+
+	// Encrypted protocols pick their transport and default port for bare
+	// addresses, and agree with URLs of their scheme.
+	for _, tt := range []struct {
+		protocol string
+		server   string
+		want     string
+	}{
+		{"dot", "dns.example", "tls://dns.example:853"},
+		{"dot", "dns.example:8853", "tls://dns.example:8853"},
+		{"dot", "tls://dns.example", "tls://dns.example:853"},
+		{"doh", "dns.example", "https://dns.example:443/dns-query"},
+		{"doh", "https://dns.example/resolve", "https://dns.example:443/resolve"},
+		{"tcp", "192.0.2.53", "tcp://192.0.2.53:53"},
+		{"", "tls://dns.example", "tls://dns.example:853"},
+	} {
+		client := &Client{ID: "proto", Server: tt.server, Protocol: tt.protocol}
+		upstreams := client.upstreams()
+		if len(upstreams) != 1 || upstreams[0].Scheme+"://"+upstreams[0].Address()+upstreams[0].Path != tt.want {
+			t.Errorf("protocol %q, server %q: upstreams %+v, want %s", tt.protocol, tt.server, upstreams, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		protocol string
+		server   string
+		valid    bool
+	}{
+		{"tcp", "tcp://192.0.2.53", true},
+		{"dot", "https://dns.example", false},
+		{"udp", "tls://dns.example", false},
+		{"quic", "192.0.2.53", false},
+	} {
+		config := Config{Clients: []ClientConfig{{ID: "c", Server: tt.server, Protocol: tt.protocol}}}
+		if err := config.Validate(); (err == nil) != tt.valid {
+			t.Errorf("protocol %q with server %q: %v, want valid %t", tt.protocol, tt.server, err, tt.valid)
+		}
+	}
+}
+
+// tlsRecorder is a recorder answering as over TLS.
+type tlsRecorder struct{ *recorder }
+
+func (w tlsRecorder) ConnectionState() *tls.ConnectionState { return &tls.ConnectionState{} }
+
+func TestEDNSPadding(t *testing.T) {
+	for _, block := range []int{DefaultQueryPaddingBlock, DefaultResponsePaddingBlock} {
+		for _, name := range []string{"a.", "example.com.", strings.Repeat("x", 60) + ".example.com."} {
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			m.SetEdns0(4096, false)
+			padMessage(m, block)
+			if size := m.Len(); size%block != 0 {
+				t.Errorf("%s padded to %d octets, not a multiple of %d", name, size, block)
+			}
+			packed, err := m.Pack()
+			if err != nil || len(packed) != m.Len() {
+				t.Errorf("%s: packs to %d octets (%v), Len says %d", name, len(packed), err, m.Len())
+			}
+		}
+	}
+
+	// Queries to encrypted upstreams are padded, those to plain ones not.
+	var sizes []int
+	var mu sync.Mutex
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil || paddingOption(q) == nil {
+			http.Error(w, "query not padded", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		sizes = append(sizes, len(body))
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")})
+		packed, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	t.Cleanup(ts.Close)
+	saved := dohClient
+	dohClient = ts.Client()
+	t.Cleanup(func() { dohClient = saved })
+	var plainPadded atomic.Bool
+	plain := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if paddingOption(r) != nil {
+			plainPadded.Store(true)
+		}
+		answerA("192.0.2.1", 300)(w, r)
+	})
+	for _, server := range []string{ts.URL + "/dns-query", plain} {
+		client := newTestClient(t, "padding", server)
+		client.PaddingBlock = DefaultQueryPaddingBlock
+		if _, err := client.QueryDNS(context.Background(), "example.com", dns.TypeA); err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+	}
+	mu.Lock()
+	if len(sizes) != 1 || sizes[0]%DefaultQueryPaddingBlock != 0 {
+		t.Errorf("DoH query sizes %v, want one multiple of %d", sizes, DefaultQueryPaddingBlock)
+	}
+	mu.Unlock()
+	if plainPadded.Load() {
+		t.Error("a plain DNS query was padded")
+	}
+
+	// Responses are padded only over encrypted transports, and only to
+	// padded queries.
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "padding", startUpstream(t, answerA("192.0.2.1", 300))))
+	h := newTestHandler(t, gm)
+	h.PaddingBlock = DefaultResponsePaddingBlock
+	for _, tt := range []struct {
+		name      string
+		encrypted bool
+		padded    bool
+	}{
+		{"encrypted, padded query", true, true},
+		{"encrypted, unpadded query", true, false},
+		{"plain, padded query", false, true},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		if tt.padded {
+			padMessage(r, DefaultQueryPaddingBlock)
+		}
+		rec := newRecorder()
+		var w dns.ResponseWriter = rec
+		if tt.encrypted {
+			w = tlsRecorder{rec}
+		}
+		h.ServeDNS(w, r)
+		want := tt.encrypted && tt.padded
+		if got := paddingOption(rec.msg) != nil; got != want {
+			t.Errorf("%s: response padded %t, want %t", tt.name, got, want)
+		}
+		if want && rec.msg.Len()%DefaultResponsePaddingBlock != 0 {
+			t.Errorf("%s: response of %d octets, not a multiple of %d", tt.name, rec.msg.Len(), DefaultResponsePaddingBlock)
+		}
+	}
+}
+
+func TestShortTTLNamesAreNotShared(t *testing.T) {
+	tracker := NewShortTTLs(30*time.Second, 3)
+	for i := 1; i <= 3; i++ {
+		if short := tracker.Observe("Flappy.example.com.", 10*time.Second); short != (i == 3) {
+			t.Errorf("short answer %d: short %t, want %t", i, short, i == 3)
+		}
+	}
+	if !tracker.Short("flappy.example.com.") {
+		t.Error("a name with three short answers in a row is not short")
+	}
+	if tracker.Observe("flappy.example.com.", time.Minute) || tracker.Short("flappy.example.com.") {
+		t.Error("a long answer did not reset the streak")
+	}
+	if NewShortTTLs(-1, 3).Observe("flappy.example.com.", 0) {
+		t.Error("a disabled tracker reported a short name")
+	}
+
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ttl := uint32(300)
+		if strings.HasPrefix(r.Question[0].Name, "short.") {
+			ttl = 10
+		}
+		answerA("192.0.2.1", ttl)(w, r)
+	})
+	clients := testClients(t, 3)
+	resolver, receiver, reader := clients[0], clients[1], clients[2]
+	gm := &GroupManager{}
+	for _, c := range clients {
+		c.Upstreams = []string{upstream}
+		c.ShortTTLs = NewShortTTLs(30*time.Second, 1)
+		gm.AddClientToGroup(c)
+	}
+	resolver.Gossip = true
+	receiver.startGossipReceiver(10)
+
+	for _, name := range []string{"short.example.com.", "long.example.com."} {
+		if _, err := resolver.QueryDNS(context.Background(), name, dns.TypeA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Gossip is asynchronous: wait for the long name to arrive.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := receiver.Peek("long.example.com.", dns.TypeA); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := receiver.Peek("long.example.com.", dns.TypeA); !ok {
+		t.Error("the long-TTL answer was not gossiped")
+	}
+	if _, ok := receiver.Peek("short.example.com.", dns.TypeA); ok {
+		t.Error("the short-TTL answer was gossiped")
+	}
+
+	// Peers do not serve their copies of short names either.
+	if result, err := reader.QueryDNS(context.Background(), "long.example.com.", dns.TypeA); err != nil || result.Source != SourcePeer {
+		t.Errorf("long name answered from %q (%v), want a peer", result.Source, err)
+	}
+	if result, err := reader.QueryDNS(context.Background(), "short.example.com.", dns.TypeA); err != nil || result.Source != SourceUpstream {
+		t.Errorf("short name answered from %q (%v), want resolved fresh", result.Source, err)
+	}
+}
+
+func TestHealthCheckName(t *testing.T) {
+	// The upstream never answers: only an answer without resolving works.
+	upstream, queries, _ := hangingUpstream(t)
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "health", upstream))
+	h := newTestHandler(t, gm)
+	defaults := Config{}.WithDefaults()
+	h.HealthCheckName, h.HealthCheckAnswer = defaults.HealthCheckName, defaults.HealthCheckAnswer
+
+	for _, name := range []string{"health.check.", "HEALTH.Check"} {
+		reply := serve(t, h, name, dns.TypeA)
+		if reply.Rcode != dns.RcodeSuccess || !reply.Authoritative || len(reply.Answer) != 1 {
+			t.Fatalf("%s: rcode %s, AA %t, answers %v; want one authoritative answer", name, dns.RcodeToString[reply.Rcode], reply.Authoritative, reply.Answer)
+		}
+		if got := addressOf(reply.Answer[0]); got != "127.0.0.1" || reply.Answer[0].Header().Ttl != 0 {
+			t.Errorf("%s: answered %s, want 127.0.0.1 with TTL 0", name, reply.Answer[0])
+		}
+	}
+
+	h.HealthCheckName, h.HealthCheckAnswer = "alive.dns.internal", "::1"
+	if reply := serve(t, h, "alive.dns.internal.", dns.TypeAAAA); len(reply.Answer) != 1 || addressOf(reply.Answer[0]) != "::1" {
+		t.Errorf("configured name: answers %v, want ::1", reply.Answer)
+	}
+	if reply := serve(t, h, "alive.dns.internal.", dns.TypeA); reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 {
+		t.Errorf("A query for an IPv6 health answer: rcode %s, answers %v; want NODATA", dns.RcodeToString[reply.Rcode], reply.Answer)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("health checks sent %d upstream queries", n)
+	}
+
+	for _, bad := range []Config{
+		{HealthCheckName: "bad..name"},
+		{HealthCheckAnswer: "localhost"},
+	} {
+		bad.Clients = []ClientConfig{{ID: "c", Server: "192.0.2.53"}}
+		if err := bad.Validate(); err == nil {
+			t.Errorf("health check %q/%q passed validation", bad.HealthCheckName, bad.HealthCheckAnswer)
+		}
+	}
+}
+
+func TestIDNSpellingsShareOneEntry(t *testing.T) {
+	// "bücher.example." sent as raw UTF-8 arrives with escaped bytes.
+	const raw, punycode = `b\195\188cher.example.`, "xn--bcher-kva.example."
+	for name, want := range map[string]string{
+		raw:                      punycode,
+		`B\195\188CHER.Example.`: punycode,
+		"XN--BCHER-KVA.example.": punycode,
+		"Example.COM.":           "example.com.",
+		`a\.b.example.`:          `a\.b.example.`,
+	} {
+		if got := normalizeName(name); got != want {
+			t.Errorf("normalizeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	var queries atomic.Int32
+	var mu sync.Mutex
+	var asked []string
+	answer := answerA("192.0.2.1", 300)
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		mu.Lock()
+		asked = append(asked, r.Question[0].Name)
+		mu.Unlock()
+		answer(w, r)
+	})
+	gm := &GroupManager{}
+	gm.AddClientToGroup(newTestClient(t, "idn", upstream))
+	h := newTestHandler(t, gm)
+
+	for _, name := range []string{raw, punycode, "Xn--Bcher-Kva.Example."} {
+		reply := serve(t, h, name, dns.TypeA)
+		if len(reply.Answer) != 1 || addressOf(reply.Answer[0]) != "192.0.2.1" {
+			t.Fatalf("%s: answers %v, want 192.0.2.1", name, reply.Answer)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("three spellings of one name sent %d upstream queries, want 1", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(asked) != 1 || asked[0] != punycode {
+		t.Errorf("upstream was asked %q, want %q", asked, punycode)
+	}
+}
+
+func TestLogLevelChangesAtRuntime(t *testing.T) {
+	old := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(old) })
+	logLevel.Set(slog.LevelInfo)
+	mux := adminMux([]*GroupManager{{}}, false)
+
+	loglevel := func(method, body string) (int, string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/loglevel", strings.NewReader(body)))
+		var reply map[string]string
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return w.Code, reply["level"]
+	}
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug traces enabled at info level")
+	}
+	if code, level := loglevel("POST", `{"level":"debug"}`); code != http.StatusOK || level != "DEBUG" {
+		t.Fatalf("POST debug: %d %q, want 200 DEBUG", code, level)
+	}
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug traces still disabled after POST debug")
+	}
+	if code, level := loglevel("GET", ""); code != http.StatusOK || level != "DEBUG" {
+		t.Errorf("GET: %d %q, want 200 DEBUG", code, level)
+	}
+	if code, _ := loglevel("POST", `{"level":"verbose"}`); code != http.StatusBadRequest {
+		t.Errorf("POST of an unknown level: %d, want 400", code)
+	}
+	if code, _ := loglevel("PUT", `{"level":"info"}`); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: %d, want 405", code)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("rejected requests changed the level to %s", logLevel.Level())
+	}
+	if code, level := loglevel("POST", `{"level":"info"}`); code != http.StatusOK || level != "INFO" {
+		t.Errorf("POST info: %d %q, want 200 INFO", code, level)
+	}
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug traces still enabled after POST info")
+	}
+}
+
+func TestDebugLogRateLimit(t *testing.T) {
+	limiter := &logRateLimiter{}
+	for i := 0; i < 10; i++ {
+		if !limiter.allow() {
+			t.Fatal("a limiter without a rate dropped a line")
+		}
+	}
+	limiter = &logRateLimiter{}
+	limiter.PerSecond.Store(2)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if limiter.allow() {
+			allowed++
+		}
+	}
+	// The loop may straddle a second boundary, admitting a second batch.
+	if allowed < 2 || allowed > 4 {
+		t.Errorf("a limit of 2 a second admitted %d of 10 lines", allowed)
+	}
+}
+
+func TestGetAllTypes(t *testing.T) {
+	client := newTestClient(t, "c0", "")
+	now := time.Now()
+	txt, err := dns.NewRR(`example.com. 300 IN TXT "v=spf1 -all"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa, err := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aaaa, err := newAddressRecord("example.com.", dns.TypeAAAA, "2001:db8::1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Set(cacheKey("example.com.", dns.TypeA), addressEntry(t, "example.com.", "192.0.2.1", now, time.Minute))
+	client.Set(cacheKey("example.com.", dns.TypeAAAA), DNSResponse{IPAddress: "2001:db8::1", Records: []dns.RR{aaaa}, Timestamp: now, TTL: time.Minute})
+	client.Set(cacheKey("example.com.", dns.TypeTXT), DNSResponse{Records: []dns.RR{txt}, Timestamp: now, TTL: time.Minute})
+	// An expired NODATA answer: no records tell its type.
+	client.Set(cacheKey("example.com.", dns.TypeMX), DNSResponse{Authority: []dns.RR{soa}, Timestamp: now.Add(-time.Hour), TTL: time.Minute})
+	client.Set(cacheKey("example.com.", dns.TypeA)+dnssecKeySuffix, addressEntry(t, "example.com.", "192.0.2.9", now, time.Minute))
+	client.Set(cacheKey("www.example.com.", dns.TypeA), addressEntry(t, "www.example.com.", "192.0.2.2", now, time.Minute))
+
+	entries := client.GetAllTypes("Example.COM")
+	want := map[uint16]int{dns.TypeA: 1, dns.TypeAAAA: 1, dns.TypeTXT: 1, dns.TypeMX: 0}
+	if len(entries) != len(want) {
+		t.Fatalf("GetAllTypes returned %d types, want %d: %v", len(entries), len(want), entries)
+	}
+	for qtype, records := range want {
+		entry, ok := entries[qtype]
+		if !ok || len(entry.Records) != records {
+			t.Errorf("%s: entry %v (found %t), want %d records", dns.Type(qtype), entry, ok, records)
+		}
+	}
+	if entries[dns.TypeA].IPAddress != "192.0.2.1" {
+		t.Errorf("A entry holds %s, want the plain entry's 192.0.2.1", entries[dns.TypeA].IPAddress)
+	}
+	if entries[dns.TypeMX].Fresh() {
+		t.Error("the expired NODATA entry is reported fresh")
+	}
+	if hits := client.Cache[cacheKey("example.com.", dns.TypeA)].Hits; hits != 0 {
+		t.Errorf("GetAllTypes counted %d hits", hits)
+	}
+	if entries := client.GetAllTypes("missing.example."); len(entries) != 0 {
+		t.Errorf("an uncached name returned %v", entries)
+	}
+
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	w := httptest.NewRecorder()
+	adminMux([]*GroupManager{gm}, false).ServeHTTP(w, httptest.NewRequest("GET", "/cache/lookup?name=example.com&type=ALL", nil))
+	var listed []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("type=ALL: %d %v", w.Code, err)
+	}
+	var types []string
+	for _, entry := range listed {
+		types = append(types, fmt.Sprint(entry["type"]))
+	}
+	if got := strings.Join(types, " "); got != "A MX TXT AAAA" {
+		t.Errorf("type=ALL listed types %q, want them all sorted by type", got)
+	}
+}
+
+func TestHitRatioEWMA(t *testing.T) {
+	var e EWMA
+	for _, x := range []float64{1, 0, 1, 1} {
+		e.Observe(x)
+	}
+	if got := e.Value(); math.Abs(got-0.75) > 1e-9 {
+		t.Errorf("EWMA of its first values = %v, want their mean 0.75", got)
+	}
+	for i := 0; i < 300; i++ {
+		e.Observe(1)
+	}
+	high := e.Value()
+	if high < 0.95 {
+		t.Fatalf("EWMA after 300 hits = %v, want above 0.95", high)
+	}
+	last := high
+	for i := 0; i < 100; i++ {
+		e.Observe(0)
+		if v := e.Value(); v >= last {
+			t.Fatalf("miss %d raised the EWMA from %v to %v", i, last, v)
+		} else {
+			last = v
+		}
+	}
+	if want := high * math.Pow(1-HitRatioAlpha, 100); math.Abs(last-want) > 1e-9 {
+		t.Errorf("EWMA after 100 misses = %v, want %v", last, want)
+	}
+
+	var concurrent EWMA
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				concurrent.Observe(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := concurrent.Value(); got != 1 {
+		t.Errorf("EWMA of concurrent hits = %v, want 1", got)
+	}
+
+	upstream := startUpstream(t, answerA("192.0.2.1", 300))
+	gm := &GroupManager{}
+	client := newTestClient(t, "c0", upstream)
+	gm.AddClientToGroup(client)
+	// Two misses, then three hits.
+	for _, name := range []string{"a.example.", "b.example.", "a.example.", "b.example.", "a.example."} {
+		if _, err := client.QueryDNS(context.Background(), name, dns.TypeA); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if got := client.Stats().HitRatioEWMA; math.Abs(got-0.6) > 1e-9 {
+		t.Errorf("client hit ratio EWMA = %v, want 0.6", got)
+	}
+	if got := client.Group().AggregateStats().HitRatioEWMA; math.Abs(got-0.6) > 1e-9 {
+		t.Errorf("group hit ratio EWMA = %v, want 0.6", got)
+	}
+}
+
+func TestCNAMELoopsAreServFail(t *testing.T) {
+	cname := func(name, target string) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: target}
+	}
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch name := r.Question[0].Name; name {
+		case "ping.example.", "pong.example.":
+			// Each answer is one link; the loop closes across queries.
+			target := map[string]string{"ping.example.": "pong.example.", "pong.example.": "ping.example."}[name]
+			m.Answer = []dns.RR{cname(name, target)}
+		case "self.example.":
+			// The loop is within a single answer.
+			m.Answer = []dns.RR{cname("self.example.", "other.example."), cname("other.example.", "self.example.")}
+		default:
+			// hop0 -> hop1 -> ... -> hop9, one link per answer.
+			var n int
+			fmt.Sscanf(name, "hop%d.example.", &n)
+			m.Answer = []dns.RR{cname(name, fmt.Sprintf("hop%d.example.", n+1))}
+		}
+		w.WriteMsg(m)
+	})
+	gm := &GroupManager{}
+	client := newTestClient(t, "loop", upstream)
+	client.MaxCNAMEDepth = 3
+	client.BreakerSettings = BreakerSettings{Threshold: 100, Window: time.Minute, Cooldown: time.Minute}
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	for _, tt := range []struct {
+		name, err string
+		queries   int32
+	}{
+		{"ping.example.", "CNAME loop at ping.example.", 2},
+		{"self.example.", "CNAME loop at self.example.", 1},
+		{"hop0.example.", "longer than 3", 4},
+	} {
+		before := queries.Load()
+		if _, err := client.QueryDNS(context.Background(), tt.name, dns.TypeA); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+		if n := queries.Load() - before; n != tt.queries {
+			t.Errorf("%s: %d upstream queries, want %d", tt.name, n, tt.queries)
+		}
+		if reply := serve(t, h, tt.name, dns.TypeA); reply.Rcode != dns.RcodeServerFailure {
+			t.Errorf("%s: rcode %s, want SERVFAIL", tt.name, dns.RcodeToString[reply.Rcode])
+		}
+	}
+}
+
+func TestForwarderLoopIsServFail(t *testing.T) {
+	// Two instances forward loop.test. to each other.
+	var mu sync.Mutex
+	var handlers [2]*Handler
+	var hops []int // of every query either instance received
+	var addrs [2]string
+	for i := range addrs {
+		i := i
+		addrs[i] = startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			h := handlers[i]
+			hops = append(hops, hopCount(r))
+			mu.Unlock()
+			h.ServeDNS(w, r)
+		})
+	}
+	mu.Lock()
+	for i := range handlers {
+		client := newTestClient(t, fmt.Sprintf("fwd%d", i), "")
+		client.ForwardZones = []ForwardZone{{Name: "loop.test.", Upstreams: []string{addrs[1-i]}}}
+		gm := &GroupManager{}
+		gm.AddClientToGroup(client)
+		handlers[i] = newTestHandler(t, gm)
+	}
+	mu.Unlock()
+
+	done := make(chan *dns.Msg, 1)
+	go func() {
+		m := new(dns.Msg)
+		m.SetQuestion("www.loop.test.", dns.TypeA)
+		reply, err := dns.Exchange(m, addrs[0])
+		if err != nil {
+			t.Error(err)
+		}
+		done <- reply
+	}()
+	select {
+	case reply := <-done:
+		if reply != nil && reply.Rcode != dns.RcodeServerFailure {
+			t.Errorf("looping query: rcode %s, want SERVFAIL", dns.RcodeToString[reply.Rcode])
+		}
+	case <-time.After(DefaultQueryTimeout):
+		t.Fatal("looping query was not answered")
+	}
+	// The client's query and one per hop: the instance seeing
+	// DefaultMaxForwardHops refuses it.
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []int{0, 1, 2, 3, DefaultMaxForwardHops}; !slices.Equal(hops, want) {
+		t.Errorf("loop queries carried hop counts %v, want %v", hops, want)
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	soa, err := dns.NewRR("example. 600 IN SOA ns.example. admin.example. 1 3600 600 86400 60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries sync.Map // name/type -> *atomic.Int32
+	count := func(name string, qtype uint16) *atomic.Int32 {
+		n, _ := queries.LoadOrStore(cacheKey(name, qtype), new(atomic.Int32))
+		return n.(*atomic.Int32)
+	}
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		count(q.Name, q.Qtype).Add(1)
+		m := new(dns.Msg)
+		switch q.Name {
+		case "v4only.example.":
+			if q.Qtype == dns.TypeA {
+				answerA("192.0.2.1", 300)(w, r)
+				return
+			}
+			m.SetReply(r)
+			m.Ns = []dns.RR{soa}
+		case "missing.example.":
+			m.SetRcode(r, dns.RcodeNameError)
+			m.Ns = []dns.RR{soa}
+		default:
+			m.SetRcode(r, dns.RcodeServerFailure)
+		}
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "negative", upstream)
+	client.BreakerSettings = BreakerSettings{Threshold: 100, Window: time.Minute, Cooldown: time.Minute}
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	for _, tt := range []struct {
+		name    string
+		rcode   int
+		soa     bool  // the zone's SOA is in the authority section
+		queries int32 // upstream queries for two lookups
+	}{
+		{"v4only.example.", dns.RcodeSuccess, true, 1},        // NODATA, cached
+		{"missing.example.", dns.RcodeNameError, false, 2},    // NXDOMAIN, passed on uncached
+		{"broken.example.", dns.RcodeServerFailure, false, 2}, // resolver failure, retried
+	} {
+		for i := 0; i < 2; i++ {
+			reply := serve(t, h, tt.name, dns.TypeAAAA)
+			if reply.Rcode != tt.rcode || len(reply.Answer) != 0 {
+				t.Errorf("%s, lookup %d: rcode %s with %d answers, want %s and none", tt.name, i, dns.RcodeToString[reply.Rcode], len(reply.Answer), dns.RcodeToString[tt.rcode])
+			}
+			if tt.soa && (len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA) {
+				t.Errorf("%s, lookup %d: authority %v, want the zone's SOA", tt.name, i, reply.Ns)
+			}
+		}
+		if n := count(tt.name, dns.TypeAAAA).Load(); n != tt.queries {
+			t.Errorf("%s: %d upstream queries, want %d", tt.name, n, tt.queries)
+		}
+	}
+
+	// NODATA is cached for the SOA's MINIMUM, and only for its own type.
+	entry, ok := client.Peek("v4only.example.", dns.TypeAAAA)
+	if !ok || entry.TTL != time.Minute || len(entry.Records) != 0 {
+		t.Errorf("NODATA entry %+v (found %t), want no records for 1m", entry, ok)
+	}
+	if reply := serve(t, h, "v4only.example.", dns.TypeA); len(reply.Answer) != 1 {
+		t.Errorf("A for a name with a cached AAAA NODATA: answers %v, want the address", reply.Answer)
+	}
+}
+
+func TestDNSKEYAndDSAnswersAreUnmodified(t *testing.T) {
+	rrs := func(lines ...string) []dns.RR {
+		var records []dns.RR
+		for _, line := range lines {
+			rr, err := dns.NewRR(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rr)
+		}
+		return records
+	}
+	sig := func(covered string) string {
+		return "example.com. 3600 IN RRSIG " + covered + " 13 2 3600 20300101000000 20200101000000 12345 example.com. dGVzdHNpZ25hdHVyZQ=="
+	}
+	upstreamAnswers := map[uint16][]dns.RR{
+		dns.TypeDNSKEY: rrs(
+			"example.com. 3600 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+			"example.com. 3600 IN DNSKEY 256 3 13 oJMRESz5E4gYzS/q6XDrvU1qMPYIjCWzJaOau8XNEZeqCYKD5ar0IRd8KqXXFJkqmVfRvMGPmM1x8fGAa2XhSA==",
+			sig("DNSKEY"),
+		),
+		dns.TypeDS: rrs(
+			"example.com. 3600 IN DS 12345 13 2 3490a6806d47f17a34c29e2ce80e8a999ffbe4be7f5a0a61d9f8b5bd0e3e1c4f",
+			sig("DS"),
+		),
+	}
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, rr := range upstreamAnswers[r.Question[0].Qtype] {
+			if rr.Header().Rrtype != dns.TypeRRSIG || r.IsEdns0() != nil && r.IsEdns0().Do() {
+				m.Answer = append(m.Answer, dns.Copy(rr))
+			}
+		}
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "dnssec", upstream)
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	for qtype, want := range upstreamAnswers {
+		for _, pass := range []string{"upstream", "cache"} {
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", qtype)
+			r.SetEdns0(4096, true)
+			w := newRecorder()
+			h.ServeDNS(w, r)
+			got := w.msg.Answer
+			if len(got) != len(want) {
+				t.Fatalf("%s from %s: %d records, want the upstream's %d: %v", dns.Type(qtype), pass, len(got), len(want), got)
+			}
+			for i := range want {
+				// IsDuplicate compares every field but the TTL, which may
+				// have counted down by a second from the cache.
+				if !dns.IsDuplicate(got[i], want[i]) || want[i].Header().Ttl-got[i].Header().Ttl > 1 {
+					t.Errorf("%s from %s: record %d is %v, want %v", dns.Type(qtype), pass, i, got[i], want[i])
+				}
+			}
+		}
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d upstream queries, want one per type", n)
+	}
+
+	// Without DO the signatures go, and the keys stay.
+	reply := serve(t, h, "example.com.", dns.TypeDNSKEY)
+	if len(reply.Answer) != 2 {
+		t.Errorf("DNSKEY without DO: %v, want the two keys", reply.Answer)
+	}
+	for _, rr := range reply.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Errorf("DNSKEY without DO kept %v", rr)
+		}
+	}
+	if kept := stripDNSSEC(append([]dns.RR(nil), upstreamAnswers[dns.TypeDS]...), dns.TypeRRSIG); len(kept) != 2 {
+		t.Errorf("stripDNSSEC of an RRSIG query kept %v, want everything", kept)
+	}
+}
+
+func TestRRsetExpiresAtShortestTTL(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i, ttl := range []uint32{300, 30, 120} {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(192, 0, 2, byte(i+1)),
+			})
+		}
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "rrset", upstream)
+	key := cacheKey("mixed.example.com.", dns.TypeA)
+
+	result, err := client.QueryDNS(context.Background(), "mixed.example.com.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TTL != 30*time.Second || len(result.Records) != 3 {
+		t.Errorf("answer with %d records for %s, want all 3 for 30s", len(result.Records), result.TTL)
+	}
+	if entry, ok := client.Peek("mixed.example.com.", dns.TypeA); !ok || entry.TTL != 30*time.Second {
+		t.Errorf("cached for %s (found %t), want 30s", entry.TTL, ok)
+	}
+	if _, err := client.QueryDNS(context.Background(), "mixed.example.com.", dns.TypeA); err != nil || queries.Load() != 1 {
+		t.Errorf("second lookup: %v after %d upstream queries, want a cache hit", err, queries.Load())
+	}
+
+	// Once the shortest TTL runs out the whole set is fetched again, even
+	// though two of its records would still be valid.
+	client.Mutex.Lock()
+	entry := client.Cache[key]
+	entry.Timestamp = time.Now().Add(-31 * time.Second)
+	client.Cache[key] = entry
+	client.Mutex.Unlock()
+	result, err = client.QueryDNS(context.Background(), "mixed.example.com.", dns.TypeA)
+	if err != nil || result.Source != SourceUpstream || queries.Load() != 2 {
+		t.Errorf("lookup after 31s: source %q, %v, %d upstream queries; want a refetch", result.Source, err, queries.Load())
+	}
+}
+
+func TestCheckingDisabled(t *testing.T) {
+	var mu sync.Mutex
+	var sawCD []bool
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		sawCD = append(sawCD, r.CheckingDisabled)
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		// A validating upstream vouches for what it checked.
+		m.AuthenticatedData = !r.CheckingDisabled
+		ip := "192.0.2.1"
+		if r.CheckingDisabled {
+			ip = "192.0.2.66" // bogus data a validator would have refused
+		}
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)})
+		w.WriteMsg(m)
+	})
+	client := newTestClient(t, "cd", upstream)
+	gm := &GroupManager{}
+	gm.AddClientToGroup(client)
+	h := newTestHandler(t, gm)
+
+	query := func(cd bool) *dns.Msg {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion("signed.example.com.", dns.TypeA)
+		r.CheckingDisabled = cd
+		w := newRecorder()
+		h.ServeDNS(w, r)
+		if w.msg == nil {
+			t.Fatal("no reply")
+		}
+		return w.msg
+	}
+
+	reply := query(true)
+	if !reply.CheckingDisabled || reply.AuthenticatedData {
+		t.Errorf("CD=1 reply has CD %t and AD %t, want CD echoed and AD clear", reply.CheckingDisabled, reply.AuthenticatedData)
+	}
+	if len(reply.Answer) != 1 || addressOf(reply.Answer[0]) != "192.0.2.66" {
+		t.Errorf("CD=1 answers %v, want the unchecked 192.0.2.66", reply.Answer)
+	}
+	if _, ok := client.Peek("signed.example.com.", dns.TypeA); ok {
+		t.Error("an answer fetched with CD=1 was cached")
+	}
+
+	// The CD=1 answer must not reach a query relying on validation.
+	reply = query(false)
+	if reply.CheckingDisabled || reply.AuthenticatedData {
+		t.Errorf("CD=0 reply has CD %t and AD %t, want both clear even though the upstream set AD", reply.CheckingDisabled, reply.AuthenticatedData)
+	}
+	if len(reply.Answer) != 1 || addressOf(reply.Answer[0]) != "192.0.2.1" {
+		t.Errorf("CD=0 answers %v, want the validated 192.0.2.1", reply.Answer)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []bool{true, false}; !slices.Equal(sawCD, want) {
+		t.Errorf("upstream saw CD %v, want %v", sawCD, want)
+	}
+}
+
+func TestUpstreamLimiterIsFairAcrossClients(t *testing.T) {
+	l := NewUpstreamLimiter(1)
+	if err := l.Acquire(context.Background(), "holder"); err != nil {
+		t.Fatal(err)
+	}
+	grants := make(chan string)
+	wait := func(client string) {
+		queued := l.waiting.Load()
+		go func() {
+			if err := l.Acquire(context.Background(), client); err != nil {
+				t.Error(err)
+			}
+			grants <- client
+		}()
+		// Queue the waiters in a known order.
+		for l.waiting.Load() == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		wait("greedy")
+	}
+	for _, client := range []string{"light1", "light2", "light3"} {
+		wait(client)
+	}
+
+	var order []string
+	for i := 0; i < 7; i++ {
+		l.Release()
+		order = append(order, <-grants)
+	}
+	// greedy queued first, but each light client gets a turn before its
+	// second waiter does.
+	if want := []string{"greedy", "light1", "light2", "light3", "greedy", "greedy", "greedy"}; !slices.Equal(order, want) {
+		t.Errorf("slots granted to %v, want %v", order, want)
+	}
+	if n := l.InFlight(); n != 1 {
+		t.Errorf("%d slots in flight, want the last grant's 1", n)
+	}
+	l.Release()
+	if n := l.InFlight(); n != 0 {
+		t.Errorf("%d slots in flight after the last release", n)
+	}
+
+	// A waiter that gives up leaves the line.
+	l.Acquire(context.Background(), "holder")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx, "impatient"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire on a full limiter returned %v, want the deadline", err)
+	}
+	l.Release()
+	if n := l.InFlight(); n != 0 {
+		t.Errorf("%d slots in flight after the holder released, want 0", n)
+	}
+}
+
+func TestClientInFlightLimitAndGauge(t *testing.T) {
+	clients := testClients(t, 2)
+	greedy, light := clients[0], clients[1]
+	greedy.inFlightSlots = make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		if err := greedy.acquireInFlight(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := greedy.acquireInFlight(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("third query over client_max_inflight 2 returned %v, want the deadline", err)
+	}
+	if err := light.acquireInFlight(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gm := &GroupManager{}
+	gm.AddClientToGroup(greedy)
+	gm.AddClientToGroup(light)
+	gauge := func() string {
+		var b bytes.Buffer
+		writeMetrics(&b, []*GroupManager{gm})
+		return b.String()
+	}
+	for _, line := range []string{`dns_client_upstream_inflight{client="c0"} 2`, `dns_client_upstream_inflight{client="c1"} 1`} {
+		if !strings.Contains(gauge(), line) {
+			t.Errorf("/metrics lacks %s", line)
+		}
+	}
+	greedy.releaseInFlight()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := greedy.acquireInFlight(ctx); err != nil {
+		t.Errorf("a freed slot was not reused: %v", err)
+	}
+	light.releaseInFlight()
+	if line := `dns_client_upstream_inflight{client="c1"} 0`; !strings.Contains(gauge(), line) {
+		t.Errorf("/metrics lacks %s", line)
+	}
+}